@@ -14,6 +14,9 @@ type DownloadResponse struct {
 	SizeBytes         int64
 	Data              io.ReadCloser
 	TargetDisposition string
+
+	// Vary lists the request headers which affected the response, if any
+	Vary string
 }
 
 type StreamDataResponse struct {
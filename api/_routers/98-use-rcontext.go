@@ -136,6 +136,10 @@ beforeParseDownload:
 			headers.Set("Accept-Ranges", "bytes")
 		}
 
+		if downloadRes.Vary != "" {
+			headers.Add("Vary", downloadRes.Vary)
+		}
+
 		disposition := downloadRes.TargetDisposition
 		if disposition == "" {
 			disposition = "attachment"
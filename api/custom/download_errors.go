@@ -0,0 +1,101 @@
+package custom
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/api/_apimeta"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/errcache"
+)
+
+type DownloadError struct {
+	Origin    string `json:"origin"`
+	MediaId   string `json:"media_id"`
+	Error     string `json:"error"`
+	Failures  int    `json:"failures"`
+	ExpiresTs int64  `json:"expires_ts"`
+}
+
+type ClearedDownloadErrors struct {
+	Cleared int `json:"cleared"`
+}
+
+// downloadErrorsKey returns the error cache key for the server_name and media_id query parameters. When a media ID is
+// given the key must match exactly, otherwise it is a prefix. Returns (key, exact, ok).
+func downloadErrorsKey(r *http.Request) (string, bool, bool) {
+	serverName := r.URL.Query().Get("server_name")
+	mediaId := r.URL.Query().Get("media_id")
+	if serverName == "" {
+		return "", false, mediaId == ""
+	}
+	if strings.Contains(serverName, "/") || strings.Contains(mediaId, "/") {
+		return "", false, false
+	}
+	if mediaId == "" {
+		return serverName + "/", false, true
+	}
+	return serverName + "/" + mediaId, true, true
+}
+
+func GetDownloadErrors(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	key, exact, ok := downloadErrorsKey(r)
+	if !ok {
+		return _responses.BadRequest("invalid server_name or media_id")
+	}
+
+	entries, err := errcache.DownloadErrors.List(rctx, key)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to get download errors")
+	}
+
+	errs := make([]*DownloadError, 0, len(entries))
+	for _, e := range entries {
+		if exact && e.Key != key {
+			continue
+		}
+		origin, mediaId, _ := strings.Cut(e.Key, "/")
+		errs = append(errs, &DownloadError{
+			Origin:    origin,
+			MediaId:   mediaId,
+			Error:     e.Error,
+			Failures:  e.Failures,
+			ExpiresTs: e.ExpiresTs,
+		})
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: errs}
+}
+
+func ClearDownloadErrors(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	key, exact, ok := downloadErrorsKey(r)
+	if !ok {
+		return _responses.BadRequest("invalid server_name or media_id")
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"key":   key,
+		"exact": exact,
+	})
+
+	rctx.Log.Infof("User %s is clearing cached download errors", user.UserId)
+	var cleared int
+	var err error
+	if exact {
+		cleared, err = errcache.DownloadErrors.Delete(rctx, key)
+	} else {
+		cleared, err = errcache.DownloadErrors.Clear(rctx, key)
+	}
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to clear download errors")
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: &ClearedDownloadErrors{Cleared: cleared}}
+}
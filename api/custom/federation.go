@@ -2,6 +2,7 @@ package custom
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 
 	"github.com/getsentry/sentry-go"
@@ -10,7 +11,9 @@ import (
 	"github.com/t2bot/matrix-media-repo/api/_routers"
 
 	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/common/config"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/federation"
 	"github.com/t2bot/matrix-media-repo/matrix"
 )
 
@@ -58,3 +61,120 @@ func GetFederationInfo(r *http.Request, rctx rcontext.RequestContext, user _apim
 	resp["versions_response"] = out
 	return &_responses.DoNotCacheResponse{Payload: resp}
 }
+
+type FederationPolicies struct {
+	ServeMode string               `json:"serve_mode"`
+	Policies  []*federation.Policy `json:"policies"`
+}
+
+func GetFederationPolicies(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	policies, err := federation.ListPolicies(rctx)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to get federation policies")
+	}
+
+	serveMode := config.Get().Federation.ServeMode
+	if serveMode == "" {
+		serveMode = federation.ServeModeAll
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: &FederationPolicies{
+		ServeMode: serveMode,
+		Policies:  policies,
+	}}
+}
+
+func SetFederationPolicy(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	defer r.Body.Close()
+	policy := &federation.Policy{}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&policy); err != nil {
+		rctx.Log.Error(err)
+		return _responses.BadRequest("failed to read policy")
+	}
+	policy.Source = federation.SourceDatabase
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"glob": policy.Glob,
+	})
+
+	if err := policy.Validate(); err != nil {
+		return _responses.BadRequest(err.Error())
+	}
+
+	rctx.Log.Infof("User %s is setting a federation policy", user.UserId)
+	if err := federation.SetPolicy(rctx, policy); err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to set federation policy")
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: policy}
+}
+
+func DeleteFederationPolicy(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	glob := _routers.GetParam("glob", r)
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"glob": glob,
+	})
+
+	rctx.Log.Infof("User %s is deleting a federation policy", user.UserId)
+	if err := federation.DeletePolicy(rctx, glob); err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to delete federation policy")
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: &_responses.EmptyResponse{}}
+}
+
+func GetFederationBreakers(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	return &_responses.DoNotCacheResponse{Payload: matrix.ListBreakers()}
+}
+
+func ResetFederationBreaker(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	kind := _routers.GetParam("kind", r)
+	name := _routers.GetParam("name", r)
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"kind": kind,
+		"name": name,
+	})
+
+	rctx.Log.Infof("User %s is resetting a breaker", user.UserId)
+	state, err := matrix.ResetBreaker(kind, name)
+	if errors.Is(err, matrix.ErrBreakerNotFound) {
+		return _responses.NotFoundError()
+	} else if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to reset breaker")
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: state}
+}
+
+func TripFederationBreaker(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	kind := _routers.GetParam("kind", r)
+	name := _routers.GetParam("name", r)
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"kind": kind,
+		"name": name,
+	})
+
+	rctx.Log.Infof("User %s is tripping a breaker", user.UserId)
+	state, err := matrix.TripBreaker(kind, name)
+	if errors.Is(err, matrix.ErrBreakerNotFound) {
+		return _responses.NotFoundError()
+	} else if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to trip breaker")
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: state}
+}
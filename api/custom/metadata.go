@@ -0,0 +1,27 @@
+package custom
+
+import (
+	"net/http"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/t2bot/matrix-media-repo/api/_apimeta"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/tasks"
+)
+
+type MetadataBackfillResponse struct {
+	TaskID int `json:"task_id"`
+}
+
+func BackfillMetadata(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	rctx.Log.Infof("User %s has started a media metadata backfill", user.UserId)
+	task, err := tasks.RunMetadataBackfill(rctx)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("Unexpected error starting metadata backfill")
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: &MetadataBackfillResponse{TaskID: task.TaskId}}
+}
@@ -0,0 +1,119 @@
+package custom
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/api/_apimeta"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/api/_routers"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/prefetch"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+type PrefetchRequest struct {
+	Mxcs []string `json:"mxcs"`
+}
+
+type PrefetchResponse struct {
+	Queued int `json:"queued"`
+}
+
+type appserviceTransaction struct {
+	Events []struct {
+		Content interface{} `json:"content"`
+	} `json:"events"`
+}
+
+func GetPrefetchStatus(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	return &_responses.DoNotCacheResponse{Payload: prefetch.GetStatus()}
+}
+
+func PrefetchMedia(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	defer r.Body.Close()
+	req := &PrefetchRequest{}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&req); err != nil {
+		rctx.Log.Error(err)
+		return _responses.BadRequest("failed to read prefetch request")
+	}
+
+	rctx.Log.Infof("User %s is prefetching %d media items", user.UserId, len(req.Mxcs))
+	queued, err := prefetch.Enqueue(rctx, req.Mxcs)
+	if errors.Is(err, prefetch.ErrDisabled) {
+		return _responses.BadRequest(err.Error())
+	} else if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to prefetch media")
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: &PrefetchResponse{Queued: queued}}
+}
+
+// PrefetchTransaction accepts appservice transactions from the homeserver, prefetching media in the events.
+func PrefetchTransaction(r *http.Request, rctx rcontext.RequestContext) interface{} {
+	defer r.Body.Close()
+	conf := config.Get().Downloads.Prefetch
+	if !conf.Enabled || conf.AppserviceToken == "" {
+		return _responses.NotFoundError()
+	}
+
+	token := util.GetAccessTokenFromRequest(r)
+	if subtle.ConstantTimeCompare([]byte(token), []byte(conf.AppserviceToken)) != 1 {
+		return _responses.AuthFailed()
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"txnId": _routers.GetParam("txnId", r),
+	})
+
+	txn := &appserviceTransaction{}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&txn); err != nil {
+		rctx.Log.Error(err)
+		return _responses.BadRequest("failed to read transaction")
+	}
+
+	mxcs := make([]string, 0)
+	for _, ev := range txn.Events {
+		mxcs = appendEventMxcs(mxcs, ev.Content)
+	}
+	if len(mxcs) > 0 {
+		queued, err := prefetch.Enqueue(rctx, mxcs)
+		if err != nil {
+			rctx.Log.Error(err)
+			sentry.CaptureException(err)
+			return _responses.InternalServerError("failed to prefetch media")
+		}
+		rctx.Log.Debugf("Prefetching %d media items from transaction", queued)
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: &_responses.EmptyResponse{}}
+}
+
+// appendEventMxcs finds the media in event content, including thumbnails and encrypted files.
+func appendEventMxcs(mxcs []string, content interface{}) []string {
+	switch val := content.(type) {
+	case map[string]interface{}:
+		for k, v := range val {
+			if s, ok := v.(string); ok && (k == "url" || k == "thumbnail_url") && strings.HasPrefix(s, "mxc://") {
+				mxcs = append(mxcs, s)
+			} else {
+				mxcs = appendEventMxcs(mxcs, v)
+			}
+		}
+	case []interface{}:
+		for _, v := range val {
+			mxcs = appendEventMxcs(mxcs, v)
+		}
+	}
+	return mxcs
+}
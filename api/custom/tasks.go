@@ -22,6 +22,7 @@ type TaskStatus struct {
 	EndTs      int64                   `json:"end_ts"`
 	IsFinished bool                    `json:"is_finished"`
 	Error      string                  `json:"error_message"`
+	Progress   *database.AnonymousJson `json:"progress"`
 }
 
 func GetTask(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
@@ -56,6 +57,7 @@ func GetTask(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserIn
 		EndTs:      task.EndTs,
 		IsFinished: task.EndTs > 0,
 		Error:      task.Error,
+		Progress:   task.Progress,
 	}}
 }
 
@@ -79,6 +81,7 @@ func ListAllTasks(r *http.Request, rctx rcontext.RequestContext, user _apimeta.U
 			EndTs:      task.EndTs,
 			IsFinished: task.EndTs > 0,
 			Error:      task.Error,
+			Progress:   task.Progress,
 		})
 	}
 
@@ -105,6 +108,7 @@ func ListUnfinishedTasks(r *http.Request, rctx rcontext.RequestContext, user _ap
 			EndTs:      task.EndTs,
 			IsFinished: task.EndTs > 0,
 			Error:      task.Error,
+			Progress:   task.Progress,
 		})
 	}
 
@@ -0,0 +1,82 @@
+package custom
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/api/_apimeta"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/api/_routers"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/tasks"
+)
+
+type ThumbnailPurgeResponse struct {
+	TaskID int `json:"task_id"`
+}
+
+func PurgeAllThumbnails(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	// Purging every thumbnail at once is rarely intended, so require a content type filter
+	if r.URL.Query().Get("content_type") == "" {
+		return _responses.BadRequest("Missing content_type argument")
+	}
+	return startThumbnailPurge(r, rctx, user, "", "")
+}
+
+func PurgeDomainThumbnails(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	serverName := _routers.GetParam("serverName", r)
+	if !_routers.ServerNameRegex.MatchString(serverName) {
+		return _responses.BadRequest("invalid server name")
+	}
+	return startThumbnailPurge(r, rctx, user, serverName, "")
+}
+
+func PurgeMediaThumbnails(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	server := _routers.GetParam("server", r)
+	mediaId := _routers.GetParam("mediaId", r)
+	if !_routers.ServerNameRegex.MatchString(server) {
+		return _responses.BadRequest("invalid server ID")
+	}
+	return startThumbnailPurge(r, rctx, user, server, mediaId)
+}
+
+func startThumbnailPurge(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo, origin string, mediaId string) interface{} {
+	var err error
+	contentType := r.URL.Query().Get("content_type")
+	regenerate := false
+	regenerateStr := r.URL.Query().Get("regenerate")
+	if regenerateStr != "" {
+		regenerate, err = strconv.ParseBool(regenerateStr)
+		if err != nil {
+			return _responses.BadRequest("Error parsing regenerate: " + err.Error())
+		}
+	}
+	allSizes := false
+	allSizesStr := r.URL.Query().Get("all_sizes")
+	if allSizesStr != "" {
+		allSizes, err = strconv.ParseBool(allSizesStr)
+		if err != nil {
+			return _responses.BadRequest("Error parsing all_sizes: " + err.Error())
+		}
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"origin":      origin,
+		"mediaId":     mediaId,
+		"contentType": contentType,
+		"regenerate":  regenerate,
+		"allSizes":    allSizes,
+	})
+
+	rctx.Log.Infof("User %s has started a thumbnail purge", user.UserId)
+	task, err := tasks.RunThumbnailRegeneration(rctx, origin, mediaId, contentType, regenerate, allSizes)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("Unexpected error starting thumbnail purge")
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: &ThumbnailPurgeResponse{TaskID: task.TaskId}}
+}
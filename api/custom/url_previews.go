@@ -0,0 +1,319 @@
+package custom
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/api/_apimeta"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_preview"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+type UrlPreviewInfo struct {
+	Url            string                      `json:"url"`
+	LanguageHeader string                      `json:"language_header"`
+	BucketTs       int64                       `json:"bucket_ts"`
+	ErrorCode      string                      `json:"error_code,omitempty"`
+	SiteUrl        string                      `json:"site_url,omitempty"`
+	SiteName       string                      `json:"site_name,omitempty"`
+	Type           string                      `json:"type,omitempty"`
+	Title          string                      `json:"title,omitempty"`
+	Description    string                      `json:"description,omitempty"`
+	ImageMxc       string                      `json:"image_mxc,omitempty"`
+	ImageType      string                      `json:"image_type,omitempty"`
+	ImageSize      int64                       `json:"image_size,omitempty"`
+	ImageWidth     int                         `json:"image_width,omitempty"`
+	ImageHeight    int                         `json:"image_height,omitempty"`
+	Extra          *database.DbUrlPreviewExtra `json:"extra,omitempty"`
+}
+
+type UrlPreviewsInfo struct {
+	Url      string               `json:"url"`
+	Blocked  bool                 `json:"blocked"`
+	Previews []*UrlPreviewInfo    `json:"previews"`
+	Block    *UrlPreviewBlockInfo `json:"block,omitempty"`
+}
+
+type UrlPreviewRefreshRequest struct {
+	Url      string `json:"url"`
+	Language string `json:"language"`
+}
+
+type DeletedUrlPreviews struct {
+	Deleted   int      `json:"deleted"`
+	ImageMxcs []string `json:"image_mxcs"`
+}
+
+type UrlPreviewBlockInfo struct {
+	Url        string `json:"url"`
+	Reason     string `json:"reason"`
+	CreationTs int64  `json:"creation_ts"`
+}
+
+type UrlPreviewBlockRequest struct {
+	Url    string `json:"url"`
+	Reason string `json:"reason"`
+}
+
+func urlPreviewInfo(p *database.DbUrlPreview) *UrlPreviewInfo {
+	return &UrlPreviewInfo{
+		Url:            p.Url,
+		LanguageHeader: p.LanguageHeader,
+		BucketTs:       p.BucketTs,
+		ErrorCode:      p.ErrorCode,
+		SiteUrl:        p.SiteUrl,
+		SiteName:       p.SiteName,
+		Type:           p.ResourceType,
+		Title:          p.Title,
+		Description:    p.Description,
+		ImageMxc:       p.ImageMxc,
+		ImageType:      p.ImageType,
+		ImageSize:      p.ImageSize,
+		ImageWidth:     p.ImageWidth,
+		ImageHeight:    p.ImageHeight,
+		Extra:          p.Extra,
+	}
+}
+
+// previewUrlKey gets the URL as it is cached, which is the canonical URL if canonicalization is enabled.
+func previewUrlKey(rctx rcontext.RequestContext, urlStr string) (string, bool) {
+	parsedUrl, ok := parsePreviewUrl(rctx, urlStr)
+	if !ok {
+		return "", false
+	}
+	return parsedUrl.String(), true
+}
+
+// previewBlockKey gets the URL as it is blocked, which is the cached URL without a fragment.
+func previewBlockKey(rctx rcontext.RequestContext, urlStr string) (string, bool) {
+	parsedUrl, ok := parsePreviewUrl(rctx, urlStr)
+	if !ok {
+		return "", false
+	}
+	return pipeline_preview.BlockKey(parsedUrl), true
+}
+
+func parsePreviewUrl(rctx rcontext.RequestContext, urlStr string) (*url.URL, bool) {
+	//goland:noinspection HttpUrlsUsage
+	if !strings.HasPrefix(urlStr, "http://") && !strings.HasPrefix(urlStr, "https://") {
+		return nil, false
+	}
+	parsedUrl, err := pipeline_preview.ParseUrl(rctx, urlStr)
+	if err != nil {
+		return nil, false
+	}
+	return parsedUrl, true
+}
+
+// deletedImages drops the empty MXC URIs of previews which didn't have an image.
+func deletedImages(mxcs []string) *DeletedUrlPreviews {
+	images := make([]string, 0, len(mxcs))
+	for _, mxc := range mxcs {
+		if mxc != "" {
+			images = append(images, mxc)
+		}
+	}
+	return &DeletedUrlPreviews{Deleted: len(mxcs), ImageMxcs: images}
+}
+
+func GetUrlPreviews(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	urlStr, ok := previewUrlKey(rctx, r.URL.Query().Get("url"))
+	if !ok {
+		return _responses.BadRequest("invalid url")
+	}
+
+	previews, err := database.GetInstance().UrlPreviews.Prepare(rctx).GetAllForUrl(urlStr)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to get url previews")
+	}
+	blockKey, _ := previewBlockKey(rctx, r.URL.Query().Get("url"))
+	block, err := database.GetInstance().UrlBlocks.Prepare(rctx).Get(blockKey)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to get url preview block")
+	}
+
+	info := &UrlPreviewsInfo{
+		Url:      urlStr,
+		Blocked:  block != nil,
+		Previews: make([]*UrlPreviewInfo, 0, len(previews)),
+	}
+	for _, p := range previews {
+		info.Previews = append(info.Previews, urlPreviewInfo(p))
+	}
+	if block != nil {
+		info.Block = &UrlPreviewBlockInfo{Url: block.Url, Reason: block.Reason, CreationTs: block.CreationTs}
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: info}
+}
+
+func RefreshUrlPreview(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	defer r.Body.Close()
+	req := &UrlPreviewRefreshRequest{}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&req); err != nil {
+		rctx.Log.Error(err)
+		return _responses.BadRequest("failed to read refresh request")
+	}
+	urlStr, ok := previewUrlKey(rctx, req.Url)
+	if !ok {
+		return _responses.BadRequest("invalid url")
+	}
+	languageHeader := req.Language
+	if languageHeader == "" {
+		languageHeader = rctx.Config.UrlPreviews.DefaultLanguage
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"url": urlStr,
+	})
+	rctx.Log.Infof("User %s is refreshing the previews for a URL", user.UserId)
+
+	if _, err := database.GetInstance().UrlPreviews.Prepare(rctx).DeleteForUrl(urlStr); err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to delete url previews")
+	}
+
+	preview, err := pipeline_preview.Execute(rctx, r.Host, urlStr, user.UserId, pipeline_preview.PreviewOpts{
+		Timestamp:      util.NowMillis(),
+		LanguageHeader: languageHeader,
+	})
+	if err != nil {
+		if errors.Is(err, common.ErrInvalidHost) || errors.Is(err, common.ErrHostNotAllowed) || errors.Is(err, common.ErrUrlNotAllowed) {
+			return _responses.BadRequest(err.Error())
+		} else if errors.Is(err, common.ErrMediaNotFound) || errors.Is(err, common.ErrHostNotFound) {
+			return _responses.NotFoundError()
+		} else if errors.Is(err, common.ErrRateLimitExceeded) {
+			return _responses.RateLimitReached()
+		}
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to refresh url preview")
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: urlPreviewInfo(preview)}
+}
+
+func DeleteUrlPreviews(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	prefix := r.URL.Query().Get("url_prefix")
+	domain := r.URL.Query().Get("domain")
+	if (prefix == "") == (domain == "") {
+		return _responses.BadRequest("exactly one of url_prefix or domain is required")
+	}
+	if domain != "" && strings.ContainsAny(domain, "/?#") {
+		return _responses.BadRequest("invalid domain")
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"urlPrefix": prefix,
+		"domain":    domain,
+	})
+	rctx.Log.Infof("User %s is deleting url previews", user.UserId)
+
+	db := database.GetInstance().UrlPreviews.Prepare(rctx)
+	var mxcs []string
+	var err error
+	if domain != "" {
+		mxcs, err = db.DeleteForDomain(domain)
+	} else {
+		mxcs, err = db.DeleteWithPrefix(prefix)
+	}
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to delete url previews")
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: deletedImages(mxcs)}
+}
+
+func GetUrlPreviewBlocks(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	blocks, err := database.GetInstance().UrlBlocks.Prepare(rctx).GetAll()
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to get url preview blocks")
+	}
+
+	infos := make([]*UrlPreviewBlockInfo, 0, len(blocks))
+	for _, b := range blocks {
+		infos = append(infos, &UrlPreviewBlockInfo{Url: b.Url, Reason: b.Reason, CreationTs: b.CreationTs})
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: infos}
+}
+
+func BlockUrlPreview(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	defer r.Body.Close()
+	req := &UrlPreviewBlockRequest{}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&req); err != nil {
+		rctx.Log.Error(err)
+		return _responses.BadRequest("failed to read block request")
+	}
+	urlStr, ok := previewUrlKey(rctx, req.Url)
+	if !ok {
+		return _responses.BadRequest("invalid url")
+	}
+	blockKey, _ := previewBlockKey(rctx, req.Url)
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"url": blockKey,
+	})
+	rctx.Log.Infof("User %s is blocking previews of a URL", user.UserId)
+
+	block := &database.DbUrlPreviewBlock{
+		Url:        blockKey,
+		Reason:     req.Reason,
+		CreationTs: util.NowMillis(),
+	}
+	if err := database.GetInstance().UrlBlocks.Prepare(rctx).Upsert(block); err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to block url")
+	}
+
+	// Previews which are already cached would otherwise still be served
+	mxcs, err := database.GetInstance().UrlPreviews.Prepare(rctx).DeleteForUrl(urlStr)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to delete url previews")
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: deletedImages(mxcs)}
+}
+
+func UnblockUrlPreview(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
+	blockKey, ok := previewBlockKey(rctx, r.URL.Query().Get("url"))
+	if !ok {
+		return _responses.BadRequest("invalid url")
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"url": blockKey,
+	})
+	rctx.Log.Infof("User %s is unblocking previews of a URL", user.UserId)
+
+	if err := database.GetInstance().UrlBlocks.Prepare(rctx).Delete(blockKey); err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("failed to unblock url")
+	}
+
+	return &_responses.DoNotCacheResponse{Payload: &_responses.EmptyResponse{}}
+}
@@ -102,6 +102,8 @@ func DownloadMedia(r *http.Request, rctx rcontext.RequestContext, auth _apimeta.
 			return _responses.RequestTooLarge()
 		} else if errors.Is(err, common.ErrRateLimitExceeded) {
 			return _responses.RateLimitReached()
+		} else if errors.Is(err, common.ErrHostNotAllowed) {
+			return _responses.MediaBlocked()
 		} else if errors.Is(err, common.ErrMediaQuarantined) {
 			rctx.Log.Debug("Quarantined media accessed. Has stream? ", stream != nil)
 			if stream != nil {
@@ -111,6 +113,8 @@ func DownloadMedia(r *http.Request, rctx rcontext.RequestContext, auth _apimeta.
 			}
 		} else if errors.Is(err, common.ErrMediaNotYetUploaded) {
 			return _responses.NotYetUploaded()
+		} else if errors.Is(err, common.ErrMediaMismatch) {
+			return _responses.BadGatewayError("remote server sent media which does not match its metadata")
 		} else if errors.As(err, &redirect) {
 			return _responses.Redirect(redirect.RedirectUrl)
 		}
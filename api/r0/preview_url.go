@@ -27,6 +27,22 @@ type MatrixOpenGraph struct {
 	ImageSize   int64  `json:"matrix:image:size,omitempty"`
 	ImageWidth  int    `json:"og:image:width,omitempty"`
 	ImageHeight int    `json:"og:image:height,omitempty"`
+
+	FaviconMxc     string `json:"matrix:favicon,omitempty"`
+	FaviconType    string `json:"matrix:favicon:type,omitempty"`
+	VideoUrl       string `json:"og:video,omitempty"`
+	VideoType      string `json:"og:video:type,omitempty"`
+	VideoWidth     int    `json:"og:video:width,omitempty"`
+	VideoHeight    int    `json:"og:video:height,omitempty"`
+	AudioUrl       string `json:"og:audio,omitempty"`
+	AudioType      string `json:"og:audio:type,omitempty"`
+	TwitterCard    string `json:"twitter:card,omitempty"`
+	TwitterSite    string `json:"twitter:site,omitempty"`
+	TwitterCreator string `json:"twitter:creator,omitempty"`
+	Author         string `json:"article:author,omitempty"`
+	PublishedTime  string `json:"article:published_time,omitempty"`
+	DurationMs     int64  `json:"matrix:duration_ms,omitempty"`
+	Locale         string `json:"og:locale,omitempty"`
 }
 
 func PreviewUrl(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{} {
@@ -72,6 +88,8 @@ func PreviewUrl(r *http.Request, rctx rcontext.RequestContext, user _apimeta.Use
 			err = common.ErrInvalidHost
 		} else if preview.ErrorCode == common.ErrCodeNotFound {
 			err = common.ErrMediaNotFound
+		} else if preview.ErrorCode == common.ErrCodeForbidden {
+			err = common.ErrHostNotAllowed
 		} else {
 			err = errors.New("url previews: unknown error code: " + preview.ErrorCode)
 		}
@@ -79,15 +97,17 @@ func PreviewUrl(r *http.Request, rctx rcontext.RequestContext, user _apimeta.Use
 	if err != nil {
 		if errors.Is(err, common.ErrMediaNotFound) || errors.Is(err, common.ErrHostNotFound) {
 			return _responses.NotFoundError()
-		} else if errors.Is(err, common.ErrInvalidHost) || errors.Is(err, common.ErrHostNotAllowed) {
+		} else if errors.Is(err, common.ErrInvalidHost) || errors.Is(err, common.ErrHostNotAllowed) || errors.Is(err, common.ErrUrlNotAllowed) {
 			return _responses.BadRequest(err.Error())
+		} else if errors.Is(err, common.ErrRateLimitExceeded) {
+			return _responses.RateLimitReached()
 		} else {
 			sentry.CaptureException(err)
 			return _responses.InternalServerError("Unexpected Error")
 		}
 	}
 
-	return &MatrixOpenGraph{
+	res := &MatrixOpenGraph{
 		Url:         preview.SiteUrl,
 		SiteName:    preview.SiteName,
 		Type:        preview.ResourceType,
@@ -99,4 +119,22 @@ func PreviewUrl(r *http.Request, rctx rcontext.RequestContext, user _apimeta.Use
 		ImageWidth:  preview.ImageWidth,
 		ImageHeight: preview.ImageHeight,
 	}
+	if preview.Extra != nil {
+		res.FaviconMxc = preview.Extra.FaviconMxc
+		res.FaviconType = preview.Extra.FaviconType
+		res.VideoUrl = preview.Extra.VideoUrl
+		res.VideoType = preview.Extra.VideoType
+		res.VideoWidth = preview.Extra.VideoWidth
+		res.VideoHeight = preview.Extra.VideoHeight
+		res.AudioUrl = preview.Extra.AudioUrl
+		res.AudioType = preview.Extra.AudioType
+		res.TwitterCard = preview.Extra.TwitterCard
+		res.TwitterSite = preview.Extra.TwitterSite
+		res.TwitterCreator = preview.Extra.TwitterCreator
+		res.Author = preview.Extra.Author
+		res.PublishedTime = preview.Extra.PublishedTime
+		res.DurationMs = preview.Extra.DurationMs
+		res.Locale = preview.Extra.Locale
+	}
+	return res
 }
@@ -138,6 +138,7 @@ func ThumbnailMedia(r *http.Request, rctx rcontext.RequestContext, auth _apimeta
 		Height:   height,
 		Method:   method,
 		Animated: animated,
+		Accept:   r.Header.Get("Accept"),
 	})
 	if err != nil {
 		var redirect datastores.RedirectError
@@ -153,6 +154,8 @@ func ThumbnailMedia(r *http.Request, rctx rcontext.RequestContext, auth _apimeta
 			return _responses.RequestTooLarge()
 		} else if errors.Is(err, common.ErrRateLimitExceeded) {
 			return _responses.RateLimitReached()
+		} else if errors.Is(err, common.ErrHostNotAllowed) {
+			return _responses.MediaBlocked()
 		} else if errors.Is(err, common.ErrMediaQuarantined) {
 			rctx.Log.Debug("Quarantined media accessed. Has stream? ", stream != nil)
 			if stream != nil {
@@ -197,5 +200,6 @@ func ThumbnailMedia(r *http.Request, rctx rcontext.RequestContext, auth _apimeta
 		SizeBytes:         thumbnail.SizeBytes,
 		Data:              stream,
 		TargetDisposition: "infer",
+		Vary:              "Accept", // the animated format depends on what the client accepts
 	}
 }
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"slices"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/sirupsen/logrus"
@@ -14,63 +15,100 @@ import (
 	"github.com/t2bot/matrix-media-repo/api/unstable"
 	v1 "github.com/t2bot/matrix-media-repo/api/v1"
 	"github.com/t2bot/matrix-media-repo/homeserver_interop/synapse"
+	"github.com/t2bot/matrix-media-repo/metrics"
 )
 
 const PrefixMedia = "/_matrix/media"
 const PrefixClient = "/_matrix/client"
 const PrefixFederation = "/_matrix/federation"
+const PrefixAppservice = "/_matrix/app"
 
-func buildRoutes() http.Handler {
+// Route groups which can be served by a listener
+const (
+	RouteGroupClient     = "client"
+	RouteGroupFederation = "federation"
+	RouteGroupAdmin      = "admin"
+	RouteGroupMetrics    = "metrics"
+	RouteGroupAppservice = "appservice"
+)
+
+var allRouteGroups = []string{RouteGroupClient, RouteGroupFederation, RouteGroupAdmin, RouteGroupMetrics, RouteGroupAppservice}
+
+// groupedRouter only registers routes which belong to one of its route groups.
+type groupedRouter struct {
+	*httprouter.Router
+	groups map[string]bool
+}
+
+func (r *groupedRouter) has(group string) bool {
+	return r.groups[group]
+}
+
+func buildRoutes(groups []string) http.Handler {
 	counter := &_routers.RequestCounter{}
-	router := buildPrimaryRouter()
+	router := &groupedRouter{Router: buildPrimaryRouter(), groups: make(map[string]bool)}
+	for _, group := range groups {
+		if !slices.Contains(allRouteGroups, group) {
+			logrus.Warnf("Unknown route group '%s' - ignoring", group)
+			continue
+		}
+		router.groups[group] = true
+	}
 
 	pprofSecret := os.Getenv("MEDIA_PPROF_SECRET_KEY")
-	if pprofSecret != "" {
+	if pprofSecret != "" && router.has(RouteGroupAdmin) {
 		logrus.Warn("Enabling pprof/debug http endpoints")
-		_debug.BindPprofEndpoints(router, pprofSecret)
+		_debug.BindPprofEndpoints(router.Router, pprofSecret)
+	}
+
+	if router.has(RouteGroupMetrics) {
+		router.HandlerFunc("GET", "/metrics", metrics.Handler)
+		router.HandlerFunc("GET", "/_media/metrics", metrics.Handler)
 	}
 
 	// Standard (spec) features
-	register([]string{"PUT"}, PrefixMedia, "upload/:server/:mediaId", mxV3, router, makeRoute(_routers.RequireAccessToken(r0.UploadMediaAsync, false), "upload_async", counter))
-	register([]string{"POST"}, PrefixMedia, "upload", mxSpecV3Transition, router, makeRoute(_routers.RequireAccessToken(r0.UploadMediaSync, false), "upload", counter))
+	register(RouteGroupClient, []string{"PUT"}, PrefixMedia, "upload/:server/:mediaId", mxV3, router, makeRoute(_routers.RequireAccessToken(r0.UploadMediaAsync, false), "upload_async", counter))
+	register(RouteGroupClient, []string{"POST"}, PrefixMedia, "upload", mxSpecV3Transition, router, makeRoute(_routers.RequireAccessToken(r0.UploadMediaSync, false), "upload", counter))
 	downloadRoute := makeRoute(_routers.OptionalAccessToken(r0.DownloadMediaUser), "download", counter)
-	register([]string{"GET", "HEAD"}, PrefixMedia, "download/:server/:mediaId/:filename", mxSpecV3Transition, router, downloadRoute)
-	register([]string{"GET", "HEAD"}, PrefixMedia, "download/:server/:mediaId", mxSpecV3Transition, router, downloadRoute)
-	register([]string{"GET"}, PrefixMedia, "thumbnail/:server/:mediaId", mxSpecV3Transition, router, makeRoute(_routers.OptionalAccessToken(r0.ThumbnailMediaUser), "thumbnail", counter))
+	register(RouteGroupClient, []string{"GET", "HEAD"}, PrefixMedia, "download/:server/:mediaId/:filename", mxSpecV3Transition, router, downloadRoute)
+	register(RouteGroupClient, []string{"GET", "HEAD"}, PrefixMedia, "download/:server/:mediaId", mxSpecV3Transition, router, downloadRoute)
+	register(RouteGroupClient, []string{"GET"}, PrefixMedia, "thumbnail/:server/:mediaId", mxSpecV3Transition, router, makeRoute(_routers.OptionalAccessToken(r0.ThumbnailMediaUser), "thumbnail", counter))
 	previewUrlRoute := makeRoute(_routers.RequireAccessToken(r0.PreviewUrl, false), "url_preview", counter)
-	register([]string{"GET"}, PrefixMedia, "preview_url", mxSpecV3TransitionCS, router, previewUrlRoute)
-	register([]string{"GET"}, PrefixMedia, "identicon/*seed", mxR0, router, makeRoute(_routers.OptionalAccessToken(r0.Identicon), "identicon", counter))
+	register(RouteGroupClient, []string{"GET"}, PrefixMedia, "preview_url", mxSpecV3TransitionCS, router, previewUrlRoute)
+	register(RouteGroupClient, []string{"GET"}, PrefixMedia, "identicon/*seed", mxR0, router, makeRoute(_routers.OptionalAccessToken(r0.Identicon), "identicon", counter))
 	configRoute := makeRoute(_routers.RequireAccessToken(r0.PublicConfig, false), "config", counter)
-	register([]string{"GET"}, PrefixMedia, "config", mxSpecV3TransitionCS, router, configRoute)
-	register([]string{"POST"}, PrefixClient, "logout", mxSpecV3TransitionCS, router, makeRoute(_routers.RequireAccessToken(r0.Logout, false), "logout", counter))
-	register([]string{"POST"}, PrefixClient, "logout/all", mxSpecV3TransitionCS, router, makeRoute(_routers.RequireAccessToken(r0.LogoutAll, false), "logout_all", counter))
-	register([]string{"POST"}, PrefixMedia, "create", mxV1, router, makeRoute(_routers.RequireAccessToken(v1.CreateMedia, false), "create", counter))
-	register([]string{"GET"}, PrefixClient, "versions", mxNoVersion, router, makeRoute(_routers.OptionalAccessToken(r0.ClientVersions), "client_versions", counter))
-	register([]string{"GET"}, PrefixClient, "media/preview_url", mxV1, router, previewUrlRoute)
-	register([]string{"GET"}, PrefixClient, "media/config", mxV1, router, configRoute)
+	register(RouteGroupClient, []string{"GET"}, PrefixMedia, "config", mxSpecV3TransitionCS, router, configRoute)
+	register(RouteGroupClient, []string{"POST"}, PrefixClient, "logout", mxSpecV3TransitionCS, router, makeRoute(_routers.RequireAccessToken(r0.Logout, false), "logout", counter))
+	register(RouteGroupClient, []string{"POST"}, PrefixClient, "logout/all", mxSpecV3TransitionCS, router, makeRoute(_routers.RequireAccessToken(r0.LogoutAll, false), "logout_all", counter))
+	register(RouteGroupClient, []string{"POST"}, PrefixMedia, "create", mxV1, router, makeRoute(_routers.RequireAccessToken(v1.CreateMedia, false), "create", counter))
+	register(RouteGroupClient, []string{"GET"}, PrefixClient, "versions", mxNoVersion, router, makeRoute(_routers.OptionalAccessToken(r0.ClientVersions), "client_versions", counter))
+	register(RouteGroupClient, []string{"GET"}, PrefixClient, "media/preview_url", mxV1, router, previewUrlRoute)
+	register(RouteGroupClient, []string{"GET"}, PrefixClient, "media/config", mxV1, router, configRoute)
 	authedDownloadRoute := makeRoute(_routers.RequireAccessToken(v1.ClientDownloadMedia, true), "download", counter)
-	register([]string{"GET"}, PrefixClient, "media/download/:server/:mediaId/:filename", mxV1, router, authedDownloadRoute)
-	register([]string{"GET"}, PrefixClient, "media/download/:server/:mediaId", mxV1, router, authedDownloadRoute)
-	register([]string{"GET"}, PrefixClient, "media/thumbnail/:server/:mediaId", mxV1, router, makeRoute(_routers.RequireAccessToken(v1.ClientThumbnailMedia, true), "thumbnail", counter))
-	register([]string{"GET"}, PrefixFederation, "media/download/:mediaId", mxV1, router, makeRoute(_routers.RequireServerAuth(v1.FederationDownloadMedia), "download", counter))
-	register([]string{"GET"}, PrefixFederation, "media/thumbnail/:mediaId", mxV1, router, makeRoute(_routers.RequireServerAuth(v1.FederationThumbnailMedia), "thumbnail", counter))
+	register(RouteGroupClient, []string{"GET"}, PrefixClient, "media/download/:server/:mediaId/:filename", mxV1, router, authedDownloadRoute)
+	register(RouteGroupClient, []string{"GET"}, PrefixClient, "media/download/:server/:mediaId", mxV1, router, authedDownloadRoute)
+	register(RouteGroupClient, []string{"GET"}, PrefixClient, "media/thumbnail/:server/:mediaId", mxV1, router, makeRoute(_routers.RequireAccessToken(v1.ClientThumbnailMedia, true), "thumbnail", counter))
+	register(RouteGroupFederation, []string{"GET"}, PrefixFederation, "media/download/:mediaId", mxV1, router, makeRoute(_routers.RequireServerAuth(v1.FederationDownloadMedia), "download", counter))
+	register(RouteGroupFederation, []string{"GET"}, PrefixFederation, "media/thumbnail/:mediaId", mxV1, router, makeRoute(_routers.RequireServerAuth(v1.FederationThumbnailMedia), "thumbnail", counter))
 
 	// Custom features
-	register([]string{"GET"}, PrefixMedia, "local_copy/:server/:mediaId", mxUnstable, router, makeRoute(_routers.RequireAccessToken(unstable.LocalCopy, false), "local_copy", counter))
-	register([]string{"GET"}, PrefixMedia, "info/:server/:mediaId", mxUnstable, router, makeRoute(_routers.RequireAccessToken(unstable.MediaInfo, false), "info", counter))
+	register(RouteGroupClient, []string{"GET"}, PrefixMedia, "local_copy/:server/:mediaId", mxUnstable, router, makeRoute(_routers.RequireAccessToken(unstable.LocalCopy, false), "local_copy", counter))
+	register(RouteGroupClient, []string{"GET"}, PrefixMedia, "info/:server/:mediaId", mxUnstable, router, makeRoute(_routers.RequireAccessToken(unstable.MediaInfo, false), "info", counter))
 	purgeOneRoute := makeRoute(_routers.RequireAccessToken(custom.PurgeIndividualRecord, false), "purge_individual_media", counter)
-	register([]string{"DELETE"}, PrefixMedia, "download/:server/:mediaId", mxUnstable, router, purgeOneRoute)
-	register([]string{"GET"}, PrefixMedia, "usage", msc4034, router, makeRoute(_routers.RequireAccessToken(unstable.PublicUsage, false), "usage", counter))
+	register(RouteGroupAdmin, []string{"DELETE"}, PrefixMedia, "download/:server/:mediaId", mxUnstable, router, purgeOneRoute)
+	register(RouteGroupClient, []string{"GET"}, PrefixMedia, "usage", msc4034, router, makeRoute(_routers.RequireAccessToken(unstable.PublicUsage, false), "usage", counter))
 
 	// Custom and top-level features
-	router.Handler("GET", fmt.Sprintf("%s/version", PrefixMedia), makeRoute(_routers.OptionalAccessToken(custom.GetVersion), "get_version", counter))
+	if router.has(RouteGroupClient) {
+		router.Handler("GET", fmt.Sprintf("%s/version", PrefixMedia), makeRoute(_routers.OptionalAccessToken(custom.GetVersion), "get_version", counter))
+	}
 	healthzRoute := makeRoute(_routers.OptionalAccessToken(custom.GetHealthz), "healthz", counter) // Note: healthz handling is special in makeRoute()
 	router.Handler("GET", "/healthz", healthzRoute)
 	router.Handler("HEAD", "/healthz", healthzRoute)
 
 	// Register the Synapse admin API endpoints we're compatible with
 	synUserStatsRoute := makeRoute(_routers.RequireAccessToken(custom.SynGetUsersMediaStats, false), "users_usage_stats", counter)
-	register([]string{"GET"}, synapse.PrefixAdminApi, "statistics/users/media", mxV1, router, synUserStatsRoute)
+	register(RouteGroupAdmin, []string{"GET"}, synapse.PrefixAdminApi, "statistics/users/media", mxV1, router, synUserStatsRoute)
 
 	// All admin routes are unstable only
 	purgeRemoteRoute := makeRoute(_routers.RequireRepoAdmin(custom.PurgeRemoteMedia), "purge_remote_media", counter)
@@ -83,9 +121,9 @@ func buildRoutes() http.Handler {
 		{"server/:serverName", makeRoute(_routers.RequireAccessToken(custom.PurgeDomainMedia, false), "purge_domain_media", counter)},
 		{":server/:mediaId", purgeOneRoute},
 	})
-	register([]string{"POST"}, PrefixMedia, "admin/purge/*branch", mxUnstable, router, purgeBranch)
-	register([]string{"POST"}, PrefixMedia, "admin/purge_remote", mxUnstable, router, purgeRemoteRoute)
-	register([]string{"POST"}, PrefixClient, "admin/purge_media_cache", mxUnstable, router, purgeRemoteRoute) // synapse compat
+	register(RouteGroupAdmin, []string{"POST"}, PrefixMedia, "admin/purge/*branch", mxUnstable, router, purgeBranch)
+	register(RouteGroupAdmin, []string{"POST"}, PrefixMedia, "admin/purge_remote", mxUnstable, router, purgeRemoteRoute)
+	register(RouteGroupAdmin, []string{"POST"}, PrefixClient, "admin/purge_media_cache", mxUnstable, router, purgeRemoteRoute) // synapse compat
 	quarantineRoomRoute := makeRoute(_routers.RequireAccessToken(custom.QuarantineRoomMedia, false), "quarantine_room", counter)
 	quarantineBranch := branchedRoute([]branch{
 		{"room/:roomId", quarantineRoomRoute},
@@ -93,33 +131,57 @@ func buildRoutes() http.Handler {
 		{"server/:serverName", makeRoute(_routers.RequireAccessToken(custom.QuarantineDomainMedia, false), "quarantine_domain", counter)},
 		{":server/:mediaId", makeRoute(_routers.RequireAccessToken(custom.QuarantineMedia, false), "quarantine_media", counter)},
 	})
-	register([]string{"POST"}, PrefixMedia, "admin/quarantine/*branch", mxUnstable, router, quarantineBranch)
-	register([]string{"POST"}, PrefixClient, "admin/quarantine_media/:roomId", mxUnstable, router, quarantineRoomRoute) // synapse compat
-	register([]string{"GET"}, PrefixMedia, "admin/datastores/:datastoreId/size_estimate", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.GetDatastoreStorageEstimate), "get_storage_estimate", counter))
-	register([]string{"POST"}, PrefixMedia, "admin/datastores/:sourceDsId/transfer_to/:targetDsId", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.MigrateBetweenDatastores), "datastore_transfer", counter))
-	register([]string{"GET"}, PrefixMedia, "admin/datastores", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.GetDatastores), "list_datastores", counter))
-	register([]string{"GET"}, PrefixMedia, "admin/federation/test/:serverName", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.GetFederationInfo), "federation_test", counter))
-	register([]string{"GET"}, PrefixMedia, "admin/usage/:serverName", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.GetDomainUsage), "domain_usage", counter))
-	register([]string{"GET"}, PrefixMedia, "admin/usage/:serverName/users", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.GetUserUsage), "user_usage", counter))
-	register([]string{"GET"}, PrefixMedia, "admin/usage/:serverName/users-stats", mxUnstable, router, synUserStatsRoute)
-	register([]string{"GET"}, PrefixMedia, "admin/usage/:serverName/uploads", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.GetUploadsUsage), "uploads_usage", counter))
+	register(RouteGroupAdmin, []string{"POST"}, PrefixMedia, "admin/quarantine/*branch", mxUnstable, router, quarantineBranch)
+	register(RouteGroupAdmin, []string{"POST"}, PrefixClient, "admin/quarantine_media/:roomId", mxUnstable, router, quarantineRoomRoute) // synapse compat
+	register(RouteGroupAdmin, []string{"GET"}, PrefixMedia, "admin/datastores/:datastoreId/size_estimate", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.GetDatastoreStorageEstimate), "get_storage_estimate", counter))
+	register(RouteGroupAdmin, []string{"POST"}, PrefixMedia, "admin/datastores/:sourceDsId/transfer_to/:targetDsId", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.MigrateBetweenDatastores), "datastore_transfer", counter))
+	register(RouteGroupAdmin, []string{"GET"}, PrefixMedia, "admin/datastores", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.GetDatastores), "list_datastores", counter))
+	register(RouteGroupAdmin, []string{"GET"}, PrefixMedia, "admin/federation/test/:serverName", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.GetFederationInfo), "federation_test", counter))
+	register(RouteGroupAdmin, []string{"GET"}, PrefixMedia, "admin/federation/policies", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.GetFederationPolicies), "list_federation_policies", counter))
+	register(RouteGroupAdmin, []string{"POST"}, PrefixMedia, "admin/federation/policies", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.SetFederationPolicy), "set_federation_policy", counter))
+	register(RouteGroupAdmin, []string{"DELETE"}, PrefixMedia, "admin/federation/policies/:glob", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.DeleteFederationPolicy), "delete_federation_policy", counter))
+	register(RouteGroupAdmin, []string{"GET"}, PrefixMedia, "admin/federation/breakers", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.GetFederationBreakers), "list_federation_breakers", counter))
+	register(RouteGroupAdmin, []string{"POST"}, PrefixMedia, "admin/federation/breakers/:kind/:name/reset", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.ResetFederationBreaker), "reset_federation_breaker", counter))
+	register(RouteGroupAdmin, []string{"POST"}, PrefixMedia, "admin/federation/breakers/:kind/:name/trip", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.TripFederationBreaker), "trip_federation_breaker", counter))
+	register(RouteGroupAdmin, []string{"GET"}, PrefixMedia, "admin/federation/download_errors", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.GetDownloadErrors), "list_download_errors", counter))
+	register(RouteGroupAdmin, []string{"DELETE"}, PrefixMedia, "admin/federation/download_errors", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.ClearDownloadErrors), "clear_download_errors", counter))
+	register(RouteGroupAdmin, []string{"GET"}, PrefixMedia, "admin/prefetch", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.GetPrefetchStatus), "prefetch_status", counter))
+	register(RouteGroupAdmin, []string{"POST"}, PrefixMedia, "admin/prefetch", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.PrefetchMedia), "prefetch_media", counter))
+	register(RouteGroupAdmin, []string{"GET"}, PrefixMedia, "admin/url_previews", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.GetUrlPreviews), "get_url_previews", counter))
+	register(RouteGroupAdmin, []string{"DELETE"}, PrefixMedia, "admin/url_previews", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.DeleteUrlPreviews), "delete_url_previews", counter))
+	register(RouteGroupAdmin, []string{"POST"}, PrefixMedia, "admin/url_previews/refresh", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.RefreshUrlPreview), "refresh_url_preview", counter))
+	register(RouteGroupAdmin, []string{"GET"}, PrefixMedia, "admin/url_previews/blocks", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.GetUrlPreviewBlocks), "list_url_preview_blocks", counter))
+	register(RouteGroupAdmin, []string{"POST"}, PrefixMedia, "admin/url_previews/blocks", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.BlockUrlPreview), "block_url_preview", counter))
+	register(RouteGroupAdmin, []string{"DELETE"}, PrefixMedia, "admin/url_previews/blocks", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.UnblockUrlPreview), "unblock_url_preview", counter))
+	register(RouteGroupAppservice, []string{"PUT"}, PrefixAppservice, "transactions/:txnId", mxV1, router, makeRoute(custom.PrefetchTransaction, "prefetch_transaction", counter))
+	register(RouteGroupAdmin, []string{"GET"}, PrefixMedia, "admin/usage/:serverName", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.GetDomainUsage), "domain_usage", counter))
+	register(RouteGroupAdmin, []string{"GET"}, PrefixMedia, "admin/usage/:serverName/users", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.GetUserUsage), "user_usage", counter))
+	register(RouteGroupAdmin, []string{"GET"}, PrefixMedia, "admin/usage/:serverName/users-stats", mxUnstable, router, synUserStatsRoute)
+	register(RouteGroupAdmin, []string{"GET"}, PrefixMedia, "admin/usage/:serverName/uploads", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.GetUploadsUsage), "uploads_usage", counter))
 	tasksBranch := branchedRoute([]branch{
 		{"all", makeRoute(_routers.RequireRepoAdmin(custom.ListAllTasks), "list_all_background_tasks", counter)},
 		{"unfinished", makeRoute(_routers.RequireRepoAdmin(custom.ListUnfinishedTasks), "list_unfinished_background_tasks", counter)},
 		{":taskId", makeRoute(_routers.RequireRepoAdmin(custom.GetTask), "get_background_task", counter)},
 	})
-	register([]string{"GET"}, PrefixMedia, "admin/tasks/*branch", mxUnstable, router, tasksBranch)
-	register([]string{"POST"}, PrefixMedia, "admin/user/:userId/export", mxUnstable, router, makeRoute(_routers.RequireAccessToken(custom.ExportUserData, false), "export_user_data", counter))
-	register([]string{"POST"}, PrefixMedia, "admin/server/:serverName/export", mxUnstable, router, makeRoute(_routers.RequireAccessToken(custom.ExportServerData, false), "export_server_data", counter))
-	register([]string{"GET"}, PrefixMedia, "admin/export/:exportId/view", mxUnstable, router, makeRoute(_routers.OptionalAccessToken(custom.ViewExport), "view_export", counter))
-	register([]string{"GET"}, PrefixMedia, "admin/export/:exportId/metadata", mxUnstable, router, makeRoute(_routers.OptionalAccessToken(custom.GetExportMetadata), "get_export_metadata", counter))
-	register([]string{"GET"}, PrefixMedia, "admin/export/:exportId/part/:partId", mxUnstable, router, makeRoute(_routers.OptionalAccessToken(custom.DownloadExportPart), "download_export_part", counter))
-	register([]string{"DELETE"}, PrefixMedia, "admin/export/:exportId", mxUnstable, router, makeRoute(_routers.OptionalAccessToken(custom.DeleteExport), "delete_export", counter))
-	register([]string{"POST"}, PrefixMedia, "admin/import", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.StartImport), "start_import", counter))
-	register([]string{"POST"}, PrefixMedia, "admin/import/:importId/part", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.AppendToImport), "append_to_import", counter))
-	register([]string{"POST"}, PrefixMedia, "admin/import/:importId/close", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.StopImport), "stop_import", counter))
-	register([]string{"GET"}, PrefixMedia, "admin/media/:server/:mediaId/attributes", mxUnstable, router, makeRoute(_routers.RequireAccessToken(custom.GetAttributes, false), "get_media_attributes", counter))
-	register([]string{"POST"}, PrefixMedia, "admin/media/:server/:mediaId/attributes", mxUnstable, router, makeRoute(_routers.RequireAccessToken(custom.SetAttributes, false), "set_media_attributes", counter))
+	register(RouteGroupAdmin, []string{"GET"}, PrefixMedia, "admin/tasks/*branch", mxUnstable, router, tasksBranch)
+	thumbnailPurgeBranch := branchedRoute([]branch{
+		{"all", makeRoute(_routers.RequireRepoAdmin(custom.PurgeAllThumbnails), "purge_all_thumbnails", counter)},
+		{"server/:serverName", makeRoute(_routers.RequireRepoAdmin(custom.PurgeDomainThumbnails), "purge_domain_thumbnails", counter)},
+		{":server/:mediaId", makeRoute(_routers.RequireRepoAdmin(custom.PurgeMediaThumbnails), "purge_media_thumbnails", counter)},
+	})
+	register(RouteGroupAdmin, []string{"POST"}, PrefixMedia, "admin/thumbnails/purge/*branch", mxUnstable, router, thumbnailPurgeBranch)
+	register(RouteGroupAdmin, []string{"POST"}, PrefixMedia, "admin/metadata/backfill", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.BackfillMetadata), "backfill_metadata", counter))
+	register(RouteGroupAdmin, []string{"POST"}, PrefixMedia, "admin/user/:userId/export", mxUnstable, router, makeRoute(_routers.RequireAccessToken(custom.ExportUserData, false), "export_user_data", counter))
+	register(RouteGroupAdmin, []string{"POST"}, PrefixMedia, "admin/server/:serverName/export", mxUnstable, router, makeRoute(_routers.RequireAccessToken(custom.ExportServerData, false), "export_server_data", counter))
+	register(RouteGroupAdmin, []string{"GET"}, PrefixMedia, "admin/export/:exportId/view", mxUnstable, router, makeRoute(_routers.OptionalAccessToken(custom.ViewExport), "view_export", counter))
+	register(RouteGroupAdmin, []string{"GET"}, PrefixMedia, "admin/export/:exportId/metadata", mxUnstable, router, makeRoute(_routers.OptionalAccessToken(custom.GetExportMetadata), "get_export_metadata", counter))
+	register(RouteGroupAdmin, []string{"GET"}, PrefixMedia, "admin/export/:exportId/part/:partId", mxUnstable, router, makeRoute(_routers.OptionalAccessToken(custom.DownloadExportPart), "download_export_part", counter))
+	register(RouteGroupAdmin, []string{"DELETE"}, PrefixMedia, "admin/export/:exportId", mxUnstable, router, makeRoute(_routers.OptionalAccessToken(custom.DeleteExport), "delete_export", counter))
+	register(RouteGroupAdmin, []string{"POST"}, PrefixMedia, "admin/import", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.StartImport), "start_import", counter))
+	register(RouteGroupAdmin, []string{"POST"}, PrefixMedia, "admin/import/:importId/part", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.AppendToImport), "append_to_import", counter))
+	register(RouteGroupAdmin, []string{"POST"}, PrefixMedia, "admin/import/:importId/close", mxUnstable, router, makeRoute(_routers.RequireRepoAdmin(custom.StopImport), "stop_import", counter))
+	register(RouteGroupAdmin, []string{"GET"}, PrefixMedia, "admin/media/:server/:mediaId/attributes", mxUnstable, router, makeRoute(_routers.RequireAccessToken(custom.GetAttributes, false), "get_media_attributes", counter))
+	register(RouteGroupAdmin, []string{"POST"}, PrefixMedia, "admin/media/:server/:mediaId/attributes", mxUnstable, router, makeRoute(_routers.RequireAccessToken(custom.SetAttributes, false), "set_media_attributes", counter))
 
 	return router
 }
@@ -149,7 +211,11 @@ var (
 	mxNoVersion          matrixVersions = []string{""}
 )
 
-func register(methods []string, prefix string, postfix string, versions matrixVersions, router *httprouter.Router, handler http.Handler) {
+// register adds the route to the router, if the router serves the route's group.
+func register(group string, methods []string, prefix string, postfix string, versions matrixVersions, router *groupedRouter, handler http.Handler) {
+	if !router.has(group) {
+		return
+	}
 	for _, method := range methods {
 		for _, version := range versions {
 			path := fmt.Sprintf("%s/%s/%s", prefix, version, postfix)
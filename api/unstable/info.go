@@ -4,10 +4,8 @@ import (
 	"errors"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 
-	"github.com/disintegration/imaging"
 	"github.com/getsentry/sentry-go"
 	"github.com/sirupsen/logrus"
 	"github.com/t2bot/matrix-media-repo/api/_apimeta"
@@ -16,9 +14,8 @@ import (
 	"github.com/t2bot/matrix-media-repo/common"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/metadata"
 	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_download"
-	"github.com/t2bot/matrix-media-repo/thumbnailing"
-	"github.com/t2bot/matrix-media-repo/thumbnailing/i"
 	"github.com/t2bot/matrix-media-repo/util"
 )
 
@@ -80,7 +77,7 @@ func MediaInfo(r *http.Request, rctx rcontext.RequestContext, user _apimeta.User
 	record, stream, err := pipeline_download.Execute(rctx, server, mediaId, pipeline_download.DownloadOpts{
 		FetchRemoteIfNeeded: downloadRemote,
 		BlockForReadUntil:   30 * time.Second,
-		RecordOnly:          false,
+		RecordOnly:          true,
 	})
 	// Error handling copied from download endpoint
 	if err != nil {
@@ -89,6 +86,15 @@ func MediaInfo(r *http.Request, rctx rcontext.RequestContext, user _apimeta.User
 		} else if errors.Is(err, common.ErrMediaTooLarge) {
 			return _responses.RequestTooLarge()
 		} else if errors.Is(err, common.ErrMediaQuarantined) {
+			// We only asked for the record, so fetch the quarantine image (if any) now
+			_, stream, err = pipeline_download.Execute(rctx, server, mediaId, pipeline_download.DownloadOpts{
+				FetchRemoteIfNeeded: false,
+				BlockForReadUntil:   30 * time.Second,
+			})
+			if !errors.Is(err, common.ErrMediaQuarantined) && stream != nil {
+				stream.Close()
+				stream = nil
+			}
 			rctx.Log.Debug("Quarantined media accessed. Has stream? ", stream != nil)
 			if stream != nil {
 				return _responses.MakeQuarantinedImageResponse(stream)
@@ -112,25 +118,22 @@ func MediaInfo(r *http.Request, rctx rcontext.RequestContext, user _apimeta.User
 		},
 	}
 
-	if strings.HasPrefix(response.ContentType, "image/") {
-		img, err := imaging.Decode(stream)
-		if err == nil {
-			response.Width = img.Bounds().Max.X
-			response.Height = img.Bounds().Max.Y
-		}
-	} else if strings.HasPrefix(response.ContentType, "audio/") {
-		generator, reconstructed, err := thumbnailing.GetGenerator(stream, response.ContentType, false)
-		if err == nil {
-			if audiogenerator, ok := generator.(i.AudioGenerator); ok {
-				audioInfo, err := audiogenerator.GetAudioData(reconstructed, 768, rctx)
-				if err == nil {
-					response.KeySamples = audioInfo.KeySamples
-					response.NumChannels = audioInfo.Channels
-					response.DurationSeconds = audioInfo.Duration.Seconds()
-					response.NumTotalSamples = audioInfo.TotalSamples
-				}
-			}
-		}
+	mediaMetadata, err := metadata.GetOrExtract(rctx, record)
+	if errors.Is(err, metadata.ErrExtractionFailed) {
+		// Broken media still has info, just without dimensions. The returned metadata is empty.
+		rctx.Log.Debug("Unable to extract media metadata: ", err)
+	} else if err != nil {
+		rctx.Log.Error("Unexpected error getting media metadata: ", err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("Unexpected Error")
+	}
+	response.Width = mediaMetadata.Width
+	response.Height = mediaMetadata.Height
+	if mediaMetadata.NumTotalSamples > 0 {
+		response.KeySamples = mediaMetadata.KeySamples
+		response.NumChannels = mediaMetadata.NumChannels
+		response.DurationSeconds = float64(mediaMetadata.DurationMs) / 1000.0
+		response.NumTotalSamples = mediaMetadata.NumTotalSamples
 	}
 
 	thumbs, err := database.GetInstance().Thumbnails.Prepare(rctx).GetForMedia(record.Origin, record.MediaId)
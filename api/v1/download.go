@@ -2,8 +2,11 @@ package v1
 
 import (
 	"bytes"
+	"encoding/json"
+	"io"
 	"net/http"
 
+	"github.com/getsentry/sentry-go"
 	"github.com/t2bot/matrix-media-repo/util/ids"
 
 	"github.com/t2bot/matrix-media-repo/api/_apimeta"
@@ -11,6 +14,11 @@ import (
 	"github.com/t2bot/matrix-media-repo/api/_routers"
 	"github.com/t2bot/matrix-media-repo/api/r0"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/federation"
+	"github.com/t2bot/matrix-media-repo/matrix"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/metadata"
+	"github.com/t2bot/matrix-media-repo/restrictions"
 	"github.com/t2bot/matrix-media-repo/util/readers"
 )
 
@@ -29,6 +37,15 @@ func FederationDownloadMedia(r *http.Request, rctx rcontext.RequestContext, serv
 	r.URL.RawQuery = query.Encode()
 	r = _routers.ForceSetParam("server", r.Host, r)
 
+	if canServe, err := federation.CanServe(rctx, server.ServerName); err != nil {
+		rctx.Log.Error("Error checking federation policy: ", err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("unable to check federation policy")
+	} else if !canServe {
+		rctx.Log.Debugf("Federation policy prevents serving media to %s", server.ServerName)
+		return _responses.MediaBlocked()
+	}
+
 	res := r0.DownloadMedia(r, rctx, _apimeta.AuthContext{Server: server})
 	boundary, err := ids.NewUniqueId()
 	if err != nil {
@@ -42,7 +59,7 @@ func FederationDownloadMedia(r *http.Request, rctx rcontext.RequestContext, serv
 			SizeBytes:   0,
 			Data: readers.NewMultipartReader(
 				boundary,
-				&readers.MultipartPart{ContentType: "application/json", Reader: readers.MakeCloser(bytes.NewReader([]byte("{}")))},
+				&readers.MultipartPart{ContentType: "application/json", Reader: makeFederationMetadataPart(rctx, r.Host, _routers.GetParam("mediaId", r))},
 				&readers.MultipartPart{ContentType: dl.ContentType, FileName: dl.Filename, Reader: dl.Data},
 			),
 			TargetDisposition: "attachment",
@@ -54,7 +71,7 @@ func FederationDownloadMedia(r *http.Request, rctx rcontext.RequestContext, serv
 			SizeBytes:   0,
 			Data: readers.NewMultipartReader(
 				boundary,
-				&readers.MultipartPart{ContentType: "application/json", Reader: readers.MakeCloser(bytes.NewReader([]byte("{}")))},
+				&readers.MultipartPart{ContentType: "application/json", Reader: makeFederationMetadataPart(rctx, r.Host, _routers.GetParam("mediaId", r))},
 				&readers.MultipartPart{Location: rd.ToUrl},
 			),
 			TargetDisposition: "attachment",
@@ -63,3 +80,58 @@ func FederationDownloadMedia(r *http.Request, rctx rcontext.RequestContext, serv
 		return res
 	}
 }
+
+// makeFederationMetadataPart describes the media for the JSON part of a federation download response. Errors are not
+// fatal: the remote server just won't be able to verify what it downloads.
+func makeFederationMetadataPart(rctx rcontext.RequestContext, origin string, mediaId string) io.ReadCloser {
+	empty := readers.MakeCloser(bytes.NewReader([]byte("{}")))
+
+	record, err := database.GetInstance().Media.Prepare(rctx).GetById(origin, mediaId)
+	if err != nil {
+		rctx.Log.Warn("Non-fatal error getting media record for federation metadata: ", err)
+		return empty
+	}
+	if record == nil {
+		return empty
+	}
+
+	fedMetadata := &matrix.FederationMediaMetadata{}
+	if record.Quarantined {
+		// The media part will be a placeholder (if anything), so don't describe the original
+		fedMetadata.Quarantined = true
+	} else {
+		fedMetadata.UploadName = record.UploadName
+		fedMetadata.ContentType = record.ContentType
+		fedMetadata.Sha256 = record.Sha256Hash
+		fedMetadata.SizeBytes = &record.SizeBytes
+
+		if fedMetadata.RequiresAuth, err = restrictions.DoesMediaRequireAuth(rctx, origin, mediaId); err != nil {
+			rctx.Log.Warn("Non-fatal error checking media restrictions for federation metadata: ", err)
+		}
+
+		if extracted, err := metadata.Get(rctx, record); err != nil {
+			rctx.Log.Warn("Non-fatal error getting media metadata for federation metadata: ", err)
+		} else if extracted != nil {
+			fedMetadata.Extras = make(map[string]interface{})
+			if extracted.Width > 0 && extracted.Height > 0 {
+				fedMetadata.Extras["width"] = extracted.Width
+				fedMetadata.Extras["height"] = extracted.Height
+			}
+			if extracted.DurationMs > 0 {
+				fedMetadata.Extras["duration_ms"] = extracted.DurationMs
+			}
+		}
+	}
+
+	raw, err := matrix.MakeFederationMetadata(fedMetadata)
+	if err != nil {
+		rctx.Log.Warn("Non-fatal error encoding federation metadata: ", err)
+		return empty
+	}
+	b, err := json.Marshal(raw)
+	if err != nil {
+		rctx.Log.Warn("Non-fatal error encoding federation metadata: ", err)
+		return empty
+	}
+	return readers.MakeCloser(bytes.NewReader(b))
+}
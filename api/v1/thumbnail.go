@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"net/http"
 
+	"github.com/getsentry/sentry-go"
 	"github.com/t2bot/matrix-media-repo/util/ids"
 
 	"github.com/t2bot/matrix-media-repo/api/_apimeta"
@@ -11,6 +12,7 @@ import (
 	"github.com/t2bot/matrix-media-repo/api/_routers"
 	"github.com/t2bot/matrix-media-repo/api/r0"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/federation"
 	"github.com/t2bot/matrix-media-repo/util/readers"
 )
 
@@ -29,6 +31,15 @@ func FederationThumbnailMedia(r *http.Request, rctx rcontext.RequestContext, ser
 	r.URL.RawQuery = query.Encode()
 	r = _routers.ForceSetParam("server", r.Host, r)
 
+	if canServe, err := federation.CanServe(rctx, server.ServerName); err != nil {
+		rctx.Log.Error("Error checking federation policy: ", err)
+		sentry.CaptureException(err)
+		return _responses.InternalServerError("unable to check federation policy")
+	} else if !canServe {
+		rctx.Log.Debugf("Federation policy prevents serving media to %s", server.ServerName)
+		return _responses.MediaBlocked()
+	}
+
 	res := r0.ThumbnailMedia(r, rctx, _apimeta.AuthContext{Server: server})
 	boundary, err := ids.NewUniqueId()
 	if err != nil {
@@ -46,6 +57,7 @@ func FederationThumbnailMedia(r *http.Request, rctx rcontext.RequestContext, ser
 				&readers.MultipartPart{ContentType: dl.ContentType, FileName: dl.Filename, Reader: dl.Data},
 			),
 			TargetDisposition: "attachment",
+			Vary:              dl.Vary,
 		}
 	} else if rd, ok := res.(*_responses.RedirectResponse); ok {
 		return &_responses.DownloadResponse{
@@ -6,6 +6,7 @@ import (
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,6 +19,7 @@ import (
 )
 
 var srv *http.Server
+var listeners = make([]*http.Server, 0)
 var waitGroup = &sync.WaitGroup{}
 var reload = false
 
@@ -30,16 +32,7 @@ func Init() *sync.WaitGroup {
 	//	}
 	//}()
 
-	handler := buildRoutes()
-
-	if config.Get().RateLimit.Enabled {
-		logrus.Debug("Enabling rate limit")
-		handler = tollbooth.LimitHandler(limits.GetRequestLimiter(), handler)
-	}
-
-	// Note: we bind Sentry here to ensure we capture *everything*
-	sentryHandler := sentryhttp.New(sentryhttp.Options{})
-	srv = &http.Server{Addr: address, Handler: sentryHandler.Handle(handler)}
+	srv = &http.Server{Addr: address, Handler: buildHandler(config.Get().General.RouteGroups, nil)}
 	reload = false
 
 	go func() {
@@ -57,9 +50,74 @@ func Init() *sync.WaitGroup {
 		}
 	}()
 
+	for _, l := range config.Get().General.Listeners {
+		startListener(l)
+	}
+
 	return waitGroup
 }
 
+// startListener starts an additional listener, serving only the route groups it is configured for. The main thread
+// doesn't wait on these listeners.
+func startListener(l config.ListenerConfig) {
+	address := net.JoinHostPort(l.BindAddress, strconv.Itoa(l.Port))
+	server := &http.Server{Addr: address, Handler: buildHandler(l.RouteGroups, l.HostnameAliases)}
+	listeners = append(listeners, server)
+
+	go func() {
+		log := logrus.WithField("address", address).WithField("route_groups", l.RouteGroups)
+		var err error
+		if l.TlsCertificate != "" {
+			log.Info("Started additional listener. Listening at https://" + address)
+			err = server.ListenAndServeTLS(l.TlsCertificate, l.TlsKey)
+		} else {
+			//goland:noinspection HttpUrlsUsage
+			log.Info("Started additional listener. Listening at http://" + address)
+			err = server.ListenAndServe()
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			sentry.CaptureException(err)
+			logrus.Fatal(err)
+		}
+	}()
+}
+
+func buildHandler(groups []string, hostnameAliases map[string]string) http.Handler {
+	handler := buildRoutes(groups)
+
+	if config.Get().RateLimit.Enabled {
+		logrus.Debug("Enabling rate limit")
+		handler = tollbooth.LimitHandler(limits.GetRequestLimiter(), handler)
+	}
+
+	if len(hostnameAliases) > 0 {
+		handler = aliasHostnames(hostnameAliases, handler)
+	}
+
+	// Note: we bind Sentry here to ensure we capture *everything*
+	sentryHandler := sentryhttp.New(sentryhttp.Options{})
+	return sentryHandler.Handle(handler)
+}
+
+// aliasHostnames treats requests for an aliased hostname as though they were made for the server name it points to,
+// allowing a listener to be reached on a hostname of its own (such as one only used for federation).
+func aliasHostnames(aliases map[string]string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		forwarded := r.Header.Get("X-Forwarded-Host") != "" && config.Get().General.UseForwardedHost
+		if forwarded {
+			host = r.Header.Get("X-Forwarded-Host")
+		}
+		if serverName, ok := aliases[strings.Split(host, ":")[0]]; ok {
+			r.Host = serverName
+			if forwarded {
+				r.Header.Set("X-Forwarded-Host", serverName)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func Reload() {
 	reload = true
 
@@ -71,9 +129,15 @@ func Reload() {
 }
 
 func Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, server := range listeners {
+		if err := server.Shutdown(ctx); err != nil {
+			panic(err)
+		}
+	}
+	listeners = make([]*http.Server, 0)
 	if srv != nil {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
 		if err := srv.Shutdown(ctx); err != nil {
 			panic(err)
 		}
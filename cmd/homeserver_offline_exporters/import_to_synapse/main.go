@@ -117,7 +117,7 @@ func main() {
 				}
 				defer src.Close()
 
-				thumb, err := thumbnailing.GenerateThumbnail(src, record.ContentType, s.width, s.height, s.method, false, ctx)
+				thumb, err := thumbnailing.GenerateThumbnail(src, record.ContentType, s.width, s.height, s.method, false, "", ctx)
 				if err != nil {
 					if thumb.Reader != nil {
 						err2 := thumb.Reader.Close()
@@ -4,11 +4,15 @@ import (
 	"flag"
 	"io"
 	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
 
 	"github.com/t2bot/matrix-media-repo/common/config"
 	"github.com/t2bot/matrix-media-repo/common/logging"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/thumbnailing"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/sandbox"
 	"github.com/t2bot/matrix-media-repo/util"
 )
 
@@ -20,9 +24,21 @@ func main() {
 	targetHeight := flag.Int("h", 512, "The target height of the thumbnail")
 	targetMethod := flag.String("m", "scale", "The method to use for resizing. Can be 'scale' or 'crop'")
 	targetAnimated := flag.Bool("a", false, "Whether the thumbnail should be animated (if supported)")
+	animatedFormat := flag.String("af", "webp", "The format to use for animated thumbnails. Can be 'webp', 'apng', or 'gif'")
+	cropStrategy := flag.String("c", "", "The crop strategy to use when the method is 'crop'. Can be 'center', 'entropy', or 'edges'. Defaults to the configured strategy.")
 	forceMime := flag.String("f", "", "Force the mime type of the input file, ignoring the detected mime type")
+	workerMode := flag.Bool("worker", false, "Run as a sandboxed thumbnail worker for the media repo, reading jobs from stdin. Not intended for manual use.")
+	workerMemoryMb := flag.Int64("worker-memory-mb", 0, "The memory limit in megabytes for worker mode. Zero to disable.")
+	workerCpuSeconds := flag.Int("worker-cpu-seconds", 0, "The per-thumbnail CPU time limit in seconds for worker mode. Zero to disable.")
+	assetsPath := flag.String("assets", config.DefaultAssetsPath, "The absolute path for the assets folder (worker mode only)")
+	logLevel := flag.String("log-level", "info", "The log level to use (worker mode only)")
 	flag.Parse()
 
+	if *workerMode {
+		runWorker(*assetsPath, *logLevel, *workerMemoryMb, *workerCpuSeconds)
+		return
+	}
+
 	if inFile == nil || *inFile == "" {
 		panic("No input file specified")
 	}
@@ -50,8 +66,11 @@ func main() {
 		panic(err)
 	}
 	ctx := rcontext.Initial()
+	if cropStrategy != nil && *cropStrategy != "" {
+		ctx.Config.Thumbnails.CropStrategy = *cropStrategy
+	}
 
-	ctx.Log.WithField("width", *targetWidth).WithField("height", *targetHeight).WithField("method", *targetMethod).WithField("animated", *targetAnimated).Info("Thumbnailing options:")
+	ctx.Log.WithField("width", *targetWidth).WithField("height", *targetHeight).WithField("method", *targetMethod).WithField("animated", *targetAnimated).WithField("animatedFormat", *animatedFormat).WithField("cropStrategy", ctx.Config.Thumbnails.CropStrategy).Info("Thumbnailing options:")
 
 	// Read source image
 	f, err := os.Open(*inFile)
@@ -72,7 +91,7 @@ func main() {
 	}
 
 	ctx.Log.Info("Generating thumbnail")
-	t, err := thumbnailing.GenerateThumbnail(f, mime, *targetWidth, *targetHeight, *targetMethod, *targetAnimated, ctx)
+	t, err := thumbnailing.GenerateThumbnail(f, mime, *targetWidth, *targetHeight, *targetMethod, *targetAnimated, *animatedFormat, ctx)
 	if err != nil {
 		panic(err)
 	}
@@ -90,3 +109,21 @@ func main() {
 
 	ctx.Log.Info("Done!")
 }
+
+func runWorker(assetsPath string, logLevel string, memoryMb int64, cpuSeconds int) {
+	// The config is supplied with each job, and stdout is reserved for results
+	config.Runtime.AssetsPath = assetsPath
+	if err := logging.Setup("-", false, false, logLevel); err != nil {
+		panic(err)
+	}
+	logrus.SetOutput(os.Stderr)
+
+	err := thumbnailing.ServeSandboxWorker(os.Stdin, os.Stdout, sandbox.Limits{
+		MaxMemoryBytes: memoryMb * 1024 * 1024,
+		MaxCpuTime:     time.Duration(cpuSeconds) * time.Second,
+	})
+	if err != nil {
+		logrus.Error("Error serving thumbnail jobs: ", err)
+		os.Exit(1)
+	}
+}
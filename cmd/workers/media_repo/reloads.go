@@ -17,6 +17,8 @@ import (
 	"github.com/t2bot/matrix-media-repo/pool"
 	"github.com/t2bot/matrix-media-repo/redislib"
 	"github.com/t2bot/matrix-media-repo/tasks"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/sandbox"
+	"github.com/t2bot/matrix-media-repo/url_previewing/p"
 )
 
 func setupReloads() {
@@ -33,6 +35,7 @@ func setupReloads() {
 	reloadMatrixCachesOnChan(globals.MatrixCachesReloadChan)
 	reloadPGOOnChan(globals.PGOReloadChan)
 	reloadBucketsOnChan(globals.BucketsReloadChan)
+	reloadOEmbedOnChan(globals.OEmbedReloadChan)
 }
 
 func stopReloads() {
@@ -63,6 +66,8 @@ func stopReloads() {
 	globals.PGOReloadChan <- false
 	logrus.Debug("Stopping BucketsReloadChan")
 	globals.BucketsReloadChan <- false
+	logrus.Debug("Stopping OEmbedReloadChan")
+	globals.OEmbedReloadChan <- false
 }
 
 func reloadWebOnChan(reloadChan chan bool) {
@@ -189,8 +194,10 @@ func reloadPoolOnChan(reloadChan chan bool) {
 			shouldReload := <-reloadChan
 			if shouldReload {
 				pool.AdjustSize()
+				sandbox.Reload()
 			} else {
 				pool.Drain()
+				sandbox.Stop()
 				return // received stop
 			}
 		}
@@ -256,3 +263,17 @@ func reloadBucketsOnChan(reloadChan chan bool) {
 		}
 	}()
 }
+
+func reloadOEmbedOnChan(reloadChan chan bool) {
+	go func() {
+		defer close(reloadChan)
+		for {
+			shouldReload := <-reloadChan
+			if shouldReload {
+				_ = p.ReloadOEmbedProviders() // errors are logged, and the previous providers kept
+			} else {
+				return // received stop
+			}
+		}
+	}()
+}
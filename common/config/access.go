@@ -144,6 +144,15 @@ func reloadConfig() (*MainRepoConfig, map[string]*DomainRepoConfig, error) {
 	if err != nil {
 		return nil, nil, err
 	}
+	if err = validateFederation(c.Federation); err != nil {
+		return nil, nil, err
+	}
+	if err = c.Downloads.Prefetch.Validate(); err != nil {
+		return nil, nil, err
+	}
+	if err = c.UrlPreviews.OEmbedProviders.Validate(); err != nil {
+		return nil, nil, err
+	}
 
 	// Start building domain configs
 	dMaps := make(map[string]map[string]interface{})
@@ -21,7 +21,11 @@ func NewDefaultDomainConfig() DomainRepoConfig {
 		Downloads: DownloadsConfig{
 			MaxSizeBytes:               104857600, // 100mb
 			FailureCacheMinutes:        15,
+			FailureCacheMaxMinutes:     240,
 			DefaultRangeChunkSizeBytes: 10485760, // 10mb
+			FetchRemoteThumbnails:      true,
+			MaxRedirects:               5,
+			StreamRemoteMedia:          false,
 		},
 		UrlPreviews: UrlPreviewsConfig{
 			Enabled:          true,
@@ -47,9 +51,38 @@ func NewDefaultDomainConfig() DomainRepoConfig {
 			AllowedNetworks: []string{
 				"0.0.0.0/0", // "Everything"
 			},
-			DefaultLanguage: "en-US,en",
-			UserAgent:       "matrix-media-repo",
-			OEmbed:          false,
+			DefaultLanguage:   "en-US,en",
+			UserAgent:         "matrix-media-repo",
+			OEmbed:            false,
+			Proxy:             "",
+			AllowedDomains:    []string{},
+			DisallowedDomains: []string{},
+			DomainOverrides:   []UrlPreviewDomainOverride{},
+			Canonicalization: UrlCanonicalizationConfig{
+				Enabled: false,
+				StripParams: []string{
+					"utm_*",
+					"fbclid",
+					"gclid",
+					"dclid",
+					"gbraid",
+					"wbraid",
+					"msclkid",
+					"yclid",
+					"igshid",
+					"mc_cid",
+					"mc_eid",
+					"_hsenc",
+					"_hsmi",
+					"mkt_tok",
+				},
+				StripAllParams: false,
+				Rules:          []UrlCanonicalizationRule{},
+			},
+			Favicons: UrlPreviewFaviconsConfig{
+				Enabled:      true,
+				MaxSizeBytes: 262144, // 256kb
+			},
 		},
 		Thumbnails: ThumbnailsConfig{
 			MaxSourceBytes:      10485760, // 10mb
@@ -58,6 +91,10 @@ func NewDefaultDomainConfig() DomainRepoConfig {
 			AllowAnimated:       true,
 			DefaultAnimated:     false,
 			StillFrame:          0.5,
+			CropStrategy:        "center",
+			AnimatedFormats:     []string{"webp", "apng", "gif"},
+			MaxAnimatedFrames:   100,
+			MaxAnimatedFps:      20,
 			Sizes: []ThumbnailSize{
 				{32, 32},
 				{96, 96},
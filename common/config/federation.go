@@ -0,0 +1,54 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Values for federation policies and the serve mode. These are shared with the federation package, which validates
+// policies set through the admin API the same way.
+const (
+	FederationPolicyAllow = "allow"
+	FederationPolicyDeny  = "deny"
+
+	FederationServeModeAll       = "all"
+	FederationServeModeAllowlist = "allowlist"
+)
+
+func isValidPolicyValue(val string) bool {
+	return val == "" || val == FederationPolicyAllow || val == FederationPolicyDeny
+}
+
+// Validate returns an error if the policy can't be used.
+func (p FederationPolicyConfig) Validate() error {
+	if p.Glob == "" {
+		return errors.New("glob is required")
+	}
+	if !isValidPolicyValue(p.Fetch) {
+		return fmt.Errorf("fetch must be '%s' or '%s'", FederationPolicyAllow, FederationPolicyDeny)
+	}
+	if !isValidPolicyValue(p.Serve) {
+		return fmt.Errorf("serve must be '%s' or '%s'", FederationPolicyAllow, FederationPolicyDeny)
+	}
+	if p.MaxBytes < 0 {
+		return errors.New("max bytes cannot be negative")
+	}
+	if p.TimeoutSeconds < 0 {
+		return errors.New("timeout cannot be negative")
+	}
+	return nil
+}
+
+// validateFederation rejects federation settings which would otherwise silently fall back to the defaults, such as a
+// misspelled policy value.
+func validateFederation(c FederationConfig) error {
+	if c.ServeMode != "" && c.ServeMode != FederationServeModeAll && c.ServeMode != FederationServeModeAllowlist {
+		return fmt.Errorf("federation.serveMode must be '%s' or '%s', not '%s'", FederationServeModeAll, FederationServeModeAllowlist, c.ServeMode)
+	}
+	for i, p := range c.Policies {
+		if err := p.Validate(); err != nil {
+			return fmt.Errorf("federation.policies[%d] (%s): %w", i, p.Glob, err)
+		}
+	}
+	return nil
+}
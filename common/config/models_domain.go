@@ -37,7 +37,11 @@ type DatastoreConfig struct {
 type DownloadsConfig struct {
 	MaxSizeBytes               int64 `yaml:"maxBytes"`
 	FailureCacheMinutes        int   `yaml:"failureCacheMinutes"`
+	FailureCacheMaxMinutes     int   `yaml:"failureCacheMaxMinutes"`
 	DefaultRangeChunkSizeBytes int64 `yaml:"defaultRangeChunkSizeBytes"`
+	FetchRemoteThumbnails      bool  `yaml:"fetchRemoteThumbnails"`
+	MaxRedirects               int   `yaml:"maxRedirects"`
+	StreamRemoteMedia          bool  `yaml:"streamRemoteMedia"`
 }
 
 type ThumbnailsConfig struct {
@@ -50,6 +54,10 @@ type ThumbnailsConfig struct {
 	AllowAnimated       bool            `yaml:"allowAnimated"`
 	DefaultAnimated     bool            `yaml:"defaultAnimated"`
 	StillFrame          float32         `yaml:"stillFrame"`
+	CropStrategy        string          `yaml:"cropStrategy"`
+	AnimatedFormats     []string        `yaml:"animatedFormats,flow"`
+	MaxAnimatedFrames   int             `yaml:"maxAnimatedFrames"`
+	MaxAnimatedFps      int             `yaml:"maxAnimatedFps"`
 }
 
 type ThumbnailSize struct {
@@ -58,19 +66,49 @@ type ThumbnailSize struct {
 }
 
 type UrlPreviewsConfig struct {
-	Enabled            bool     `yaml:"enabled"`
-	NumWords           int      `yaml:"numWords"`
-	NumTitleWords      int      `yaml:"numTitleWords"`
-	MaxLength          int      `yaml:"maxLength"`
-	MaxTitleLength     int      `yaml:"maxTitleLength"`
-	MaxPageSizeBytes   int64    `yaml:"maxPageSizeBytes"`
-	FilePreviewTypes   []string `yaml:"filePreviewTypes,flow"`
-	DisallowedNetworks []string `yaml:"disallowedNetworks,flow"`
-	AllowedNetworks    []string `yaml:"allowedNetworks,flow"`
-	UnsafeCertificates bool     `yaml:"previewUnsafeCertificates"`
-	DefaultLanguage    string   `yaml:"defaultLanguage"`
-	UserAgent          string   `yaml:"userAgent"`
-	OEmbed             bool     `yaml:"oEmbed"`
+	Enabled            bool                       `yaml:"enabled"`
+	NumWords           int                        `yaml:"numWords"`
+	NumTitleWords      int                        `yaml:"numTitleWords"`
+	MaxLength          int                        `yaml:"maxLength"`
+	MaxTitleLength     int                        `yaml:"maxTitleLength"`
+	MaxPageSizeBytes   int64                      `yaml:"maxPageSizeBytes"`
+	FilePreviewTypes   []string                   `yaml:"filePreviewTypes,flow"`
+	DisallowedNetworks []string                   `yaml:"disallowedNetworks,flow"`
+	AllowedNetworks    []string                   `yaml:"allowedNetworks,flow"`
+	UnsafeCertificates bool                       `yaml:"previewUnsafeCertificates"`
+	DefaultLanguage    string                     `yaml:"defaultLanguage"`
+	UserAgent          string                     `yaml:"userAgent"`
+	OEmbed             bool                       `yaml:"oEmbed"`
+	Proxy              string                     `yaml:"proxy"`
+	AllowedDomains     []string                   `yaml:"allowedDomains,flow"`
+	DisallowedDomains  []string                   `yaml:"disallowedDomains,flow"`
+	DomainOverrides    []UrlPreviewDomainOverride `yaml:"domainOverrides,flow"`
+	Canonicalization   UrlCanonicalizationConfig  `yaml:"canonicalization"`
+	Favicons           UrlPreviewFaviconsConfig   `yaml:"favicons"`
+}
+
+type UrlPreviewFaviconsConfig struct {
+	Enabled      bool  `yaml:"enabled"`
+	MaxSizeBytes int64 `yaml:"maxSizeBytes"`
+}
+
+type UrlCanonicalizationConfig struct {
+	Enabled        bool                      `yaml:"enabled"`
+	StripParams    []string                  `yaml:"stripParams,flow"`
+	StripAllParams bool                      `yaml:"stripAllParams"`
+	Rules          []UrlCanonicalizationRule `yaml:"rules,flow"`
+}
+
+type UrlCanonicalizationRule struct {
+	Domains     []string `yaml:"domains,flow"`
+	StripParams []string `yaml:"stripParams,flow"`
+	KeepParams  []string `yaml:"keepParams,flow"`
+}
+
+type UrlPreviewDomainOverride struct {
+	Domains        []string `yaml:"domains,flow"`
+	UserAgent      string   `yaml:"userAgent"`
+	TimeoutSeconds int      `yaml:"timeoutSeconds"`
 }
 
 type IdenticonsConfig struct {
@@ -1,15 +1,26 @@
 package config
 
 type GeneralConfig struct {
-	BindAddress                string `yaml:"bindAddress"`
-	Port                       int    `yaml:"port"`
-	LogDirectory               string `yaml:"logDirectory"`
-	LogColors                  bool   `yaml:"logColors"`
-	JsonLogs                   bool   `yaml:"jsonLogs"`
-	LogLevel                   string `yaml:"logLevel"`
-	TrustAnyForward            bool   `yaml:"trustAnyForwardedAddress"`
-	UseForwardedHost           bool   `yaml:"useForwardedHost"`
-	FreezeUnauthenticatedMedia bool   `yaml:"freezeUnauthenticatedMedia"`
+	BindAddress                string           `yaml:"bindAddress"`
+	Port                       int              `yaml:"port"`
+	LogDirectory               string           `yaml:"logDirectory"`
+	LogColors                  bool             `yaml:"logColors"`
+	JsonLogs                   bool             `yaml:"jsonLogs"`
+	LogLevel                   string           `yaml:"logLevel"`
+	TrustAnyForward            bool             `yaml:"trustAnyForwardedAddress"`
+	UseForwardedHost           bool             `yaml:"useForwardedHost"`
+	FreezeUnauthenticatedMedia bool             `yaml:"freezeUnauthenticatedMedia"`
+	RouteGroups                []string         `yaml:"routeGroups,flow"`
+	Listeners                  []ListenerConfig `yaml:"listeners,flow"`
+}
+
+type ListenerConfig struct {
+	BindAddress     string            `yaml:"bindAddress"`
+	Port            int               `yaml:"port"`
+	TlsCertificate  string            `yaml:"tlsCertificate"`
+	TlsKey          string            `yaml:"tlsKey"`
+	RouteGroups     []string          `yaml:"routeGroups,flow"`
+	HostnameAliases map[string]string `yaml:"hostnameAliases"`
 }
 
 type HomeserverConfig struct {
@@ -32,20 +43,58 @@ type DbPoolConfig struct {
 
 type MainDownloadsConfig struct {
 	DownloadsConfig `yaml:",inline"`
-	NumWorkers      int `yaml:"numWorkers"`
-	ExpireDays      int `yaml:"expireAfterDays"`
+	NumWorkers      int            `yaml:"numWorkers"`
+	ExpireDays      int            `yaml:"expireAfterDays"`
+	Prefetch        PrefetchConfig `yaml:"prefetch"`
+}
+
+type PrefetchConfig struct {
+	Enabled         bool   `yaml:"enabled"`
+	NumWorkers      int    `yaml:"numWorkers"`
+	MaxQueued       int    `yaml:"maxQueued"`
+	AppserviceToken string `yaml:"hsToken"`
 }
 
 type MainThumbnailsConfig struct {
 	ThumbnailsConfig `yaml:",inline"`
-	NumWorkers       int `yaml:"numWorkers"`
-	ExpireDays       int `yaml:"expireAfterDays"`
+	NumWorkers       int                    `yaml:"numWorkers"`
+	ExpireDays       int                    `yaml:"expireAfterDays"`
+	Sandbox          ThumbnailSandboxConfig `yaml:"sandbox"`
+}
+
+type ThumbnailSandboxConfig struct {
+	Enabled            bool   `yaml:"enabled"`
+	NumWorkers         int    `yaml:"numWorkers"`
+	Executable         string `yaml:"executable"`
+	MaxMemoryMegabytes int64  `yaml:"maxMemoryMegabytes"`
+	MaxCpuSeconds      int    `yaml:"maxCpuSeconds"`
+	TimeoutSeconds     int    `yaml:"timeoutSeconds"`
+	MaxJobsPerWorker   int    `yaml:"maxJobsPerWorker"`
 }
 
 type MainUrlPreviewsConfig struct {
 	UrlPreviewsConfig `yaml:",inline"`
-	NumWorkers        int `yaml:"numWorkers"`
-	ExpireDays        int `yaml:"expireAfterDays"`
+	NumWorkers        int                   `yaml:"numWorkers"`
+	ExpireDays        int                   `yaml:"expireAfterDays"`
+	OEmbedProviders   OEmbedProvidersConfig `yaml:"oEmbedProviders"`
+}
+
+type OEmbedProvidersConfig struct {
+	UseBuiltin bool                   `yaml:"useBuiltin"`
+	Disabled   []string               `yaml:"disabled,flow"`
+	Providers  []OEmbedProviderConfig `yaml:"providers,flow"`
+}
+
+type OEmbedProviderConfig struct {
+	Name      string                 `yaml:"name"`
+	Url       string                 `yaml:"url"`
+	Endpoints []OEmbedEndpointConfig `yaml:"endpoints,flow"`
+}
+
+type OEmbedEndpointConfig struct {
+	Url       string   `yaml:"url"`
+	Schemes   []string `yaml:"schemes,flow"`
+	Discovery bool     `yaml:"discovery"`
 }
 
 type RateLimitConfig struct {
@@ -56,7 +105,9 @@ type RateLimitConfig struct {
 }
 
 type RateLimitBucketsConfig struct {
-	Downloads RateLimitDownloadBucketConfig `yaml:"downloads"`
+	Downloads         RateLimitDownloadBucketConfig `yaml:"downloads"`
+	UrlPreviewUsers   RateLimitCountBucketConfig    `yaml:"urlPreviewUsers"`
+	UrlPreviewDomains RateLimitCountBucketConfig    `yaml:"urlPreviewDomains"`
 }
 
 type RateLimitDownloadBucketConfig struct {
@@ -65,6 +116,11 @@ type RateLimitDownloadBucketConfig struct {
 	OverflowLimitBytes  int64 `yaml:"overflowLimitBytes"`
 }
 
+type RateLimitCountBucketConfig struct {
+	Capacity       int64 `yaml:"capacity"`
+	DrainPerMinute int64 `yaml:"drainPerMinute"`
+}
+
 type MetricsConfig struct {
 	Enabled     bool   `yaml:"enabled"`
 	BindAddress string `yaml:"bindAddress"`
@@ -77,8 +133,21 @@ type SharedSecretConfig struct {
 }
 
 type FederationConfig struct {
-	BackoffAt    int      `yaml:"backoffAt"`
-	IgnoredHosts []string `yaml:"ignoredHosts,flow"`
+	BackoffAt              int                      `yaml:"backoffAt"`
+	BreakerWindowSeconds   int                      `yaml:"breakerWindowSeconds"`
+	BreakerCooldownSeconds int                      `yaml:"breakerCooldownSeconds"`
+	IgnoredHosts           []string                 `yaml:"ignoredHosts,flow"`
+	ServeMode              string                   `yaml:"serveMode"`
+	Policies               []FederationPolicyConfig `yaml:"policies,flow"`
+}
+
+type FederationPolicyConfig struct {
+	Glob           string `yaml:"glob"`
+	Fetch          string `yaml:"fetch"`
+	Serve          string `yaml:"serve"`
+	MaxBytes       int64  `yaml:"maxBytes"`
+	TimeoutSeconds int    `yaml:"timeoutSeconds"`
+	NeverCache     bool   `yaml:"neverCache"`
 }
 
 type PluginConfig struct {
@@ -0,0 +1,49 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/dyatlov/go-oembed/oembed"
+)
+
+// Validate returns an error if a configured oEmbed provider can't be used.
+func (c OEmbedProvidersConfig) Validate() error {
+	for i, provider := range c.Providers {
+		if provider.Name == "" {
+			return fmt.Errorf("urlPreviews.oEmbedProviders.providers[%d]: name is required", i)
+		}
+		for _, endpoint := range provider.Endpoints {
+			if endpoint.Url == "" && !endpoint.Discovery {
+				return fmt.Errorf("urlPreviews.oEmbedProviders: provider %s has an endpoint without a url or discovery", provider.Name)
+			}
+			if err := checkOEmbedSchemes(provider.Url, endpoint.Schemes); err != nil {
+				return fmt.Errorf("urlPreviews.oEmbedProviders: provider %s: %w", provider.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkOEmbedSchemes has the oEmbed library parse the schemes (or the scheme it would default to for the provider's
+// url). The library panics on schemes it can't convert to a regular expression, which is turned into an error here.
+func checkOEmbedSchemes(providerUrl string, schemes []string) (err error) {
+	b, err := json.Marshal([]oembed.Provider{{
+		URL:       providerUrl,
+		Endpoints: []oembed.Endpoint{{URL: "https://example.org/oembed", Schemes: schemes}},
+	}})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New("invalid scheme")
+			if rErr, ok := r.(error); ok {
+				err = fmt.Errorf("invalid scheme: %w", rErr)
+			}
+		}
+	}()
+	return oembed.NewOembed().ParseProviders(bytes.NewReader(b))
+}
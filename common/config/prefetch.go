@@ -0,0 +1,19 @@
+package config
+
+import (
+	"errors"
+)
+
+// Validate returns an error if prefetching is enabled but could never run anything.
+func (c PrefetchConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.NumWorkers <= 0 {
+		return errors.New("downloads.prefetch.numWorkers must be at least 1 when prefetching is enabled")
+	}
+	if c.MaxQueued <= 0 {
+		return errors.New("downloads.prefetch.maxQueued must be at least 1 when prefetching is enabled")
+	}
+	return nil
+}
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"reflect"
+	"slices"
 	"time"
 
 	"github.com/bep/debounce"
@@ -68,11 +70,16 @@ func onFileChanged() {
 	logrus.Info("Reloading matrix caches")
 	globals.MatrixCachesReloadChan <- true
 
+	logrus.Info("Reloading oEmbed providers")
+	globals.OEmbedReloadChan <- true
+
 	bindAddressChange := configNew.General.BindAddress != configNow.General.BindAddress
 	bindPortChange := configNew.General.Port != configNow.General.Port
 	forwardAddressChange := configNew.General.TrustAnyForward != configNow.General.TrustAnyForward
 	forwardedHostChange := configNew.General.UseForwardedHost != configNow.General.UseForwardedHost
-	if bindAddressChange || bindPortChange || forwardAddressChange || forwardedHostChange {
+	routeGroupsChange := !slices.Equal(configNew.General.RouteGroups, configNow.General.RouteGroups)
+	listenersChange := !reflect.DeepEqual(configNew.General.Listeners, configNow.General.Listeners)
+	if bindAddressChange || bindPortChange || forwardAddressChange || forwardedHostChange || routeGroupsChange || listenersChange {
 		logrus.Warn("Webserver configuration changed - remounting")
 		globals.WebReloadChan <- true
 	}
@@ -18,3 +18,5 @@ var ErrMediaNotYetUploaded = errors.New("media not yet uploaded")
 var ErrMediaDimensionsTooSmall = errors.New("media is too small dimensionally")
 var ErrRateLimitExceeded = errors.New("rate limit exceeded")
 var ErrRestrictedAuth = errors.New("authentication is required to download this media")
+var ErrMediaMismatch = errors.New("media does not match the metadata provided by the remote server")
+var ErrUrlNotAllowed = errors.New("url not allowed")
@@ -13,3 +13,4 @@ var ErrorCacheReloadChan = make(chan bool)
 var MatrixCachesReloadChan = make(chan bool)
 var PGOReloadChan = make(chan bool)
 var BucketsReloadChan = make(chan bool)
+var OEmbedReloadChan = make(chan bool)
@@ -62,6 +62,16 @@ func (c RequestContext) LogWithFields(fields logrus.Fields) RequestContext {
 	return c.ReplaceLogger(c.Log.WithFields(fields))
 }
 
+func (c RequestContext) WithConfig(conf config.DomainRepoConfig) RequestContext {
+	ctx := context.WithValue(c.Context, common.ContextServerConfig, conf)
+	return RequestContext{
+		Context: ctx,
+		Log:     c.Log,
+		Config:  conf,
+		Request: c.Request,
+	}
+}
+
 func (c RequestContext) AsBackground() RequestContext {
 	return RequestContext{
 		Context: context.Background(),
@@ -29,6 +29,10 @@ type Database struct {
 	Exports         *exportsTableStatements
 	ExportParts     *exportPartsTableStatements
 	RestrictedMedia *restrictedMediaTableStatements
+	MediaMetadata   *mediaMetadataTableStatements
+	RemoteMetadata  *remoteMediaMetadataTableStatements
+	FedPolicies     *federationPoliciesTableStatements
+	UrlBlocks       *urlPreviewBlocksTableStatements
 }
 
 var instance *Database
@@ -130,6 +134,18 @@ func openDatabase(connectionString string, maxConns int, maxIdleConns int) error
 	if d.RestrictedMedia, err = prepareRestrictedMediaTables(d.conn); err != nil {
 		return errors.New("failed to create restricted media table accessor: " + err.Error())
 	}
+	if d.MediaMetadata, err = prepareMediaMetadataTables(d.conn); err != nil {
+		return errors.New("failed to create media metadata table accessor: " + err.Error())
+	}
+	if d.RemoteMetadata, err = prepareRemoteMediaMetadataTables(d.conn); err != nil {
+		return errors.New("failed to create remote media metadata table accessor: " + err.Error())
+	}
+	if d.FedPolicies, err = prepareFederationPoliciesTables(d.conn); err != nil {
+		return errors.New("failed to create federation policies table accessor: " + err.Error())
+	}
+	if d.UrlBlocks, err = prepareUrlPreviewBlocksTables(d.conn); err != nil {
+		return errors.New("failed to create url preview blocks table accessor: " + err.Error())
+	}
 
 	instance = d
 	return nil
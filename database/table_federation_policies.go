@@ -0,0 +1,87 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+type DbFederationPolicy struct {
+	Glob           string
+	Fetch          string
+	Serve          string
+	MaxBytes       int64
+	TimeoutSeconds int
+	NeverCache     bool
+	CreationTs     int64
+}
+
+const selectAllFederationPolicies = "SELECT glob, fetch_policy, serve_policy, max_bytes, timeout_seconds, never_cache, creation_ts FROM federation_policies;"
+const upsertFederationPolicy = "INSERT INTO federation_policies (glob, fetch_policy, serve_policy, max_bytes, timeout_seconds, never_cache, creation_ts) VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT (glob) DO UPDATE SET fetch_policy = $2, serve_policy = $3, max_bytes = $4, timeout_seconds = $5, never_cache = $6;"
+const deleteFederationPolicy = "DELETE FROM federation_policies WHERE glob = $1;"
+
+type federationPoliciesTableStatements struct {
+	selectAllFederationPolicies *sql.Stmt
+	upsertFederationPolicy      *sql.Stmt
+	deleteFederationPolicy      *sql.Stmt
+}
+
+type federationPoliciesTableWithContext struct {
+	statements *federationPoliciesTableStatements
+	ctx        rcontext.RequestContext
+}
+
+func prepareFederationPoliciesTables(db *sql.DB) (*federationPoliciesTableStatements, error) {
+	var err error
+	var stmts = &federationPoliciesTableStatements{}
+
+	if stmts.selectAllFederationPolicies, err = db.Prepare(selectAllFederationPolicies); err != nil {
+		return nil, errors.New("error preparing selectAllFederationPolicies: " + err.Error())
+	}
+	if stmts.upsertFederationPolicy, err = db.Prepare(upsertFederationPolicy); err != nil {
+		return nil, errors.New("error preparing upsertFederationPolicy: " + err.Error())
+	}
+	if stmts.deleteFederationPolicy, err = db.Prepare(deleteFederationPolicy); err != nil {
+		return nil, errors.New("error preparing deleteFederationPolicy: " + err.Error())
+	}
+
+	return stmts, nil
+}
+
+func (s *federationPoliciesTableStatements) Prepare(ctx rcontext.RequestContext) *federationPoliciesTableWithContext {
+	return &federationPoliciesTableWithContext{
+		statements: s,
+		ctx:        ctx,
+	}
+}
+
+func (s *federationPoliciesTableWithContext) GetAll() ([]*DbFederationPolicy, error) {
+	results := make([]*DbFederationPolicy, 0)
+	rows, err := s.statements.selectAllFederationPolicies.QueryContext(s.ctx)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return results, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		val := &DbFederationPolicy{}
+		if err = rows.Scan(&val.Glob, &val.Fetch, &val.Serve, &val.MaxBytes, &val.TimeoutSeconds, &val.NeverCache, &val.CreationTs); err != nil {
+			return nil, err
+		}
+		results = append(results, val)
+	}
+	return results, nil
+}
+
+func (s *federationPoliciesTableWithContext) Upsert(record *DbFederationPolicy) error {
+	_, err := s.statements.upsertFederationPolicy.ExecContext(s.ctx, record.Glob, record.Fetch, record.Serve, record.MaxBytes, record.TimeoutSeconds, record.NeverCache, record.CreationTs)
+	return err
+}
+
+func (s *federationPoliciesTableWithContext) Delete(glob string) error {
+	_, err := s.statements.deleteFederationPolicy.ExecContext(s.ctx, glob)
+	return err
+}
@@ -3,6 +3,7 @@ package database
 import (
 	"database/sql"
 	"errors"
+	"strings"
 
 	"github.com/lib/pq"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
@@ -49,28 +50,34 @@ const updateMediaLocation = "UPDATE media SET datastore_id = $3, location = $4 W
 const selectMediaByLocation = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location FROM media WHERE datastore_id = $1 AND location = $2;"
 const selectMediaByQuarantine = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location FROM media WHERE quarantined = TRUE;"
 const selectMediaByQuarantineAndOrigin = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, creation_ts, quarantined, datastore_id, location FROM media WHERE quarantined = TRUE AND origin = $1;"
+const selectMediaWithThumbnails = "SELECT m.origin, m.media_id, m.upload_name, m.content_type, m.user_id, m.sha256_hash, m.size_bytes, m.creation_ts, m.quarantined, m.datastore_id, m.location FROM media AS m WHERE m.content_type LIKE $1 ESCAPE '\\' AND EXISTS (SELECT 1 FROM thumbnails AS t WHERE t.origin = m.origin AND t.media_id = m.media_id);"
+const selectMediaWithoutMetadata = "SELECT DISTINCT ON (m.sha256_hash) m.origin, m.media_id, m.upload_name, m.content_type, m.user_id, m.sha256_hash, m.size_bytes, m.creation_ts, m.quarantined, m.datastore_id, m.location FROM media AS m WHERE m.sha256_hash > $1 AND NOT EXISTS (SELECT 1 FROM media_metadata AS mm WHERE mm.sha256_hash = m.sha256_hash) ORDER BY m.sha256_hash LIMIT $2;"
+const selectMediaWithThumbnailsByOrigin = "SELECT m.origin, m.media_id, m.upload_name, m.content_type, m.user_id, m.sha256_hash, m.size_bytes, m.creation_ts, m.quarantined, m.datastore_id, m.location FROM media AS m WHERE m.origin = $1 AND m.content_type LIKE $2 ESCAPE '\\' AND EXISTS (SELECT 1 FROM thumbnails AS t WHERE t.origin = m.origin AND t.media_id = m.media_id);"
 
 type mediaTableStatements struct {
-	selectDistinctMediaDatastoreIds  *sql.Stmt
-	selectMediaIsQuarantinedByHash   *sql.Stmt
-	selectMediaByHash                *sql.Stmt
-	insertMedia                      *sql.Stmt
-	selectMediaExists                *sql.Stmt
-	selectMediaById                  *sql.Stmt
-	selectMediaByUserId              *sql.Stmt
-	selectOldMediaByUserId           *sql.Stmt
-	selectMediaByOrigin              *sql.Stmt
-	selectOldMediaByOrigin           *sql.Stmt
-	selectMediaByLocationExists      *sql.Stmt
-	selectMediaByUserCount           *sql.Stmt
-	selectMediaByOriginAndUserIds    *sql.Stmt
-	selectMediaByOriginAndIds        *sql.Stmt
-	selectOldMediaExcludingDomains   *sql.Stmt
-	deleteMedia                      *sql.Stmt
-	updateMediaLocation              *sql.Stmt
-	selectMediaByLocation            *sql.Stmt
-	selectMediaByQuarantine          *sql.Stmt
-	selectMediaByQuarantineAndOrigin *sql.Stmt
+	selectDistinctMediaDatastoreIds   *sql.Stmt
+	selectMediaIsQuarantinedByHash    *sql.Stmt
+	selectMediaByHash                 *sql.Stmt
+	insertMedia                       *sql.Stmt
+	selectMediaExists                 *sql.Stmt
+	selectMediaById                   *sql.Stmt
+	selectMediaByUserId               *sql.Stmt
+	selectOldMediaByUserId            *sql.Stmt
+	selectMediaByOrigin               *sql.Stmt
+	selectOldMediaByOrigin            *sql.Stmt
+	selectMediaByLocationExists       *sql.Stmt
+	selectMediaByUserCount            *sql.Stmt
+	selectMediaByOriginAndUserIds     *sql.Stmt
+	selectMediaByOriginAndIds         *sql.Stmt
+	selectOldMediaExcludingDomains    *sql.Stmt
+	deleteMedia                       *sql.Stmt
+	updateMediaLocation               *sql.Stmt
+	selectMediaByLocation             *sql.Stmt
+	selectMediaByQuarantine           *sql.Stmt
+	selectMediaByQuarantineAndOrigin  *sql.Stmt
+	selectMediaWithThumbnails         *sql.Stmt
+	selectMediaWithThumbnailsByOrigin *sql.Stmt
+	selectMediaWithoutMetadata        *sql.Stmt
 }
 
 type MediaTableWithContext struct {
@@ -142,6 +149,15 @@ func prepareMediaTables(db *sql.DB) (*mediaTableStatements, error) {
 	if stmts.selectMediaByQuarantineAndOrigin, err = db.Prepare(selectMediaByQuarantineAndOrigin); err != nil {
 		return nil, errors.New("error preparing selectMediaByQuarantineAndOrigin: " + err.Error())
 	}
+	if stmts.selectMediaWithThumbnails, err = db.Prepare(selectMediaWithThumbnails); err != nil {
+		return nil, errors.New("error preparing selectMediaWithThumbnails: " + err.Error())
+	}
+	if stmts.selectMediaWithThumbnailsByOrigin, err = db.Prepare(selectMediaWithThumbnailsByOrigin); err != nil {
+		return nil, errors.New("error preparing selectMediaWithThumbnailsByOrigin: " + err.Error())
+	}
+	if stmts.selectMediaWithoutMetadata, err = db.Prepare(selectMediaWithoutMetadata); err != nil {
+		return nil, errors.New("error preparing selectMediaWithoutMetadata: " + err.Error())
+	}
 
 	return stmts, nil
 }
@@ -249,6 +265,32 @@ func (s *MediaTableWithContext) GetByOriginQuarantine(origin string) ([]*DbMedia
 	return s.scanRows(s.statements.selectMediaByQuarantineAndOrigin.QueryContext(s.ctx, origin))
 }
 
+// GetWithThumbnails returns the media which has thumbnails and a content type matching the glob pattern. An empty
+// pattern matches all content types.
+func (s *MediaTableWithContext) GetWithThumbnails(contentTypeGlob string) ([]*DbMedia, error) {
+	return s.scanRows(s.statements.selectMediaWithThumbnails.QueryContext(s.ctx, globToLike(contentTypeGlob)))
+}
+
+// GetByOriginWithThumbnails is GetWithThumbnails limited to a single origin.
+func (s *MediaTableWithContext) GetByOriginWithThumbnails(origin string, contentTypeGlob string) ([]*DbMedia, error) {
+	return s.scanRows(s.statements.selectMediaWithThumbnailsByOrigin.QueryContext(s.ctx, origin, globToLike(contentTypeGlob)))
+}
+
+// globToLike converts a glob pattern using `*` wildcards into a LIKE pattern using `\` as the escape character.
+func globToLike(pattern string) string {
+	if pattern == "" {
+		return "%"
+	}
+	escaped := strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(pattern)
+	return strings.ReplaceAll(escaped, "*", "%")
+}
+
+// GetWithoutMetadata returns up to `limit` records, one per hash, after the given hash which don't have stored metadata.
+// Media which previously failed extraction has metadata stored (marked as failed), so is not returned.
+func (s *MediaTableWithContext) GetWithoutMetadata(afterSha256Hash string, limit int) ([]*DbMedia, error) {
+	return s.scanRows(s.statements.selectMediaWithoutMetadata.QueryContext(s.ctx, afterSha256Hash, limit))
+}
+
 func (s *MediaTableWithContext) GetById(origin string, mediaId string) (*DbMedia, error) {
 	row := s.statements.selectMediaById.QueryRowContext(s.ctx, origin, mediaId)
 	val := &DbMedia{Locatable: &Locatable{}}
@@ -0,0 +1,83 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+type DbMediaMetadata struct {
+	Sha256Hash      string
+	Width           int
+	Height          int
+	DurationMs      int64
+	NumChannels     int
+	NumTotalSamples int
+	KeySamples      [][2]float64
+	CreationTs      int64
+	// ExtractionFailed is set when the media couldn't be parsed. The other fields are empty, and the extraction is not
+	// retried.
+	ExtractionFailed bool
+}
+
+const selectMediaMetadata = "SELECT sha256_hash, width, height, duration_ms, num_channels, num_total_samples, key_samples, creation_ts, extraction_failed FROM media_metadata WHERE sha256_hash = $1;"
+const upsertMediaMetadata = "INSERT INTO media_metadata (sha256_hash, width, height, duration_ms, num_channels, num_total_samples, key_samples, creation_ts, extraction_failed) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) ON CONFLICT (sha256_hash) DO UPDATE SET width = $2, height = $3, duration_ms = $4, num_channels = $5, num_total_samples = $6, key_samples = $7, creation_ts = $8, extraction_failed = $9;"
+
+type mediaMetadataTableStatements struct {
+	selectMediaMetadata *sql.Stmt
+	upsertMediaMetadata *sql.Stmt
+}
+
+type mediaMetadataTableWithContext struct {
+	statements *mediaMetadataTableStatements
+	ctx        rcontext.RequestContext
+}
+
+func prepareMediaMetadataTables(db *sql.DB) (*mediaMetadataTableStatements, error) {
+	var err error
+	var stmts = &mediaMetadataTableStatements{}
+
+	if stmts.selectMediaMetadata, err = db.Prepare(selectMediaMetadata); err != nil {
+		return nil, errors.New("error preparing selectMediaMetadata: " + err.Error())
+	}
+	if stmts.upsertMediaMetadata, err = db.Prepare(upsertMediaMetadata); err != nil {
+		return nil, errors.New("error preparing upsertMediaMetadata: " + err.Error())
+	}
+
+	return stmts, nil
+}
+
+func (s *mediaMetadataTableStatements) Prepare(ctx rcontext.RequestContext) *mediaMetadataTableWithContext {
+	return &mediaMetadataTableWithContext{
+		statements: s,
+		ctx:        ctx,
+	}
+}
+
+func (s *mediaMetadataTableWithContext) Get(sha256hash string) (*DbMediaMetadata, error) {
+	row := s.statements.selectMediaMetadata.QueryRowContext(s.ctx, sha256hash)
+	val := &DbMediaMetadata{}
+	samples := make([]byte, 0)
+	err := row.Scan(&val.Sha256Hash, &val.Width, &val.Height, &val.DurationMs, &val.NumChannels, &val.NumTotalSamples, &samples, &val.CreationTs, &val.ExtractionFailed)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(samples, &val.KeySamples); err != nil {
+		return nil, err
+	}
+	return val, nil
+}
+
+func (s *mediaMetadataTableWithContext) Upsert(record *DbMediaMetadata) error {
+	samples, err := json.Marshal(record.KeySamples)
+	if err != nil {
+		return err
+	}
+	_, err = s.statements.upsertMediaMetadata.ExecContext(s.ctx, record.Sha256Hash, record.Width, record.Height, record.DurationMs, record.NumChannels, record.NumTotalSamples, samples, record.CreationTs, record.ExtractionFailed)
+	return err
+}
@@ -0,0 +1,65 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+type DbRemoteMediaMetadata struct {
+	Origin     string
+	MediaId    string
+	Metadata   *AnonymousJson
+	CreationTs int64
+}
+
+const selectRemoteMediaMetadata = "SELECT origin, media_id, metadata, creation_ts FROM remote_media_metadata WHERE origin = $1 AND media_id = $2;"
+const upsertRemoteMediaMetadata = "INSERT INTO remote_media_metadata (origin, media_id, metadata, creation_ts) VALUES ($1, $2, $3, $4) ON CONFLICT (origin, media_id) DO UPDATE SET metadata = $3, creation_ts = $4;"
+
+type remoteMediaMetadataTableStatements struct {
+	selectRemoteMediaMetadata *sql.Stmt
+	upsertRemoteMediaMetadata *sql.Stmt
+}
+
+type remoteMediaMetadataTableWithContext struct {
+	statements *remoteMediaMetadataTableStatements
+	ctx        rcontext.RequestContext
+}
+
+func prepareRemoteMediaMetadataTables(db *sql.DB) (*remoteMediaMetadataTableStatements, error) {
+	var err error
+	var stmts = &remoteMediaMetadataTableStatements{}
+
+	if stmts.selectRemoteMediaMetadata, err = db.Prepare(selectRemoteMediaMetadata); err != nil {
+		return nil, errors.New("error preparing selectRemoteMediaMetadata: " + err.Error())
+	}
+	if stmts.upsertRemoteMediaMetadata, err = db.Prepare(upsertRemoteMediaMetadata); err != nil {
+		return nil, errors.New("error preparing upsertRemoteMediaMetadata: " + err.Error())
+	}
+
+	return stmts, nil
+}
+
+func (s *remoteMediaMetadataTableStatements) Prepare(ctx rcontext.RequestContext) *remoteMediaMetadataTableWithContext {
+	return &remoteMediaMetadataTableWithContext{
+		statements: s,
+		ctx:        ctx,
+	}
+}
+
+func (s *remoteMediaMetadataTableWithContext) Get(origin string, mediaId string) (*DbRemoteMediaMetadata, error) {
+	row := s.statements.selectRemoteMediaMetadata.QueryRowContext(s.ctx, origin, mediaId)
+	val := &DbRemoteMediaMetadata{}
+	err := row.Scan(&val.Origin, &val.MediaId, &val.Metadata, &val.CreationTs)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+		val = nil
+	}
+	return val, err
+}
+
+func (s *remoteMediaMetadataTableWithContext) Upsert(record *DbRemoteMediaMetadata) error {
+	_, err := s.statements.upsertRemoteMediaMetadata.ExecContext(s.ctx, record.Origin, record.MediaId, record.Metadata, record.CreationTs)
+	return err
+}
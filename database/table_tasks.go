@@ -8,20 +8,22 @@ import (
 )
 
 type DbTask struct {
-	TaskId  int
-	Name    string
-	Params  *AnonymousJson
-	StartTs int64
-	EndTs   int64
-	Error   string
+	TaskId   int
+	Name     string
+	Params   *AnonymousJson
+	StartTs  int64
+	EndTs    int64
+	Error    string
+	Progress *AnonymousJson
 }
 
-const selectTask = "SELECT id, task, params, start_ts, end_ts, error FROM background_tasks WHERE id = $1;"
-const insertTask = "INSERT INTO background_tasks (task, params, start_ts, end_ts) VALUES ($1, $2, $3, 0) RETURNING id, task, params, start_ts, end_ts, error;"
-const selectAllTasks = "SELECT id, task, params, start_ts, end_ts, error FROM background_tasks;"
-const selectIncompleteTasks = "SELECT id, task, params, start_ts, end_ts, error FROM background_tasks WHERE end_ts <= 0;"
+const selectTask = "SELECT id, task, params, start_ts, end_ts, error, progress FROM background_tasks WHERE id = $1;"
+const insertTask = "INSERT INTO background_tasks (task, params, start_ts, end_ts) VALUES ($1, $2, $3, 0) RETURNING id, task, params, start_ts, end_ts, error, progress;"
+const selectAllTasks = "SELECT id, task, params, start_ts, end_ts, error, progress FROM background_tasks;"
+const selectIncompleteTasks = "SELECT id, task, params, start_ts, end_ts, error, progress FROM background_tasks WHERE end_ts <= 0;"
 const updateTaskEndTime = "UPDATE background_tasks SET end_ts = $2 WHERE id = $1;"
 const updateTaskError = "UPDATE background_tasks SET error = $2 WHERE id = $1;"
+const updateTaskProgress = "UPDATE background_tasks SET progress = $2 WHERE id = $1;"
 
 type tasksTableStatements struct {
 	selectTask            *sql.Stmt
@@ -30,6 +32,7 @@ type tasksTableStatements struct {
 	selectIncompleteTasks *sql.Stmt
 	updateTaskEndTime     *sql.Stmt
 	updateTaskError       *sql.Stmt
+	updateTaskProgress    *sql.Stmt
 }
 
 type tasksTableWithContext struct {
@@ -59,6 +62,9 @@ func prepareTasksTables(db *sql.DB) (*tasksTableStatements, error) {
 	if stmts.updateTaskError, err = db.Prepare(updateTaskError); err != nil {
 		return nil, errors.New("error preparing updateTaskError: " + err.Error())
 	}
+	if stmts.updateTaskProgress, err = db.Prepare(updateTaskProgress); err != nil {
+		return nil, errors.New("error preparing updateTaskProgress: " + err.Error())
+	}
 
 	return stmts, nil
 }
@@ -73,7 +79,7 @@ func (s *tasksTableStatements) Prepare(ctx rcontext.RequestContext) *tasksTableW
 func (s *tasksTableWithContext) Insert(name string, params *AnonymousJson, startTs int64) (*DbTask, error) {
 	row := s.statements.insertTask.QueryRowContext(s.ctx, name, params, startTs)
 	val := &DbTask{}
-	err := row.Scan(&val.TaskId, &val.Name, &val.Params, &val.StartTs, &val.EndTs, &val.Error)
+	err := row.Scan(&val.TaskId, &val.Name, &val.Params, &val.StartTs, &val.EndTs, &val.Error, &val.Progress)
 	if err != nil {
 		return nil, err
 	}
@@ -90,10 +96,15 @@ func (s *tasksTableWithContext) SetError(taskId int, errVal string) error {
 	return err
 }
 
+func (s *tasksTableWithContext) SetProgress(taskId int, progress *AnonymousJson) error {
+	_, err := s.statements.updateTaskProgress.ExecContext(s.ctx, taskId, progress)
+	return err
+}
+
 func (s *tasksTableWithContext) Get(id int) (*DbTask, error) {
 	row := s.statements.selectTask.QueryRowContext(s.ctx, id)
 	val := &DbTask{}
-	err := row.Scan(&val.TaskId, &val.Name, &val.Params, &val.StartTs, &val.EndTs, &val.Error)
+	err := row.Scan(&val.TaskId, &val.Name, &val.Params, &val.StartTs, &val.EndTs, &val.Error, &val.Progress)
 	if errors.Is(err, sql.ErrNoRows) {
 		err = nil
 		val = nil
@@ -116,7 +127,7 @@ func (s *tasksTableWithContext) GetAll(includingFinished bool) ([]*DbTask, error
 	}
 	for rows.Next() {
 		val := &DbTask{}
-		if err = rows.Scan(&val.TaskId, &val.Name, &val.Params, &val.StartTs, &val.EndTs, &val.Error); err != nil {
+		if err = rows.Scan(&val.TaskId, &val.Name, &val.Params, &val.StartTs, &val.EndTs, &val.Error, &val.Progress); err != nil {
 			return nil, err
 		}
 		results = append(results, val)
@@ -11,38 +11,47 @@ type DbMethod string
 
 type DbThumbnail struct {
 	*Locatable
-	Origin      string
-	MediaId     string
-	ContentType string
-	Width       int
-	Height      int
-	Method      string
-	Animated    bool
+	Origin       string
+	MediaId      string
+	ContentType  string
+	Width        int
+	Height       int
+	Method       string
+	Animated     bool
+	CropStrategy string
+	// AnimatedFormat is the requested animated output format, or empty for static thumbnails
+	AnimatedFormat string
 	//Sha256Hash  string
 	SizeBytes  int64
 	CreationTs int64
 	//DatastoreId string
 	//Location    string
+	// Quarantined is only set on thumbnails fetched from the origin, for media we don't have a record of
+	Quarantined bool
 }
 
-const selectThumbnailByParams = "SELECT origin, media_id, content_type, width, height, method, animated, sha256_hash, size_bytes, creation_ts, datastore_id, location FROM thumbnails WHERE origin = $1 AND media_id = $2 AND width = $3 AND height = $4 AND method = $5 AND animated = $6;"
-const insertThumbnail = "INSERT INTO thumbnails (origin, media_id, content_type, width, height, method, animated, sha256_hash, size_bytes, creation_ts, datastore_id, location) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12);"
+const selectThumbnailByParams = "SELECT origin, media_id, content_type, width, height, method, animated, crop_strategy, animated_format, sha256_hash, size_bytes, creation_ts, datastore_id, location, quarantined FROM thumbnails WHERE origin = $1 AND media_id = $2 AND width = $3 AND height = $4 AND method = $5 AND animated = $6 AND crop_strategy = $7 AND animated_format = $8;"
+const insertThumbnail = "INSERT INTO thumbnails (origin, media_id, content_type, width, height, method, animated, crop_strategy, animated_format, sha256_hash, size_bytes, creation_ts, datastore_id, location, quarantined) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15);"
 const selectThumbnailByLocationExists = "SELECT TRUE FROM thumbnails WHERE datastore_id = $1 AND location = $2 LIMIT 1;"
-const selectThumbnailsForMedia = "SELECT origin, media_id, content_type, width, height, method, animated, sha256_hash, size_bytes, creation_ts, datastore_id, location FROM thumbnails WHERE origin = $1 AND media_id = $2;"
-const selectOldThumbnails = "SELECT origin, media_id, content_type, width, height, method, animated, sha256_hash, size_bytes, creation_ts, datastore_id, location FROM thumbnails WHERE sha256_hash IN (SELECT t2.sha256_hash FROM thumbnails AS t2 WHERE t2.creation_ts < $1);"
-const deleteThumbnail = "DELETE FROM thumbnails WHERE origin = $1 AND media_id = $2 AND content_type = $3 AND width = $4 AND height = $5 AND method = $6 AND animated = $7 AND sha256_hash = $8 AND size_bytes = $9 AND creation_ts = $10 AND datastore_id = $11 AND location = $12;"
+const selectThumbnailsForMedia = "SELECT origin, media_id, content_type, width, height, method, animated, crop_strategy, animated_format, sha256_hash, size_bytes, creation_ts, datastore_id, location, quarantined FROM thumbnails WHERE origin = $1 AND media_id = $2;"
+const selectOldThumbnails = "SELECT origin, media_id, content_type, width, height, method, animated, crop_strategy, animated_format, sha256_hash, size_bytes, creation_ts, datastore_id, location, quarantined FROM thumbnails WHERE sha256_hash IN (SELECT t2.sha256_hash FROM thumbnails AS t2 WHERE t2.creation_ts < $1);"
+const deleteThumbnail = "DELETE FROM thumbnails WHERE origin = $1 AND media_id = $2 AND content_type = $3 AND width = $4 AND height = $5 AND method = $6 AND animated = $7 AND crop_strategy = $8 AND animated_format = $9 AND sha256_hash = $10 AND size_bytes = $11 AND creation_ts = $12 AND datastore_id = $13 AND location = $14;"
 const updateThumbnailLocation = "UPDATE thumbnails SET datastore_id = $3, location = $4 WHERE datastore_id = $1 AND location = $2;"
-const selectThumbnailsByLocation = "SELECT origin, media_id, content_type, width, height, method, animated, sha256_hash, size_bytes, creation_ts, datastore_id, location FROM thumbnails WHERE datastore_id = $1 AND location = $2;"
+const selectThumbnailQuarantinedForMedia = "SELECT TRUE FROM thumbnails WHERE origin = $1 AND media_id = $2 AND quarantined = TRUE LIMIT 1;"
+const updateThumbnailQuarantineForMedia = "UPDATE thumbnails SET quarantined = $3 WHERE origin = $1 AND media_id = $2 AND quarantined <> $3;"
+const selectThumbnailsByLocation = "SELECT origin, media_id, content_type, width, height, method, animated, crop_strategy, animated_format, sha256_hash, size_bytes, creation_ts, datastore_id, location, quarantined FROM thumbnails WHERE datastore_id = $1 AND location = $2;"
 
 type thumbnailsTableStatements struct {
-	selectThumbnailByParams         *sql.Stmt
-	insertThumbnail                 *sql.Stmt
-	selectThumbnailByLocationExists *sql.Stmt
-	selectThumbnailsForMedia        *sql.Stmt
-	selectOldThumbnails             *sql.Stmt
-	deleteThumbnail                 *sql.Stmt
-	updateThumbnailLocation         *sql.Stmt
-	selectThumbnailsByLocation      *sql.Stmt
+	selectThumbnailByParams            *sql.Stmt
+	insertThumbnail                    *sql.Stmt
+	selectThumbnailByLocationExists    *sql.Stmt
+	selectThumbnailsForMedia           *sql.Stmt
+	selectOldThumbnails                *sql.Stmt
+	deleteThumbnail                    *sql.Stmt
+	updateThumbnailLocation            *sql.Stmt
+	selectThumbnailsByLocation         *sql.Stmt
+	selectThumbnailQuarantinedForMedia *sql.Stmt
+	updateThumbnailQuarantineForMedia  *sql.Stmt
 }
 
 type thumbnailsTableWithContext struct {
@@ -78,6 +87,12 @@ func prepareThumbnailsTables(db *sql.DB) (*thumbnailsTableStatements, error) {
 	if stmts.selectThumbnailsByLocation, err = db.Prepare(selectThumbnailsByLocation); err != nil {
 		return nil, errors.New("error preparing selectThumbnailsByLocation: " + err.Error())
 	}
+	if stmts.selectThumbnailQuarantinedForMedia, err = db.Prepare(selectThumbnailQuarantinedForMedia); err != nil {
+		return nil, errors.New("error preparing selectThumbnailQuarantinedForMedia: " + err.Error())
+	}
+	if stmts.updateThumbnailQuarantineForMedia, err = db.Prepare(updateThumbnailQuarantineForMedia); err != nil {
+		return nil, errors.New("error preparing updateThumbnailQuarantineForMedia: " + err.Error())
+	}
 
 	return stmts, nil
 }
@@ -89,10 +104,10 @@ func (s *thumbnailsTableStatements) Prepare(ctx rcontext.RequestContext) *thumbn
 	}
 }
 
-func (s *thumbnailsTableWithContext) GetByParams(origin string, mediaId string, width int, height int, method string, animated bool) (*DbThumbnail, error) {
-	row := s.statements.selectThumbnailByParams.QueryRowContext(s.ctx, origin, mediaId, width, height, method, animated)
+func (s *thumbnailsTableWithContext) GetByParams(origin string, mediaId string, width int, height int, method string, animated bool, cropStrategy string, animatedFormat string) (*DbThumbnail, error) {
+	row := s.statements.selectThumbnailByParams.QueryRowContext(s.ctx, origin, mediaId, width, height, method, animated, cropStrategy, animatedFormat)
 	val := &DbThumbnail{Locatable: &Locatable{}}
-	err := row.Scan(&val.Origin, &val.MediaId, &val.ContentType, &val.Width, &val.Height, &val.Method, &val.Animated, &val.Sha256Hash, &val.SizeBytes, &val.CreationTs, &val.DatastoreId, &val.Location)
+	err := row.Scan(&val.Origin, &val.MediaId, &val.ContentType, &val.Width, &val.Height, &val.Method, &val.Animated, &val.CropStrategy, &val.AnimatedFormat, &val.Sha256Hash, &val.SizeBytes, &val.CreationTs, &val.DatastoreId, &val.Location, &val.Quarantined)
 	if errors.Is(err, sql.ErrNoRows) {
 		err = nil
 		val = nil
@@ -110,7 +125,7 @@ func (s *thumbnailsTableWithContext) scanRows(rows *sql.Rows, err error) ([]*DbT
 	}
 	for rows.Next() {
 		val := &DbThumbnail{Locatable: &Locatable{}}
-		if err = rows.Scan(&val.Origin, &val.MediaId, &val.ContentType, &val.Width, &val.Height, &val.Method, &val.Animated, &val.Sha256Hash, &val.SizeBytes, &val.CreationTs, &val.DatastoreId, &val.Location); err != nil {
+		if err = rows.Scan(&val.Origin, &val.MediaId, &val.ContentType, &val.Width, &val.Height, &val.Method, &val.Animated, &val.CropStrategy, &val.AnimatedFormat, &val.Sha256Hash, &val.SizeBytes, &val.CreationTs, &val.DatastoreId, &val.Location, &val.Quarantined); err != nil {
 			return nil, err
 		}
 		results = append(results, val)
@@ -132,7 +147,7 @@ func (s *thumbnailsTableWithContext) GetByLocation(datastoreId string, location
 }
 
 func (s *thumbnailsTableWithContext) Insert(record *DbThumbnail) error {
-	_, err := s.statements.insertThumbnail.ExecContext(s.ctx, record.Origin, record.MediaId, record.ContentType, record.Width, record.Height, record.Method, record.Animated, record.Sha256Hash, record.SizeBytes, record.CreationTs, record.DatastoreId, record.Location)
+	_, err := s.statements.insertThumbnail.ExecContext(s.ctx, record.Origin, record.MediaId, record.ContentType, record.Width, record.Height, record.Method, record.Animated, record.CropStrategy, record.AnimatedFormat, record.Sha256Hash, record.SizeBytes, record.CreationTs, record.DatastoreId, record.Location, record.Quarantined)
 	return err
 }
 
@@ -148,7 +163,7 @@ func (s *thumbnailsTableWithContext) LocationExists(datastoreId string, location
 }
 
 func (s *thumbnailsTableWithContext) Delete(record *DbThumbnail) error {
-	_, err := s.statements.deleteThumbnail.ExecContext(s.ctx, record.Origin, record.MediaId, record.ContentType, record.Width, record.Height, record.Method, record.Animated, record.Sha256Hash, record.SizeBytes, record.CreationTs, record.DatastoreId, record.Location)
+	_, err := s.statements.deleteThumbnail.ExecContext(s.ctx, record.Origin, record.MediaId, record.ContentType, record.Width, record.Height, record.Method, record.Animated, record.CropStrategy, record.AnimatedFormat, record.Sha256Hash, record.SizeBytes, record.CreationTs, record.DatastoreId, record.Location)
 	return err
 }
 
@@ -156,3 +171,24 @@ func (s *thumbnailsTableWithContext) UpdateLocation(sourceDsId string, sourceLoc
 	_, err := s.statements.updateThumbnailLocation.ExecContext(s.ctx, sourceDsId, sourceLocation, targetDsId, targetLocation)
 	return err
 }
+
+// IsQuarantinedForMedia returns whether any thumbnail of the given media has been quarantined. Only thumbnails
+// fetched from the origin are quarantined this way, as they might be the only record we have of the media.
+func (s *thumbnailsTableWithContext) IsQuarantinedForMedia(origin string, mediaId string) (bool, error) {
+	row := s.statements.selectThumbnailQuarantinedForMedia.QueryRowContext(s.ctx, origin, mediaId)
+	val := false
+	err := row.Scan(&val)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+		val = false
+	}
+	return val, err
+}
+
+func (s *thumbnailsTableWithContext) UpdateQuarantineForMedia(origin string, mediaId string, quarantined bool) (int64, error) {
+	c, err := s.statements.updateThumbnailQuarantineForMedia.ExecContext(s.ctx, origin, mediaId, quarantined)
+	if err != nil {
+		return 0, err
+	}
+	return c.RowsAffected()
+}
@@ -0,0 +1,101 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+type DbUrlPreviewBlock struct {
+	Url        string
+	Reason     string
+	CreationTs int64
+}
+
+const selectUrlPreviewBlock = "SELECT url, reason, creation_ts FROM url_preview_blocks WHERE url = $1;"
+const selectAllUrlPreviewBlocks = "SELECT url, reason, creation_ts FROM url_preview_blocks;"
+const upsertUrlPreviewBlock = "INSERT INTO url_preview_blocks (url, reason, creation_ts) VALUES ($1, $2, $3) ON CONFLICT (url) DO UPDATE SET reason = $2;"
+const deleteUrlPreviewBlock = "DELETE FROM url_preview_blocks WHERE url = $1;"
+
+type urlPreviewBlocksTableStatements struct {
+	selectUrlPreviewBlock     *sql.Stmt
+	selectAllUrlPreviewBlocks *sql.Stmt
+	upsertUrlPreviewBlock     *sql.Stmt
+	deleteUrlPreviewBlock     *sql.Stmt
+}
+
+type urlPreviewBlocksTableWithContext struct {
+	statements *urlPreviewBlocksTableStatements
+	ctx        rcontext.RequestContext
+}
+
+func prepareUrlPreviewBlocksTables(db *sql.DB) (*urlPreviewBlocksTableStatements, error) {
+	var err error
+	var stmts = &urlPreviewBlocksTableStatements{}
+
+	if stmts.selectUrlPreviewBlock, err = db.Prepare(selectUrlPreviewBlock); err != nil {
+		return nil, errors.New("error preparing selectUrlPreviewBlock: " + err.Error())
+	}
+	if stmts.selectAllUrlPreviewBlocks, err = db.Prepare(selectAllUrlPreviewBlocks); err != nil {
+		return nil, errors.New("error preparing selectAllUrlPreviewBlocks: " + err.Error())
+	}
+	if stmts.upsertUrlPreviewBlock, err = db.Prepare(upsertUrlPreviewBlock); err != nil {
+		return nil, errors.New("error preparing upsertUrlPreviewBlock: " + err.Error())
+	}
+	if stmts.deleteUrlPreviewBlock, err = db.Prepare(deleteUrlPreviewBlock); err != nil {
+		return nil, errors.New("error preparing deleteUrlPreviewBlock: " + err.Error())
+	}
+
+	return stmts, nil
+}
+
+func (s *urlPreviewBlocksTableStatements) Prepare(ctx rcontext.RequestContext) *urlPreviewBlocksTableWithContext {
+	return &urlPreviewBlocksTableWithContext{
+		statements: s,
+		ctx:        ctx,
+	}
+}
+
+func (s *urlPreviewBlocksTableWithContext) Get(url string) (*DbUrlPreviewBlock, error) {
+	row := s.statements.selectUrlPreviewBlock.QueryRowContext(s.ctx, url)
+	val := &DbUrlPreviewBlock{}
+	err := row.Scan(&val.Url, &val.Reason, &val.CreationTs)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return val, err
+}
+
+func (s *urlPreviewBlocksTableWithContext) GetAll() ([]*DbUrlPreviewBlock, error) {
+	results := make([]*DbUrlPreviewBlock, 0)
+	rows, err := s.statements.selectAllUrlPreviewBlocks.QueryContext(s.ctx)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return results, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		val := &DbUrlPreviewBlock{}
+		if err = rows.Scan(&val.Url, &val.Reason, &val.CreationTs); err != nil {
+			return nil, err
+		}
+		results = append(results, val)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (s *urlPreviewBlocksTableWithContext) Upsert(record *DbUrlPreviewBlock) error {
+	_, err := s.statements.upsertUrlPreviewBlock.ExecContext(s.ctx, record.Url, record.Reason, record.CreationTs)
+	return err
+}
+
+func (s *urlPreviewBlocksTableWithContext) Delete(url string) error {
+	_, err := s.statements.deleteUrlPreviewBlock.ExecContext(s.ctx, url)
+	return err
+}
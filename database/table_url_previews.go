@@ -2,7 +2,10 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"regexp"
+	"strings"
 
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/util"
@@ -23,16 +26,45 @@ type DbUrlPreview struct {
 	ImageWidth     int
 	ImageHeight    int
 	LanguageHeader string
+	Extra          *DbUrlPreviewExtra
 }
 
-const selectUrlPreview = "SELECT url, error_code, bucket_ts, site_url, site_name, resource_type, description, title, image_mxc, image_type, image_size, image_width, image_height, language_header FROM url_previews WHERE url = $1 AND bucket_ts = $2 AND language_header = $3;"
-const insertUrlPreview = "INSERT INTO url_previews (url, error_code, bucket_ts, site_url, site_name, resource_type, description, title, image_mxc, image_type, image_size, image_width, image_height, language_header) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14);"
+// DbUrlPreviewExtra holds the less common parts of a URL preview, which are stored together as JSON.
+type DbUrlPreviewExtra struct {
+	FaviconMxc     string `json:"favicon_mxc,omitempty"`
+	FaviconType    string `json:"favicon_type,omitempty"`
+	VideoUrl       string `json:"video_url,omitempty"`
+	VideoType      string `json:"video_type,omitempty"`
+	VideoWidth     int    `json:"video_width,omitempty"`
+	VideoHeight    int    `json:"video_height,omitempty"`
+	AudioUrl       string `json:"audio_url,omitempty"`
+	AudioType      string `json:"audio_type,omitempty"`
+	TwitterCard    string `json:"twitter_card,omitempty"`
+	TwitterSite    string `json:"twitter_site,omitempty"`
+	TwitterCreator string `json:"twitter_creator,omitempty"`
+	Author         string `json:"author,omitempty"`
+	PublishedTime  string `json:"published_time,omitempty"`
+	DurationMs     int64  `json:"duration_ms,omitempty"`
+	Locale         string `json:"locale,omitempty"`
+}
+
+const selectUrlPreview = "SELECT url, error_code, bucket_ts, site_url, site_name, resource_type, description, title, image_mxc, image_type, image_size, image_width, image_height, language_header, extra FROM url_previews WHERE url = $1 AND bucket_ts = $2 AND language_header = $3;"
+const insertUrlPreview = "INSERT INTO url_previews (url, error_code, bucket_ts, site_url, site_name, resource_type, description, title, image_mxc, image_type, image_size, image_width, image_height, language_header, extra) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15);"
 const deleteOldUrlPreviews = "DELETE FROM url_previews WHERE bucket_ts <= $1;"
+const selectUrlPreviewsForUrl = "SELECT url, error_code, bucket_ts, site_url, site_name, resource_type, description, title, image_mxc, image_type, image_size, image_width, image_height, language_header, extra FROM url_previews WHERE url = $1 ORDER BY bucket_ts DESC;"
+const deleteUrlPreviewsForUrl = "DELETE FROM url_previews WHERE url = $1 RETURNING image_mxc;"
+const deleteUrlPreviewsWithPrefix = "DELETE FROM url_previews WHERE url LIKE $1 ESCAPE '\\' RETURNING image_mxc;"
+const deleteUrlPreviewsMatching = "DELETE FROM url_previews WHERE url ~* $1 RETURNING image_mxc;"
 
 type urlPreviewsTableStatements struct {
 	selectUrlPreview     *sql.Stmt
 	insertUrlPreview     *sql.Stmt
 	deleteOldUrlPreviews *sql.Stmt
+
+	selectUrlPreviewsForUrl     *sql.Stmt
+	deleteUrlPreviewsForUrl     *sql.Stmt
+	deleteUrlPreviewsWithPrefix *sql.Stmt
+	deleteUrlPreviewsMatching   *sql.Stmt
 }
 
 type urlPreviewsTableWithContext struct {
@@ -53,6 +85,18 @@ func prepareUrlPreviewsTables(db *sql.DB) (*urlPreviewsTableStatements, error) {
 	if stmts.deleteOldUrlPreviews, err = db.Prepare(deleteOldUrlPreviews); err != nil {
 		return nil, errors.New("error preparing deleteOldUrlPreviews: " + err.Error())
 	}
+	if stmts.selectUrlPreviewsForUrl, err = db.Prepare(selectUrlPreviewsForUrl); err != nil {
+		return nil, errors.New("error preparing selectUrlPreviewsForUrl: " + err.Error())
+	}
+	if stmts.deleteUrlPreviewsForUrl, err = db.Prepare(deleteUrlPreviewsForUrl); err != nil {
+		return nil, errors.New("error preparing deleteUrlPreviewsForUrl: " + err.Error())
+	}
+	if stmts.deleteUrlPreviewsWithPrefix, err = db.Prepare(deleteUrlPreviewsWithPrefix); err != nil {
+		return nil, errors.New("error preparing deleteUrlPreviewsWithPrefix: " + err.Error())
+	}
+	if stmts.deleteUrlPreviewsMatching, err = db.Prepare(deleteUrlPreviewsMatching); err != nil {
+		return nil, errors.New("error preparing deleteUrlPreviewsMatching: " + err.Error())
+	}
 
 	return stmts, nil
 }
@@ -66,24 +110,68 @@ func (s *urlPreviewsTableStatements) Prepare(ctx rcontext.RequestContext) *urlPr
 
 func (s *urlPreviewsTableWithContext) Get(url string, ts int64, languageHeader string) (*DbUrlPreview, error) {
 	row := s.statements.selectUrlPreview.QueryRowContext(s.ctx, url, ts, languageHeader)
-	val := &DbUrlPreview{}
-	err := row.Scan(&val.Url, &val.ErrorCode, &val.BucketTs, &val.SiteUrl, &val.SiteName, &val.ResourceType, &val.Description, &val.Title, &val.ImageMxc, &val.ImageType, &val.ImageSize, &val.ImageWidth, &val.ImageHeight, &val.LanguageHeader)
+	val, err := scanUrlPreview(row)
 	if errors.Is(err, sql.ErrNoRows) {
 		return nil, nil
 	}
 	return val, err
 }
 
+func (s *urlPreviewsTableWithContext) GetAllForUrl(url string) ([]*DbUrlPreview, error) {
+	results := make([]*DbUrlPreview, 0)
+	rows, err := s.statements.selectUrlPreviewsForUrl.QueryContext(s.ctx, url)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return results, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		val, err := scanUrlPreview(rows)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, val)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func scanUrlPreview(row interface{ Scan(dest ...any) error }) (*DbUrlPreview, error) {
+	val := &DbUrlPreview{}
+	extra := make([]byte, 0)
+	err := row.Scan(&val.Url, &val.ErrorCode, &val.BucketTs, &val.SiteUrl, &val.SiteName, &val.ResourceType, &val.Description, &val.Title, &val.ImageMxc, &val.ImageType, &val.ImageSize, &val.ImageWidth, &val.ImageHeight, &val.LanguageHeader, &extra)
+	if err != nil {
+		return nil, err
+	}
+	val.Extra = &DbUrlPreviewExtra{}
+	if err = json.Unmarshal(extra, val.Extra); err != nil {
+		return nil, err
+	}
+	return val, nil
+}
+
 func (s *urlPreviewsTableWithContext) Insert(p *DbUrlPreview) error {
-	_, err := s.statements.insertUrlPreview.ExecContext(s.ctx, p.Url, p.ErrorCode, p.BucketTs, p.SiteUrl, p.SiteName, p.ResourceType, p.Description, p.Title, p.ImageMxc, p.ImageType, p.ImageSize, p.ImageWidth, p.ImageHeight, p.LanguageHeader)
+	if p.Extra == nil {
+		p.Extra = &DbUrlPreviewExtra{}
+	}
+	extra, err := json.Marshal(p.Extra)
+	if err != nil {
+		return err
+	}
+	_, err = s.statements.insertUrlPreview.ExecContext(s.ctx, p.Url, p.ErrorCode, p.BucketTs, p.SiteUrl, p.SiteName, p.ResourceType, p.Description, p.Title, p.ImageMxc, p.ImageType, p.ImageSize, p.ImageWidth, p.ImageHeight, p.LanguageHeader, extra)
 	return err
 }
 
-func (s *urlPreviewsTableWithContext) InsertError(url string, errorCode string) {
+func (s *urlPreviewsTableWithContext) InsertError(url string, languageHeader string, errorCode string) {
 	_ = s.Insert(&DbUrlPreview{
-		Url:       url,
-		ErrorCode: errorCode,
-		BucketTs:  util.GetHourBucket(util.NowMillis()),
+		Url:            url,
+		ErrorCode:      errorCode,
+		BucketTs:       util.GetHourBucket(util.NowMillis()),
+		LanguageHeader: languageHeader,
 		// remainder of fields don't matter
 	})
 }
@@ -92,3 +180,45 @@ func (s *urlPreviewsTableWithContext) DeleteOlderThan(ts int64) error {
 	_, err := s.statements.deleteOldUrlPreviews.ExecContext(s.ctx, ts)
 	return err
 }
+
+// DeleteForUrl deletes the cached previews for the URL, returning the MXC URIs of their images.
+func (s *urlPreviewsTableWithContext) DeleteForUrl(url string) ([]string, error) {
+	return s.deleteReturningImages(s.statements.deleteUrlPreviewsForUrl, url)
+}
+
+// DeleteWithPrefix deletes the cached previews for URLs starting with the prefix, returning the MXC URIs of their
+// images.
+func (s *urlPreviewsTableWithContext) DeleteWithPrefix(prefix string) ([]string, error) {
+	escaped := strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(prefix)
+	return s.deleteReturningImages(s.statements.deleteUrlPreviewsWithPrefix, escaped+"%")
+}
+
+// DeleteForDomain deletes the cached previews for URLs on the domain (case-insensitive, with any port), returning the
+// MXC URIs of their images.
+func (s *urlPreviewsTableWithContext) DeleteForDomain(domain string) ([]string, error) {
+	pattern := "^https?://" + regexp.QuoteMeta(domain) + "(:[0-9]+)?([/?#]|$)"
+	return s.deleteReturningImages(s.statements.deleteUrlPreviewsMatching, pattern)
+}
+
+func (s *urlPreviewsTableWithContext) deleteReturningImages(stmt *sql.Stmt, arg string) ([]string, error) {
+	results := make([]string, 0)
+	rows, err := stmt.QueryContext(s.ctx, arg)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return results, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var mxc string
+		if err = rows.Scan(&mxc); err != nil {
+			return nil, err
+		}
+		results = append(results, mxc)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
@@ -13,6 +13,19 @@ import (
 	"github.com/t2bot/matrix-media-repo/util/readers"
 )
 
+// SpoolPath returns the directory to spool media to while storing it in the datastore, creating it if needed. An
+// empty string means the system's temporary directory.
+func SpoolPath(datastore config.DatastoreConfig) (string, error) {
+	if datastore.Type != "s3" || datastore.Options["tempPath"] == "" {
+		return "", nil
+	}
+	fpath := datastore.Options["tempPath"]
+	if err := os.Mkdir(fpath, os.ModeDir|0700); err != nil && !os.IsExist(err) {
+		return "", errors.New("error creating temp path: " + err.Error())
+	}
+	return fpath, nil
+}
+
 func BufferTemp(datastore config.DatastoreConfig, contents io.ReadCloser) (string, int64, io.ReadCloser, error) {
 	fpath := ""
 	var err error
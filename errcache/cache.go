@@ -1,39 +1,345 @@
 package errcache
 
 import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/getsentry/sentry-go"
 	"github.com/patrickmn/go-cache"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/matrix"
+	"github.com/t2bot/matrix-media-repo/redislib"
 )
 
+// knownErrors are restored from their message when read from Redis, so callers can still compare them. Errors with
+// their own types are restored using their kind instead (see encodeError).
+var knownErrors = []error{
+	common.ErrMediaNotFound,
+	common.ErrMediaTooLarge,
+	common.ErrInvalidHost,
+	common.ErrHostNotFound,
+	common.ErrHostNotAllowed,
+	common.ErrMediaQuarantined,
+	common.ErrMediaMismatch,
+}
+
+var redisGlobEscaper = strings.NewReplacer("\\", "\\\\", "*", "\\*", "?", "\\?", "[", "\\[", "]", "\\]")
+
+// Entry is a cached error. Entries are remembered after they expire so repeated failures can back off further.
+type Entry struct {
+	Key       string `json:"key"`
+	Error     string `json:"error"`
+	Kind      string `json:"kind,omitempty"`
+	Data      string `json:"data,omitempty"`
+	Failures  int    `json:"failures"`
+	ExpiresTs int64  `json:"expires_ts"`
+
+	err error
+}
+
+// Err returns the cached error.
+func (e *Entry) Err() error {
+	return e.err
+}
+
+func (e *Entry) expired() bool {
+	return time.Now().UnixMilli() >= e.ExpiresTs
+}
+
+// ErrCache caches errors for an exponentially increasing amount of time, from the base expiration up to the max
+// expiration. When Redis is configured, the errors are shared between processes.
 type ErrCache struct {
-	cache *cache.Cache
-	mu    sync.Mutex
+	name          string
+	cache         *cache.Cache
+	mu            sync.Mutex // protects the expirations
+	localMu       sync.Mutex // serializes updates to the local cache
+	expiration    time.Duration
+	maxExpiration time.Duration
 }
 
-func NewErrCache(expiration time.Duration) *ErrCache {
-	return &ErrCache{cache: cache.New(expiration, expiration*2)}
+func NewErrCache(name string, expiration time.Duration, maxExpiration time.Duration) *ErrCache {
+	e := &ErrCache{name: name, cache: cache.New(cache.NoExpiration, time.Minute)}
+	e.Resize(expiration, maxExpiration)
+	return e
 }
 
-func (e *ErrCache) Resize(expiration time.Duration) {
+func (e *ErrCache) Resize(expiration time.Duration, maxExpiration time.Duration) {
 	e.mu.Lock()
-	e.cache = cache.NewFrom(expiration, expiration*2, e.cache.Items())
-	e.mu.Unlock()
+	defer e.mu.Unlock()
+	if maxExpiration < expiration {
+		maxExpiration = expiration
+	}
+	e.expiration = expiration
+	e.maxExpiration = maxExpiration
+}
+
+func (e *ErrCache) redisKey(key string) string {
+	return "mmr:errcache:" + e.name + ":" + key
 }
 
-func (e *ErrCache) Get(key string) error {
+// Backoff returns how long to cache an error after the given number of failures.
+func (e *ErrCache) Backoff(failures int) time.Duration {
 	e.mu.Lock()
-	if err, ok := e.cache.Get(key); ok {
-		e.mu.Unlock()
-		return err.(error)
+	defer e.mu.Unlock()
+	return e.backoffLocked(failures)
+}
+
+func (e *ErrCache) backoffLocked(failures int) time.Duration {
+	d := e.expiration
+	for i := 1; i < failures && d < e.maxExpiration; i++ {
+		d *= 2
+	}
+	if d > e.maxExpiration {
+		d = e.maxExpiration
+	}
+	return d
+}
+
+const (
+	errorKindServerNotAllowed = "server_not_allowed"
+	errorKindMatrix           = "matrix"
+)
+
+// encodeError returns the kind and data needed to restore a typed error after reading it from Redis.
+func encodeError(err error) (string, string) {
+	var notAllowedErr matrix.ServerNotAllowedError
+	if errors.As(err, &notAllowedErr) {
+		return errorKindServerNotAllowed, notAllowedErr.ServerName
+	}
+	var mxErr *matrix.ErrorResponse
+	if errors.As(err, &mxErr) {
+		if b, jsonErr := json.Marshal(mxErr); jsonErr == nil {
+			return errorKindMatrix, string(b)
+		}
+	}
+	return "", ""
+}
+
+// decodeError restores the error for an entry read from Redis.
+func decodeError(entry *Entry) error {
+	switch entry.Kind {
+	case errorKindServerNotAllowed:
+		return matrix.MakeServerNotAllowedError(entry.Data)
+	case errorKindMatrix:
+		mxErr := &matrix.ErrorResponse{}
+		if err := json.Unmarshal([]byte(entry.Data), mxErr); err == nil {
+			return mxErr
+		}
+	}
+	for _, known := range knownErrors {
+		if known.Error() == entry.Error {
+			return known
+		}
+	}
+	return errors.New(entry.Error)
+}
+
+// Entries are stored in Redis as a hash, so the failures can be counted atomically by every process.
+const (
+	redisFieldEntry    = "entry"
+	redisFieldFailures = "failures"
+)
+
+// EncodeEntry returns the fields of the hash an entry is stored as in Redis.
+func EncodeEntry(entry *Entry) (map[string]string, error) {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		redisFieldEntry:    string(b),
+		redisFieldFailures: strconv.Itoa(entry.Failures),
+	}, nil
+}
+
+// DecodeEntry restores an entry, including its error, from the fields of the hash it is stored as in Redis. The
+// failures field takes precedence over the failures in the entry, as it is counted separately.
+func DecodeEntry(values map[string]string) (*Entry, error) {
+	entry := &Entry{}
+	if err := json.Unmarshal([]byte(values[redisFieldEntry]), entry); err != nil {
+		return nil, err
+	}
+	if val, ok := values[redisFieldFailures]; ok {
+		failures, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, err
+		}
+		entry.Failures = failures
+	}
+	entry.err = decodeError(entry)
+	return entry, nil
+}
+
+func (e *ErrCache) getEntry(ctx rcontext.RequestContext, key string) *Entry {
+	if redislib.IsConnected() {
+		values, ok, err := redislib.GetHashValues(ctx, e.redisKey(key))
+		if err == nil {
+			if !ok || values[redisFieldEntry] == "" {
+				return nil // the failure might have been counted without the entry being written yet
+			}
+			var entry *Entry
+			if entry, err = DecodeEntry(values); err == nil {
+				return entry
+			}
+		}
+		ctx.Log.Warn("Non-fatal error reading error cache from Redis - using local cache: ", err)
+		sentry.CaptureException(err)
+	}
+
+	if val, ok := e.cache.Get(key); ok {
+		return val.(*Entry)
 	}
-	e.mu.Unlock()
 	return nil
 }
 
-func (e *ErrCache) Set(key string, err error) {
+// Get returns the cached error for the key, or nil if there is none.
+func (e *ErrCache) Get(ctx rcontext.RequestContext, key string) error {
+	entry := e.getEntry(ctx, key)
+	if entry == nil || entry.expired() {
+		return nil
+	}
+	return entry.err
+}
+
+// Set caches the error for the key. If the key failed recently, the error is cached for longer than last time.
+func (e *ErrCache) Set(ctx rcontext.RequestContext, key string, err error) {
 	e.mu.Lock()
-	e.cache.Set(key, err, cache.DefaultExpiration)
+	maxExpiration := e.maxExpiration
 	e.mu.Unlock()
+	if maxExpiration <= 0 {
+		return // caching is disabled
+	}
+
+	kind, data := encodeError(err)
+	entry := &Entry{
+		Key:   key,
+		Error: err.Error(),
+		Kind:  kind,
+		Data:  data,
+		err:   err,
+	}
+
+	if redislib.IsConnected() {
+		// Failures are forgotten once the key hasn't failed for the max expiration. The count is kept for at least
+		// that long, and then for however long the error is cached on top.
+		failures, redisErr := redislib.IncrementHashValue(ctx, e.redisKey(key), redisFieldFailures, 1, 2*maxExpiration)
+		var values map[string]string
+		if redisErr == nil {
+			expiration := e.Backoff(int(failures))
+			entry.Failures = int(failures)
+			entry.ExpiresTs = time.Now().Add(expiration).UnixMilli()
+			values, redisErr = EncodeEntry(entry)
+			if redisErr == nil {
+				delete(values, redisFieldFailures) // other processes might have counted more failures since
+				redisErr = redislib.SetHashValues(ctx, e.redisKey(key), values, expiration+maxExpiration)
+			}
+		}
+		if redisErr == nil {
+			return
+		}
+		ctx.Log.Warn("Non-fatal error writing error cache to Redis - using local cache: ", redisErr)
+		sentry.CaptureException(redisErr)
+	}
+
+	// Hold the lock between reading and writing the local entry so concurrent failures are all counted
+	e.localMu.Lock()
+	defer e.localMu.Unlock()
+	entry.Failures = 1
+	if val, ok := e.cache.Get(key); ok {
+		entry.Failures = val.(*Entry).Failures + 1
+	}
+	expiration := e.Backoff(entry.Failures)
+	entry.ExpiresTs = time.Now().Add(expiration).UnixMilli()
+	e.cache.Set(key, entry, expiration+maxExpiration)
+}
+
+// List returns the cached errors with keys starting with the prefix, including expired errors which are still
+// counting towards the backoff.
+func (e *ErrCache) List(ctx rcontext.RequestContext, prefix string) ([]*Entry, error) {
+	entries := make([]*Entry, 0)
+	for key, item := range e.cache.Items() {
+		if strings.HasPrefix(key, prefix) {
+			entries = append(entries, item.Object.(*Entry))
+		}
+	}
+
+	if redislib.IsConnected() {
+		keys, err := redislib.ScanKeys(ctx, redisGlobEscaper.Replace(e.redisKey(prefix))+"*")
+		if err != nil {
+			return nil, err
+		}
+		for _, redisKey := range keys {
+			values, ok, err := redislib.GetHashValues(ctx, redisKey)
+			if err != nil {
+				return nil, err
+			}
+			if !ok || values[redisFieldEntry] == "" {
+				continue // expired since scanning, or not written yet
+			}
+			entry, err := DecodeEntry(values)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+	return entries, nil
+}
+
+// Clear removes the cached errors with keys starting with the prefix, returning how many were removed.
+func (e *ErrCache) Clear(ctx rcontext.RequestContext, prefix string) (int, error) {
+	count := 0
+	for key := range e.cache.Items() {
+		if strings.HasPrefix(key, prefix) {
+			e.cache.Delete(key)
+			count++
+		}
+	}
+
+	if redislib.IsConnected() {
+		keys, err := redislib.ScanKeys(ctx, redisGlobEscaper.Replace(e.redisKey(prefix))+"*")
+		if err != nil {
+			return count, err
+		}
+		if err = redislib.DeleteValues(ctx, keys...); err != nil {
+			return count, err
+		}
+		count += len(keys)
+	}
+
+	return count, nil
+}
+
+// Delete removes the cached error for exactly the key, returning how many were removed like Clear.
+func (e *ErrCache) Delete(ctx rcontext.RequestContext, key string) (int, error) {
+	count := 0
+	if _, ok := e.cache.Get(key); ok {
+		e.cache.Delete(key)
+		count++
+	}
+
+	if redislib.IsConnected() {
+		_, ok, err := redislib.GetHashValues(ctx, e.redisKey(key))
+		if err != nil {
+			return count, err
+		}
+		if ok {
+			if err = redislib.DeleteValues(ctx, e.redisKey(key)); err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+
+	return count, nil
 }
@@ -9,9 +9,15 @@ import (
 var DownloadErrors *ErrCache
 
 func Init() {
-	DownloadErrors = NewErrCache(time.Duration(config.Get().Downloads.FailureCacheMinutes) * time.Minute)
+	expiration, maxExpiration := downloadExpirations()
+	DownloadErrors = NewErrCache("download", expiration, maxExpiration)
 }
 
 func AdjustSize() {
-	DownloadErrors.Resize(time.Duration(config.Get().Downloads.FailureCacheMinutes) * time.Minute)
+	DownloadErrors.Resize(downloadExpirations())
+}
+
+func downloadExpirations() (time.Duration, time.Duration) {
+	conf := config.Get().Downloads
+	return time.Duration(conf.FailureCacheMinutes) * time.Minute, time.Duration(conf.FailureCacheMaxMinutes) * time.Minute
 }
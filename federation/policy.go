@@ -0,0 +1,206 @@
+package federation
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/ryanuber/go-glob"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+const (
+	PolicyAllow = config.FederationPolicyAllow
+	PolicyDeny  = config.FederationPolicyDeny
+)
+
+const (
+	ServeModeAll       = config.FederationServeModeAll
+	ServeModeAllowlist = config.FederationServeModeAllowlist
+)
+
+const (
+	SourceConfig   = "config"
+	SourceDatabase = "database"
+)
+
+// Policy controls how we interact with remote servers matching the glob. Zero values mean "use the default".
+type Policy struct {
+	Glob           string `json:"glob"`
+	Fetch          string `json:"fetch,omitempty"`
+	Serve          string `json:"serve,omitempty"`
+	MaxBytes       int64  `json:"max_bytes,omitempty"`
+	TimeoutSeconds int    `json:"timeout_seconds,omitempty"`
+	NeverCache     bool   `json:"never_cache,omitempty"`
+	Source         string `json:"source,omitempty"`
+}
+
+// Policies set via the admin API are shared between instances through the database, so we only cache them briefly.
+var dbPolicies = cache.New(1*time.Minute, 2*time.Minute)
+var dbPoliciesLock = new(sync.Mutex)
+
+const dbPoliciesCacheKey = "policies"
+
+// Validate returns an error if the policy can't be used. Policies in the config are validated the same way when the
+// config is loaded.
+func (p *Policy) Validate() error {
+	return config.FederationPolicyConfig{
+		Glob:           p.Glob,
+		Fetch:          p.Fetch,
+		Serve:          p.Serve,
+		MaxBytes:       p.MaxBytes,
+		TimeoutSeconds: p.TimeoutSeconds,
+		NeverCache:     p.NeverCache,
+	}.Validate()
+}
+
+// CanFetch returns true if media may be downloaded from the server.
+func (p *Policy) CanFetch() bool {
+	return p.Fetch != PolicyDeny
+}
+
+func fromConfig(c config.FederationPolicyConfig) *Policy {
+	return &Policy{
+		Glob:           c.Glob,
+		Fetch:          c.Fetch,
+		Serve:          c.Serve,
+		MaxBytes:       c.MaxBytes,
+		TimeoutSeconds: c.TimeoutSeconds,
+		NeverCache:     c.NeverCache,
+		Source:         SourceConfig,
+	}
+}
+
+func fromDatabase(r *database.DbFederationPolicy) *Policy {
+	return &Policy{
+		Glob:           r.Glob,
+		Fetch:          r.Fetch,
+		Serve:          r.Serve,
+		MaxBytes:       r.MaxBytes,
+		TimeoutSeconds: r.TimeoutSeconds,
+		NeverCache:     r.NeverCache,
+		Source:         SourceDatabase,
+	}
+}
+
+func getDatabasePolicies(ctx rcontext.RequestContext) ([]*Policy, error) {
+	dbPoliciesLock.Lock()
+	defer dbPoliciesLock.Unlock()
+
+	if val, ok := dbPolicies.Get(dbPoliciesCacheKey); ok {
+		return val.([]*Policy), nil
+	}
+
+	records, err := database.GetInstance().FedPolicies.Prepare(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	policies := make([]*Policy, 0, len(records))
+	for _, r := range records {
+		policies = append(policies, fromDatabase(r))
+	}
+
+	SortDatabasePolicies(policies)
+
+	dbPolicies.Set(dbPoliciesCacheKey, policies, cache.DefaultExpiration)
+	return policies, nil
+}
+
+// SortDatabasePolicies sorts policies set through the admin API into the order they are evaluated. There's no order in
+// the database, so the longest (and usually most specific) globs go first. This is only an approximation of
+// specificity, so ties are broken alphabetically to at least keep the order stable.
+func SortDatabasePolicies(policies []*Policy) {
+	sort.Slice(policies, func(i, j int) bool {
+		if len(policies[i].Glob) != len(policies[j].Glob) {
+			return len(policies[i].Glob) > len(policies[j].Glob)
+		}
+		return policies[i].Glob < policies[j].Glob
+	})
+}
+
+// ListPolicies returns all the policies in the order they are evaluated: admin API policies first, then those from
+// the config.
+func ListPolicies(ctx rcontext.RequestContext) ([]*Policy, error) {
+	policies, err := getDatabasePolicies(ctx)
+	if err != nil {
+		return nil, err
+	}
+	all := make([]*Policy, 0, len(policies)+len(config.Get().Federation.Policies))
+	all = append(all, policies...)
+	for _, c := range config.Get().Federation.Policies {
+		all = append(all, fromConfig(c))
+	}
+	return all, nil
+}
+
+// GetPolicy returns the first policy matching the server name, or an empty policy if none match.
+func GetPolicy(ctx rcontext.RequestContext, serverName string) (*Policy, error) {
+	policies, err := ListPolicies(ctx)
+	if err != nil {
+		return nil, err
+	}
+	serverName = strings.ToLower(serverName)
+	for _, p := range policies {
+		if glob.Glob(strings.ToLower(p.Glob), serverName) {
+			return p, nil
+		}
+	}
+	return &Policy{}, nil
+}
+
+// SetPolicy creates or replaces a policy for the admin API.
+func SetPolicy(ctx rcontext.RequestContext, policy *Policy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	err := database.GetInstance().FedPolicies.Prepare(ctx).Upsert(&database.DbFederationPolicy{
+		Glob:           policy.Glob,
+		Fetch:          policy.Fetch,
+		Serve:          policy.Serve,
+		MaxBytes:       policy.MaxBytes,
+		TimeoutSeconds: policy.TimeoutSeconds,
+		NeverCache:     policy.NeverCache,
+		CreationTs:     util.NowMillis(),
+	})
+	dbPolicies.Delete(dbPoliciesCacheKey)
+	return err
+}
+
+// DeletePolicy removes a policy set via the admin API. Policies from the config can't be deleted.
+func DeletePolicy(ctx rcontext.RequestContext, glob string) error {
+	err := database.GetInstance().FedPolicies.Prepare(ctx).Delete(glob)
+	dbPolicies.Delete(dbPoliciesCacheKey)
+	return err
+}
+
+// CanServe returns true if the server may download our media over federation.
+func CanServe(ctx rcontext.RequestContext, serverName string) (bool, error) {
+	policy, err := GetPolicy(ctx, serverName)
+	if err != nil {
+		return false, err
+	}
+	if policy.Serve != "" {
+		return policy.Serve == PolicyAllow, nil
+	}
+	return config.Get().Federation.ServeMode != ServeModeAllowlist, nil
+}
+
+// ApplyPolicy returns a context using the policy's download limits in place of the configured ones.
+func ApplyPolicy(ctx rcontext.RequestContext, policy *Policy) rcontext.RequestContext {
+	if policy.MaxBytes <= 0 && policy.TimeoutSeconds <= 0 {
+		return ctx
+	}
+	conf := ctx.Config
+	if policy.MaxBytes > 0 {
+		conf.Downloads.MaxSizeBytes = policy.MaxBytes
+	}
+	if policy.TimeoutSeconds > 0 {
+		conf.TimeoutSeconds.Federation = policy.TimeoutSeconds
+	}
+	return ctx.WithConfig(conf)
+}
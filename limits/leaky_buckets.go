@@ -1,16 +1,26 @@
 package limits
 
 import (
+	"net"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/t2bot/go-leaky-bucket"
 	"github.com/t2bot/matrix-media-repo/common/config"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"golang.org/x/net/publicsuffix"
 )
 
 var buckets = make(map[string]*leaky.Bucket)
+var previewUserBuckets = make(map[string]*leaky.Bucket)
+var previewDomainBuckets = make(map[string]*leaky.Bucket)
 var bucketLock = &sync.Mutex{}
+var lastCountBucketSweep = time.Now()
+
+// countBucketSweepInterval is how often drained URL preview buckets are removed. A drained bucket is the same as a
+// new one, so removing it doesn't change any limits, but stops the maps from growing with every user and domain seen.
+const countBucketSweepInterval = 5 * time.Minute
 
 func GetBucket(ctx rcontext.RequestContext, subject string) (*leaky.Bucket, error) {
 	if !config.Get().RateLimit.Enabled {
@@ -34,6 +44,68 @@ func GetBucket(ctx rcontext.RequestContext, subject string) (*leaky.Bucket, erro
 	return bucket, nil
 }
 
+// GetUrlPreviewUserBucket gets the bucket counting the URL previews generated for a user. Returns nil if the bucket
+// is disabled.
+func GetUrlPreviewUserBucket(ctx rcontext.RequestContext, userId string) (*leaky.Bucket, error) {
+	return getCountBucket(previewUserBuckets, userId, config.Get().RateLimit.Buckets.UrlPreviewUsers)
+}
+
+// GetUrlPreviewDomainBucket gets the bucket counting the URL previews generated for pages on the host's domain (see
+// UrlPreviewDomainKey). Returns nil if the bucket is disabled.
+func GetUrlPreviewDomainBucket(ctx rcontext.RequestContext, host string) (*leaky.Bucket, error) {
+	return getCountBucket(previewDomainBuckets, UrlPreviewDomainKey(host), config.Get().RateLimit.Buckets.UrlPreviewDomains)
+}
+
+// UrlPreviewDomainKey gets the domain the host is counted against for URL previews: its registrable domain (eTLD+1),
+// so subdomains can't be used to get around the limit. IP addresses and hosts without a registrable domain are
+// counted on their own.
+func UrlPreviewDomainKey(host string) string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	domain, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return host
+	}
+	return domain
+}
+
+func getCountBucket(subjectBuckets map[string]*leaky.Bucket, subject string, conf config.RateLimitCountBucketConfig) (*leaky.Bucket, error) {
+	if !config.Get().RateLimit.Enabled || conf.Capacity <= 0 || conf.DrainPerMinute <= 0 {
+		return nil, nil
+	}
+
+	bucketLock.Lock()
+	defer bucketLock.Unlock()
+
+	if time.Since(lastCountBucketSweep) >= countBucketSweepInterval {
+		sweepCountBuckets(previewUserBuckets)
+		sweepCountBuckets(previewDomainBuckets)
+		lastCountBucketSweep = time.Now()
+	}
+
+	bucket, ok := subjectBuckets[subject]
+	if !ok {
+		var err error
+		bucket, err = leaky.NewBucket(conf.DrainPerMinute, time.Minute, conf.Capacity)
+		if err != nil {
+			return nil, err
+		}
+		subjectBuckets[subject] = bucket
+	}
+
+	return bucket, nil
+}
+
+func sweepCountBuckets(subjectBuckets map[string]*leaky.Bucket) {
+	for subject, bucket := range subjectBuckets {
+		if bucket.Value() <= 0 {
+			delete(subjectBuckets, subject)
+		}
+	}
+}
+
 func ExpandBuckets() {
 	bucketLock.Lock()
 	defer bucketLock.Unlock()
@@ -42,4 +114,16 @@ func ExpandBuckets() {
 		bucket.Capacity = config.Get().RateLimit.Buckets.Downloads.CapacityBytes
 		bucket.DrainBy = config.Get().RateLimit.Buckets.Downloads.DrainBytesPerMinute
 	}
+	expandCountBuckets(previewUserBuckets, config.Get().RateLimit.Buckets.UrlPreviewUsers)
+	expandCountBuckets(previewDomainBuckets, config.Get().RateLimit.Buckets.UrlPreviewDomains)
+}
+
+func expandCountBuckets(subjectBuckets map[string]*leaky.Bucket, conf config.RateLimitCountBucketConfig) {
+	if conf.Capacity <= 0 || conf.DrainPerMinute <= 0 {
+		return // disabled, so the buckets won't be used
+	}
+	for _, bucket := range subjectBuckets {
+		bucket.Capacity = conf.Capacity
+		bucket.DrainBy = conf.DrainPerMinute
+	}
 }
@@ -1,54 +1,549 @@
 package matrix
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"net/url"
+	"sort"
 	"sync"
 	"time"
 
-	"github.com/rubyist/circuitbreaker"
+	"github.com/getsentry/sentry-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
 	"github.com/t2bot/matrix-media-repo/common/config"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/metrics"
+	"github.com/t2bot/matrix-media-repo/redislib"
 	"github.com/t2bot/matrix-media-repo/util"
 )
 
+const (
+	BreakerKindHomeserver = "homeserver"
+	BreakerKindFederation = "federation"
+)
+
+const (
+	BreakerStateClosed   = "closed"
+	BreakerStateHalfOpen = "half_open"
+	BreakerStateOpen     = "open"
+)
+
+var ErrBreakerOpen = errors.New("breaker open")
+var ErrBreakerTimeout = errors.New("breaker time out")
+var ErrBreakerNotFound = errors.New("breaker not found")
+
+const breakersNotifyRedisChannel = "mmr:breakers"
+const breakersRedisKeyPrefix = "mmr:breaker:"
+
+// How long an automatically tripped breaker's state is kept in Redis for workers which start later
+const breakerStateRetention = 24 * time.Hour
+
 var breakers = &sync.Map{}
 var federationBreakers = &sync.Map{}
+var breakersRedisChan <-chan string
+var breakersRedisLock = new(sync.Mutex)
+var breakersWorkerId string
+
+// breakerNotification is sent to other workers when a breaker changes state.
+type breakerNotification struct {
+	WorkerId string        `json:"worker_id"`
+	State    *BreakerState `json:"state"`
+}
+
+// BreakerState is a snapshot of a breaker, as shown to admins and shared with other workers.
+type BreakerState struct {
+	Kind          string `json:"kind"`
+	Name          string `json:"name"`
+	State         string `json:"state"`
+	Failures      int    `json:"failures"`
+	TrippedSince  int64  `json:"tripped_since_ts,omitempty"`
+	LastFailureTs int64  `json:"last_failure_ts,omitempty"`
+	LastError     string `json:"last_error,omitempty"`
+	Manual        bool   `json:"manual,omitempty"`
+}
+
+// breaker stops calls to a host after too many failures. Failures only count towards tripping the breaker if they
+// happen within the configured window of each other. Once tripped, a single trial call is allowed through after the
+// cooldown: if it succeeds the breaker is reset, otherwise the cooldown starts again. Breakers tripped by an admin
+// stay tripped until reset.
+type breaker struct {
+	kind      string
+	name      string
+	threshold int
+
+	mu           sync.Mutex
+	failures     int
+	trippedSince time.Time
+	lastFailure  time.Time
+	lastError    string
+	manual       bool
+	trial        bool
+
+	// metricState is the state counted in the breakers metric
+	metricState string
+}
+
+func newBreaker(kind string, name string, threshold int) *breaker {
+	b := &breaker{kind: kind, name: name, threshold: threshold}
+	subscribeRedisBreakers()
+	if state := loadRedisBreakerState(kind, name); state != nil {
+		b.applyState(state)
+	} else {
+		b.updateMetrics()
+	}
+	return b
+}
+
+func cooldown() time.Duration {
+	return time.Duration(config.Get().Federation.BreakerCooldownSeconds) * time.Second
+}
+
+func failureWindow() time.Duration {
+	return time.Duration(config.Get().Federation.BreakerWindowSeconds) * time.Second
+}
+
+// CallContext runs fn if the breaker allows it, recording the result. If fn takes longer than the timeout, the call
+// counts as a failure and ErrBreakerTimeout is returned. Calls cancelled by the context don't count as failures.
+func (b *breaker) CallContext(ctx context.Context, fn func() error, timeout time.Duration) error {
+	if !b.ready() {
+		return ErrBreakerOpen
+	}
+
+	var err error
+	if timeout == 0 {
+		err = fn()
+	} else {
+		ch := make(chan error, 1)
+		go func() {
+			ch <- fn()
+			close(ch)
+		}()
+		select {
+		case err = <-ch:
+		case <-time.After(timeout):
+			b.fail(ErrBreakerTimeout)
+			return ErrBreakerTimeout
+		}
+	}
+
+	if err != nil {
+		if errors.Is(ctx.Err(), context.Canceled) {
+			b.release()
+		} else {
+			b.fail(err)
+		}
+		return err
+	}
+	b.success()
+	return nil
+}
+
+func (b *breaker) ready() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.trippedSince.IsZero() {
+		return true
+	}
+	if b.manual || b.trial {
+		return false
+	}
+	if time.Since(b.trippedSince) >= cooldown() {
+		b.trial = true
+		b.updateMetricsLocked()
+		return true
+	}
+	return false
+}
+
+// release gives up a trial call without recording a result, letting the next call try instead.
+func (b *breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.trial {
+		b.trial = false
+		b.updateMetricsLocked()
+	}
+}
+
+func (b *breaker) fail(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if window := failureWindow(); window > 0 && !b.lastFailure.IsZero() && now.Sub(b.lastFailure) > window {
+		b.failures = 0
+	}
+	b.failures++
+	b.lastFailure = now
+	b.lastError = err.Error()
+
+	wasTrial := b.trial
+	b.trial = false
+	if wasTrial || (b.trippedSince.IsZero() && b.failures >= b.threshold) {
+		b.trippedSince = now
+		b.publishLocked()
+	}
+	b.updateMetricsLocked()
+}
+
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	wasTripped := !b.trippedSince.IsZero()
+	b.failures = 0
+	b.trippedSince = time.Time{}
+	b.trial = false
+	if wasTripped {
+		b.publishLocked()
+	}
+	b.updateMetricsLocked()
+}
+
+// Reset closes the breaker and clears its failures.
+func (b *breaker) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.trippedSince = time.Time{}
+	b.manual = false
+	b.trial = false
+	b.publishLocked()
+	b.updateMetricsLocked()
+}
+
+// Trip opens the breaker until it is reset.
+func (b *breaker) Trip() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trippedSince = time.Now()
+	b.manual = true
+	b.trial = false
+	b.lastError = "tripped by an administrator"
+	b.publishLocked()
+	b.updateMetricsLocked()
+}
+
+func (b *breaker) State() *BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stateLocked()
+}
+
+func (b *breaker) stateLocked() *BreakerState {
+	state := &BreakerState{
+		Kind:      b.kind,
+		Name:      b.name,
+		State:     BreakerStateClosed,
+		Failures:  b.failures,
+		LastError: b.lastError,
+		Manual:    b.manual,
+	}
+	if !b.lastFailure.IsZero() {
+		state.LastFailureTs = b.lastFailure.UnixMilli()
+	}
+	if !b.trippedSince.IsZero() {
+		state.TrippedSince = b.trippedSince.UnixMilli()
+		if !b.manual && (b.trial || time.Since(b.trippedSince) >= cooldown()) {
+			state.State = BreakerStateHalfOpen
+		} else {
+			state.State = BreakerStateOpen
+		}
+	}
+	return state
+}
+
+// applyState copies a state from another worker without sharing it again.
+func (b *breaker) applyState(state *BreakerState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = state.Failures
+	b.lastError = state.LastError
+	b.manual = state.Manual
+	b.trial = false
+	if state.TrippedSince > 0 {
+		b.trippedSince = time.UnixMilli(state.TrippedSince)
+	} else {
+		b.trippedSince = time.Time{}
+	}
+	if state.LastFailureTs > 0 {
+		b.lastFailure = time.UnixMilli(state.LastFailureTs)
+	}
+	b.updateMetricsLocked()
+}
 
-func getBreakerAndConfig(serverName string) (*config.DomainRepoConfig, *circuit.Breaker) {
+func (b *breaker) updateMetrics() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.updateMetricsLocked()
+}
+
+func (b *breaker) updateMetricsLocked() {
+	state := BreakerStateClosed
+	stateVal := float64(0)
+	if !b.trippedSince.IsZero() {
+		state = BreakerStateOpen
+		stateVal = 2
+		if b.trial {
+			state = BreakerStateHalfOpen
+			stateVal = 1
+		}
+	}
+	if state != b.metricState {
+		if b.metricState != "" {
+			metrics.Breakers.With(prometheus.Labels{"kind": b.kind, "state": b.metricState}).Dec()
+		}
+		metrics.Breakers.With(prometheus.Labels{"kind": b.kind, "state": state}).Inc()
+		b.metricState = state
+	}
+
+	// Any remote server can get a federation breaker, so only homeservers (which are configured) get their own series
+	if b.kind == BreakerKindHomeserver {
+		labels := prometheus.Labels{"kind": b.kind, "host": b.name}
+		metrics.BreakerState.With(labels).Set(stateVal)
+		metrics.BreakerFailures.With(labels).Set(float64(b.failures))
+	}
+}
+
+func (b *breaker) publishLocked() {
+	queueBreakerPublish(b.stateLocked())
+}
+
+// Breaker changes are shared by a single publisher in the order they happened, so an earlier state can't overwrite a
+// later one in Redis. Breakers hold their lock while queueing, so the queue doesn't block on Redis.
+var breakerPublishQueue = make([]*BreakerState, 0)
+var breakerPublishLock = new(sync.Mutex)
+var breakerPublishSignal = make(chan bool, 1)
+var breakerPublishOnce = new(sync.Once)
+
+func queueBreakerPublish(state *BreakerState) {
+	breakerPublishOnce.Do(func() {
+		go runBreakerPublisher()
+	})
+
+	breakerPublishLock.Lock()
+	breakerPublishQueue = append(breakerPublishQueue, state)
+	breakerPublishLock.Unlock()
+
+	select {
+	case breakerPublishSignal <- true:
+	default: // the publisher is already going to check the queue
+	}
+}
+
+func runBreakerPublisher() {
+	for range breakerPublishSignal {
+		for {
+			breakerPublishLock.Lock()
+			if len(breakerPublishQueue) == 0 {
+				breakerPublishLock.Unlock()
+				break
+			}
+			state := breakerPublishQueue[0]
+			breakerPublishQueue[0] = nil
+			breakerPublishQueue = breakerPublishQueue[1:]
+			breakerPublishLock.Unlock()
+
+			publishBreakerState(state)
+		}
+	}
+}
+
+func publishBreakerState(state *BreakerState) {
+	payload, err := json.Marshal(&breakerNotification{WorkerId: breakersWorkerId, State: state})
+	if err != nil {
+		logrus.Warn("Non-fatal error encoding breaker state: ", err)
+		return
+	}
+	ctx := rcontext.Initial()
+	if err = storeRedisBreakerState(ctx, state); err != nil {
+		logrus.Warn("Non-fatal error storing breaker state: ", err)
+		sentry.CaptureException(err)
+	}
+	if err = redislib.Publish(ctx, breakersNotifyRedisChannel, string(payload)); err != nil {
+		logrus.Warn("Non-fatal error sharing breaker state: ", err)
+		sentry.CaptureException(err)
+	}
+}
+
+func breakerRedisKey(kind string, name string) string {
+	return breakersRedisKeyPrefix + kind + ":" + name
+}
+
+// storeRedisBreakerState keeps the state of tripped breakers in Redis so workers which start later can pick it up.
+func storeRedisBreakerState(ctx rcontext.RequestContext, state *BreakerState) error {
+	key := breakerRedisKey(state.Kind, state.Name)
+	if state.State == BreakerStateClosed {
+		return redislib.DeleteValues(ctx, key)
+	}
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	retain := breakerStateRetention
+	if state.Manual {
+		retain = 0 // until reset
+	}
+	return redislib.SetValue(ctx, key, string(b), retain)
+}
+
+// loadRedisBreakerState returns the state of the breaker as last shared by any worker, or nil if unknown.
+func loadRedisBreakerState(kind string, name string) *BreakerState {
+	val, ok, err := redislib.GetValue(rcontext.Initial(), breakerRedisKey(kind, name))
+	if err != nil {
+		logrus.Warn("Non-fatal error loading breaker state: ", err)
+		sentry.CaptureException(err)
+		return nil
+	}
+	if !ok {
+		return nil
+	}
+	state := &BreakerState{}
+	if err = json.Unmarshal([]byte(val), state); err != nil {
+		logrus.Warn("Non-fatal error decoding breaker state: ", err)
+		return nil
+	}
+	return state
+}
+
+func subscribeRedisBreakers() {
+	breakersRedisLock.Lock()
+	defer breakersRedisLock.Unlock()
+
+	if breakersRedisChan != nil {
+		return
+	}
+
+	if breakersWorkerId == "" {
+		var err error
+		if breakersWorkerId, err = util.GenerateRandomString(16); err != nil {
+			logrus.Warn("Non-fatal error generating worker ID for breakers - not sharing breaker state: ", err)
+			sentry.CaptureException(err)
+			return
+		}
+	}
+
+	breakersRedisChan = redislib.Subscribe(breakersNotifyRedisChannel)
+	if breakersRedisChan == nil {
+		return // no redis to subscribe with
+	}
+	go func() {
+		for val := range breakersRedisChan {
+			notification := &breakerNotification{}
+			if err := json.Unmarshal([]byte(val), notification); err != nil || notification.State == nil {
+				logrus.Warn("Non-fatal error receiving from breakers notify channel: ", err)
+				continue
+			}
+			if notification.WorkerId == breakersWorkerId {
+				continue // our own change
+			}
+			if b, err := getBreaker(notification.State.Kind, notification.State.Name); err == nil {
+				b.applyState(notification.State)
+			}
+		}
+	}()
+}
+
+func getBreakerAndConfig(serverName string) (*config.DomainRepoConfig, *breaker) {
 	hs := config.GetDomain(serverName)
 
-	var cb *circuit.Breaker
+	var cb *breaker
 	cbRaw, hasCb := breakers.Load(hs.Name)
 	if !hasCb {
-		backoffAt := int64(hs.BackoffAt)
+		backoffAt := hs.BackoffAt
 		if backoffAt <= 0 {
 			backoffAt = 10 // default to 10 for those who don't have this set
 		}
-		cb = circuit.NewConsecutiveBreaker(backoffAt)
-		breakers.Store(hs.Name, cb)
-	} else {
-		cb = cbRaw.(*circuit.Breaker)
+		cbRaw, _ = breakers.LoadOrStore(hs.Name, newBreaker(BreakerKindHomeserver, hs.Name, backoffAt))
 	}
+	cb = cbRaw.(*breaker)
 
 	return hs, cb
 }
 
-func getFederationBreaker(hostname string) *circuit.Breaker {
-	var cb *circuit.Breaker
+func getFederationBreaker(hostname string) *breaker {
+	var cb *breaker
 	cbRaw, hasCb := federationBreakers.Load(hostname)
 	if !hasCb {
-		backoffAt := int64(config.Get().Federation.BackoffAt)
+		backoffAt := config.Get().Federation.BackoffAt
 		if backoffAt <= 0 {
 			backoffAt = 20 // default to 20 for those who don't have this set
 		}
-		cb = circuit.NewConsecutiveBreaker(backoffAt)
-		federationBreakers.Store(hostname, cb)
-	} else {
-		cb = cbRaw.(*circuit.Breaker)
+		cbRaw, _ = federationBreakers.LoadOrStore(hostname, newBreaker(BreakerKindFederation, hostname, backoffAt))
 	}
+	cb = cbRaw.(*breaker)
 	return cb
 }
 
+// getBreaker returns the breaker of the given kind for a homeserver name or federation host, creating it if needed.
+func getBreaker(kind string, name string) (*breaker, error) {
+	if kind == BreakerKindHomeserver {
+		if config.GetDomain(name) == nil {
+			return nil, ErrBreakerNotFound
+		}
+		_, cb := getBreakerAndConfig(name)
+		return cb, nil
+	} else if kind == BreakerKindFederation {
+		return getFederationBreaker(name), nil
+	}
+	return nil, ErrBreakerNotFound
+}
+
+// ResetBreaker closes the breaker and clears its failures, returning its new state.
+func ResetBreaker(kind string, name string) (*BreakerState, error) {
+	cb, err := getBreaker(kind, name)
+	if err != nil {
+		return nil, err
+	}
+	cb.Reset()
+	return cb.State(), nil
+}
+
+// TripBreaker opens the breaker until it is reset, returning its new state.
+func TripBreaker(kind string, name string) (*BreakerState, error) {
+	cb, err := getBreaker(kind, name)
+	if err != nil {
+		return nil, err
+	}
+	cb.Trip()
+	return cb.State(), nil
+}
+
+// CallBreaker runs fn through the breaker of the given kind for a homeserver name or federation host, the same way
+// requests made by the media repo are. See breaker.CallContext for how the result is recorded.
+func CallBreaker(ctx context.Context, kind string, name string, fn func() error, timeout time.Duration) error {
+	cb, err := getBreaker(kind, name)
+	if err != nil {
+		return err
+	}
+	return cb.CallContext(ctx, fn, timeout)
+}
+
+// ListBreakers returns the state of all known breakers, sorted by kind then name.
+func ListBreakers() []*BreakerState {
+	states := make([]*BreakerState, 0)
+	collect := func(key, value any) bool {
+		states = append(states, value.(*breaker).State())
+		return true
+	}
+	breakers.Range(collect)
+	federationBreakers.Range(collect)
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].Kind != states[j].Kind {
+			return states[i].Kind < states[j].Kind
+		}
+		return states[i].Name < states[j].Name
+	})
+	return states
+}
+
 func doBreakerRequest(ctx rcontext.RequestContext, serverName string, accessToken string, appserviceUserId string, ipAddr string, method string, path string, resp interface{}) error {
 	hs, cb := getBreakerAndConfig(serverName)
 
@@ -0,0 +1,68 @@
+package matrix
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/t2bot/matrix-media-repo/database"
+)
+
+// FederationMetadataKey is the key our media metadata is stored under in the JSON part of multipart federation media
+// responses. The rest of the object is reserved for the spec.
+const FederationMetadataKey = "io.t2bot.media"
+
+// FederationMediaMetadata describes the media part of a multipart federation media response. All fields are optional.
+type FederationMediaMetadata struct {
+	UploadName   string `json:"upload_name,omitempty"`
+	ContentType  string `json:"content_type,omitempty"`
+	Sha256       string `json:"sha256,omitempty"`
+	SizeBytes    *int64 `json:"size,omitempty"`
+	Quarantined  bool   `json:"quarantined,omitempty"`
+	RequiresAuth bool   `json:"requires_auth,omitempty"`
+
+	// Extras are informational only, like dimensions or duration.
+	Extras map[string]interface{} `json:"extras,omitempty"`
+}
+
+type federationMetadataEnvelope struct {
+	Media *FederationMediaMetadata `json:"io.t2bot.media,omitempty"`
+}
+
+// MakeFederationMetadata wraps the media metadata for use as the JSON part of a multipart federation media response.
+func MakeFederationMetadata(metadata *FederationMediaMetadata) (*database.AnonymousJson, error) {
+	val := &database.AnonymousJson{}
+	if err := val.ApplyFrom(federationMetadataEnvelope{Media: metadata}); err != nil {
+		return nil, err
+	}
+	return val, nil
+}
+
+// ParseFederationMetadata reads and validates our media metadata from the JSON part of a multipart federation media
+// response. Returns nil if the remote server didn't supply any.
+func ParseFederationMetadata(raw *database.AnonymousJson) (*FederationMediaMetadata, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	if _, ok := (*raw)[FederationMetadataKey]; !ok {
+		return nil, nil
+	}
+	envelope := &federationMetadataEnvelope{}
+	if err := raw.ApplyTo(envelope); err != nil {
+		return nil, errors.New("invalid media metadata: " + err.Error())
+	}
+	metadata := envelope.Media
+	if metadata == nil {
+		return nil, nil
+	}
+	if metadata.Sha256 != "" {
+		metadata.Sha256 = strings.ToLower(metadata.Sha256)
+		if b, err := hex.DecodeString(metadata.Sha256); err != nil || len(b) != 32 {
+			return nil, errors.New("invalid media metadata: sha256 is not a hex-encoded hash")
+		}
+	}
+	if metadata.SizeBytes != nil && *metadata.SizeBytes < 0 {
+		return nil, errors.New("invalid media metadata: negative size")
+	}
+	return metadata, nil
+}
@@ -164,7 +164,7 @@ func FederatedGet(ctx rcontext.RequestContext, reqUrl string, realHost string, d
 			}
 		}
 
-		client.Timeout = time.Duration(ctx.Config.TimeoutSeconds.UrlPreviews) * time.Second
+		client.Timeout = time.Duration(ctx.Config.TimeoutSeconds.Federation) * time.Second
 		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
 			if len(via) > 5 { // arbitrary
 				return errors.New("too many redirects")
@@ -28,6 +28,24 @@ var ThumbnailsGenerated = prometheus.NewCounterVec(prometheus.CounterOpts{
 var MediaDownloaded = prometheus.NewCounterVec(prometheus.CounterOpts{
 	Name: "media_downloaded_total",
 }, []string{"origin"})
+var RemoteThumbnailsRequested = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "media_remote_thumbnails_requested_total",
+}, []string{"origin"})
+var FederationMediaFetches = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "media_federation_fetches_total",
+}, []string{"origin", "fetch"})
+var QueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "media_queue_depth",
+}, []string{"queue", "priority"})
+var BreakerState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "media_breaker_state",
+}, []string{"kind", "host"})
+var BreakerFailures = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "media_breaker_failures",
+}, []string{"kind", "host"})
+var Breakers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "media_breakers",
+}, []string{"kind", "state"})
 var UrlPreviewsGenerated = prometheus.NewCounterVec(prometheus.CounterOpts{
 	Name: "media_url_previews_generated_total",
 }, []string{"type"})
@@ -50,6 +68,12 @@ func init() {
 	prometheus.MustRegister(CacheMisses)
 	prometheus.MustRegister(ThumbnailsGenerated)
 	prometheus.MustRegister(MediaDownloaded)
+	prometheus.MustRegister(RemoteThumbnailsRequested)
+	prometheus.MustRegister(FederationMediaFetches)
+	prometheus.MustRegister(QueueDepth)
+	prometheus.MustRegister(BreakerState)
+	prometheus.MustRegister(BreakerFailures)
+	prometheus.MustRegister(Breakers)
 	prometheus.MustRegister(UrlPreviewsGenerated)
 	prometheus.MustRegister(S3Operations)
 	prometheus.MustRegister(MediaAgeAccessed)
@@ -17,7 +17,8 @@ import (
 
 var srv *http.Server
 
-func internalHandler(res http.ResponseWriter, req *http.Request) {
+// Handler serves the metrics for Prometheus to scrape.
+func Handler(res http.ResponseWriter, req *http.Request) {
 	promhttp.Handler().ServeHTTP(res, req)
 }
 
@@ -27,8 +28,8 @@ func Init() {
 		return
 	}
 	rtr := http.NewServeMux()
-	rtr.HandleFunc("/metrics", internalHandler)
-	rtr.HandleFunc("/_media/metrics", internalHandler)
+	rtr.HandleFunc("/metrics", Handler)
+	rtr.HandleFunc("/_media/metrics", Handler)
 
 	address := net.JoinHostPort(config.Get().Metrics.BindAddress, strconv.Itoa(config.Get().Metrics.Port))
 	srv = &http.Server{Addr: address, Handler: rtr}
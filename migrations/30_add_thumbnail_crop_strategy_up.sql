@@ -0,0 +1,4 @@
+ALTER TABLE thumbnails ADD COLUMN IF NOT EXISTS crop_strategy TEXT NOT NULL DEFAULT '';
+UPDATE thumbnails SET crop_strategy = 'center' WHERE method = 'crop';
+DROP INDEX IF EXISTS thumbnails_index;
+CREATE UNIQUE INDEX IF NOT EXISTS thumbnails_index ON thumbnails (media_id, origin, width, height, method, animated, crop_strategy);
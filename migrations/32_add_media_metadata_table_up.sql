@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS media_metadata (
+	sha256_hash TEXT PRIMARY KEY NOT NULL,
+	width INT NOT NULL,
+	height INT NOT NULL,
+	duration_ms BIGINT NOT NULL,
+	num_channels INT NOT NULL,
+	num_total_samples INT NOT NULL,
+	key_samples JSON NOT NULL,
+	creation_ts BIGINT NOT NULL
+);
@@ -0,0 +1,4 @@
+DELETE FROM thumbnails WHERE animated = TRUE AND animated_format NOT IN ('', 'gif');
+DROP INDEX IF EXISTS thumbnails_index;
+CREATE UNIQUE INDEX IF NOT EXISTS thumbnails_index ON thumbnails (media_id, origin, width, height, method, animated, crop_strategy);
+ALTER TABLE thumbnails DROP COLUMN IF EXISTS animated_format;
@@ -0,0 +1,5 @@
+ALTER TABLE thumbnails ADD COLUMN IF NOT EXISTS animated_format TEXT NOT NULL DEFAULT '';
+UPDATE thumbnails SET animated_format = 'gif' WHERE animated = TRUE AND content_type = 'image/gif';
+UPDATE thumbnails SET animated_format = 'apng' WHERE animated = TRUE AND content_type = 'image/png';
+DROP INDEX IF EXISTS thumbnails_index;
+CREATE UNIQUE INDEX IF NOT EXISTS thumbnails_index ON thumbnails (media_id, origin, width, height, method, animated, crop_strategy, animated_format);
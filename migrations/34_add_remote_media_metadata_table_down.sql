@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS remote_media_metadata_index;
+DROP TABLE IF EXISTS remote_media_metadata;
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS remote_media_metadata (
+	origin TEXT NOT NULL,
+	media_id TEXT NOT NULL,
+	metadata JSON NOT NULL,
+	creation_ts BIGINT NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS remote_media_metadata_index ON remote_media_metadata (origin, media_id);
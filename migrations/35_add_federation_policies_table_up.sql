@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS federation_policies (
+	glob TEXT PRIMARY KEY NOT NULL,
+	fetch_policy TEXT NOT NULL,
+	serve_policy TEXT NOT NULL,
+	max_bytes BIGINT NOT NULL,
+	timeout_seconds INT NOT NULL,
+	never_cache BOOLEAN NOT NULL,
+	creation_ts BIGINT NOT NULL
+);
@@ -0,0 +1 @@
+ALTER TABLE url_previews ADD COLUMN extra JSON NOT NULL DEFAULT '{}';
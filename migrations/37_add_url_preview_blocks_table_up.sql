@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS url_preview_blocks (
+	url TEXT PRIMARY KEY NOT NULL,
+	reason TEXT NOT NULL,
+	creation_ts BIGINT NOT NULL
+);
@@ -0,0 +1 @@
+ALTER TABLE media_metadata DROP COLUMN extraction_failed;
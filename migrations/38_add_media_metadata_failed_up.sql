@@ -0,0 +1 @@
+ALTER TABLE media_metadata ADD COLUMN extraction_failed BOOLEAN NOT NULL DEFAULT FALSE;
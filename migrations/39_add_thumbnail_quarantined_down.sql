@@ -0,0 +1 @@
+ALTER TABLE thumbnails DROP COLUMN IF EXISTS quarantined;
@@ -0,0 +1 @@
+ALTER TABLE thumbnails ADD COLUMN IF NOT EXISTS quarantined BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,49 @@
+package datastore_op
+
+import (
+	"io"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_upload"
+	"github.com/t2bot/matrix-media-repo/util/readers"
+)
+
+// PutAndStream stores the input like PutAndReturnStream, but returns a stream of the input as it is read instead of
+// waiting for it to be stored. The stream only ends once the media has been stored: if storing fails, including when
+// the input is cut short, the stream returns the error instead and nothing is stored. Closing the stream early does
+// not stop the media from being stored: storing happens on a context detached from the caller's, which is also given
+// to done along with the result when storing finishes.
+func PutAndStream(ctx rcontext.RequestContext, origin string, mediaId string, input io.ReadCloser, contentType string, fileName string, kind datastores.Kind, done func(rcontext.RequestContext, *database.DbMedia, error)) (io.ReadCloser, error) {
+	// Spool alongside the datastore's other temporary files
+	dsConf, err := datastores.Pick(ctx, kind)
+	if err != nil {
+		_ = input.Close()
+		return nil, err
+	}
+	spoolPath, err := datastores.SpoolPath(dsConf)
+	if err != nil {
+		_ = input.Close()
+		return nil, err
+	}
+	spool, err := readers.NewSpool(spoolPath)
+	if err != nil {
+		_ = input.Close()
+		return nil, err
+	}
+
+	// The caller's context is cancelled when the stream is closed or the caller stops waiting for it
+	ctx = ctx.AsBackground()
+	go func() {
+		tee := io.TeeReader(input, spool)
+		m, err := pipeline_upload.Execute(ctx, origin, mediaId, io.NopCloser(tee), contentType, fileName, "", kind)
+		if closeErr := input.Close(); closeErr != nil {
+			ctx.Log.Warn("Non-fatal error closing remote stream: ", closeErr)
+		}
+		done(ctx, m, err)
+		spool.Finish(err)
+	}()
+
+	return spool, nil
+}
@@ -0,0 +1,103 @@
+package download
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/matrix"
+	"github.com/t2bot/matrix-media-repo/metrics"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+// readMultipartMedia reads the metadata and media parts of an authenticated (multipart/mixed) federation media
+// response, following the media part's Location header if the remote server redirected us.
+func readMultipartMedia(ctx rcontext.RequestContext, origin string, resp *http.Response) (*database.AnonymousJson, *util.MatrixMediaPart, error) {
+	contentType := resp.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "multipart/mixed;") {
+		return nil, nil, fmt.Errorf("expected multipart/mixed, got %s", contentType)
+	}
+
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	partReader := multipart.NewReader(resp.Body, params["boundary"])
+
+	// The first part should always be the metadata
+	metadata := &database.AnonymousJson{}
+	jsonPart, err := partReader.NextPart()
+	if err != nil {
+		return nil, nil, err
+	}
+	partType := jsonPart.Header.Get("Content-Type")
+	if partType == "" || partType == "application/json" {
+		decoder := json.NewDecoder(jsonPart)
+		err = decoder.Decode(&metadata)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		return nil, nil, fmt.Errorf("expected application/json as the first part, got %s instead", partType)
+	}
+
+	ctx.Log.Debugf("Got metadata: %v", metadata)
+
+	// The second part should always be the media itself
+	bodyPart, err := partReader.NextPart()
+	if err != nil {
+		return nil, nil, err
+	}
+	mediaPart := util.MatrixMediaPartFromMimeMultipart(bodyPart)
+
+	locationHeader := mediaPart.Header.Get("Location")
+	if locationHeader != "" {
+		// the media part body won't have anything for us - go `GET` the URL.
+		ctx.Log.Debugf("Redirecting to %s", locationHeader)
+
+		err = mediaPart.Body.Close()
+		if err != nil {
+			sentry.CaptureException(errors.Join(errors.New("non-fatal error closing redirected MSC3916 body"), err))
+			ctx.Log.Debug("Non-fatal error closing redirected MSC3916 body: ", err)
+		}
+
+		// We're done with the remote server's response too
+		if err = resp.Body.Close(); err != nil {
+			ctx.Log.Debug("Non-fatal error closing redirected MSC3916 response: ", err)
+		}
+
+		resp, err = FollowRedirect(ctx, locationHeader)
+		if err != nil {
+			return nil, nil, err
+		}
+		mediaPart = util.MatrixMediaPartFromResponse(resp)
+		metrics.FederationMediaFetches.With(prometheus.Labels{"origin": origin, "fetch": "redirected"}).Inc()
+	} else {
+		metrics.FederationMediaFetches.With(prometheus.Labels{"origin": origin, "fetch": "direct"}).Inc()
+	}
+
+	return metadata, mediaPart, nil
+}
+
+// isUnrecognizedEndpoint determines if a 404 response means the remote server doesn't support the endpoint, rather
+// than not having the media. The response body is consumed.
+func isUnrecognizedEndpoint(ctx rcontext.RequestContext, resp *http.Response) bool {
+	defer resp.Body.Close()
+	decoder := json.NewDecoder(resp.Body)
+	mxerr := &matrix.ErrorResponse{}
+	if err := decoder.Decode(&mxerr); err != nil {
+		// we probably got not-json - assume the endpoint is unknown
+		ctx.Log.Debugf("Ignoring JSON decoding error on download error %d: %v", resp.StatusCode, err)
+		return true
+	}
+	return mxerr.ErrorCode == "M_UNRECOGNIZED"
+}
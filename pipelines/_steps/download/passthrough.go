@@ -0,0 +1,44 @@
+package download
+
+import (
+	"io"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+// passthrough buffers downloaded media without storing it, for servers we're not supposed to cache media from. The
+// returned record does not exist in the database, and has no location in a datastore.
+func passthrough(ctx rcontext.RequestContext, origin string, mediaId string, res downloadResult) (*database.DbMedia, io.ReadCloser, error) {
+	dsConf, err := datastores.Pick(ctx, datastores.RemoteMediaKind)
+	if err != nil {
+		_ = res.r.Close()
+		return nil, nil, err
+	}
+
+	sha256hash, sizeBytes, r, err := datastores.BufferTemp(dsConf, res.r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	quarantined, err := database.GetInstance().Media.Prepare(ctx).IsHashQuarantined(sha256hash)
+	if err != nil {
+		_ = r.Close()
+		return nil, nil, err
+	}
+
+	return &database.DbMedia{
+		Locatable: &database.Locatable{
+			Sha256Hash: sha256hash,
+		},
+		Origin:      origin,
+		MediaId:     mediaId,
+		UploadName:  res.filename,
+		ContentType: res.contentType,
+		SizeBytes:   sizeBytes,
+		CreationTs:  util.NowMillis(),
+		Quarantined: quarantined,
+	}, r, nil
+}
@@ -0,0 +1,73 @@
+package download
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/url_previewing/u"
+	"github.com/t2bot/matrix-media-repo/util/readers"
+)
+
+var ErrTooManyRedirects = errors.New("too many redirects")
+
+// FollowRedirect downloads the media at a location given by a remote server, following further HTTP redirects up to
+// the configured limit. The location itself counts as the first redirect. Because the location can be anywhere, only
+// addresses permitted by the URL preview network settings are contacted.
+func FollowRedirect(ctx rcontext.RequestContext, location string) (*http.Response, error) {
+	maxRedirects := ctx.Config.Downloads.MaxRedirects
+	if maxRedirects <= 0 {
+		return nil, ErrTooManyRedirects
+	}
+
+	parsed, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Scheme != "https" && parsed.Scheme != "http" {
+		return nil, fmt.Errorf("unsupported redirect scheme '%s'", parsed.Scheme)
+	}
+
+	timeout := time.Duration(ctx.Config.TimeoutSeconds.Federation) * time.Second
+	client := &http.Client{
+		Transport: u.NewSafeTransport(ctx, timeout),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return ErrTooManyRedirects
+			}
+			ctx.Log.Debugf("Redirected to %s", req.URL.String())
+			return nil
+		},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, parsed.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, common.ErrMediaNotFound
+		}
+		return nil, fmt.Errorf("unexpected status code %d after redirect", resp.StatusCode)
+	}
+
+	// The limits applied to the remote server's response don't carry over to wherever we were sent
+	if ctx.Config.Downloads.MaxSizeBytes > 0 {
+		if resp.ContentLength > ctx.Config.Downloads.MaxSizeBytes {
+			_ = resp.Body.Close()
+			return nil, common.ErrMediaTooLarge
+		}
+		resp.Body = readers.LimitReaderWithOverrunError(resp.Body, ctx.Config.Downloads.MaxSizeBytes)
+	}
+
+	return resp, nil
+}
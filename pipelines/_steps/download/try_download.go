@@ -1,16 +1,13 @@
 package download
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"mime"
-	"mime/multipart"
 	"net/http"
 	"net/url"
 	"strconv"
-	"strings"
 
 	"github.com/getsentry/sentry-go"
 	"github.com/prometheus/client_golang/prometheus"
@@ -19,10 +16,12 @@ import (
 	"github.com/t2bot/matrix-media-repo/database"
 	"github.com/t2bot/matrix-media-repo/datastores"
 	"github.com/t2bot/matrix-media-repo/errcache"
+	"github.com/t2bot/matrix-media-repo/federation"
 	"github.com/t2bot/matrix-media-repo/matrix"
 	"github.com/t2bot/matrix-media-repo/metrics"
 	"github.com/t2bot/matrix-media-repo/pipelines/_steps/datastore_op"
 	"github.com/t2bot/matrix-media-repo/pool"
+	"github.com/t2bot/matrix-media-repo/restrictions"
 	"github.com/t2bot/matrix-media-repo/util"
 	"github.com/t2bot/matrix-media-repo/util/readers"
 )
@@ -30,27 +29,41 @@ import (
 type downloadResult struct {
 	r           io.ReadCloser
 	metadata    *database.AnonymousJson
+	fedMetadata *matrix.FederationMediaMetadata
 	filename    string
 	contentType string
+	sizeBytes   int64 // zero if unknown
 	err         error
 }
 
-func TryDownload(ctx rcontext.RequestContext, origin string, mediaId string) (*database.DbMedia, io.ReadCloser, error) {
+// TryDownload downloads and stores remote media. If stream is true and the media will be stored, the returned stream
+// reads the media as it arrives from the remote server rather than after it has been stored. The returned record is
+// then only a placeholder describing the media: it doesn't exist in the database yet, and has no hash or location.
+func TryDownload(ctx rcontext.RequestContext, origin string, mediaId string, stream bool) (*database.DbMedia, io.ReadCloser, error) {
 	if util.IsServerOurs(origin) {
 		return nil, nil, common.ErrMediaNotFound
 	}
 
+	policy, err := federation.GetPolicy(ctx, origin)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !policy.CanFetch() {
+		return nil, nil, common.ErrHostNotAllowed
+	}
+	ctx = federation.ApplyPolicy(ctx, policy)
+
 	ch := make(chan downloadResult)
 	defer close(ch)
 	fn := func() {
 		cacheKey := fmt.Sprintf("%s/%s", origin, mediaId)
-		if err := errcache.DownloadErrors.Get(cacheKey); err != nil {
+		if err := errcache.DownloadErrors.Get(ctx, cacheKey); err != nil {
 			ch <- downloadResult{err: err}
 			return
 		}
 
 		errFn := func(err error) {
-			errcache.DownloadErrors.Set(cacheKey, err)
+			errcache.DownloadErrors.Set(ctx, cacheKey, err)
 			ch <- downloadResult{err: err}
 		}
 
@@ -72,22 +85,16 @@ func TryDownload(ctx rcontext.RequestContext, origin string, mediaId string) (*d
 				return
 			}
 			if resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusUnauthorized {
-				errFn(matrix.MakeServerNotAllowedError(ctx.Request.Host))
+				serverName := ctx.Config.Name
+				if ctx.Request != nil {
+					serverName = ctx.Request.Host
+				}
+				errFn(matrix.MakeServerNotAllowedError(serverName))
 				return
 			} else if resp.StatusCode == http.StatusNotFound {
-				decoder := json.NewDecoder(resp.Body)
-				resp2 := resp // copy response in case we clear it out later
-				defer resp2.Body.Close()
-				mxerr := &matrix.ErrorResponse{}
-				if err = decoder.Decode(&mxerr); err != nil {
-					// we probably got not-json - ignore and move on
-					ctx.Log.Debugf("Ignoring JSON decoding error on download error %d: %v", resp.StatusCode, err)
+				if isUnrecognizedEndpoint(ctx, resp) {
+					ctx.Log.Debugf("Destination doesn't support MSC3916")
 					resp = nil // indicate we want to use fallback
-				} else {
-					if mxerr.ErrorCode == "M_UNRECOGNIZED" {
-						ctx.Log.Debugf("Destination doesn't support MSC3916")
-						resp = nil // indicate we want to use fallback
-					}
 				}
 			} else if resp.StatusCode == http.StatusOK {
 				usesMultipartFormat = true
@@ -136,70 +143,56 @@ func TryDownload(ctx rcontext.RequestContext, origin string, mediaId string) (*d
 
 		contentType := resp.Header.Get("Content-Type") // we default Content-Type after we inspect for multiparts
 
-		metadata := &database.AnonymousJson{}
+		var metadata *database.AnonymousJson
+		var fedMetadata *matrix.FederationMediaMetadata
 		mediaPart := util.MatrixMediaPartFromResponse(resp)
 		if usesMultipartFormat {
-			if !strings.HasPrefix(contentType, "multipart/mixed;") {
-				errFn(fmt.Errorf("expected multipart/mixed, got %s", contentType))
-				return
-			}
-
-			_, params, err := mime.ParseMediaType(contentType)
+			metadata, mediaPart, err = readMultipartMedia(ctx, origin, resp)
 			if err != nil {
 				errFn(err)
 				return
 			}
+			contentType = mediaPart.Header.Get("Content-Type") // Content-Type should really be the media content type
 
-			partReader := multipart.NewReader(resp.Body, params["boundary"])
-
-			// The first part should always be the metadata
-			jsonPart, err := partReader.NextPart()
+			fedMetadata, err = matrix.ParseFederationMetadata(metadata)
 			if err != nil {
+				_ = mediaPart.Body.Close()
 				errFn(err)
 				return
 			}
-			partType := jsonPart.Header.Get("Content-Type")
-			if partType == "" || partType == "application/json" {
-				decoder := json.NewDecoder(jsonPart)
-				err = decoder.Decode(&metadata)
-				if err != nil {
-					errFn(err)
-					return
-				}
-			} else {
-				errFn(fmt.Errorf("expected application/json as the first part, got %s instead", partType))
-			}
+		}
 
-			ctx.Log.Debugf("Got metadata: %v", metadata)
+		fileName := "download"
+		_, params, err := mime.ParseMediaType(mediaPart.Header.Get("Content-Disposition"))
+		if err == nil && params["filename"] != "" {
+			fileName = params["filename"]
+		}
 
-			// The second part should always be the media itself
-			bodyPart, err := partReader.NextPart()
-			if err != nil {
-				errFn(err)
+		if fedMetadata != nil {
+			if fedMetadata.Quarantined {
+				// Whatever we were sent is a placeholder for the real media
+				_ = mediaPart.Body.Close()
+				errFn(common.ErrMediaQuarantined)
+				return
+			}
+			if fedMetadata.SizeBytes != nil && ctx.Config.Downloads.MaxSizeBytes > 0 && *fedMetadata.SizeBytes > ctx.Config.Downloads.MaxSizeBytes {
+				_ = mediaPart.Body.Close()
+				errFn(common.ErrMediaTooLarge)
 				return
 			}
-			mediaPart = util.MatrixMediaPartFromMimeMultipart(bodyPart)
-			contentType = mediaPart.Header.Get("Content-Type") // Content-Type should really be the media content type
-
-			locationHeader := mediaPart.Header.Get("Location")
-			if locationHeader != "" {
-				// the media part body won't have anything for us - go `GET` the URL.
-				ctx.Log.Debugf("Redirecting to %s", locationHeader)
 
-				err = mediaPart.Body.Close()
-				if err != nil {
-					sentry.CaptureException(errors.Join(errors.New("non-fatal error closing redirected MSC3916 body"), err))
-					ctx.Log.Debug("Non-fatal error closing redirected MSC3916 body: ", err)
-				}
+			if contentType == "" {
+				contentType = fedMetadata.ContentType
+			}
+			if fileName == "download" && fedMetadata.UploadName != "" {
+				fileName = fedMetadata.UploadName
+			}
 
-				resp, err = http.DefaultClient.Get(locationHeader)
-				if err != nil {
-					errFn(err)
-					return
-				}
-				mediaPart = util.MatrixMediaPartFromResponse(resp)
-				contentType = mediaPart.Header.Get("Content-Type")
+			expectedSize := int64(-1)
+			if fedMetadata.SizeBytes != nil {
+				expectedSize = *fedMetadata.SizeBytes
 			}
+			mediaPart.Body = readers.NewVerifyingReader(mediaPart.Body, expectedSize, fedMetadata.Sha256)
 		}
 
 		// Default the Content-Type if we haven't already
@@ -207,21 +200,27 @@ func TryDownload(ctx rcontext.RequestContext, origin string, mediaId string) (*d
 			contentType = "application/octet-stream" // binary
 		}
 
-		fileName := "download"
-		_, params, err := mime.ParseMediaType(mediaPart.Header.Get("Content-Disposition"))
-		if err == nil && params["filename"] != "" {
-			fileName = params["filename"]
+		// The Content-Length of a multipart response includes the metadata, so we can only use the declared size
+		sizeBytes := int64(0)
+		if fedMetadata != nil && fedMetadata.SizeBytes != nil {
+			sizeBytes = *fedMetadata.SizeBytes
+		} else if !usesMultipartFormat && contentLength > 0 {
+			sizeBytes = contentLength
 		}
 
 		ch <- downloadResult{
 			r:           mediaPart.Body,
 			metadata:    metadata,
+			fedMetadata: fedMetadata,
 			filename:    fileName,
 			contentType: contentType,
+			sizeBytes:   sizeBytes,
 			err:         nil,
 		}
 	}
-	if err := pool.DownloadQueue.Schedule(fn); err != nil {
+	if err := pool.DownloadQueue.Schedule(pool.PriorityOf(ctx), fn, func(err error) {
+		ch <- downloadResult{err: err}
+	}); err != nil {
 		return nil, nil, err
 	}
 	res := <-ch
@@ -229,8 +228,88 @@ func TryDownload(ctx rcontext.RequestContext, origin string, mediaId string) (*d
 		return nil, nil, res.err
 	}
 
-	// At this point, res.r is our http response body.
-	// TODO: Do something with res.metadata (MSC3911)
+	// Restrictions apply to the media however we end up serving it, including when it isn't cached
+	if res.fedMetadata != nil {
+		applyRestrictions(ctx, origin, mediaId, res.fedMetadata)
+	}
+
+	// At this point, res.r is our http response body. If the remote server described the media, the stream will fail
+	// to be stored if it doesn't match.
+	if policy.NeverCache {
+		return passthrough(ctx, origin, mediaId, res)
+	}
+	if stream && ctx.Config.Downloads.StreamRemoteMedia {
+		return streamWhileStoring(ctx, origin, mediaId, res)
+	}
+
+	record, r, err := datastore_op.PutAndReturnStream(ctx, origin, mediaId, res.r, res.contentType, res.filename, datastores.RemoteMediaKind)
+	if err = finishDownload(ctx, origin, mediaId, res, err); err != nil {
+		return nil, nil, err
+	}
+	return record, r, nil
+}
+
+// streamWhileStoring stores the media in the background, returning a placeholder record and a stream of the media as
+// it arrives. If the media fails to store, the stream fails too.
+func streamWhileStoring(ctx rcontext.RequestContext, origin string, mediaId string, res downloadResult) (*database.DbMedia, io.ReadCloser, error) {
+	r, err := datastore_op.PutAndStream(ctx, origin, mediaId, res.r, res.contentType, res.filename, datastores.RemoteMediaKind, func(ctx rcontext.RequestContext, record *database.DbMedia, err error) {
+		if err = finishDownload(ctx, origin, mediaId, res, err); err != nil {
+			ctx.Log.Debug("Error storing streamed remote media: ", err)
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &database.DbMedia{
+		Locatable:   &database.Locatable{},
+		Origin:      origin,
+		MediaId:     mediaId,
+		UploadName:  res.filename,
+		ContentType: res.contentType,
+		SizeBytes:   res.sizeBytes,
+		CreationTs:  util.NowMillis(),
+	}, r, nil
+}
+
+// finishDownload handles the result of storing downloaded media, returning the error to pass on.
+func finishDownload(ctx rcontext.RequestContext, origin string, mediaId string, res downloadResult, err error) error {
+	if err != nil {
+		if errors.Is(err, common.ErrMediaMismatch) {
+			ctx.Log.Warn("Remote server sent media which does not match its metadata")
+			errcache.DownloadErrors.Set(ctx, fmt.Sprintf("%s/%s", origin, mediaId), err)
+		}
+		return err
+	}
+
+	if res.metadata != nil {
+		persistMetadata(ctx, origin, mediaId, res.metadata)
+	}
+	return nil
+}
 
-	return datastore_op.PutAndReturnStream(ctx, origin, mediaId, res.r, res.contentType, res.filename, datastores.RemoteMediaKind)
+// persistMetadata stores the metadata the remote server sent alongside the media. Errors are not fatal because we
+// already have the media.
+func persistMetadata(ctx rcontext.RequestContext, origin string, mediaId string, raw *database.AnonymousJson) {
+	err := database.GetInstance().RemoteMetadata.Prepare(ctx).Upsert(&database.DbRemoteMediaMetadata{
+		Origin:     origin,
+		MediaId:    mediaId,
+		Metadata:   raw,
+		CreationTs: util.NowMillis(),
+	})
+	if err != nil {
+		ctx.Log.Warn("Non-fatal error persisting remote media metadata: ", err)
+		sentry.CaptureException(err)
+	}
+}
+
+// applyRestrictions records the restrictions the remote server described for the media. Errors are not fatal, like
+// in persistMetadata.
+func applyRestrictions(ctx rcontext.RequestContext, origin string, mediaId string, fedMetadata *matrix.FederationMediaMetadata) {
+	if fedMetadata.RequiresAuth {
+		if err := restrictions.SetMediaRequiresAuth(ctx, origin, mediaId); err != nil {
+			ctx.Log.Warn("Non-fatal error restricting remote media: ", err)
+			sentry.CaptureException(err)
+		}
+	}
 }
@@ -0,0 +1,148 @@
+package download
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/errcache"
+	"github.com/t2bot/matrix-media-repo/federation"
+	"github.com/t2bot/matrix-media-repo/matrix"
+	"github.com/t2bot/matrix-media-repo/metrics"
+	"github.com/t2bot/matrix-media-repo/pool"
+	"github.com/t2bot/matrix-media-repo/util"
+	"github.com/t2bot/matrix-media-repo/util/readers"
+)
+
+var ErrThumbnailUnavailable = errors.New("remote server did not provide a thumbnail")
+
+// TryDownloadThumbnail asks the origin for a thumbnail of the media, without downloading the media itself. Returns
+// ErrThumbnailUnavailable if the origin can't provide one, in which case the caller should download the media and
+// thumbnail it instead. The caller is responsible for closing the returned stream.
+func TryDownloadThumbnail(ctx rcontext.RequestContext, origin string, mediaId string, width int, height int, method string, animated bool) (io.ReadCloser, string, error) {
+	if util.IsServerOurs(origin) {
+		return nil, "", common.ErrMediaNotFound
+	}
+
+	policy, err := federation.GetPolicy(ctx, origin)
+	if err != nil {
+		return nil, "", err
+	}
+	if !policy.CanFetch() {
+		return nil, "", common.ErrHostNotAllowed
+	}
+	ctx = federation.ApplyPolicy(ctx, policy)
+
+	ch := make(chan downloadResult)
+	defer close(ch)
+	fn := func() {
+		// If the media can't be downloaded then there's no point in asking for a thumbnail of it. We don't cache our
+		// own errors though: a missing thumbnail doesn't mean the media is missing.
+		cacheKey := fmt.Sprintf("%s/%s", origin, mediaId)
+		if err := errcache.DownloadErrors.Get(ctx, cacheKey); err != nil {
+			ch <- downloadResult{err: err}
+			return
+		}
+
+		baseUrl, realHost, err := matrix.GetServerApiUrl(origin)
+		if err != nil {
+			ch <- downloadResult{err: err}
+			return
+		}
+
+		query := url.Values{
+			"width":    []string{strconv.Itoa(width)},
+			"height":   []string{strconv.Itoa(height)},
+			"method":   []string{method},
+			"animated": []string{strconv.FormatBool(animated)},
+		}
+
+		var resp *http.Response
+		usesMultipartFormat := false
+		if ctx.Config.SigningKeyPath != "" {
+			thumbnailUrl := fmt.Sprintf("%s/_matrix/federation/v1/media/thumbnail/%s?%s", baseUrl, url.PathEscape(mediaId), query.Encode())
+			resp, err = matrix.FederatedGet(ctx, thumbnailUrl, realHost, origin, ctx.Config.SigningKeyPath)
+			metrics.RemoteThumbnailsRequested.With(prometheus.Labels{"origin": origin}).Inc()
+			if err != nil {
+				ch <- downloadResult{err: err}
+				return
+			}
+			if resp.StatusCode == http.StatusNotFound {
+				if isUnrecognizedEndpoint(ctx, resp) {
+					ctx.Log.Debugf("Destination doesn't support MSC3916 thumbnails")
+					resp = nil // indicate we want to use fallback
+				}
+			} else if resp.StatusCode == http.StatusOK {
+				usesMultipartFormat = true
+			}
+		}
+
+		// Try fallback (unauthenticated)
+		if resp == nil {
+			query.Set("allow_remote", "false")
+			query.Set("allow_redirect", "true")
+			thumbnailUrl := fmt.Sprintf("%s/_matrix/media/v3/thumbnail/%s/%s?%s", baseUrl, url.PathEscape(origin), url.PathEscape(mediaId), query.Encode())
+			resp, err = matrix.FederatedGet(ctx, thumbnailUrl, realHost, origin, matrix.NoSigningKey)
+			metrics.RemoteThumbnailsRequested.With(prometheus.Labels{"origin": origin}).Inc()
+			if err != nil {
+				ch <- downloadResult{err: err}
+				return
+			}
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			_ = resp.Body.Close()
+			ctx.Log.Debugf("Remote server responded with %d for thumbnail", resp.StatusCode)
+			ch <- downloadResult{err: ErrThumbnailUnavailable}
+			return
+		}
+
+		if ctx.Config.Downloads.MaxSizeBytes > 0 {
+			resp.Body = readers.LimitReaderWithOverrunError(resp.Body, ctx.Config.Downloads.MaxSizeBytes)
+		}
+
+		mediaPart := util.MatrixMediaPartFromResponse(resp)
+		if usesMultipartFormat {
+			_, mediaPart, err = readMultipartMedia(ctx, origin, resp)
+			if err != nil {
+				_ = resp.Body.Close()
+				ch <- downloadResult{err: err}
+				return
+			}
+		}
+
+		// Servers which can't thumbnail the media may return something else entirely, like the original media. We
+		// only want images.
+		contentType, _, err := mime.ParseMediaType(mediaPart.Header.Get("Content-Type"))
+		if err != nil || !strings.HasPrefix(contentType, "image/") {
+			_ = mediaPart.Body.Close()
+			_ = resp.Body.Close()
+			ctx.Log.Debugf("Remote server returned a thumbnail with unexpected content type '%s'", contentType)
+			ch <- downloadResult{err: ErrThumbnailUnavailable}
+			return
+		}
+
+		ch <- downloadResult{
+			r:           readers.NewCancelCloser(mediaPart.Body, func() { _ = resp.Body.Close() }),
+			contentType: contentType,
+		}
+	}
+	if err := pool.DownloadQueue.Schedule(pool.PriorityOf(ctx), fn, func(err error) {
+		ch <- downloadResult{err: err}
+	}); err != nil {
+		return nil, "", err
+	}
+	res := <-ch
+	if res.err != nil {
+		return nil, "", res.err
+	}
+	return res.r, res.contentType, nil
+}
@@ -0,0 +1,97 @@
+package metadata
+
+import (
+	"errors"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/pool"
+	"github.com/t2bot/matrix-media-repo/thumbnailing"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+// ErrExtractionFailed is returned when the media could be read, but its metadata could not be determined.
+var ErrExtractionFailed = errors.New("unable to extract media metadata")
+
+// Get returns the stored metadata for the media, or nil if it hasn't been extracted yet. Media which couldn't be parsed
+// has metadata with ExtractionFailed set.
+func Get(ctx rcontext.RequestContext, record *database.DbMedia) (*database.DbMediaMetadata, error) {
+	return database.GetInstance().MediaMetadata.Prepare(ctx).Get(record.Sha256Hash)
+}
+
+// GetOrExtract returns the stored metadata for the media, extracting it from the original if needed. Extraction is only
+// attempted once: later calls for media which couldn't be parsed return the failed metadata without an error.
+func GetOrExtract(ctx rcontext.RequestContext, record *database.DbMedia) (*database.DbMediaMetadata, error) {
+	existing, err := Get(ctx, record)
+	if err != nil || existing != nil {
+		return existing, err
+	}
+	return Extract(ctx, record)
+}
+
+// Extract reads the original media to determine its metadata, then stores it. If the media can't be parsed, the failure
+// is stored and ErrExtractionFailed is returned. Errors reading the media are not stored, so it can be tried again.
+func Extract(ctx rcontext.RequestContext, record *database.DbMedia) (*database.DbMediaMetadata, error) {
+	// Dev note: we use the datastore directly rather than the download step to avoid an import cycle with the
+	// upload pipeline. The cache is unlikely to be populated for freshly uploaded media anyways.
+	ds, ok := datastores.Get(ctx, record.DatastoreId)
+	if !ok {
+		return nil, errors.New("unable to locate datastore for media")
+	}
+	stream, err := datastores.Download(ctx, ds, record.Location)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	extracted, err := thumbnailing.ExtractMetadata(stream, util.FixContentType(record.ContentType), ctx)
+	if err != nil {
+		// Remember the failure so broken media isn't downloaded and parsed again every time it's looked at
+		failedRecord := &database.DbMediaMetadata{
+			Sha256Hash:       record.Sha256Hash,
+			KeySamples:       make([][2]float64, 0),
+			CreationTs:       util.NowMillis(),
+			ExtractionFailed: true,
+		}
+		if dbErr := database.GetInstance().MediaMetadata.Prepare(ctx).Upsert(failedRecord); dbErr != nil {
+			ctx.Log.Warn("Non-fatal error recording failed metadata extraction: ", dbErr)
+			sentry.CaptureException(dbErr)
+		}
+		return failedRecord, errors.Join(ErrExtractionFailed, err)
+	}
+
+	newRecord := &database.DbMediaMetadata{
+		Sha256Hash: record.Sha256Hash,
+		Width:      extracted.Width,
+		Height:     extracted.Height,
+		KeySamples: make([][2]float64, 0),
+		CreationTs: util.NowMillis(),
+	}
+	if extracted.Audio != nil {
+		newRecord.DurationMs = extracted.Audio.Duration.Milliseconds()
+		newRecord.NumChannels = extracted.Audio.Channels
+		newRecord.NumTotalSamples = extracted.Audio.TotalSamples
+		newRecord.KeySamples = extracted.Audio.KeySamples
+	}
+	if err = database.GetInstance().MediaMetadata.Prepare(ctx).Upsert(newRecord); err != nil {
+		return nil, err
+	}
+	return newRecord, nil
+}
+
+// ExtractAsync populates the metadata for the media in the background, if it isn't already known.
+func ExtractAsync(ctx rcontext.RequestContext, record *database.DbMedia) {
+	ctx = pool.WithPriority(ctx.AsBackground(), pool.PriorityBackground)
+	err := pool.ThumbnailQueue.Schedule(pool.PriorityOf(ctx), func() {
+		if _, err := GetOrExtract(ctx, record); err != nil {
+			ctx.Log.Warn("Non-fatal error extracting media metadata: ", err)
+			sentry.CaptureException(err)
+		}
+	}, nil)
+	if err != nil {
+		ctx.Log.Warn("Non-fatal error scheduling media metadata extraction: ", err)
+		sentry.CaptureException(err)
+	}
+}
@@ -0,0 +1,161 @@
+package thumbnails
+
+import (
+	"io"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/datastore_op"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/download"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/upload"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/u"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+// FetchRemote requests a thumbnail of remote media from its origin, storing it as a thumbnail record for the given
+// parameters. Returns download.ErrThumbnailUnavailable if the origin can't provide a thumbnail, and
+// common.ErrMediaQuarantined if the thumbnail matches quarantined media.
+func FetchRemote(ctx rcontext.RequestContext, origin string, mediaId string, width int, height int, method string, animated bool, cropStrategy string, animatedFormat string) (*database.DbThumbnail, io.ReadCloser, error) {
+	r, contentType, err := download.TryDownloadThumbnail(ctx, origin, mediaId, width, height, method, animated)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+
+	// Like generated thumbnails, background tasks don't have a request and store against the media's origin instead
+	host := origin
+	if ctx.Request != nil {
+		host = ctx.Request.Host
+	}
+	thumbMediaRecord, thumbStream, err := datastore_op.PutAndReturnStream(ctx, host, "", r, contentType, "", datastores.ThumbnailsKind)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The origin might not have returned the format we asked for, so record what it actually gave us. Requests for
+	// other formats find this record through FindRemote instead of asking the origin again.
+	animated, animatedFormat = RemoteAnimatedFormat(thumbMediaRecord.ContentType, animated)
+	thumbDb := database.GetInstance().Thumbnails.Prepare(ctx)
+	existing, err := thumbDb.GetByParams(origin, mediaId, width, height, method, animated, cropStrategy, animatedFormat)
+	if err != nil {
+		defer thumbStream.Close()
+		return nil, nil, err
+	}
+	if existing != nil {
+		// We raced another request, or the origin gave us the same thing for a different format
+		return existing, thumbStream, nil
+	}
+
+	newRecord := &database.DbThumbnail{
+		Origin:         origin,
+		MediaId:        mediaId,
+		ContentType:    thumbMediaRecord.ContentType,
+		Width:          width,
+		Height:         height,
+		Method:         method,
+		Animated:       animated,
+		CropStrategy:   cropStrategy,
+		AnimatedFormat: animatedFormat,
+		SizeBytes:      thumbMediaRecord.SizeBytes,
+		CreationTs:     thumbMediaRecord.CreationTs,
+		Locatable: &database.Locatable{
+			Sha256Hash:  thumbMediaRecord.Sha256Hash,
+			DatastoreId: thumbMediaRecord.DatastoreId,
+			Location:    thumbMediaRecord.Location,
+		},
+	}
+	if err = thumbDb.Insert(newRecord); err != nil {
+		defer thumbStream.Close()
+		return nil, nil, err
+	}
+
+	ctx.Log.Debugf("Stored %dx%d %s thumbnail from origin", width, height, method)
+	return newRecord, thumbStream, nil
+}
+
+// FetchRemoteWithoutStoring is like FetchRemote, but only buffers the thumbnail. The returned record does not exist in
+// the database, and has no location in a datastore.
+func FetchRemoteWithoutStoring(ctx rcontext.RequestContext, origin string, mediaId string, width int, height int, method string, animated bool, cropStrategy string, animatedFormat string) (*database.DbThumbnail, io.ReadCloser, error) {
+	r, contentType, err := download.TryDownloadThumbnail(ctx, origin, mediaId, width, height, method, animated)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dsConf, err := datastores.Pick(ctx, datastores.ThumbnailsKind)
+	if err != nil {
+		_ = r.Close()
+		return nil, nil, err
+	}
+	sha256hash, sizeBytes, thumbStream, err := datastores.BufferTemp(dsConf, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = upload.CheckQuarantineStatus(ctx, sha256hash); err != nil {
+		_ = thumbStream.Close()
+		return nil, nil, err
+	}
+
+	animated, animatedFormat = RemoteAnimatedFormat(contentType, animated)
+
+	return &database.DbThumbnail{
+		Origin:         origin,
+		MediaId:        mediaId,
+		ContentType:    contentType,
+		Width:          width,
+		Height:         height,
+		Method:         method,
+		Animated:       animated,
+		CropStrategy:   cropStrategy,
+		AnimatedFormat: animatedFormat,
+		SizeBytes:      sizeBytes,
+		CreationTs:     util.NowMillis(),
+		Locatable: &database.Locatable{
+			Sha256Hash: sha256hash,
+		},
+	}, thumbStream, nil
+}
+
+// FindRemote finds a thumbnail previously fetched from the origin for the given parameters. Animated requests accept
+// whichever format the origin returned, including static thumbnails if the origin didn't animate it.
+func FindRemote(ctx rcontext.RequestContext, origin string, mediaId string, width int, height int, method string, animated bool, cropStrategy string) (*database.DbThumbnail, error) {
+	thumbs, err := database.GetInstance().Thumbnails.Prepare(ctx).GetForMedia(origin, mediaId)
+	if err != nil {
+		return nil, err
+	}
+
+	var static *database.DbThumbnail
+	for _, t := range thumbs {
+		if t.Width != width || t.Height != height || t.Method != method || t.CropStrategy != cropStrategy {
+			continue
+		}
+		if t.Animated == animated {
+			return t, nil
+		}
+		if !t.Animated {
+			static = t
+		}
+	}
+	if animated {
+		return static, nil
+	}
+	return nil, nil
+}
+
+// RemoteAnimatedFormat determines the animated format of a thumbnail the origin returned from its content type. Only
+// animated requests can return animated thumbnails.
+func RemoteAnimatedFormat(contentType string, animated bool) (bool, string) {
+	if !animated {
+		return false, ""
+	}
+	switch contentType {
+	case "image/gif":
+		return true, u.AnimatedFormatGif
+	case "image/png", "image/apng":
+		return true, u.AnimatedFormatApng
+	case "image/webp":
+		return true, u.AnimatedFormatWebp
+	default:
+		return false, ""
+	}
+}
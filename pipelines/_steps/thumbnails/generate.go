@@ -14,6 +14,7 @@ import (
 	"github.com/t2bot/matrix-media-repo/metrics"
 	"github.com/t2bot/matrix-media-repo/pipelines/_steps/datastore_op"
 	"github.com/t2bot/matrix-media-repo/pipelines/_steps/download"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/metadata"
 	"github.com/t2bot/matrix-media-repo/pool"
 	"github.com/t2bot/matrix-media-repo/thumbnailing"
 	"github.com/t2bot/matrix-media-repo/thumbnailing/m"
@@ -25,26 +26,47 @@ type generateResult struct {
 	err error
 }
 
-func Generate(ctx rcontext.RequestContext, mediaRecord *database.DbMedia, width int, height int, method string, animated bool) (*database.DbThumbnail, io.ReadCloser, error) {
+func Generate(ctx rcontext.RequestContext, mediaRecord *database.DbMedia, width int, height int, method string, animated bool, cropStrategy string, animatedFormat string) (*database.DbThumbnail, io.ReadCloser, error) {
+	metric := metrics.ThumbnailsGenerated.With(prometheus.Labels{
+		"width":    strconv.Itoa(width),
+		"height":   strconv.Itoa(height),
+		"method":   method,
+		"animated": strconv.FormatBool(animated),
+		"origin":   mediaRecord.Origin,
+	})
+
+	// If we already know the media's dimensions then we can skip reading media we'd refuse to thumbnail
+	fixedContentType := util.FixContentType(mediaRecord.ContentType)
+	if mediaMetadata, err := metadata.Get(ctx, mediaRecord); err != nil {
+		ctx.Log.Warn("Non-fatal error getting media metadata: ", err)
+		sentry.CaptureException(err)
+	} else if mediaMetadata != nil && mediaMetadata.Width > 0 && mediaMetadata.Height > 0 {
+		err = thumbnailing.CanThumbnail(fixedContentType, mediaMetadata.Width, mediaMetadata.Height, width, height, method, animated, ctx)
+		if err != nil {
+			if errors.Is(err, common.ErrMediaDimensionsTooSmall) {
+				metric.Inc()
+			}
+			return nil, nil, err
+		}
+	}
+
+	// Large animations are expensive to thumbnail, so fall back to a still frame for them
+	generateAnimated := animated
+	if animated && ctx.Config.Thumbnails.MaxAnimateSizeBytes > 0 && mediaRecord.SizeBytes > ctx.Config.Thumbnails.MaxAnimateSizeBytes {
+		ctx.Log.Debug("Media is too large to animate - generating a static thumbnail")
+		generateAnimated = false
+	}
+
 	ch := make(chan generateResult)
 	defer close(ch)
 	fn := func() {
-		metric := metrics.ThumbnailsGenerated.With(prometheus.Labels{
-			"width":    strconv.Itoa(width),
-			"height":   strconv.Itoa(height),
-			"method":   method,
-			"animated": strconv.FormatBool(animated),
-			"origin":   mediaRecord.Origin,
-		})
-
 		mediaStream, err := download.OpenStream(ctx, mediaRecord.Locatable)
 		if err != nil {
 			ch <- generateResult{err: err}
 			return
 		}
-		fixedContentType := util.FixContentType(mediaRecord.ContentType)
 
-		i, err := thumbnailing.GenerateThumbnail(mediaStream, fixedContentType, width, height, method, animated, ctx)
+		i, err := thumbnailing.GenerateThumbnail(mediaStream, fixedContentType, width, height, method, generateAnimated, animatedFormat, ctx)
 		if err != nil {
 			if i != nil && i.Reader != nil {
 				err2 := i.Reader.Close()
@@ -63,7 +85,9 @@ func Generate(ctx rcontext.RequestContext, mediaRecord *database.DbMedia, width
 		ch <- generateResult{i: i}
 	}
 
-	if err := pool.ThumbnailQueue.Schedule(fn); err != nil {
+	if err := pool.ThumbnailQueue.Schedule(pool.PriorityOf(ctx), fn, func(err error) {
+		ch <- generateResult{err: err}
+	}); err != nil {
 		return nil, nil, err
 	}
 	res := <-ch
@@ -81,8 +105,12 @@ func Generate(ctx rcontext.RequestContext, mediaRecord *database.DbMedia, width
 	// what the thumbnailer will generate is non-trivial, but it might generate a conflicting thumbnail (particularly
 	// when `defaultAnimated` is `true`.
 	db := database.GetInstance().Thumbnails.Prepare(ctx)
+	generatedFormat := ""
+	if res.i.Animated {
+		generatedFormat = animatedFormat
+	}
 	if res.i.Animated != animated { // this is the only thing that could have changed during generation
-		existingRecord, err := db.GetByParams(mediaRecord.Origin, mediaRecord.MediaId, width, height, method, res.i.Animated)
+		existingRecord, err := db.GetByParams(mediaRecord.Origin, mediaRecord.MediaId, width, height, method, res.i.Animated, cropStrategy, generatedFormat)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -96,6 +124,7 @@ func Generate(ctx rcontext.RequestContext, mediaRecord *database.DbMedia, width
 			// image, which doesn't work.
 			if !res.i.Animated {
 				existingRecord.Animated = true
+				existingRecord.AnimatedFormat = animatedFormat
 				// we don't modify the creation time, so it expires at a sane point in history
 				err = db.Insert(existingRecord)
 				if err != nil {
@@ -112,23 +141,30 @@ func Generate(ctx rcontext.RequestContext, mediaRecord *database.DbMedia, width
 		}
 	}
 
-	// We don't have an existing record. Store the stream and insert a record.
-	thumbMediaRecord, thumbStream, err := datastore_op.PutAndReturnStream(ctx, ctx.Request.Host, "", res.i.Reader, res.i.ContentType, "", datastores.ThumbnailsKind)
+	// We don't have an existing record. Store the stream and insert a record. Background tasks don't have a
+	// request, so they store against the media's origin instead.
+	host := mediaRecord.Origin
+	if ctx.Request != nil {
+		host = ctx.Request.Host
+	}
+	thumbMediaRecord, thumbStream, err := datastore_op.PutAndReturnStream(ctx, host, "", res.i.Reader, res.i.ContentType, "", datastores.ThumbnailsKind)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	// Create a DbThumbnail
 	newRecord := &database.DbThumbnail{
-		Origin:      mediaRecord.Origin,
-		MediaId:     mediaRecord.MediaId,
-		ContentType: thumbMediaRecord.ContentType,
-		Width:       width,
-		Height:      height,
-		Method:      method,
-		Animated:    res.i.Animated,
-		SizeBytes:   thumbMediaRecord.SizeBytes,
-		CreationTs:  thumbMediaRecord.CreationTs,
+		Origin:         mediaRecord.Origin,
+		MediaId:        mediaRecord.MediaId,
+		ContentType:    thumbMediaRecord.ContentType,
+		Width:          width,
+		Height:         height,
+		Method:         method,
+		Animated:       res.i.Animated,
+		CropStrategy:   cropStrategy,
+		AnimatedFormat: generatedFormat,
+		SizeBytes:      thumbMediaRecord.SizeBytes,
+		CreationTs:     thumbMediaRecord.CreationTs,
 		Locatable: &database.Locatable{
 			Sha256Hash:  thumbMediaRecord.Sha256Hash,
 			DatastoreId: thumbMediaRecord.DatastoreId,
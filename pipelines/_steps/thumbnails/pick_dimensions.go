@@ -4,6 +4,7 @@ import (
 	"errors"
 
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/u"
 	"github.com/t2bot/matrix-media-repo/util"
 )
 
@@ -67,3 +68,10 @@ func PickNewDimensions(ctx rcontext.RequestContext, desiredWidth int, desiredHei
 
 	return targetWidth, targetHeight, desiredMethod, nil
 }
+
+func PickCropStrategy(ctx rcontext.RequestContext, method string) string {
+	if method != "crop" {
+		return ""
+	}
+	return u.NormalizeCropStrategy(ctx.Config.Thumbnails.CropStrategy)
+}
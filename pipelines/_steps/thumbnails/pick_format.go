@@ -0,0 +1,50 @@
+package thumbnails
+
+import (
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/u"
+)
+
+// PickAnimatedFormat returns the format animated thumbnails should use, given the client's Accept header. WebP and
+// APNG are only used when the client explicitly lists them, as wildcards are commonly sent by clients which can't
+// actually display them. Returns an empty string for static thumbnails.
+func PickAnimatedFormat(ctx rcontext.RequestContext, animated bool, accept string) string {
+	if !animated {
+		return ""
+	}
+
+	accepted := parseAccept(accept)
+	for _, format := range ctx.Config.Thumbnails.AnimatedFormats {
+		format = strings.ToLower(format)
+		if !u.IsAnimatedFormat(format) {
+			continue
+		}
+		if format == u.AnimatedFormatGif || accepted["image/"+format] {
+			return format
+		}
+	}
+
+	// GIF is supported everywhere, so use it even if not configured
+	return u.AnimatedFormatGif
+}
+
+func parseAccept(accept string) map[string]bool {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if q, ok := params["q"]; ok {
+			if val, err := strconv.ParseFloat(q, 64); err == nil && val <= 0 {
+				continue
+			}
+		}
+		accepted[mediaType] = true
+	}
+	return accepted
+}
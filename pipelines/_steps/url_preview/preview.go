@@ -45,7 +45,9 @@ func Preview(ctx rcontext.RequestContext, targetUrl *m.UrlPayload, languageHeade
 		}
 	}
 
-	if err := pool.UrlPreviewQueue.Schedule(fn); err != nil {
+	if err := pool.UrlPreviewQueue.Schedule(pool.PriorityOf(ctx), fn, func(err error) {
+		ch <- generateResult{err: err}
+	}); err != nil {
 		return m.PreviewResult{}, err
 	}
 	res := <-ch
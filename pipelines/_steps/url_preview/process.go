@@ -18,10 +18,8 @@ func Process(ctx rcontext.RequestContext, previewUrl string, preview m.PreviewRe
 			err = common.ErrMediaNotFound
 		}
 
-		if errors.Is(err, common.ErrMediaNotFound) {
-			previewDb.InsertError(previewUrl, common.ErrCodeNotFound)
-		} else {
-			previewDb.InsertError(previewUrl, common.ErrCodeUnknown)
+		if errCode := CachedErrorCode(err); errCode != "" {
+			previewDb.InsertError(previewUrl, languageHeader, errCode)
 		}
 		return nil, err
 	} else {
@@ -35,12 +33,32 @@ func Process(ctx rcontext.RequestContext, previewUrl string, preview m.PreviewRe
 			Description:    preview.Description,
 			Title:          preview.Title,
 			LanguageHeader: languageHeader,
+			Extra: &database.DbUrlPreviewExtra{
+				TwitterCard:    preview.TwitterCard,
+				TwitterSite:    preview.TwitterSite,
+				TwitterCreator: preview.TwitterCreator,
+				Author:         preview.Author,
+				PublishedTime:  preview.PublishedTime,
+				DurationMs:     preview.DurationMs,
+				Locale:         preview.Locale,
+			},
+		}
+		if preview.Video != nil {
+			result.Extra.VideoUrl = preview.Video.Url
+			result.Extra.VideoType = preview.Video.ContentType
+			result.Extra.VideoWidth = preview.Video.Width
+			result.Extra.VideoHeight = preview.Video.Height
+		}
+		if preview.Audio != nil {
+			result.Extra.AudioUrl = preview.Audio.Url
+			result.Extra.AudioType = preview.Audio.ContentType
 		}
 
-		// Step 7: Store the thumbnail, if needed
+		// Step 8: Store the thumbnail, if needed
 		UploadImage(ctx, preview.Image, onHost, userId, result)
+		UploadFavicon(ctx, preview.Favicon, onHost, userId, result)
 
-		// Step 8: Insert the record
+		// Step 9: Insert the record
 		err = previewDb.Insert(result)
 		if err != nil {
 			ctx.Log.Warn("Non-fatal error caching URL preview: ", err)
@@ -50,3 +68,16 @@ func Process(ctx rcontext.RequestContext, previewUrl string, preview m.PreviewRe
 		return result, nil
 	}
 }
+
+// CachedErrorCode returns the error code to cache a failed preview with, or an empty string if the failure may be
+// temporary and so shouldn't be cached.
+func CachedErrorCode(err error) string {
+	if errors.Is(err, m.ErrPreviewUnsupported) || errors.Is(err, common.ErrMediaNotFound) {
+		return common.ErrCodeNotFound
+	} else if errors.Is(err, common.ErrHostNotAllowed) {
+		return common.ErrCodeForbidden
+	} else if errors.Is(err, common.ErrInvalidHost) {
+		return common.ErrCodeInvalidHost
+	}
+	return ""
+}
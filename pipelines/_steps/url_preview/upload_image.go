@@ -2,8 +2,10 @@ package url_preview
 
 import (
 	"io"
+	"time"
 
 	"github.com/getsentry/sentry-go"
+	"github.com/patrickmn/go-cache"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/database"
 	"github.com/t2bot/matrix-media-repo/datastores"
@@ -59,6 +61,10 @@ func UploadImage(ctx rcontext.RequestContext, image *m.PreviewImage, onHost stri
 	if record == nil {
 		return
 	}
+	if w <= 0 || h <= 0 {
+		w = image.Width
+		h = image.Height
+	}
 
 	forRecord.ImageMxc = util.MxcUri(record.Origin, record.MediaId)
 	forRecord.ImageType = record.ContentType
@@ -66,3 +72,52 @@ func UploadImage(ctx rcontext.RequestContext, image *m.PreviewImage, onHost stri
 	forRecord.ImageWidth = w
 	forRecord.ImageHeight = h
 }
+
+type cachedFavicon struct {
+	mxc         string
+	contentType string
+}
+
+// Favicons stored for previews, by host and icon URL. Every page on a site tends to use the same icon, so this saves
+// storing (and charging the user for) the same icon for every preview.
+var faviconCache = cache.New(24*time.Hour, 1*time.Hour)
+
+// UploadFavicon stores the favicon for the preview, reusing the icon stored for an earlier preview if it was downloaded
+// from the same URL. Unlike UploadImage, the dimensions aren't recorded.
+func UploadFavicon(ctx rcontext.RequestContext, image *m.PreviewImage, onHost string, userId string, forRecord *database.DbUrlPreview) {
+	if image == nil || image.Data == nil {
+		return
+	}
+
+	defer image.Data.Close()
+	if forRecord.Extra == nil {
+		forRecord.Extra = &database.DbUrlPreviewExtra{}
+	}
+
+	cacheKey := ""
+	if image.Url != "" {
+		cacheKey = onHost + " " + image.Url
+		if val, ok := faviconCache.Get(cacheKey); ok {
+			favicon := val.(*cachedFavicon)
+			forRecord.Extra.FaviconMxc = favicon.mxc
+			forRecord.Extra.FaviconType = favicon.contentType
+			return
+		}
+	}
+
+	record, err := pipeline_upload.Execute(ctx, onHost, "", image.Data, image.ContentType, image.Filename, userId, datastores.LocalMediaKind)
+	if err != nil {
+		ctx.Log.Warn("Non-fatal error storing URL preview favicon: ", err)
+		sentry.CaptureException(err)
+		return
+	}
+
+	forRecord.Extra.FaviconMxc = util.MxcUri(record.Origin, record.MediaId)
+	forRecord.Extra.FaviconType = record.ContentType
+	if cacheKey != "" {
+		faviconCache.Set(cacheKey, &cachedFavicon{
+			mxc:         forRecord.Extra.FaviconMxc,
+			contentType: forRecord.Extra.FaviconType,
+		}, cache.DefaultExpiration)
+	}
+}
@@ -74,12 +74,16 @@ func Execute(ctx rcontext.RequestContext, origin string, mediaId string, opts Do
 		cancel()
 		return nil, nil, err
 	}
+	wasUnknown := record == nil
 
-	// Check rate limits before moving on much further
-	limitBucket, err := limits.GetBucket(ctx, limits.GetRequestIP(ctx.Request))
-	if err != nil {
-		cancel()
-		return nil, nil, err
+	// Check rate limits before moving on much further. Internal requests, like prefetching, aren't rate limited.
+	var limitBucket *leaky.Bucket
+	if ctx.Request != nil {
+		limitBucket, err = limits.GetBucket(ctx, limits.GetRequestIP(ctx.Request))
+		if err != nil {
+			cancel()
+			return nil, nil, err
+		}
 	}
 	didBucketMaxSize := false
 	if limitBucket != nil {
@@ -130,7 +134,14 @@ func Execute(ctx rcontext.RequestContext, origin string, mediaId string, opts Do
 		if !opts.FetchRemoteIfNeeded {
 			return nil, common.ErrMediaNotFound
 		}
-		record, r, err := download.TryDownload(ctx, origin, mediaId)
+		// The media might have been quarantined while we only had thumbnails of it from the origin
+		if quarantined, err := database.GetInstance().Thumbnails.Prepare(ctx).IsQuarantinedForMedia(origin, mediaId); err != nil {
+			return nil, err
+		} else if quarantined {
+			return quarantine.ReturnAppropriateThing(ctx, true, opts.RecordOnly, 512, 512)
+		}
+		// Callers which only want the record need to wait for the media to be stored anyway, so only stream otherwise
+		record, r, err := download.TryDownload(ctx, origin, mediaId, !opts.RecordOnly)
 		if err != nil {
 			return nil, err
 		}
@@ -138,7 +149,9 @@ func Execute(ctx rcontext.RequestContext, origin string, mediaId string, opts Do
 		if record.Quarantined {
 			return quarantine.ReturnAppropriateThing(ctx, true, opts.RecordOnly, 512, 512)
 		}
-		meta.FlagAccess(ctx, record.Sha256Hash, record.CreationTs)
+		if record.Sha256Hash != "" { // streamed media is flagged once it is stored
+			meta.FlagAccess(ctx, record.Sha256Hash, record.CreationTs)
+		}
 		if opts.RecordOnly {
 			r.Close()
 			return nil, nil
@@ -153,7 +166,7 @@ func Execute(ctx rcontext.RequestContext, origin string, mediaId string, opts Do
 	}
 	var notAllowedErr *matrix.ServerNotAllowedError
 	if errors.As(err, &notAllowedErr) {
-		if notAllowedErr.ServerName != ctx.Request.Host {
+		if ctx.Request != nil && notAllowedErr.ServerName != ctx.Request.Host {
 			ctx.Log.Debug("'Not allowed' error is for another server - retrying")
 			cancel()
 			return Execute(ctx, origin, mediaId, opts)
@@ -175,7 +188,16 @@ func Execute(ctx rcontext.RequestContext, origin string, mediaId string, opts Do
 			return nil, nil, errors.New("unexpected error: no viable record and no error condition")
 		}
 	}
-	if didBucketMaxSize && limitBucket != nil {
+	if didBucketMaxSize && limitBucket != nil && record.Sha256Hash == "" && record.SizeBytes <= 0 && r != nil {
+		// The media is being streamed without a known size, so the max size stays in the bucket until we know how
+		// much was actually read.
+		maxSize := ctx.Config.Downloads.MaxSizeBytes
+		r = readers.NewCountingCloser(r, func(read int64) {
+			if limitErr := limitBucket.Drain(maxSize - read); limitErr != nil {
+				ctx.Log.Warn("Non-fatal error restoring rate limit bucket: ", limitErr)
+			}
+		})
+	} else if didBucketMaxSize && limitBucket != nil {
 		// We need to restore the difference between max size and actual size to the caller's bucket.
 		// If for some reason the downloaded file is larger than the max size, the bucket will be added to instead.
 		// We should only get a limit error when the file is larger than the max size.
@@ -187,6 +209,20 @@ func Execute(ctx rcontext.RequestContext, origin string, mediaId string, opts Do
 			return nil, nil, limitErr
 		}
 	}
+	// Step 6: Media which was unknown in step 2 may have been downloaded with restrictions, so check again
+	if wasUnknown && !opts.AuthProvided {
+		if requiresAuth, err := restrictions.DoesMediaRequireAuth(ctx, origin, mediaId); err != nil || requiresAuth {
+			if r != nil {
+				r.Close()
+			}
+			cancel()
+			if err != nil {
+				return nil, nil, err
+			}
+			return nil, nil, common.ErrRestrictedAuth
+		}
+	}
+
 	if opts.RecordOnly {
 		if r != nil {
 			devErr := errors.New("expected no download stream, but got one anyways")
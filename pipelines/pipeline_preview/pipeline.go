@@ -5,11 +5,14 @@ import (
 	"fmt"
 	"net/url"
 
+	"github.com/t2bot/go-leaky-bucket"
 	"github.com/t2bot/matrix-media-repo/common"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/limits"
 	"github.com/t2bot/matrix-media-repo/pipelines/_steps/url_preview"
 	"github.com/t2bot/matrix-media-repo/url_previewing/m"
+	"github.com/t2bot/matrix-media-repo/url_previewing/u"
 	"github.com/t2bot/matrix-media-repo/util"
 	"golang.org/x/sync/singleflight"
 )
@@ -22,14 +25,37 @@ type PreviewOpts struct {
 }
 
 func Execute(ctx rcontext.RequestContext, onHost string, previewUrl string, userId string, opts PreviewOpts) (*database.DbUrlPreview, error) {
-	// Step 1: Check database cache
+	// Step 1: Process the URL. When enabled, the canonical URL is used for everything from here on, including caching.
 	previewDb := database.GetInstance().UrlPreviews.Prepare(ctx)
-	record, err := previewDb.Get(previewUrl, opts.Timestamp, opts.LanguageHeader)
+	parsedUrl, err := ParseUrl(ctx, previewUrl)
+	if err != nil {
+		previewDb.InsertError(previewUrl, opts.LanguageHeader, common.ErrCodeInvalidHost)
+		return nil, err
+	}
+	if ctx.Config.UrlPreviews.Canonicalization.Enabled {
+		previewUrl = parsedUrl.String()
+	}
+	parsedUrl.Fragment = "" // remove fragments because they're not useful to servers
+	parsedUrl.RawFragment = ""
+
+	// Step 2: Check that an admin hasn't blocked the URL. This is done before anything else so previews which were
+	// cached before the block (or under another form of the URL) are never served.
+	block, err := database.GetInstance().UrlBlocks.Prepare(ctx).Get(BlockKey(parsedUrl))
+	if err != nil {
+		return nil, err
+	}
+	if block != nil {
+		ctx.Log.Debugf("URL %s is blocked from previews: %s", BlockKey(parsedUrl), block.Reason)
+		return nil, common.ErrUrlNotAllowed
+	}
+
+	// Step 3: Check database cache
+	record, err := previewDb.Get(previewUrl, util.GetHourBucket(opts.Timestamp), opts.LanguageHeader)
 	if err != nil || record != nil {
 		return record, err
 	}
 
-	// Step 2: Fix timestamp bucket. If we're within 60 seconds of a bucket, just assume we're okay, so we don't
+	// Step 4: Fix timestamp bucket. If we're within 60 seconds of a bucket, just assume we're okay, so we don't
 	// infinitely recurse into ourselves.
 	now := util.NowMillis()
 	atBucket := util.GetHourBucket(opts.Timestamp) // we should only be using this for the remainder of the function
@@ -41,26 +67,63 @@ func Execute(ctx rcontext.RequestContext, onHost string, previewUrl string, user
 		})
 	}
 
-	// Step 3: Process the URL
-	parsedUrl, err := url.Parse(previewUrl)
-	if err != nil {
-		previewDb.InsertError(previewUrl, common.ErrCodeInvalidHost)
-		return nil, common.ErrInvalidHost
+	// Step 5: Check the domain rules before anything tries to resolve the host
+	if err = u.CheckDomainAllowed(parsedUrl.Hostname(), ctx); err != nil {
+		previewDb.InsertError(previewUrl, opts.LanguageHeader, common.ErrCodeForbidden)
+		return nil, err
+	}
+	if override := u.GetDomainOverride(parsedUrl.Hostname(), ctx); override != nil {
+		cfg := ctx.Config
+		if override.UserAgent != "" {
+			cfg.UrlPreviews.UserAgent = override.UserAgent
+		}
+		if override.TimeoutSeconds > 0 {
+			cfg.TimeoutSeconds.UrlPreviews = override.TimeoutSeconds
+		}
+		ctx = ctx.WithConfig(cfg)
 	}
-	parsedUrl.Fragment = "" // remove fragments because they're not useful to servers
 
-	// Step 4: Join the singleflight queue
+	// Step 6: Check the user's rate limit. Cached previews are served above without counting against it, and so are
+	// previews which were already being generated for someone else (see below).
+	var userBucket *leaky.Bucket
+	if userId != "" {
+		userBucket, err = limits.GetUrlPreviewUserBucket(ctx, userId)
+		if err != nil {
+			return nil, err
+		}
+		if err = addToBucket(ctx, userBucket); err != nil {
+			return nil, err
+		}
+	}
+
+	// Step 7: Join the singleflight queue
+	leader := false
 	r, err, _ := sf.Do(fmt.Sprintf("%s:%s_%d/%s", onHost, previewUrl, atBucket, opts.LanguageHeader), func() (interface{}, error) {
-		// Step 5: Generate preview
+		leader = true
+
+		// Check the domain's rate limit, counting each page fetched once no matter how many users asked for it
+		limitBucket, err := limits.GetUrlPreviewDomainBucket(ctx, parsedUrl.Hostname())
+		if err != nil {
+			return nil, err
+		}
+		if err = addToBucket(ctx, limitBucket); err != nil {
+			return nil, err
+		}
+
+		// Step 8: Generate preview
 		var preview m.PreviewResult
 		preview, err = url_preview.Preview(ctx, &m.UrlPayload{
 			UrlString: previewUrl,
 			ParsedUrl: parsedUrl,
 		}, opts.LanguageHeader)
 
-		// Step 6: Finish processing
+		// Step 9: Finish processing
 		return url_preview.Process(ctx, previewUrl, preview, err, onHost, userId, opts.LanguageHeader, atBucket)
 	})
+	if !leader && userBucket != nil {
+		// We only joined someone else's request, so we didn't cause a fetch: give the user their preview back
+		_ = userBucket.Drain(1)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -70,3 +133,39 @@ func Execute(ctx rcontext.RequestContext, onHost string, previewUrl string, user
 		return val, nil
 	}
 }
+
+// ParseUrl parses the URL to preview, canonicalizing it if enabled. The resulting string form is the URL used for
+// caching previews. See BlockKey for blocking.
+func ParseUrl(ctx rcontext.RequestContext, previewUrl string) (*url.URL, error) {
+	parsedUrl, err := url.Parse(previewUrl)
+	if err != nil {
+		return nil, common.ErrInvalidHost
+	}
+	if ctx.Config.UrlPreviews.Canonicalization.Enabled {
+		parsedUrl = u.Canonicalize(parsedUrl, ctx)
+	}
+	return parsedUrl, nil
+}
+
+// BlockKey gets the form of the URL which blocks are stored against: the parsed (and possibly canonicalized) URL
+// without its fragment.
+func BlockKey(parsedUrl *url.URL) string {
+	stripped := *parsedUrl
+	stripped.Fragment = ""
+	stripped.RawFragment = ""
+	return stripped.String()
+}
+
+func addToBucket(ctx rcontext.RequestContext, limitBucket *leaky.Bucket) error {
+	if limitBucket == nil {
+		return nil
+	}
+	if err := limitBucket.Add(1); err != nil {
+		if errors.Is(err, leaky.ErrBucketFull) {
+			ctx.Log.Debugf("Rate limited on URL previews (%d remaining)", limitBucket.Remaining())
+			return common.ErrRateLimitExceeded
+		}
+		return err
+	}
+	return nil
+}
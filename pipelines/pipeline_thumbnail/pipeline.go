@@ -12,12 +12,14 @@ import (
 	"github.com/t2bot/matrix-media-repo/common"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/federation"
 	"github.com/t2bot/matrix-media-repo/limits"
 	"github.com/t2bot/matrix-media-repo/pipelines/_steps/download"
 	"github.com/t2bot/matrix-media-repo/pipelines/_steps/quarantine"
 	"github.com/t2bot/matrix-media-repo/pipelines/_steps/thumbnails"
 	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_download"
 	"github.com/t2bot/matrix-media-repo/restrictions"
+	"github.com/t2bot/matrix-media-repo/util"
 	"github.com/t2bot/matrix-media-repo/util/readers"
 	"github.com/t2bot/matrix-media-repo/util/sfcache"
 )
@@ -36,10 +38,19 @@ type ThumbnailOpts struct {
 	Height   int
 	Method   string
 	Animated bool
+
+	// Accept is the client's Accept header, used to pick the format of animated thumbnails.
+	Accept string
+
+	// CropStrategy is populated by the pipeline from the domain's config.
+	CropStrategy string
+
+	// AnimatedFormat is populated by the pipeline from the domain's config and Accept header.
+	AnimatedFormat string
 }
 
 func (o ThumbnailOpts) String() string {
-	return fmt.Sprintf("%s,w=%d,h=%d,m=%s,a=%t", o.DownloadOpts.String(), o.Width, o.Height, o.Method, o.Animated)
+	return fmt.Sprintf("%s,w=%d,h=%d,m=%s,a=%t,c=%s,f=%s", o.DownloadOpts.String(), o.Width, o.Height, o.Method, o.Animated, o.CropStrategy, o.AnimatedFormat)
 }
 
 func (o ThumbnailOpts) ImpliedDownloadOpts() pipeline_download.DownloadOpts {
@@ -67,6 +78,9 @@ func Execute(ctx rcontext.RequestContext, origin string, mediaId string, opts Th
 	opts.Width = w
 	opts.Height = h
 	opts.Method = method
+	opts.CropStrategy = thumbnails.PickCropStrategy(ctx, method)
+	opts.Animated = opts.Animated && ctx.Config.Thumbnails.AllowAnimated
+	opts.AnimatedFormat = thumbnails.PickAnimatedFormat(ctx, opts.Animated, opts.Accept)
 
 	// Step 2: Make our context a timeout context
 	var cancel context.CancelFunc
@@ -77,7 +91,7 @@ func Execute(ctx rcontext.RequestContext, origin string, mediaId string, opts Th
 	sfKey := fmt.Sprintf("%s/%s?%s", origin, mediaId, opts.String())
 	fetchRecordFn := func() (*database.DbThumbnail, error) {
 		thumbDb := database.GetInstance().Thumbnails.Prepare(ctx)
-		return thumbDb.GetByParams(origin, mediaId, opts.Width, opts.Height, opts.Method, opts.Animated)
+		return thumbDb.GetByParams(origin, mediaId, opts.Width, opts.Height, opts.Method, opts.Animated, opts.CropStrategy, opts.AnimatedFormat)
 	}
 	record, err := recordSf.Do(sfKey, fetchRecordFn)
 	defer recordSf.ForgetCacheKey(sfKey)
@@ -104,7 +118,94 @@ func Execute(ctx rcontext.RequestContext, origin string, mediaId string, opts Th
 	}
 
 	r, err, _ := streamSf.Do(sfKey, func() (io.ReadCloser, error) {
-		// Step 4: Get the associated media record (without stream)
+		// Step 4: If we don't have the remote media, try to get a thumbnail from the origin instead of downloading
+		// the whole thing.
+		if opts.FetchRemoteIfNeeded && !util.IsServerOurs(origin) {
+			policy, err := federation.GetPolicy(ctx, origin)
+			if err != nil {
+				return nil, err
+			}
+			mediaRecord, err := database.GetInstance().Media.Prepare(ctx).GetById(origin, mediaId)
+			if err != nil {
+				return nil, err
+			}
+			if mediaRecord == nil {
+				// Thumbnails from the origin might be all we have of the media, so they carry its quarantine status
+				quarantined, err := database.GetInstance().Thumbnails.Prepare(ctx).IsQuarantinedForMedia(origin, mediaId)
+				if err != nil {
+					return nil, err
+				}
+				if quarantined {
+					recordSf.OverwriteCacheKey(sfKey, nil) // force record to be nil (not found)
+					return quarantine.ReturnAppropriateThing(ctx, false, opts.RecordOnly, opts.Width, opts.Height)
+				}
+			}
+			if mediaRecord == nil && record == nil && policy.NeverCache {
+				// We won't have the media to thumbnail, so the origin's thumbnail is the only option
+				if !ctx.Config.Downloads.FetchRemoteThumbnails {
+					return nil, common.ErrMediaNotFound
+				}
+				var r io.ReadCloser
+				record, r, err = thumbnails.FetchRemoteWithoutStoring(ctx, origin, mediaId, opts.Width, opts.Height, opts.Method, opts.Animated, opts.CropStrategy, opts.AnimatedFormat)
+				if err != nil {
+					if errors.Is(err, download.ErrThumbnailUnavailable) {
+						return nil, common.ErrMediaNotFound
+					}
+					if errors.Is(err, common.ErrMediaQuarantined) {
+						recordSf.OverwriteCacheKey(sfKey, nil) // force record to be nil (not found)
+						return quarantine.ReturnAppropriateThing(ctx, false, opts.RecordOnly, opts.Width, opts.Height)
+					}
+					return nil, err
+				}
+				recordSf.OverwriteCacheKey(sfKey, record)
+				if opts.RecordOnly {
+					defer r.Close()
+					return nil, nil
+				}
+				return r, nil
+			}
+			if mediaRecord == nil && ctx.Config.Downloads.FetchRemoteThumbnails {
+				if record == nil {
+					// The origin might have returned a different format than requested last time
+					record, err = thumbnails.FindRemote(ctx, origin, mediaId, opts.Width, opts.Height, opts.Method, opts.Animated, opts.CropStrategy)
+					if err != nil {
+						return nil, err
+					}
+					if record != nil {
+						recordSf.OverwriteCacheKey(sfKey, record)
+					}
+				}
+				if record == nil {
+					var r io.ReadCloser
+					record, r, err = thumbnails.FetchRemote(ctx, origin, mediaId, opts.Width, opts.Height, opts.Method, opts.Animated, opts.CropStrategy, opts.AnimatedFormat)
+					if err == nil {
+						recordSf.OverwriteCacheKey(sfKey, record)
+						if opts.RecordOnly {
+							defer r.Close()
+							return nil, nil
+						}
+						return r, nil
+					}
+					if errors.Is(err, common.ErrMediaQuarantined) {
+						recordSf.OverwriteCacheKey(sfKey, nil) // force record to be nil (not found)
+						return quarantine.ReturnAppropriateThing(ctx, false, opts.RecordOnly, opts.Width, opts.Height)
+					}
+					ctx.Log.Debug("Falling back to downloading remote media for thumbnail: ", err)
+				} else {
+					// We previously got this thumbnail from the origin
+					if opts.RecordOnly {
+						return nil, nil
+					}
+					if opts.CanRedirect {
+						return download.OpenOrRedirect(ctx, record.Locatable)
+					} else {
+						return download.OpenStream(ctx, record.Locatable)
+					}
+				}
+			}
+		}
+
+		// Step 5: Get the associated media record (without stream)
 		mediaRecord, dr, err := pipeline_download.Execute(ctx, origin, mediaId, opts.ImpliedDownloadOpts())
 		if dr != nil {
 			// Shouldn't be returned, but just in case...
@@ -121,7 +222,7 @@ func Execute(ctx rcontext.RequestContext, origin string, mediaId string, opts Th
 			return nil, common.ErrMediaNotFound
 		}
 
-		// Step 5: See if we're lucky enough to already have this thumbnail
+		// Step 6: See if we're lucky enough to already have this thumbnail
 		// Dev note: we already checked above, but there's a small chance we raced with another singleflight, so
 		// check again if the original record was nil
 		if record == nil {
@@ -141,8 +242,8 @@ func Execute(ctx rcontext.RequestContext, origin string, mediaId string, opts Th
 			}
 		}
 
-		// Step 6: Generate the thumbnail and return that
-		record, r, err := thumbnails.Generate(ctx, mediaRecord, opts.Width, opts.Height, opts.Method, opts.Animated)
+		// Step 7: Generate the thumbnail and return that
+		record, r, err := thumbnails.Generate(ctx, mediaRecord, opts.Width, opts.Height, opts.Method, opts.Animated, opts.CropStrategy, opts.AnimatedFormat)
 		if err != nil {
 			if !opts.RecordOnly && errors.Is(err, common.ErrMediaDimensionsTooSmall) {
 				var d io.ReadSeekCloser
@@ -165,7 +266,7 @@ func Execute(ctx rcontext.RequestContext, origin string, mediaId string, opts Th
 			return nil, nil
 		}
 
-		// Step 7: Return stream
+		// Step 8: Return stream
 		return r, nil
 	})
 	if errors.Is(err, common.ErrMediaQuarantined) || errors.Is(err, common.ErrMediaDimensionsTooSmall) {
@@ -173,7 +274,7 @@ func Execute(ctx rcontext.RequestContext, origin string, mediaId string, opts Th
 			return nil, readers.NewCancelCloser(r, cancel), err
 		}
 
-		if limitBucket != nil {
+		if limitBucket != nil && record != nil {
 			if limitErr := limitBucket.Drain(record.SizeBytes); limitErr != nil {
 				sentry.CaptureException(limitErr)
 				ctx.Log.Warn("Non-fatal error during bucket drain:", limitErr)
@@ -36,15 +36,15 @@ func Init() {
 }
 
 func AdjustSize() {
-	DownloadQueue.pool.Tune(config.Get().Downloads.NumWorkers)
-	ThumbnailQueue.pool.Tune(config.Get().Thumbnails.NumWorkers)
-	UrlPreviewQueue.pool.Tune(config.Get().UrlPreviews.NumWorkers)
-	TaskQueue.pool.Tune(config.Get().Tasks.NumWorkers)
+	DownloadQueue.tune(config.Get().Downloads.NumWorkers)
+	ThumbnailQueue.tune(config.Get().Thumbnails.NumWorkers)
+	UrlPreviewQueue.tune(config.Get().UrlPreviews.NumWorkers)
+	TaskQueue.tune(config.Get().Tasks.NumWorkers)
 }
 
 func Drain() {
-	DownloadQueue.pool.Release()
-	ThumbnailQueue.pool.Release()
-	UrlPreviewQueue.pool.Release()
-	TaskQueue.pool.Release()
+	DownloadQueue.Release()
+	ThumbnailQueue.Release()
+	UrlPreviewQueue.Release()
+	TaskQueue.Release()
 }
@@ -0,0 +1,57 @@
+package pool
+
+import (
+	"context"
+
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+// Priority decides how often work is picked from a queue compared to other work waiting in the same queue.
+type Priority int
+
+const (
+	// PriorityInteractive is for work a user is waiting on, like downloads and thumbnails. This is the default.
+	PriorityInteractive Priority = iota
+	// PriorityBackground is for work nobody is waiting on, like prefetching media or extracting metadata.
+	PriorityBackground
+	// PriorityBulk is for large amounts of work, like background tasks migrating or exporting media.
+	PriorityBulk
+
+	numPriorities = iota
+)
+
+// priorityWeights is how many tasks of each priority are run for every one bulk task, when all priorities have work
+// waiting. Lower priorities still get a share of the workers, so they can't be starved entirely.
+var priorityWeights = [numPriorities]int{
+	PriorityInteractive: 6,
+	PriorityBackground:  3,
+	PriorityBulk:        1,
+}
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityInteractive:
+		return "interactive"
+	case PriorityBackground:
+		return "background"
+	case PriorityBulk:
+		return "bulk"
+	default:
+		return "unknown"
+	}
+}
+
+// WithPriority returns a context which schedules its work with the given priority.
+func WithPriority(ctx rcontext.RequestContext, priority Priority) rcontext.RequestContext {
+	ctx.Context = context.WithValue(ctx.Context, common.ContextPriority, priority)
+	return ctx
+}
+
+// PriorityOf returns the priority to schedule the context's work with.
+func PriorityOf(ctx context.Context) Priority {
+	if p, ok := ctx.Value(common.ContextPriority).(Priority); ok && p >= 0 && p < numPriorities {
+		return p
+	}
+	return PriorityInteractive
+}
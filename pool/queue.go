@@ -1,16 +1,36 @@
 package pool
 
 import (
+	"sync"
 	"time"
 
 	"github.com/getsentry/sentry-go"
 	"github.com/panjf2000/ants/v2"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 	"github.com/t2bot/matrix-media-repo/common/logging"
+	"github.com/t2bot/matrix-media-repo/metrics"
 )
 
+// Queue runs tasks on a limited number of workers. Tasks waiting for a worker are picked by weighted round-robin
+// between priorities, so higher priority work goes first without lower priority work being starved.
 type Queue struct {
+	name string
 	pool *ants.Pool
+
+	mu      sync.Mutex
+	wake    *sync.Cond
+	pending [numPriorities][]queuedTask
+	current [numPriorities]int // smooth weighted round-robin state
+	running int                // tasks handed to a worker which haven't finished yet
+	closed  bool
+}
+
+// queuedTask is a task waiting for a worker. If the queue is released before the task runs, reject is called instead
+// (when set) so the caller isn't left waiting on a task which will never run.
+type queuedTask struct {
+	run    func()
+	reject func(err error)
 }
 
 func NewQueue(workers int, name string) (*Queue, error) {
@@ -33,9 +53,143 @@ func NewQueue(workers int, name string) (*Queue, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Queue{pool: p}, nil
+	q := &Queue{name: name, pool: p}
+	q.wake = sync.NewCond(&q.mu)
+	for i := Priority(0); i < numPriorities; i++ {
+		q.pending[i] = make([]queuedTask, 0)
+		q.updateMetricsLocked(i)
+	}
+	go q.dispatch()
+	return q, nil
+}
+
+// Schedule queues the task to be run with the given priority. If the queue is released before the task runs, rejected
+// is called with ants.ErrPoolClosed instead. rejected may be nil if nothing is waiting on the task.
+func (p *Queue) Schedule(priority Priority, task func(), rejected func(err error)) error {
+	if priority < 0 || priority >= numPriorities {
+		priority = PriorityInteractive
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ants.ErrPoolClosed
+	}
+	p.pending[priority] = append(p.pending[priority], queuedTask{run: task, reject: rejected})
+	p.updateMetricsLocked(priority)
+	p.wake.Signal()
+	return nil
+}
+
+// nextLocked picks the priority to run a task from, or -1 if nothing is waiting.
+func (p *Queue) nextLocked() Priority {
+	best := Priority(-1)
+	total := 0
+	for i := Priority(0); i < numPriorities; i++ {
+		if len(p.pending[i]) == 0 {
+			p.current[i] = 0
+			continue
+		}
+		p.current[i] += priorityWeights[i]
+		total += priorityWeights[i]
+		if best < 0 || p.current[i] > p.current[best] {
+			best = i
+		}
+	}
+	if best >= 0 {
+		p.current[best] -= total
+	}
+	return best
+}
+
+func (p *Queue) hasPendingLocked() bool {
+	for i := Priority(0); i < numPriorities; i++ {
+		if len(p.pending[i]) > 0 {
+			return true
+		}
+	}
+	return false
 }
 
-func (p *Queue) Schedule(task func()) error {
-	return p.pool.Submit(task)
+func (p *Queue) dispatch() {
+	for {
+		// Wait for a free worker before picking the task, so work scheduled in the meantime can still go first
+		p.mu.Lock()
+		for !p.closed && (p.running >= p.pool.Cap() || !p.hasPendingLocked()) {
+			p.wake.Wait()
+		}
+		if p.closed {
+			p.mu.Unlock()
+			return
+		}
+		priority := p.nextLocked()
+		task := p.pending[priority][0]
+		p.pending[priority] = p.pending[priority][1:]
+		p.updateMetricsLocked(priority)
+		p.running++
+		p.mu.Unlock()
+
+		if err := p.pool.Submit(func() {
+			defer p.finished()
+			task.run()
+		}); err != nil {
+			p.finished()
+			logrus.Warnf("Error submitting task to internal queue %s - rejecting task: %s", p.name, err)
+			if task.reject != nil {
+				go task.reject(err)
+			} else {
+				sentry.CaptureException(err)
+			}
+		}
+	}
+}
+
+// finished frees up the worker slot taken by a task.
+func (p *Queue) finished() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.running--
+	p.wake.Signal()
+}
+
+func (p *Queue) updateMetricsLocked(priority Priority) {
+	metrics.QueueDepth.With(prometheus.Labels{
+		"queue":    p.name,
+		"priority": priority.String(),
+	}).Set(float64(len(p.pending[priority])))
+}
+
+// Depth returns the number of tasks of the given priority waiting for a worker.
+func (p *Queue) Depth(priority Priority) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.pending[priority])
+}
+
+func (p *Queue) tune(workers int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pool.Tune(workers)
+	p.wake.Signal()
+}
+
+// Release stops the queue, rejecting tasks still waiting for a worker. This should only be done when shutting down.
+func (p *Queue) Release() {
+	p.mu.Lock()
+	p.closed = true
+	rejected := make([]queuedTask, 0)
+	for i := Priority(0); i < numPriorities; i++ {
+		rejected = append(rejected, p.pending[i]...)
+		p.pending[i] = make([]queuedTask, 0)
+		p.updateMetricsLocked(i)
+	}
+	p.wake.Broadcast()
+	p.mu.Unlock()
+
+	for _, task := range rejected {
+		if task.reject != nil {
+			go task.reject(ants.ErrPoolClosed) // the caller may not be ready to receive yet
+		}
+	}
+	p.pool.Release()
 }
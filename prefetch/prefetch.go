@@ -0,0 +1,164 @@
+package prefetch
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_download"
+	"github.com/t2bot/matrix-media-repo/pool"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+var ErrDisabled = errors.New("prefetching is disabled")
+
+// How long a single prefetch may take to download.
+const downloadTimeout = 10 * time.Minute
+
+type item struct {
+	origin  string
+	mediaId string
+
+	// The homeserver the media is being prefetched for, which decides the signing key used to download it.
+	serverName string
+}
+
+func (i item) key() string {
+	return fmt.Sprintf("%s/%s", i.origin, i.mediaId)
+}
+
+// Status describes the prefetch queue, as shown to admins.
+type Status struct {
+	Enabled   bool `json:"enabled"`
+	Queued    int  `json:"queued"`
+	Active    int  `json:"active"`
+	Completed int  `json:"completed"`
+	Failed    int  `json:"failed"`
+	Dropped   int  `json:"dropped"`
+}
+
+var lock = new(sync.Mutex)
+var wake = sync.NewCond(lock)
+var queue = make([]item, 0)
+var pending = make(map[string]bool)
+var status = Status{}
+var dispatcherStarted = false
+
+// Enqueue schedules the MXC URIs to be downloaded in the background, returning how many were queued. Media from our
+// own servers, duplicates, and invalid URIs are skipped. If the queue is full, the remaining URIs are dropped.
+func Enqueue(ctx rcontext.RequestContext, mxcs []string) (int, error) {
+	conf := config.Get().Downloads.Prefetch
+	if !conf.Enabled {
+		return 0, ErrDisabled
+	}
+	if err := conf.Validate(); err != nil {
+		// The config is validated when it's loaded, but treat anything which slipped through as disabled rather than
+		// queueing media that no worker will ever download.
+		ctx.Log.Warn("Not prefetching: ", err)
+		return 0, ErrDisabled
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	queued := 0
+	for _, mxc := range mxcs {
+		origin, mediaId, err := util.SplitMxc(mxc)
+		if err != nil || origin == "" || mediaId == "" {
+			ctx.Log.Debugf("Not prefetching invalid MXC URI '%s'", mxc)
+			continue
+		}
+		if util.IsServerOurs(origin) {
+			continue
+		}
+		i := item{origin: origin, mediaId: mediaId, serverName: ctx.Config.Name}
+		if pending[i.key()] {
+			continue
+		}
+		if len(queue) >= conf.MaxQueued {
+			status.Dropped++
+			continue
+		}
+		pending[i.key()] = true
+		queue = append(queue, i)
+		queued++
+	}
+
+	if queued > 0 {
+		if !dispatcherStarted {
+			dispatcherStarted = true
+			go dispatch()
+		}
+		wake.Broadcast()
+	}
+	return queued, nil
+}
+
+// GetStatus returns the current state of the prefetch queue.
+func GetStatus() Status {
+	lock.Lock()
+	defer lock.Unlock()
+	s := status
+	conf := config.Get().Downloads.Prefetch
+	s.Enabled = conf.Enabled && conf.Validate() == nil
+	s.Queued = len(queue)
+	return s
+}
+
+// dispatch runs the queued downloads, keeping to the prefetch worker limit. The downloads themselves are scheduled
+// below downloads for users.
+func dispatch() {
+	for {
+		lock.Lock()
+		for len(queue) == 0 || status.Active >= config.Get().Downloads.Prefetch.NumWorkers {
+			wake.Wait()
+		}
+		i := queue[0]
+		queue = queue[1:]
+		status.Active++
+		lock.Unlock()
+
+		go run(i)
+	}
+}
+
+func run(i item) {
+	ctx := rcontext.Initial().LogWithFields(logrus.Fields{
+		"prefetch_origin":   i.origin,
+		"prefetch_media_id": i.mediaId,
+	})
+	if conf := config.GetDomain(i.serverName); conf != nil {
+		ctx = ctx.WithConfig(*conf)
+	}
+	ctx = pool.WithPriority(ctx, pool.PriorityBackground)
+
+	_, _, err := pipeline_download.Execute(ctx, i.origin, i.mediaId, pipeline_download.DownloadOpts{
+		FetchRemoteIfNeeded: true,
+		BlockForReadUntil:   downloadTimeout,
+		RecordOnly:          true,
+		AuthProvided:        true,
+	})
+	if err != nil && !errors.Is(err, common.ErrMediaQuarantined) {
+		ctx.Log.Debug("Error prefetching remote media: ", err)
+		if !errors.Is(err, common.ErrMediaNotFound) && !errors.Is(err, common.ErrMediaTooLarge) && !errors.Is(err, common.ErrHostNotAllowed) {
+			sentry.CaptureException(err)
+		}
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	delete(pending, i.key())
+	status.Active--
+	if err != nil {
+		status.Failed++
+	} else {
+		status.Completed++
+	}
+	wake.Broadcast()
+}
@@ -0,0 +1,129 @@
+package redislib
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+// IsConnected returns true if Redis is configured.
+func IsConnected() bool {
+	makeConnection()
+	return ring != nil
+}
+
+// GetValue returns the value stored at the key, and whether it exists.
+func GetValue(ctx rcontext.RequestContext, key string) (string, bool, error) {
+	makeConnection()
+	if ring == nil {
+		return "", false, nil
+	}
+
+	val, err := ring.Get(ctx.Context, key).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	return val, true, nil
+}
+
+func SetValue(ctx rcontext.RequestContext, key string, value string, expiration time.Duration) error {
+	makeConnection()
+	if ring == nil {
+		return nil
+	}
+
+	return ring.Set(ctx.Context, key, value, expiration).Err()
+}
+
+func DeleteValues(ctx rcontext.RequestContext, keys ...string) error {
+	makeConnection()
+	if ring == nil || len(keys) == 0 {
+		return nil
+	}
+
+	// Keys may live on different shards, so delete them one at a time
+	for _, key := range keys {
+		if err := ring.Del(ctx.Context, key).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IncrementHashValue atomically adds to a number in a field of the hash at the key, returning the new number. The
+// expiration applies to the whole hash, and is set in the same transaction.
+func IncrementHashValue(ctx rcontext.RequestContext, key string, field string, by int64, expiration time.Duration) (int64, error) {
+	makeConnection()
+	if ring == nil {
+		return 0, nil
+	}
+
+	var incr *redis.IntCmd
+	_, err := ring.TxPipelined(ctx.Context, func(pipe redis.Pipeliner) error {
+		incr = pipe.HIncrBy(ctx.Context, key, field, by)
+		pipe.PExpire(ctx.Context, key, expiration)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return incr.Val(), nil
+}
+
+// SetHashValues sets fields of the hash at the key, leaving other fields alone. The expiration applies to the whole
+// hash, and is set in the same transaction.
+func SetHashValues(ctx rcontext.RequestContext, key string, values map[string]string, expiration time.Duration) error {
+	makeConnection()
+	if ring == nil {
+		return nil
+	}
+
+	_, err := ring.TxPipelined(ctx.Context, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx.Context, key, values)
+		pipe.PExpire(ctx.Context, key, expiration)
+		return nil
+	})
+	return err
+}
+
+// GetHashValues returns the fields of the hash stored at the key, and whether it exists.
+func GetHashValues(ctx rcontext.RequestContext, key string) (map[string]string, bool, error) {
+	makeConnection()
+	if ring == nil {
+		return nil, false, nil
+	}
+
+	val, err := ring.HGetAll(ctx.Context, key).Result()
+	if err != nil {
+		return nil, false, err
+	}
+	return val, len(val) > 0, nil
+}
+
+// ScanKeys returns the keys matching the glob-style pattern across all shards.
+func ScanKeys(ctx rcontext.RequestContext, pattern string) ([]string, error) {
+	makeConnection()
+	if ring == nil {
+		return nil, nil
+	}
+
+	keys := make([]string, 0)
+	keysLock := new(sync.Mutex)
+	err := ring.ForEachShard(ctx.Context, func(ctx2 context.Context, client *redis.Client) error {
+		iter := client.Scan(ctx2, 0, pattern, 100).Iterator()
+		for iter.Next(ctx2) {
+			keysLock.Lock()
+			keys = append(keys, iter.Val())
+			keysLock.Unlock()
+		}
+		return iter.Err()
+	})
+	return keys, err
+}
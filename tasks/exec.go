@@ -62,6 +62,7 @@ func beginTask(task *database.DbTask) {
 		return // just skip it
 	}
 	runnerCtx := rcontext.Initial().LogWithFields(logrus.Fields{"task_id": task.TaskId})
+	runnerCtx = pool.WithPriority(runnerCtx, pool.PriorityBulk)
 
 	oneHourAgo := util.NowMillis() - (60 * 60 * 1000)
 	if task.StartTs < oneHourAgo {
@@ -69,19 +70,23 @@ func beginTask(task *database.DbTask) {
 		return
 	}
 
-	if err := pool.TaskQueue.Schedule(func() {
+	if err := pool.TaskQueue.Schedule(pool.PriorityOf(runnerCtx), func() {
 		if task.Name == string(TaskDatastoreMigrate) {
 			task_runner.DatastoreMigrate(runnerCtx, task)
 		} else if task.Name == string(TaskExportData) {
 			task_runner.ExportData(runnerCtx, task)
 		} else if task.Name == string(TaskImportData) {
 			task_runner.ImportData(runnerCtx, task)
+		} else if task.Name == string(TaskRegenerateThumbs) {
+			task_runner.RegenerateThumbnails(runnerCtx, task)
+		} else if task.Name == string(TaskBackfillMetadata) {
+			task_runner.BackfillMetadata(runnerCtx, task)
 		} else {
 			m := fmt.Sprintf("Received unknown task to run %s (ID: %d)", task.Name, task.TaskId)
 			runnerCtx.Log.Warn(m)
 			sentry.CaptureMessage(m)
 		}
-	}); err != nil {
+	}, nil); err != nil {
 		m := fmt.Sprintf("Error trying to schedule task %s (ID: %d): %s", task.Name, task.TaskId, err.Error())
 		runnerCtx.Log.Warn(m)
 		sentry.CaptureMessage(m)
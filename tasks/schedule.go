@@ -22,6 +22,8 @@ const (
 	TaskDatastoreMigrate TaskName = "storage_migration"
 	TaskExportData       TaskName = "export_data"
 	TaskImportData       TaskName = "import_data"
+	TaskRegenerateThumbs TaskName = "regenerate_thumbnails"
+	TaskBackfillMetadata TaskName = "backfill_media_metadata"
 )
 const (
 	RecurringTaskPurgeThumbnails   RecurringTaskName = "recurring_purge_thumbnails"
@@ -172,3 +174,17 @@ func RunImport(ctx rcontext.RequestContext) (*database.DbTask, string, error) {
 	})
 	return task, importId, err
 }
+
+func RunThumbnailRegeneration(ctx rcontext.RequestContext, origin string, mediaId string, contentType string, regenerate bool, allSizes bool) (*database.DbTask, error) {
+	return scheduleTask(ctx, TaskRegenerateThumbs, task_runner.RegenerateThumbnailsParams{
+		Origin:      origin,
+		MediaId:     mediaId,
+		ContentType: contentType,
+		Regenerate:  regenerate,
+		AllSizes:    allSizes,
+	})
+}
+
+func RunMetadataBackfill(ctx rcontext.RequestContext) (*database.DbTask, error) {
+	return scheduleTask(ctx, TaskBackfillMetadata, struct{}{})
+}
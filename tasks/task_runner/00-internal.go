@@ -24,3 +24,17 @@ func markError(ctx rcontext.RequestContext, task *database.DbTask, errVal error)
 	}
 	ctx.Log.Debugf("Task '%s' flagged with error", task.Name)
 }
+
+func markProgress(ctx rcontext.RequestContext, task *database.DbTask, progress interface{}) {
+	jsonProgress := &database.AnonymousJson{}
+	if err := jsonProgress.ApplyFrom(progress); err != nil {
+		ctx.Log.Warn("Error encoding task progress: ", err)
+		sentry.CaptureException(err)
+		return
+	}
+	taskDb := database.GetInstance().Tasks.Prepare(ctx)
+	if err := taskDb.SetProgress(task.TaskId, jsonProgress); err != nil {
+		ctx.Log.Warn("Error updating task progress: ", err)
+		sentry.CaptureException(err)
+	}
+}
@@ -0,0 +1,55 @@
+package task_runner
+
+import (
+	"errors"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/metadata"
+)
+
+type BackfillMetadataProgress struct {
+	Processed int `json:"processed"`
+	Failed    int `json:"failed"`
+}
+
+// How many media records to load at once
+const backfillBatchSize = 100
+
+func BackfillMetadata(ctx rcontext.RequestContext, task *database.DbTask) {
+	defer markDone(ctx, task)
+
+	mediaDb := database.GetInstance().Media.Prepare(ctx)
+	progress := &BackfillMetadataProgress{}
+	markProgress(ctx, task, progress)
+
+	cursor := ""
+	for {
+		records, err := mediaDb.GetWithoutMetadata(cursor, backfillBatchSize)
+		if err != nil {
+			markError(ctx, task, errors.Join(errors.New("error in locate"), err))
+			ctx.Log.Error("Error getting media records: ", err)
+			sentry.CaptureException(err)
+			return
+		}
+		if len(records) == 0 {
+			break
+		}
+
+		for _, record := range records {
+			cursor = record.Sha256Hash
+			recordCtx := ctx.LogWithFields(logrus.Fields{"origin": record.Origin, "mediaId": record.MediaId})
+			if _, err = metadata.Extract(recordCtx, record); err != nil {
+				// Failures here are typically missing files - skip the media rather than fail the whole task
+				recordCtx.Log.Warn("Error extracting media metadata: ", err)
+				progress.Failed++
+			}
+			progress.Processed++
+		}
+		markProgress(ctx, task, progress)
+	}
+
+	markProgress(ctx, task, progress)
+}
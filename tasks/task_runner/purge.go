@@ -31,7 +31,7 @@ func (c *PurgeAuthContext) canAffect(media *database.DbMedia) bool {
 }
 
 func PurgeMedia(ctx rcontext.RequestContext, authContext *PurgeAuthContext, toHandle *QuarantineThis) ([]string, error) {
-	records, err := resolveMedia(ctx, "", toHandle)
+	records, _, err := resolveMedia(ctx, "", toHandle)
 	if err != nil {
 		return nil, err
 	}
@@ -21,7 +21,7 @@ type QuarantineThis struct {
 
 // QuarantineMedia returns (count quarantined, error)
 func QuarantineMedia(ctx rcontext.RequestContext, onlyHost string, toHandle *QuarantineThis) (int64, error) {
-	records, err := resolveMedia(ctx, onlyHost, toHandle) // records are roughly safe to rely on host-wise
+	records, missing, err := resolveMedia(ctx, onlyHost, toHandle) // records are roughly safe to rely on host-wise
 	if err != nil {
 		return 0, err
 	}
@@ -51,23 +51,52 @@ func QuarantineMedia(ctx rcontext.RequestContext, onlyHost string, toHandle *Qua
 		}
 	}
 
+	// We might only have thumbnails from the origin for remote media, which are quarantined on their own instead
+	thumbsDb := database.GetInstance().Thumbnails.Prepare(ctx)
+	for _, r := range missing {
+		count, err := thumbsDb.UpdateQuarantineForMedia(r.Origin, r.MediaId, true)
+		if err != nil {
+			return total, err
+		}
+		if count <= 0 {
+			continue
+		}
+		total++
+
+		thumbs, err := thumbsDb.GetForMedia(r.Origin, r.MediaId)
+		if err != nil {
+			return total, err
+		}
+		for _, t := range thumbs {
+			err = redislib.DeleteMedia(ctx, t.Sha256Hash)
+			if err != nil {
+				ctx.Log.Warn("Error while deleting cached thumbnail: ", err)
+				sentry.CaptureException(err)
+			}
+		}
+	}
+
 	return total, nil
 }
 
-func resolveMedia(ctx rcontext.RequestContext, onlyHost string, toHandle *QuarantineThis) ([]*database.DbMedia, error) {
+// resolveMedia returns the media records to handle, and the requested media we don't have a record of
+func resolveMedia(ctx rcontext.RequestContext, onlyHost string, toHandle *QuarantineThis) ([]*database.DbMedia, []*QuarantineRecord, error) {
 	db := database.GetInstance().Media.Prepare(ctx)
 
 	records := make([]*database.DbMedia, 0)
+	missing := make([]*QuarantineRecord, 0)
 	if toHandle.DbMedia != nil {
 		records = append(records, toHandle.DbMedia...)
 	}
 	if toHandle.Single != nil && (onlyHost == "" || toHandle.Single.Origin == onlyHost) {
 		r, err := db.GetById(toHandle.Single.Origin, toHandle.Single.MediaId)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		if r != nil {
 			records = append(records, r)
+		} else {
+			missing = append(missing, toHandle.Single)
 		}
 	}
 	if toHandle.MxcUris != nil {
@@ -77,17 +106,19 @@ func resolveMedia(ctx rcontext.RequestContext, onlyHost string, toHandle *Quaran
 				continue
 			}
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
 			r, err := db.GetById(origin, mediaId)
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
 			if r != nil {
 				records = append(records, r)
+			} else {
+				missing = append(missing, &QuarantineRecord{Origin: origin, MediaId: mediaId})
 			}
 		}
 	}
 
-	return records, nil
+	return records, missing, nil
 }
@@ -0,0 +1,266 @@
+package task_runner
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/ryanuber/go-glob"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/thumbnails"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/u"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+type RegenerateThumbnailsParams struct {
+	Origin      string `json:"origin,omitempty"`
+	MediaId     string `json:"media_id,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Regenerate  bool   `json:"regenerate"`
+	AllSizes    bool   `json:"all_sizes,omitempty"`
+}
+
+type RegenerateThumbnailsProgress struct {
+	TotalMedia          int `json:"total_media"`
+	CompletedMedia      int `json:"completed_media"`
+	ThumbnailsPurged    int `json:"thumbnails_purged"`
+	ThumbnailsGenerated int `json:"thumbnails_generated"`
+	ThumbnailsSkipped   int `json:"thumbnails_skipped"`
+	ThumbnailsFailed    int `json:"thumbnails_failed"`
+}
+
+// How many media items to process between progress updates
+const regenerateProgressInterval = 50
+
+func RegenerateThumbnails(ctx rcontext.RequestContext, task *database.DbTask) {
+	defer markDone(ctx, task)
+
+	params := RegenerateThumbnailsParams{}
+	if err := task.Params.ApplyTo(&params); err != nil {
+		markError(ctx, task, errors.Join(errors.New("error in decode"), err))
+		ctx.Log.Error("Error decoding params: ", err)
+		sentry.CaptureException(err)
+		return
+	}
+
+	mediaDb := database.GetInstance().Media.Prepare(ctx)
+	var records []*database.DbMedia
+	var err error
+	if params.Origin != "" && params.MediaId != "" {
+		var record *database.DbMedia
+		record, err = mediaDb.GetById(params.Origin, params.MediaId)
+		if record != nil && (params.ContentType == "" || glob.Glob(params.ContentType, record.ContentType)) {
+			records = []*database.DbMedia{record}
+		}
+	} else if params.Origin != "" {
+		records, err = mediaDb.GetByOriginWithThumbnails(params.Origin, params.ContentType)
+	} else {
+		records, err = mediaDb.GetWithThumbnails(params.ContentType)
+	}
+	if err != nil {
+		markError(ctx, task, errors.Join(errors.New("error in locate"), err))
+		ctx.Log.Error("Error getting media records: ", err)
+		sentry.CaptureException(err)
+		return
+	}
+
+	progress := &RegenerateThumbnailsProgress{TotalMedia: len(records)}
+	markProgress(ctx, task, progress)
+
+	for i, record := range records {
+		recordCtx := ctx.LogWithFields(logrus.Fields{"origin": record.Origin, "mediaId": record.MediaId})
+		purged, generated, skipped, failed := regenerateMediaThumbnails(recordCtx, record, params.Regenerate, params.AllSizes)
+		progress.ThumbnailsPurged += purged
+		progress.ThumbnailsGenerated += generated
+		progress.ThumbnailsSkipped += skipped
+		progress.ThumbnailsFailed += failed
+		progress.CompletedMedia = i + 1
+		if progress.CompletedMedia%regenerateProgressInterval == 0 {
+			markProgress(ctx, task, progress)
+		}
+	}
+
+	markProgress(ctx, task, progress)
+}
+
+// regenerateMediaThumbnails purges all thumbnails for the given media, optionally generating new ones in their place.
+// Returns (purged, generated, skipped, failed) counts.
+func regenerateMediaThumbnails(ctx rcontext.RequestContext, record *database.DbMedia, regenerate bool, allSizes bool) (int, int, int, int) {
+	thumbsDb := database.GetInstance().Thumbnails.Prepare(ctx)
+	mediaDb := database.GetInstance().Media.Prepare(ctx)
+
+	thumbs, err := thumbsDb.GetForMedia(record.Origin, record.MediaId)
+	if err != nil {
+		ctx.Log.Error("Error getting thumbnails for media: ", err)
+		sentry.CaptureException(err)
+		return 0, 0, 0, 0
+	}
+
+	purged := make([]*database.DbThumbnail, 0)
+	for _, thumb := range thumbs {
+		if err = thumbsDb.Delete(thumb); err != nil {
+			ctx.Log.Error("Error deleting thumbnail record: ", err)
+			sentry.CaptureException(err)
+			continue
+		}
+		purged = append(purged, thumb)
+	}
+
+	// Only remove the datastore object once nothing else references it
+	deletedLocations := make(map[string]bool)
+	for _, thumb := range purged {
+		locationId := fmt.Sprintf("%s/%s", thumb.DatastoreId, thumb.Location)
+		if _, ok := deletedLocations[locationId]; ok {
+			continue
+		}
+		if exists, err := mediaDb.LocationExists(thumb.DatastoreId, thumb.Location); err != nil {
+			ctx.Log.Error("Error checking for conflicting media: ", err)
+			sentry.CaptureException(err)
+			continue
+		} else if exists {
+			continue
+		}
+		if exists, err := thumbsDb.LocationExists(thumb.DatastoreId, thumb.Location); err != nil {
+			ctx.Log.Error("Error checking for conflicting thumbnails: ", err)
+			sentry.CaptureException(err)
+			continue
+		} else if exists {
+			continue
+		}
+		if err = datastores.RemoveWithDsId(ctx, thumb.DatastoreId, thumb.Location); err != nil {
+			ctx.Log.Error("Error deleting thumbnail from datastore: ", err)
+			sentry.CaptureException(err)
+			continue
+		}
+		deletedLocations[locationId] = true
+	}
+
+	if !regenerate || record.Quarantined {
+		return len(purged), 0, 0, 0
+	}
+
+	// Thumbnails for local media use the owning domain's config, like they would when requested by a client
+	if util.IsServerOurs(record.Origin) {
+		if dc := config.GetDomain(record.Origin); dc != nil {
+			ctx = ctx.WithConfig(*dc)
+		}
+	}
+
+	generated := 0
+	skipped := 0
+	failed := 0
+	for _, target := range PickRegenerateTargets(ctx, purged, allSizes) {
+		cropStrategy := thumbnails.PickCropStrategy(ctx, target.Method)
+		newThumb, stream, err := thumbnails.Generate(ctx, record, target.Width, target.Height, target.Method, target.Animated, cropStrategy, target.AnimatedFormat)
+		if errors.Is(err, common.ErrMediaDimensionsTooSmall) {
+			// Clients get the original media for this size, so there's nothing to regenerate
+			skipped++
+			continue
+		}
+		if err != nil {
+			ctx.Log.Warnf("Error regenerating %dx%d %s thumbnail: %s", target.Width, target.Height, target.Method, err)
+			failed++
+			continue
+		}
+		if err = stream.Close(); err != nil {
+			ctx.Log.Warn("Non-fatal error closing thumbnail stream: ", err)
+		}
+		ctx.Log.Debugf("Regenerated %dx%d %s thumbnail", newThumb.Width, newThumb.Height, newThumb.Method)
+		generated++
+	}
+
+	return len(purged), generated, skipped, failed
+}
+
+type RegenerateTarget struct {
+	Width          int
+	Height         int
+	Method         string
+	Animated       bool
+	AnimatedFormat string
+}
+
+// PickRegenerateTargets determines which thumbnails to generate in place of the purged ones. Each purged thumbnail is
+// replaced by the size a client asking for it would now get, so sizes which are no longer configured move to the
+// nearest configured size. If allSizes is set, every configured size is generated with both methods instead. The
+// animation variants which previously existed are kept if still allowed.
+func PickRegenerateTargets(ctx rcontext.RequestContext, purged []*database.DbThumbnail, allSizes bool) []RegenerateTarget {
+	type variant struct {
+		animated bool
+		format   string
+	}
+	variantOf := func(thumb *database.DbThumbnail) variant {
+		v := variant{animated: thumb.Animated && ctx.Config.Thumbnails.AllowAnimated}
+		if v.animated {
+			v.format = thumb.AnimatedFormat
+			if !isConfiguredAnimatedFormat(ctx, v.format) {
+				v.format = thumbnails.PickAnimatedFormat(ctx, true, "")
+			}
+		}
+		return v
+	}
+
+	targets := make([]RegenerateTarget, 0)
+	seen := make(map[RegenerateTarget]bool)
+	add := func(desiredWidth int, desiredHeight int, desiredMethod string, v variant) {
+		width, height, method, err := thumbnails.PickNewDimensions(ctx, desiredWidth, desiredHeight, desiredMethod)
+		if err != nil {
+			ctx.Log.Warnf("Skipping invalid thumbnail size %dx%d: %s", desiredWidth, desiredHeight, err)
+			return
+		}
+		target := RegenerateTarget{
+			Width:          width,
+			Height:         height,
+			Method:         method,
+			Animated:       v.animated,
+			AnimatedFormat: v.format,
+		}
+		if !seen[target] {
+			seen[target] = true
+			targets = append(targets, target)
+		}
+	}
+
+	if !allSizes {
+		for _, thumb := range purged {
+			add(thumb.Width, thumb.Height, thumb.Method, variantOf(thumb))
+		}
+		return targets
+	}
+
+	variants := make([]variant, 0)
+	seenVariants := make(map[variant]bool)
+	for _, thumb := range purged {
+		v := variantOf(thumb)
+		if !seenVariants[v] {
+			seenVariants[v] = true
+			variants = append(variants, v)
+		}
+	}
+	for _, size := range ctx.Config.Thumbnails.Sizes {
+		for _, method := range []string{"crop", "scale"} {
+			for _, v := range variants {
+				add(size.Width, size.Height, method, v)
+			}
+		}
+	}
+	return targets
+}
+
+func isConfiguredAnimatedFormat(ctx rcontext.RequestContext, format string) bool {
+	if format == u.AnimatedFormatGif {
+		return true
+	}
+	for _, f := range ctx.Config.Thumbnails.AnimatedFormats {
+		if strings.EqualFold(f, format) {
+			return true
+		}
+	}
+	return false
+}
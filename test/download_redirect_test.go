@@ -0,0 +1,147 @@
+package test
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/download"
+	"github.com/t2bot/matrix-media-repo/url_previewing/u"
+)
+
+func makeRedirectContext(maxRedirects int) rcontext.RequestContext {
+	ctx := rcontext.InitialNoConfig()
+	ctx.Config.Downloads.MaxRedirects = maxRedirects
+	ctx.Config.Downloads.MaxSizeBytes = 1024
+	ctx.Config.TimeoutSeconds.Federation = 5
+	ctx.Config.UrlPreviews.AllowedNetworks = []string{"127.0.0.1/32"}
+	ctx.Config.UrlPreviews.DisallowedNetworks = []string{}
+	return ctx
+}
+
+func TestFollowRedirect(t *testing.T) {
+	// The media server sits on another port, making it a different origin to the redirecting server
+	media := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/media":
+			_, _ = w.Write([]byte("media"))
+		case "/large":
+			_, _ = w.Write([]byte(strings.Repeat("a", 2048)))
+		case "/error":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer media.Close()
+
+	// /hop/N redirects N more times before reaching the media
+	var redirector *httptest.Server
+	redirector = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/denied" {
+			// 127.0.0.2 is loopback too, but isn't in the allowed networks
+			http.Redirect(w, r, strings.Replace(media.URL, "127.0.0.1", "127.0.0.2", 1)+"/media", http.StatusFound)
+			return
+		}
+		hops, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/hop/"))
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if hops <= 1 {
+			http.Redirect(w, r, media.URL+"/media", http.StatusFound)
+		} else {
+			http.Redirect(w, r, fmt.Sprintf("%s/hop/%d", redirector.URL, hops-1), http.StatusFound)
+		}
+	}))
+	defer redirector.Close()
+
+	tests := []struct {
+		name         string
+		maxRedirects int
+		location     string
+		expectedErr  error
+		anyErr       bool
+	}{
+		{name: "direct", maxRedirects: 1, location: media.URL + "/media"},
+		{name: "disabled", maxRedirects: 0, location: media.URL + "/media", expectedErr: download.ErrTooManyRedirects},
+		{name: "cross origin", maxRedirects: 2, location: redirector.URL + "/hop/1"},
+		{name: "at hop limit", maxRedirects: 4, location: redirector.URL + "/hop/3"},
+		{name: "over hop limit", maxRedirects: 3, location: redirector.URL + "/hop/3", expectedErr: download.ErrTooManyRedirects},
+		{name: "denied hop", maxRedirects: 5, location: redirector.URL + "/denied", expectedErr: common.ErrHostNotAllowed},
+		{name: "denied location", maxRedirects: 5, location: strings.Replace(media.URL, "127.0.0.1", "127.0.0.2", 1) + "/media", expectedErr: common.ErrHostNotAllowed},
+		{name: "unsupported scheme", maxRedirects: 5, location: "ftp://127.0.0.1/media", anyErr: true},
+		{name: "not found", maxRedirects: 5, location: media.URL + "/missing", expectedErr: common.ErrMediaNotFound},
+		{name: "server error", maxRedirects: 5, location: media.URL + "/error", anyErr: true},
+		{name: "too large", maxRedirects: 5, location: media.URL + "/large", expectedErr: common.ErrMediaTooLarge},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp, err := download.FollowRedirect(makeRedirectContext(test.maxRedirects), test.location)
+			if test.expectedErr != nil || test.anyErr {
+				assert.Error(t, err)
+				if test.expectedErr != nil {
+					assert.ErrorIs(t, err, test.expectedErr)
+				}
+				assert.Nil(t, resp)
+				return
+			}
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer resp.Body.Close()
+			b, err := io.ReadAll(resp.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, "media", string(b))
+		})
+	}
+
+	// Hosts on the URL preview allow list don't get to skip the network checks when following redirects
+	ctx := makeRedirectContext(5)
+	ctx.Config.UrlPreviews.AllowedDomains = []string{"127.0.0.2"}
+	resp, err := download.FollowRedirect(ctx, redirector.URL+"/denied")
+	assert.ErrorIs(t, err, common.ErrHostNotAllowed)
+	assert.Nil(t, resp)
+}
+
+func TestPreviewClientAllowedDomains(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skip("can't listen on 127.0.0.2: ", err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("preview"))
+	}))
+	server.Listener = l
+	server.Start()
+	defer server.Close()
+
+	ctx := makeRedirectContext(5)
+	ctx.Config.TimeoutSeconds.UrlPreviews = 5
+
+	// 127.0.0.2 isn't in the allowed networks ...
+	client, err := u.NewPreviewClient(ctx)
+	assert.NoError(t, err)
+	_, err = client.Get(server.URL)
+	assert.ErrorIs(t, err, common.ErrHostNotAllowed)
+
+	// ... but previews are allowed to reach it once it's on the allow list
+	ctx.Config.UrlPreviews.AllowedDomains = []string{"127.0.0.2"}
+	client, err = u.NewPreviewClient(ctx)
+	assert.NoError(t, err)
+	resp, err := client.Get(server.URL)
+	if assert.NoError(t, err) {
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, "preview", string(b))
+	}
+}
@@ -0,0 +1,168 @@
+package test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/errcache"
+	"github.com/t2bot/matrix-media-repo/matrix"
+)
+
+func TestErrCacheBackoff(t *testing.T) {
+	cache := errcache.NewErrCache("test_backoff", time.Minute, 10*time.Minute)
+	expected := []time.Duration{
+		time.Minute, // no failures yet
+		time.Minute,
+		2 * time.Minute,
+		4 * time.Minute,
+		8 * time.Minute,
+		10 * time.Minute, // capped
+		10 * time.Minute,
+	}
+	for failures, d := range expected {
+		assert.Equal(t, d, cache.Backoff(failures), "failures=%d", failures)
+	}
+	assert.Equal(t, 10*time.Minute, cache.Backoff(1000))
+
+	// The max expiration can't be lower than the base expiration
+	cache.Resize(5*time.Minute, time.Minute)
+	assert.Equal(t, 5*time.Minute, cache.Backoff(1))
+	assert.Equal(t, 5*time.Minute, cache.Backoff(3))
+
+	cache.Resize(time.Second, 3*time.Second)
+	assert.Equal(t, 2*time.Second, cache.Backoff(2))
+	assert.Equal(t, 3*time.Second, cache.Backoff(3))
+}
+
+func TestErrCacheCountsFailures(t *testing.T) {
+	ctx := rcontext.InitialNoConfig()
+	cache := errcache.NewErrCache("test_counts", time.Minute, 10*time.Minute)
+	failure := errors.New("failed")
+
+	assert.NoError(t, cache.Get(ctx, "example.org/abc"))
+	for i := 0; i < 3; i++ {
+		cache.Set(ctx, "example.org/abc", failure)
+	}
+	assert.Equal(t, failure, cache.Get(ctx, "example.org/abc"))
+
+	entries, err := cache.List(ctx, "example.org/")
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "example.org/abc", entries[0].Key)
+		assert.Equal(t, 3, entries[0].Failures)
+		expiresIn := time.Until(time.UnixMilli(entries[0].ExpiresTs))
+		assert.InDelta(t, (4 * time.Minute).Seconds(), expiresIn.Seconds(), 5)
+	}
+
+	// Concurrent failures are all counted
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cache.Set(ctx, "example.org/concurrent", failure)
+		}()
+	}
+	wg.Wait()
+	entries, err = cache.List(ctx, "example.org/concurrent")
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, 50, entries[0].Failures)
+	}
+
+	count, err := cache.Delete(ctx, "example.org/abc")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	assert.NoError(t, cache.Get(ctx, "example.org/abc"))
+	count, err = cache.Clear(ctx, "example.org/")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func TestErrCacheEntryEncoding(t *testing.T) {
+	ctx := rcontext.InitialNoConfig()
+	cache := errcache.NewErrCache("test_encoding", time.Minute, 10*time.Minute)
+
+	tests := []struct {
+		name  string
+		err   error
+		check func(t *testing.T, err error)
+	}{
+		{
+			name: "known error",
+			err:  common.ErrMediaTooLarge,
+			check: func(t *testing.T, err error) {
+				assert.ErrorIs(t, err, common.ErrMediaTooLarge)
+			},
+		},
+		{
+			name: "server not allowed",
+			err:  matrix.MakeServerNotAllowedError("denied.example.org"),
+			check: func(t *testing.T, err error) {
+				var notAllowedErr matrix.ServerNotAllowedError
+				if assert.ErrorAs(t, err, &notAllowedErr) {
+					assert.Equal(t, "denied.example.org", notAllowedErr.ServerName)
+				}
+			},
+		},
+		{
+			name: "matrix error",
+			err:  &matrix.ErrorResponse{ErrorCode: common.ErrCodeNotFound, Message: "not here"},
+			check: func(t *testing.T, err error) {
+				var mxErr *matrix.ErrorResponse
+				if assert.ErrorAs(t, err, &mxErr) {
+					assert.Equal(t, common.ErrCodeNotFound, mxErr.ErrorCode)
+					assert.Equal(t, "not here", mxErr.Message)
+				}
+			},
+		},
+		{
+			name: "other error",
+			err:  errors.New("connection reset"),
+			check: func(t *testing.T, err error) {
+				assert.EqualError(t, err, "connection reset")
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache.Set(ctx, test.name, test.err)
+			cache.Set(ctx, test.name, test.err)
+			entries, err := cache.List(ctx, test.name)
+			assert.NoError(t, err)
+			if !assert.Len(t, entries, 1) {
+				return
+			}
+
+			values, err := errcache.EncodeEntry(entries[0])
+			assert.NoError(t, err)
+			decoded, err := errcache.DecodeEntry(values)
+			assert.NoError(t, err)
+			assert.Equal(t, entries[0].Key, decoded.Key)
+			assert.Equal(t, entries[0].Error, decoded.Error)
+			assert.Equal(t, 2, decoded.Failures)
+			assert.Equal(t, entries[0].ExpiresTs, decoded.ExpiresTs)
+			test.check(t, decoded.Err())
+		})
+	}
+
+	// The separately counted failures take precedence over those in the entry
+	values, err := errcache.EncodeEntry(&errcache.Entry{Key: "counted", Error: "failed", Failures: 1})
+	assert.NoError(t, err)
+	values["failures"] = "7"
+	decoded, err := errcache.DecodeEntry(values)
+	assert.NoError(t, err)
+	assert.Equal(t, 7, decoded.Failures)
+
+	// Malformed entries fail to decode
+	_, err = errcache.DecodeEntry(map[string]string{"entry": "{not json", "failures": "1"})
+	assert.Error(t, err)
+	values["failures"] = "many"
+	_, err = errcache.DecodeEntry(values)
+	assert.Error(t, err)
+}
@@ -0,0 +1,137 @@
+package test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/matrix"
+	"github.com/t2bot/matrix-media-repo/util/readers"
+)
+
+func TestVerifyingReader(t *testing.T) {
+	content := []byte("the quick brown fox jumps over the lazy dog")
+	h := sha256.Sum256(content)
+	hash := hex.EncodeToString(h[:])
+	otherHash := strings.Repeat("0", 64)
+
+	tests := []struct {
+		name         string
+		expectedSize int64
+		expectedHash string
+		mismatch     bool
+	}{
+		{name: "matching", expectedSize: int64(len(content)), expectedHash: hash},
+		{name: "unchecked", expectedSize: -1, expectedHash: ""},
+		{name: "size only", expectedSize: int64(len(content)), expectedHash: ""},
+		{name: "hash only", expectedSize: -1, expectedHash: hash},
+		{name: "too short", expectedSize: int64(len(content)) + 1, expectedHash: hash, mismatch: true},
+		{name: "too long", expectedSize: int64(len(content)) - 1, expectedHash: hash, mismatch: true},
+		{name: "expected empty", expectedSize: 0, expectedHash: "", mismatch: true},
+		{name: "wrong hash", expectedSize: int64(len(content)), expectedHash: otherHash, mismatch: true},
+		{name: "wrong hash and unchecked size", expectedSize: -1, expectedHash: otherHash, mismatch: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Read a byte at a time so the checks happen across many reads
+			r := readers.NewVerifyingReader(io.NopCloser(iotest.OneByteReader(bytes.NewReader(content))), test.expectedSize, test.expectedHash)
+			b, err := io.ReadAll(r)
+			if test.mismatch {
+				assert.ErrorIs(t, err, common.ErrMediaMismatch)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, content, b)
+			}
+			assert.NoError(t, r.Close())
+		})
+	}
+
+	// A stream which is too long fails as soon as it goes over, rather than at the end
+	r := readers.NewVerifyingReader(io.NopCloser(iotest.OneByteReader(bytes.NewReader(content))), 4, "")
+	b, err := io.ReadAll(r)
+	assert.ErrorIs(t, err, common.ErrMediaMismatch)
+	assert.Len(t, b, 5)
+}
+
+func TestParseFederationMetadata(t *testing.T) {
+	hash := strings.Repeat("ab", 32)
+	size := int64(1234)
+
+	tests := []struct {
+		name     string
+		raw      string
+		expected *matrix.FederationMediaMetadata
+		invalid  bool
+	}{
+		{name: "empty", raw: `{}`},
+		{name: "spec fields only", raw: `{"other": true}`},
+		{name: "null metadata", raw: `{"io.t2bot.media": null}`},
+		{name: "empty metadata", raw: `{"io.t2bot.media": {}}`, expected: &matrix.FederationMediaMetadata{}},
+		{
+			name: "full metadata",
+			raw:  `{"io.t2bot.media": {"upload_name": "cat.png", "content_type": "image/png", "sha256": "` + hash + `", "size": 1234, "requires_auth": true, "extras": {"width": 10}}}`,
+			expected: &matrix.FederationMediaMetadata{
+				UploadName:   "cat.png",
+				ContentType:  "image/png",
+				Sha256:       hash,
+				SizeBytes:    &size,
+				RequiresAuth: true,
+				Extras:       map[string]interface{}{"width": float64(10)},
+			},
+		},
+		{name: "upper case hash", raw: `{"io.t2bot.media": {"sha256": "` + strings.ToUpper(hash) + `"}}`, expected: &matrix.FederationMediaMetadata{Sha256: hash}},
+		{name: "quarantined", raw: `{"io.t2bot.media": {"quarantined": true}}`, expected: &matrix.FederationMediaMetadata{Quarantined: true}},
+		{name: "not an object", raw: `{"io.t2bot.media": "cat.png"}`, invalid: true},
+		{name: "size is a string", raw: `{"io.t2bot.media": {"size": "1234"}}`, invalid: true},
+		{name: "size is fractional", raw: `{"io.t2bot.media": {"size": 12.5}}`, invalid: true},
+		{name: "negative size", raw: `{"io.t2bot.media": {"size": -1}}`, invalid: true},
+		{name: "hash is not hex", raw: `{"io.t2bot.media": {"sha256": "` + strings.Repeat("zz", 32) + `"}}`, invalid: true},
+		{name: "hash is too short", raw: `{"io.t2bot.media": {"sha256": "abcd"}}`, invalid: true},
+		{name: "hash is not a string", raw: `{"io.t2bot.media": {"sha256": 1234}}`, invalid: true},
+		{name: "quarantined is not a bool", raw: `{"io.t2bot.media": {"quarantined": "yes"}}`, invalid: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			raw := &database.AnonymousJson{}
+			assert.NoError(t, json.Unmarshal([]byte(test.raw), raw))
+
+			metadata, err := matrix.ParseFederationMetadata(raw)
+			if test.invalid {
+				assert.Error(t, err)
+				assert.Nil(t, metadata)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, metadata)
+		})
+	}
+
+	metadata, err := matrix.ParseFederationMetadata(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, metadata)
+}
+
+func TestFederationMetadataRoundTrip(t *testing.T) {
+	size := int64(42)
+	metadata := &matrix.FederationMediaMetadata{
+		UploadName:  "file.txt",
+		ContentType: "text/plain",
+		Sha256:      strings.Repeat("0f", 32),
+		SizeBytes:   &size,
+	}
+	raw, err := matrix.MakeFederationMetadata(metadata)
+	assert.NoError(t, err)
+	assert.Contains(t, *raw, matrix.FederationMetadataKey)
+
+	parsed, err := matrix.ParseFederationMetadata(raw)
+	assert.NoError(t, err)
+	assert.Equal(t, metadata, parsed)
+}
@@ -0,0 +1,66 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/federation"
+)
+
+func TestFederationPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy config.FederationPolicyConfig
+		valid  bool
+	}{
+		{name: "glob only", policy: config.FederationPolicyConfig{Glob: "example.org"}, valid: true},
+		{name: "all fields", policy: config.FederationPolicyConfig{Glob: "*.example.org", Fetch: federation.PolicyDeny, Serve: federation.PolicyAllow, MaxBytes: 1024, TimeoutSeconds: 30, NeverCache: true}, valid: true},
+		{name: "no glob", policy: config.FederationPolicyConfig{Fetch: federation.PolicyDeny}},
+		{name: "misspelled fetch", policy: config.FederationPolicyConfig{Glob: "example.org", Fetch: "denied"}},
+		{name: "upper case serve", policy: config.FederationPolicyConfig{Glob: "example.org", Serve: "ALLOW"}},
+		{name: "negative max bytes", policy: config.FederationPolicyConfig{Glob: "example.org", MaxBytes: -1}},
+		{name: "negative timeout", policy: config.FederationPolicyConfig{Glob: "example.org", TimeoutSeconds: -1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.policy.Validate()
+
+			// Policies from the admin API are validated the same way
+			apiErr := (&federation.Policy{
+				Glob:           test.policy.Glob,
+				Fetch:          test.policy.Fetch,
+				Serve:          test.policy.Serve,
+				MaxBytes:       test.policy.MaxBytes,
+				TimeoutSeconds: test.policy.TimeoutSeconds,
+				NeverCache:     test.policy.NeverCache,
+			}).Validate()
+
+			if test.valid {
+				assert.NoError(t, err)
+				assert.NoError(t, apiErr)
+			} else {
+				assert.Error(t, err)
+				assert.Equal(t, err, apiErr)
+			}
+		})
+	}
+}
+
+func TestSortDatabasePolicies(t *testing.T) {
+	policies := []*federation.Policy{
+		{Glob: "*"},
+		{Glob: "*.org"},
+		{Glob: "b.example.org"},
+		{Glob: "*.example.org"},
+		{Glob: "a.example.org"},
+		{Glob: "*.media.example.org"},
+	}
+	federation.SortDatabasePolicies(policies)
+
+	globs := make([]string, 0, len(policies))
+	for _, p := range policies {
+		globs = append(globs, p.Glob)
+	}
+	assert.Equal(t, []string{"*.media.example.org", "*.example.org", "a.example.org", "b.example.org", "*.org", "*"}, globs)
+}
@@ -0,0 +1,151 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/matrix"
+	"github.com/t2bot/matrix-media-repo/metrics"
+)
+
+// withBreakerConfig sets the federation breaker config for the duration of the test.
+func withBreakerConfig(t *testing.T, backoffAt int, cooldownSeconds int) {
+	conf := &config.Get().Federation
+	original := *conf
+	conf.BackoffAt = backoffAt
+	conf.BreakerCooldownSeconds = cooldownSeconds
+	t.Cleanup(func() {
+		*conf = original
+	})
+}
+
+func breakerState(t *testing.T, name string) *matrix.BreakerState {
+	for _, state := range matrix.ListBreakers() {
+		if state.Kind == matrix.BreakerKindFederation && state.Name == name {
+			return state
+		}
+	}
+	t.Fatalf("breaker %s not found", name)
+	return nil
+}
+
+func TestBreakerTripsAndRecovers(t *testing.T) {
+	withBreakerConfig(t, 2, 0)
+	const name = "trips.example.org"
+	failure := errors.New("failed")
+	fail := func() error { return failure }
+	succeed := func() error { return nil }
+	ctx := context.Background()
+
+	assert.ErrorIs(t, matrix.CallBreaker(ctx, matrix.BreakerKindFederation, name, fail, 0), failure)
+	assert.Equal(t, matrix.BreakerStateClosed, breakerState(t, name).State)
+	assert.ErrorIs(t, matrix.CallBreaker(ctx, matrix.BreakerKindFederation, name, fail, 0), failure)
+	assert.NotEqual(t, matrix.BreakerStateClosed, breakerState(t, name).State)
+
+	// Without a cooldown, the breaker is immediately half-open: only one trial call is let through at a time
+	inTrial := make(chan bool)
+	finishTrial := make(chan error)
+	trialDone := make(chan error)
+	go func() {
+		trialDone <- matrix.CallBreaker(ctx, matrix.BreakerKindFederation, name, func() error {
+			inTrial <- true
+			return <-finishTrial
+		}, 0)
+	}()
+	<-inTrial
+	assert.Equal(t, matrix.BreakerStateHalfOpen, breakerState(t, name).State)
+	assert.ErrorIs(t, matrix.CallBreaker(ctx, matrix.BreakerKindFederation, name, succeed, 0), matrix.ErrBreakerOpen)
+
+	// A failed trial trips the breaker again
+	finishTrial <- failure
+	assert.ErrorIs(t, <-trialDone, failure)
+	assert.Equal(t, 3, breakerState(t, name).Failures)
+
+	// A successful trial closes it
+	assert.NoError(t, matrix.CallBreaker(ctx, matrix.BreakerKindFederation, name, succeed, 0))
+	state := breakerState(t, name)
+	assert.Equal(t, matrix.BreakerStateClosed, state.State)
+	assert.Equal(t, 0, state.Failures)
+}
+
+func TestBreakerCancelledTrialIsReleased(t *testing.T) {
+	withBreakerConfig(t, 1, 0)
+	const name = "cancelled.example.org"
+	failure := errors.New("failed")
+
+	assert.ErrorIs(t, matrix.CallBreaker(context.Background(), matrix.BreakerKindFederation, name, func() error { return failure }, 0), failure)
+
+	// The trial call is cancelled, which doesn't count as a failure and lets the next call try instead
+	ctx, cancel := context.WithCancel(context.Background())
+	err := matrix.CallBreaker(ctx, matrix.BreakerKindFederation, name, func() error {
+		cancel()
+		return ctx.Err()
+	}, 0)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 1, breakerState(t, name).Failures)
+
+	assert.NoError(t, matrix.CallBreaker(context.Background(), matrix.BreakerKindFederation, name, func() error { return nil }, 0))
+	assert.Equal(t, matrix.BreakerStateClosed, breakerState(t, name).State)
+}
+
+func TestBreakerManualTrip(t *testing.T) {
+	withBreakerConfig(t, 10, 0)
+	const name = "manual.example.org"
+	ran := false
+	run := func() error {
+		ran = true
+		return nil
+	}
+
+	state, err := matrix.TripBreaker(matrix.BreakerKindFederation, name)
+	assert.NoError(t, err)
+	assert.Equal(t, matrix.BreakerStateOpen, state.State)
+	assert.True(t, state.Manual)
+
+	// Manually tripped breakers never let a trial through, even after the cooldown
+	assert.ErrorIs(t, matrix.CallBreaker(context.Background(), matrix.BreakerKindFederation, name, run, 0), matrix.ErrBreakerOpen)
+	assert.False(t, ran)
+
+	state, err = matrix.ResetBreaker(matrix.BreakerKindFederation, name)
+	assert.NoError(t, err)
+	assert.Equal(t, matrix.BreakerStateClosed, state.State)
+	assert.NoError(t, matrix.CallBreaker(context.Background(), matrix.BreakerKindFederation, name, run, 0))
+	assert.True(t, ran)
+}
+
+func TestBreakerMetrics(t *testing.T) {
+	withBreakerConfig(t, 1, 60)
+	const name = "metrics.example.org"
+	failure := errors.New("failed")
+	ctx := context.Background()
+
+	breakersIn := func(state string) float64 {
+		return testutil.ToFloat64(metrics.Breakers.With(prometheus.Labels{"kind": matrix.BreakerKindFederation, "state": state}))
+	}
+	closed := breakersIn(matrix.BreakerStateClosed)
+	open := breakersIn(matrix.BreakerStateOpen)
+
+	// New breakers count as closed
+	assert.NoError(t, matrix.CallBreaker(ctx, matrix.BreakerKindFederation, name, func() error { return nil }, 0))
+	assert.Equal(t, closed+1, breakersIn(matrix.BreakerStateClosed))
+	assert.Equal(t, open, breakersIn(matrix.BreakerStateOpen))
+
+	// Tripping moves the breaker from closed to open
+	assert.ErrorIs(t, matrix.CallBreaker(ctx, matrix.BreakerKindFederation, name, func() error { return failure }, 0), failure)
+	assert.Equal(t, closed, breakersIn(matrix.BreakerStateClosed))
+	assert.Equal(t, open+1, breakersIn(matrix.BreakerStateOpen))
+
+	_, err := matrix.ResetBreaker(matrix.BreakerKindFederation, name)
+	assert.NoError(t, err)
+	assert.Equal(t, closed+1, breakersIn(matrix.BreakerStateClosed))
+	assert.Equal(t, open, breakersIn(matrix.BreakerStateOpen))
+
+	// Remote servers don't get their own series, as there could be any number of them
+	assert.Equal(t, 0, testutil.CollectAndCount(metrics.BreakerState, "media_breaker_state"))
+	assert.Equal(t, 0, testutil.CollectAndCount(metrics.BreakerFailures, "media_breaker_failures"))
+}
@@ -0,0 +1,86 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/url_previewing/p"
+)
+
+func TestOEmbedProvidersValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider config.OEmbedProviderConfig
+		valid    bool
+	}{
+		{
+			name: "endpoint with schemes",
+			provider: config.OEmbedProviderConfig{Name: "Wiki", Url: "https://wiki.example.org", Endpoints: []config.OEmbedEndpointConfig{
+				{Url: "https://wiki.example.org/api/oembed", Schemes: []string{"https://wiki.example.org/pages/*", "https://*.wiki.example.org/*"}},
+			}},
+			valid: true,
+		},
+		{
+			name: "discovery without url",
+			provider: config.OEmbedProviderConfig{Name: "Video", Url: "https://video.example.org", Endpoints: []config.OEmbedEndpointConfig{
+				{Discovery: true},
+			}},
+			valid: true,
+		},
+		{
+			name: "no name",
+			provider: config.OEmbedProviderConfig{Url: "https://example.org", Endpoints: []config.OEmbedEndpointConfig{
+				{Url: "https://example.org/oembed"},
+			}},
+		},
+		{
+			name: "endpoint without url or discovery",
+			provider: config.OEmbedProviderConfig{Name: "Broken", Url: "https://example.org", Endpoints: []config.OEmbedEndpointConfig{
+				{Schemes: []string{"https://example.org/*"}},
+			}},
+		},
+		{
+			name: "invalid scheme",
+			provider: config.OEmbedProviderConfig{Name: "Broken", Url: "https://example.org", Endpoints: []config.OEmbedEndpointConfig{
+				{Url: "https://example.org/oembed", Schemes: []string{"https://example.org/(*"}},
+			}},
+		},
+		{
+			name: "invalid default scheme",
+			provider: config.OEmbedProviderConfig{Name: "Broken", Url: "https://example.org/[", Endpoints: []config.OEmbedEndpointConfig{
+				{Url: "https://example.org/oembed"},
+			}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := config.OEmbedProvidersConfig{Providers: []config.OEmbedProviderConfig{test.provider}}.Validate()
+			if test.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestReloadOEmbedProviders(t *testing.T) {
+	original := config.Get().UrlPreviews.OEmbedProviders
+	t.Cleanup(func() {
+		config.Get().UrlPreviews.OEmbedProviders = original
+		_ = p.ReloadOEmbedProviders()
+	})
+
+	// An invalid provider is reported rather than taking the server down
+	config.Get().UrlPreviews.OEmbedProviders = config.OEmbedProvidersConfig{
+		UseBuiltin: false,
+		Providers: []config.OEmbedProviderConfig{{Name: "Broken", Url: "https://example.org", Endpoints: []config.OEmbedEndpointConfig{
+			{Url: "https://example.org/oembed", Schemes: []string{"https://example.org/(*"}},
+		}}},
+	}
+	assert.Error(t, p.ReloadOEmbedProviders())
+
+	config.Get().UrlPreviews.OEmbedProviders.Providers[0].Endpoints[0].Schemes = []string{"https://example.org/*"}
+	assert.NoError(t, p.ReloadOEmbedProviders())
+}
@@ -0,0 +1,116 @@
+package test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/panjf2000/ants/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/pool"
+)
+
+// blockQueue occupies the queue's only worker, so tasks scheduled afterwards wait in the queue until the returned
+// function is called.
+func blockQueue(t *testing.T, q *pool.Queue) func() {
+	started := make(chan bool)
+	gate := make(chan bool)
+	block := func() {
+		started <- true
+		<-gate
+	}
+	assert.NoError(t, q.Schedule(pool.PriorityInteractive, block, nil))
+	<-started
+	return func() {
+		close(gate)
+	}
+}
+
+func TestQueuePriorities(t *testing.T) {
+	q, err := pool.NewQueue(1, "test_priorities")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Release()
+	unblock := blockQueue(t, q)
+
+	lock := new(sync.Mutex)
+	order := make([]pool.Priority, 0)
+	wg := new(sync.WaitGroup)
+	schedule := func(priority pool.Priority, count int) {
+		for i := 0; i < count; i++ {
+			wg.Add(1)
+			assert.NoError(t, q.Schedule(priority, func() {
+				lock.Lock()
+				order = append(order, priority)
+				lock.Unlock()
+				wg.Done()
+			}, nil))
+		}
+	}
+	schedule(pool.PriorityBulk, 4)
+	schedule(pool.PriorityBackground, 6)
+	schedule(pool.PriorityInteractive, 12)
+	unblock()
+	wg.Wait()
+
+	// While everything has work waiting, each round of 10 tasks is split 6:3:1, with the work spread out
+	i, b, k := pool.PriorityInteractive, pool.PriorityBackground, pool.PriorityBulk
+	assert.Equal(t, []pool.Priority{
+		i, b, i, i, b, i, k, i, b, i,
+		i, b, i, i, b, i, k, i, b, i,
+		// Only bulk work is left
+		k, k,
+	}, order)
+}
+
+func TestQueueWaitsForWorkerBeforePicking(t *testing.T) {
+	q, err := pool.NewQueue(1, "test_wait_for_worker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Release()
+	unblock := blockQueue(t, q)
+
+	// The bulk task is scheduled first, but nothing is picked while the worker is busy
+	order := make(chan pool.Priority, 2)
+	assert.NoError(t, q.Schedule(pool.PriorityBulk, func() { order <- pool.PriorityBulk }, nil))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 1, q.Depth(pool.PriorityBulk))
+	assert.NoError(t, q.Schedule(pool.PriorityInteractive, func() { order <- pool.PriorityInteractive }, nil))
+	unblock()
+
+	for _, expected := range []pool.Priority{pool.PriorityInteractive, pool.PriorityBulk} {
+		select {
+		case actual := <-order:
+			assert.Equal(t, expected, actual)
+		case <-time.After(5 * time.Second):
+			t.Fatal("task did not run")
+		}
+	}
+}
+
+func TestQueueReleaseRejectsPending(t *testing.T) {
+	q, err := pool.NewQueue(1, "test_release")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unblock := blockQueue(t, q)
+	defer unblock()
+
+	rejected := make(chan error)
+	ran := false
+	assert.NoError(t, q.Schedule(pool.PriorityBulk, func() { ran = true }, func(err error) {
+		rejected <- err
+	}))
+	q.Release()
+
+	select {
+	case err = <-rejected:
+		assert.ErrorIs(t, err, ants.ErrPoolClosed)
+	case <-time.After(5 * time.Second):
+		t.Fatal("pending task was not rejected")
+	}
+	assert.False(t, ran)
+	assert.ErrorIs(t, q.Schedule(pool.PriorityInteractive, func() {}, nil), ants.ErrPoolClosed)
+}
@@ -0,0 +1,51 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/prefetch"
+)
+
+func TestPrefetchConfigValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		conf  config.PrefetchConfig
+		valid bool
+	}{
+		{name: "disabled", conf: config.PrefetchConfig{Enabled: false}, valid: true},
+		{name: "disabled without workers", conf: config.PrefetchConfig{Enabled: false, NumWorkers: 0, MaxQueued: 0}, valid: true},
+		{name: "enabled", conf: config.PrefetchConfig{Enabled: true, NumWorkers: 2, MaxQueued: 1000}, valid: true},
+		{name: "no workers", conf: config.PrefetchConfig{Enabled: true, NumWorkers: 0, MaxQueued: 1000}},
+		{name: "negative workers", conf: config.PrefetchConfig{Enabled: true, NumWorkers: -1, MaxQueued: 1000}},
+		{name: "no queue", conf: config.PrefetchConfig{Enabled: true, NumWorkers: 2, MaxQueued: 0}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.conf.Validate()
+			if test.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestPrefetchWithoutWorkers(t *testing.T) {
+	original := config.Get().Downloads.Prefetch
+	t.Cleanup(func() {
+		config.Get().Downloads.Prefetch = original
+	})
+	config.Get().Downloads.Prefetch = config.PrefetchConfig{Enabled: true, NumWorkers: 0, MaxQueued: 1000}
+
+	// Nothing is queued, as nothing would ever download it
+	ctx := rcontext.InitialNoConfig()
+	queued, err := prefetch.Enqueue(ctx, []string{"mxc://remote.example.org/abc"})
+	assert.ErrorIs(t, err, prefetch.ErrDisabled)
+	assert.Equal(t, 0, queued)
+	assert.False(t, prefetch.GetStatus().Enabled)
+	assert.Equal(t, 0, prefetch.GetStatus().Queued)
+}
@@ -0,0 +1,141 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/datastore_op"
+	"github.com/t2bot/matrix-media-repo/test/test_internals"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+type PutAndStreamSuite struct {
+	suite.Suite
+	deps *test_internals.ContainerDeps
+}
+
+func (s *PutAndStreamSuite) SetupSuite() {
+	deps, err := test_internals.MakeTestDeps()
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.deps = deps
+}
+
+func (s *PutAndStreamSuite) TearDownSuite() {
+	if s.deps != nil {
+		if s.T().Failed() {
+			s.deps.Debug()
+		}
+		s.deps.Teardown()
+	}
+}
+
+type putAndStreamResult struct {
+	record *database.DbMedia
+	err    error
+}
+
+// putAndStream stores the input as remote media, returning the stream and a channel for the result of storing it.
+func (s *PutAndStreamSuite) putAndStream(ctx rcontext.RequestContext, mediaId string, input io.Reader) (io.ReadCloser, chan putAndStreamResult) {
+	t := s.T()
+	ch := make(chan putAndStreamResult, 1)
+	r, err := datastore_op.PutAndStream(ctx, "remote.example.org", mediaId, io.NopCloser(input), "image/png", "image.png", datastores.RemoteMediaKind, func(ctx rcontext.RequestContext, record *database.DbMedia, err error) {
+		ch <- putAndStreamResult{record: record, err: err}
+	})
+	assert.NoError(t, err)
+	assert.NotNil(t, r)
+	return r, ch
+}
+
+func (s *PutAndStreamSuite) waitForResult(ch chan putAndStreamResult) putAndStreamResult {
+	select {
+	case res := <-ch:
+		return res
+	case <-time.After(30 * time.Second):
+		s.T().Fatal("media was not stored")
+		return putAndStreamResult{}
+	}
+}
+
+func (s *PutAndStreamSuite) TestStreamsWhileStoring() {
+	t := s.T()
+	ctx := rcontext.Initial()
+
+	_, img, err := test_internals.MakeTestImage(128, 128)
+	assert.NoError(t, err)
+	content, err := io.ReadAll(img)
+	assert.NoError(t, err)
+	mediaId, err := util.GenerateRandomString(32)
+	assert.NoError(t, err)
+
+	r, ch := s.putAndStream(ctx, mediaId, bytes.NewReader(content))
+	b, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, content, b)
+	assert.NoError(t, r.Close())
+
+	// The stream only ends once the media has been stored
+	res := s.waitForResult(ch)
+	assert.NoError(t, res.err)
+	if assert.NotNil(t, res.record) {
+		assert.Equal(t, int64(len(content)), res.record.SizeBytes)
+	}
+	record, err := database.GetInstance().Media.Prepare(ctx).GetById("remote.example.org", mediaId)
+	assert.NoError(t, err)
+	assert.NotNil(t, record)
+}
+
+func (s *PutAndStreamSuite) TestInputCutShort() {
+	t := s.T()
+	ctx := rcontext.Initial()
+
+	mediaId, err := util.GenerateRandomString(32)
+	assert.NoError(t, err)
+	failure := errors.New("connection reset")
+	r, ch := s.putAndStream(ctx, mediaId, io.MultiReader(bytes.NewReader([]byte("partial media")), iotest.ErrReader(failure)))
+
+	// The stream fails rather than ending as though it were the whole media, and nothing is stored
+	_, err = io.ReadAll(r)
+	assert.ErrorIs(t, err, failure)
+	assert.NoError(t, r.Close())
+	res := s.waitForResult(ch)
+	assert.ErrorIs(t, res.err, failure)
+	record, err := database.GetInstance().Media.Prepare(ctx).GetById("remote.example.org", mediaId)
+	assert.NoError(t, err)
+	assert.Nil(t, record)
+}
+
+func (s *PutAndStreamSuite) TestStoresAfterStreamClosed() {
+	t := s.T()
+	ctx := rcontext.Initial()
+
+	_, img, err := test_internals.MakeTestImage(128, 128)
+	assert.NoError(t, err)
+	mediaId, err := util.GenerateRandomString(32)
+	assert.NoError(t, err)
+
+	// The user going away doesn't stop the media from being stored
+	r, ch := s.putAndStream(ctx, mediaId, img)
+	assert.NoError(t, r.Close())
+	res := s.waitForResult(ch)
+	assert.NoError(t, res.err)
+	assert.NotNil(t, res.record)
+	record, err := database.GetInstance().Media.Prepare(ctx).GetById("remote.example.org", mediaId)
+	assert.NoError(t, err)
+	assert.NotNil(t, record)
+}
+
+func TestPutAndStreamSuite(t *testing.T) {
+	suite.Run(t, new(PutAndStreamSuite))
+}
@@ -0,0 +1,58 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/tasks/task_runner"
+)
+
+func TestPickRegenerateTargets(t *testing.T) {
+	ctx := rcontext.InitialNoConfig()
+	ctx.Config.Thumbnails.Sizes = []config.ThumbnailSize{
+		{Width: 32, Height: 32},
+		{Width: 320, Height: 240},
+	}
+	ctx.Config.Thumbnails.AllowAnimated = true
+	ctx.Config.Thumbnails.AnimatedFormats = []string{"webp"}
+
+	purged := []*database.DbThumbnail{
+		{Width: 32, Height: 32, Method: "crop"},
+		// A size which is no longer configured moves to the nearest configured size
+		{Width: 96, Height: 96, Method: "crop"},
+		// Duplicates are only generated once
+		{Width: 32, Height: 32, Method: "crop"},
+		// Animated formats which are no longer configured fall back to GIF, which every client supports
+		{Width: 32, Height: 32, Method: "scale", Animated: true, AnimatedFormat: "apng"},
+	}
+
+	// Only the sizes which existed are regenerated
+	assert.Equal(t, []task_runner.RegenerateTarget{
+		{Width: 32, Height: 32, Method: "crop"},
+		{Width: 240, Height: 240, Method: "crop"},
+		{Width: 32, Height: 32, Method: "scale", Animated: true, AnimatedFormat: "gif"},
+	}, task_runner.PickRegenerateTargets(ctx, purged, false))
+
+	// Every configured size with both methods, for each animation variant which existed
+	assert.Equal(t, []task_runner.RegenerateTarget{
+		{Width: 32, Height: 32, Method: "crop"},
+		{Width: 32, Height: 32, Method: "crop", Animated: true, AnimatedFormat: "gif"},
+		{Width: 32, Height: 32, Method: "scale"},
+		{Width: 32, Height: 32, Method: "scale", Animated: true, AnimatedFormat: "gif"},
+		{Width: 320, Height: 240, Method: "crop"},
+		{Width: 320, Height: 240, Method: "crop", Animated: true, AnimatedFormat: "gif"},
+		{Width: 320, Height: 240, Method: "scale"},
+		{Width: 320, Height: 240, Method: "scale", Animated: true, AnimatedFormat: "gif"},
+	}, task_runner.PickRegenerateTargets(ctx, purged, true))
+
+	// Animated thumbnails aren't regenerated once animation is disallowed
+	ctx.Config.Thumbnails.AllowAnimated = false
+	assert.Equal(t, []task_runner.RegenerateTarget{
+		{Width: 32, Height: 32, Method: "scale"},
+	}, task_runner.PickRegenerateTargets(ctx, purged[3:], false))
+
+	assert.Empty(t, task_runner.PickRegenerateTargets(ctx, nil, true))
+}
@@ -0,0 +1,241 @@
+package test
+
+import (
+	"io"
+	"log"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/thumbnails"
+	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_download"
+	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_thumbnail"
+	"github.com/t2bot/matrix-media-repo/tasks/task_runner"
+	"github.com/t2bot/matrix-media-repo/test/test_internals"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+type RemoteThumbnailsSuite struct {
+	suite.Suite
+	deps *test_internals.ContainerDeps
+}
+
+func (s *RemoteThumbnailsSuite) SetupSuite() {
+	deps, err := test_internals.MakeTestDeps()
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.deps = deps
+}
+
+func (s *RemoteThumbnailsSuite) TearDownSuite() {
+	if s.deps != nil {
+		if s.T().Failed() {
+			s.deps.Debug()
+		}
+		s.deps.Teardown()
+	}
+}
+
+func (s *RemoteThumbnailsSuite) makeContext() rcontext.RequestContext {
+	ctx := rcontext.Initial()
+	ctx.Request = httptest.NewRequest("GET", "/_matrix/client/v1/media/thumbnail", nil)
+	ctx.Config.Downloads.FetchRemoteThumbnails = true
+	ctx.Config.Quarantine.ReplaceThumbnails = false
+	ctx.Config.Quarantine.ReplaceDownloads = false
+	return ctx
+}
+
+// storeRemoteThumbnail stores a thumbnail record as though the origin returned it, without a record for the media
+func (s *RemoteThumbnailsSuite) storeRemoteThumbnail(ctx rcontext.RequestContext, origin string, mediaId string, animated bool, animatedFormat string) *database.DbThumbnail {
+	t := s.T()
+
+	client := s.deps.Homeservers[0].UnprivilegedUsers[0].WithCsUrl(s.deps.Machines[0].HttpUrl)
+	contentType, img, err := test_internals.MakeTestImage(96, 96)
+	assert.NoError(t, err)
+	res, err := client.Upload("image"+util.ExtensionForContentType(contentType), contentType, img)
+	assert.NoError(t, err)
+	uploadOrigin, uploadId, err := util.SplitMxc(res.MxcUri)
+	assert.NoError(t, err)
+	media, err := database.GetInstance().Media.Prepare(ctx).GetById(uploadOrigin, uploadId)
+	assert.NoError(t, err)
+	assert.NotNil(t, media)
+
+	record := &database.DbThumbnail{
+		Origin:         origin,
+		MediaId:        mediaId,
+		ContentType:    media.ContentType,
+		Width:          96,
+		Height:         96,
+		Method:         "scale",
+		Animated:       animated,
+		CropStrategy:   "",
+		AnimatedFormat: animatedFormat,
+		SizeBytes:      media.SizeBytes,
+		CreationTs:     util.NowMillis(),
+		Locatable:      media.Locatable,
+	}
+	assert.NoError(t, database.GetInstance().Thumbnails.Prepare(ctx).Insert(record))
+	return record
+}
+
+func (s *RemoteThumbnailsSuite) TestServeStoredRemoteThumbnail() {
+	t := s.T()
+	ctx := s.makeContext()
+
+	const origin = "remote.example.org"
+	mediaId, err := util.GenerateRandomString(32)
+	assert.NoError(t, err)
+
+	// The origin returned a GIF when we asked for an animated thumbnail
+	s.storeRemoteThumbnail(ctx, origin, mediaId, true, "gif")
+
+	found, err := thumbnails.FindRemote(ctx, origin, mediaId, 96, 96, "scale", true, "")
+	assert.NoError(t, err)
+	if assert.NotNil(t, found) {
+		assert.True(t, found.Animated)
+		assert.Equal(t, "gif", found.AnimatedFormat)
+	}
+	found, err = thumbnails.FindRemote(ctx, origin, mediaId, 96, 96, "scale", false, "")
+	assert.NoError(t, err)
+	assert.Nil(t, found) // static requests don't get animated thumbnails
+
+	// Requests for another animated format are served the stored thumbnail instead of asking the origin again
+	record, r, err := pipeline_thumbnail.Execute(ctx, origin, mediaId, pipeline_thumbnail.ThumbnailOpts{
+		DownloadOpts: pipeline_download.DownloadOpts{
+			FetchRemoteIfNeeded: true,
+			BlockForReadUntil:   30 * time.Second,
+		},
+		Width:    96,
+		Height:   96,
+		Method:   "scale",
+		Animated: true,
+		Accept:   "image/webp",
+	})
+	assert.NoError(t, err)
+	if assert.NotNil(t, record) {
+		assert.Equal(t, "gif", record.AnimatedFormat)
+	}
+	if assert.NotNil(t, r) {
+		b, err := io.ReadAll(r)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, b)
+		assert.NoError(t, r.Close())
+	}
+}
+
+func (s *RemoteThumbnailsSuite) TestQuarantineRemoteThumbnails() {
+	t := s.T()
+	ctx := s.makeContext()
+
+	const origin = "remote.example.org"
+	mediaId, err := util.GenerateRandomString(32)
+	assert.NoError(t, err)
+	s.storeRemoteThumbnail(ctx, origin, mediaId, false, "")
+
+	thumbDb := database.GetInstance().Thumbnails.Prepare(ctx)
+	quarantined, err := thumbDb.IsQuarantinedForMedia(origin, mediaId)
+	assert.NoError(t, err)
+	assert.False(t, quarantined)
+
+	count, err := task_runner.QuarantineMedia(ctx, "", &task_runner.QuarantineThis{
+		MxcUris: []string{util.MxcUri(origin, mediaId)},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+
+	quarantined, err = thumbDb.IsQuarantinedForMedia(origin, mediaId)
+	assert.NoError(t, err)
+	assert.True(t, quarantined)
+
+	// Neither the stored thumbnail nor any other size is served now
+	for _, width := range []int{96, 320} {
+		_, r, err := pipeline_thumbnail.Execute(ctx, origin, mediaId, pipeline_thumbnail.ThumbnailOpts{
+			DownloadOpts: pipeline_download.DownloadOpts{
+				FetchRemoteIfNeeded: true,
+				BlockForReadUntil:   30 * time.Second,
+			},
+			Width:  width,
+			Height: width,
+			Method: "scale",
+		})
+		assert.ErrorIs(t, err, common.ErrMediaQuarantined)
+		assert.Nil(t, r)
+	}
+
+	// ... and the full media isn't downloaded from the origin either
+	_, r, err := pipeline_download.Execute(ctx, origin, mediaId, pipeline_download.DownloadOpts{
+		FetchRemoteIfNeeded: true,
+		BlockForReadUntil:   30 * time.Second,
+	})
+	assert.ErrorIs(t, err, common.ErrMediaQuarantined)
+	assert.Nil(t, r)
+
+	// Quarantining again doesn't count the media twice
+	count, err = task_runner.QuarantineMedia(ctx, "", &task_runner.QuarantineThis{
+		Single: &task_runner.QuarantineRecord{Origin: origin, MediaId: mediaId},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), count)
+}
+
+func (s *RemoteThumbnailsSuite) TestNeverCacheWithoutRemoteThumbnails() {
+	t := s.T()
+	ctx := s.makeContext()
+	ctx.Config.Downloads.FetchRemoteThumbnails = false
+
+	const origin = "ephemeral.example.org"
+	policies := config.Get().Federation.Policies
+	config.Get().Federation.Policies = append([]config.FederationPolicyConfig{{Glob: origin, NeverCache: true}}, policies...)
+	defer func() {
+		config.Get().Federation.Policies = policies
+	}()
+
+	mediaId, err := util.GenerateRandomString(32)
+	assert.NoError(t, err)
+
+	// We won't store the media, and can't ask the origin for a thumbnail, so there's nothing to serve
+	_, r, err := pipeline_thumbnail.Execute(ctx, origin, mediaId, pipeline_thumbnail.ThumbnailOpts{
+		DownloadOpts: pipeline_download.DownloadOpts{
+			FetchRemoteIfNeeded: true,
+			BlockForReadUntil:   30 * time.Second,
+		},
+		Width:  96,
+		Height: 96,
+		Method: "scale",
+	})
+	assert.ErrorIs(t, err, common.ErrMediaNotFound)
+	assert.Nil(t, r)
+}
+
+func TestRemoteThumbnailsSuite(t *testing.T) {
+	suite.Run(t, new(RemoteThumbnailsSuite))
+}
+
+func TestRemoteAnimatedFormat(t *testing.T) {
+	tests := []struct {
+		contentType    string
+		requested      bool
+		animated       bool
+		animatedFormat string
+	}{
+		{contentType: "image/gif", requested: true, animated: true, animatedFormat: "gif"},
+		{contentType: "image/png", requested: true, animated: true, animatedFormat: "apng"},
+		{contentType: "image/apng", requested: true, animated: true, animatedFormat: "apng"},
+		{contentType: "image/webp", requested: true, animated: true, animatedFormat: "webp"},
+		{contentType: "image/jpeg", requested: true, animated: false, animatedFormat: ""},
+		{contentType: "image/gif", requested: false, animated: false, animatedFormat: ""},
+		{contentType: "image/webp", requested: false, animated: false, animatedFormat: ""},
+	}
+	for _, test := range tests {
+		animated, animatedFormat := thumbnails.RemoteAnimatedFormat(test.contentType, test.requested)
+		assert.Equal(t, test.animated, animated, test.contentType)
+		assert.Equal(t, test.animatedFormat, animatedFormat, test.contentType)
+	}
+}
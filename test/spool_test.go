@@ -0,0 +1,131 @@
+package test
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/datastores"
+	"github.com/t2bot/matrix-media-repo/util/readers"
+)
+
+// spoolFiles returns the names of the files left in the directory.
+func spoolFiles(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestSpool(t *testing.T) {
+	dir := t.TempDir()
+	s, err := readers.NewSpool(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, spoolFiles(t, dir), 1) // the spool uses the directory it was given
+
+	// The reader waits for the writer rather than seeing EOF
+	read := make(chan []byte)
+	go func() {
+		b, err := io.ReadAll(s)
+		assert.NoError(t, err)
+		read <- b
+	}()
+	for _, chunk := range []string{"hello ", "spooled ", "world"} {
+		n, err := s.Write([]byte(chunk))
+		assert.NoError(t, err)
+		assert.Equal(t, len(chunk), n)
+		time.Sleep(5 * time.Millisecond)
+	}
+	select {
+	case <-read:
+		t.Fatal("reader finished before the writer")
+	case <-time.After(20 * time.Millisecond):
+	}
+	s.Finish(nil)
+
+	select {
+	case b := <-read:
+		assert.Equal(t, "hello spooled world", string(b))
+	case <-time.After(5 * time.Second):
+		t.Fatal("reader did not finish")
+	}
+
+	// The file is only removed once both sides are done
+	assert.Len(t, spoolFiles(t, dir), 1)
+	assert.NoError(t, s.Close())
+	assert.Empty(t, spoolFiles(t, dir))
+}
+
+func TestSpoolWriterError(t *testing.T) {
+	dir := t.TempDir()
+	s, err := readers.NewSpool(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = s.Write([]byte("partial"))
+	assert.NoError(t, err)
+
+	// The reader gets the error even though there's unread data: the media is incomplete
+	failure := errors.New("connection reset")
+	s.Finish(failure)
+	_, err = io.ReadAll(s)
+	assert.ErrorIs(t, err, failure)
+	assert.NoError(t, s.Close())
+	assert.Empty(t, spoolFiles(t, dir))
+}
+
+func TestSpoolReaderClosedEarly(t *testing.T) {
+	dir := t.TempDir()
+	s, err := readers.NewSpool(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = s.Write([]byte("before"))
+	assert.NoError(t, err)
+	assert.NoError(t, s.Close())
+
+	// The writer carries on without failing, but nothing more is kept
+	n, err := s.Write([]byte("after"))
+	assert.NoError(t, err)
+	assert.Equal(t, 5, n)
+	_, err = s.Read(make([]byte, 10))
+	assert.ErrorIs(t, err, os.ErrClosed)
+
+	assert.Len(t, spoolFiles(t, dir), 1)
+	s.Finish(nil)
+	assert.Empty(t, spoolFiles(t, dir))
+}
+
+func TestSpoolMissingDirectory(t *testing.T) {
+	_, err := readers.NewSpool(path.Join(t.TempDir(), "missing"))
+	assert.Error(t, err)
+}
+
+func TestSpoolPath(t *testing.T) {
+	tempPath := path.Join(t.TempDir(), "s3-temp")
+	spoolPath, err := datastores.SpoolPath(config.DatastoreConfig{Type: "s3", Options: map[string]string{"tempPath": tempPath}})
+	assert.NoError(t, err)
+	assert.Equal(t, tempPath, spoolPath)
+	stat, err := os.Stat(tempPath)
+	if assert.NoError(t, err) {
+		assert.True(t, stat.IsDir())
+	}
+
+	// Datastores without a temporary path use the system's
+	spoolPath, err = datastores.SpoolPath(config.DatastoreConfig{Type: "s3", Options: map[string]string{}})
+	assert.NoError(t, err)
+	assert.Equal(t, "", spoolPath)
+	spoolPath, err = datastores.SpoolPath(config.DatastoreConfig{Type: "file", Options: map[string]string{"path": t.TempDir()}})
+	assert.NoError(t, err)
+	assert.Equal(t, "", spoolPath)
+}
@@ -8,6 +8,7 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/t2bot/matrix-media-repo/common/assets"
@@ -15,11 +16,16 @@ import (
 	"github.com/t2bot/matrix-media-repo/homeserver_interop"
 	"github.com/t2bot/matrix-media-repo/homeserver_interop/mmr"
 	"github.com/t2bot/matrix-media-repo/homeserver_interop/synapse"
+	"github.com/t2bot/matrix-media-repo/pool"
 	"github.com/testcontainers/testcontainers-go"
 	"github.com/testcontainers/testcontainers-go/modules/postgres"
 	"github.com/testcontainers/testcontainers-go/wait"
 )
 
+// Tests can run pipelines in-process against the containers too, which need the worker pools. These are only set up
+// once, no matter how many suites run.
+var initPools = new(sync.Once)
+
 type ContainerDeps struct {
 	ctx               context.Context
 	pgContainer       *postgres.PostgresContainer
@@ -201,6 +207,7 @@ func MakeTestDeps() (*ContainerDeps, error) {
 	assets.SetupMigrations(config.DefaultMigrationsPath)
 	assets.SetupTemplates(config.DefaultTemplatesPath)
 	assets.SetupAssets(config.DefaultAssetsPath)
+	initPools.Do(pool.Init)
 
 	return &ContainerDeps{
 		ctx:               ctx,
@@ -0,0 +1,169 @@
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/thumbnailing"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/sandbox"
+)
+
+func TestSandboxJobStreaming(t *testing.T) {
+	first := make([]byte, 200*1024) // several chunks
+	if _, err := rand.Read(first); err != nil {
+		t.Fatal(err)
+	}
+	second := []byte("second")
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, sandbox.WriteJob(buf, sandbox.Job{ContentType: "image/png", Width: 32}, bytes.NewReader(first)))
+	assert.NoError(t, sandbox.WriteJob(buf, sandbox.Job{ContentType: "image/jpeg"}, bytes.NewReader(second)))
+	assert.NoError(t, sandbox.WriteJob(buf, sandbox.Job{ContentType: "image/gif"}, bytes.NewReader(nil)))
+
+	r := bufio.NewReader(buf)
+	job, media, err := sandbox.ReadJob(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "image/png", job.ContentType)
+	assert.Equal(t, 32, job.Width)
+	b, err := io.ReadAll(media)
+	assert.NoError(t, err)
+	assert.Equal(t, first, b)
+
+	job, media, err = sandbox.ReadJob(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "image/jpeg", job.ContentType)
+	b, err = io.ReadAll(media)
+	assert.NoError(t, err)
+	assert.Equal(t, second, b)
+
+	job, media, err = sandbox.ReadJob(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "image/gif", job.ContentType)
+	b, err = io.ReadAll(media)
+	assert.NoError(t, err)
+	assert.Empty(t, b)
+
+	_, _, err = sandbox.ReadJob(r)
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestSandboxJobMalformed(t *testing.T) {
+	full := &bytes.Buffer{}
+	assert.NoError(t, sandbox.WriteJob(full, sandbox.Job{}, bytes.NewReader([]byte("some media"))))
+
+	// Ending part way through the media is an error, not the end of the media
+	_, media, err := sandbox.ReadJob(bufio.NewReader(bytes.NewReader(full.Bytes()[:full.Len()-6])))
+	assert.NoError(t, err)
+	_, err = io.ReadAll(media)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Chunk lengths are limited
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, 1<<30)
+	_, media, err = sandbox.ReadJob(bufio.NewReader(bytes.NewReader(append([]byte("{}\n"), header...))))
+	assert.NoError(t, err)
+	_, err = io.ReadAll(media)
+	assert.Error(t, err)
+
+	_, _, err = sandbox.ReadJob(bufio.NewReader(bytes.NewReader([]byte("{}"))))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestSandboxWorker(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 256, 128))
+	for x := 0; x < 256; x++ {
+		img.SetNRGBA(x, x%128, color.NRGBA{R: 255, A: 255})
+	}
+	pngBytes := &bytes.Buffer{}
+	if err := png.Encode(pngBytes, img); err != nil {
+		t.Fatal(err)
+	}
+
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- thumbnailing.ServeSandboxWorker(inR, outW, sandbox.Limits{})
+	}()
+	results := bufio.NewReader(outR)
+	conf := config.Get().Thumbnails.ThumbnailsConfig
+
+	// Unsupported media isn't read by the worker, but is still consumed so the next job works
+	go func() {
+		assert.NoError(t, sandbox.WriteJob(inW, sandbox.Job{ContentType: "application/x-unknown", Width: 32, Height: 32, Method: "scale", Config: conf}, bytes.NewReader(make([]byte, 300*1024))))
+	}()
+	result, thumbnail, err := sandbox.ReadResult(results)
+	assert.NoError(t, err)
+	assert.Equal(t, "unsupported", result.ErrorCode)
+	assert.Empty(t, thumbnail)
+
+	go func() {
+		assert.NoError(t, sandbox.WriteJob(inW, sandbox.Job{ContentType: "image/png", Width: 64, Height: 64, Method: "scale", Config: conf}, bytes.NewReader(pngBytes.Bytes())))
+	}()
+	result, thumbnail, err = sandbox.ReadResult(results)
+	assert.NoError(t, err)
+	assert.Empty(t, result.Error)
+	assert.Equal(t, "image/png", result.ContentType)
+	decoded, err := png.Decode(bytes.NewReader(thumbnail))
+	assert.NoError(t, err)
+	assert.Equal(t, 64, decoded.Bounds().Dx())
+	assert.Equal(t, 32, decoded.Bounds().Dy())
+
+	// Metadata is extracted by the worker too
+	go func() {
+		assert.NoError(t, sandbox.WriteJob(inW, sandbox.Job{Kind: sandbox.JobKindMetadata, ContentType: "image/png", Config: conf}, bytes.NewReader(pngBytes.Bytes())))
+	}()
+	result, thumbnail, err = sandbox.ReadResult(results)
+	assert.NoError(t, err)
+	assert.Empty(t, result.Error)
+	assert.Empty(t, thumbnail)
+	if assert.NotNil(t, result.Metadata) {
+		assert.Equal(t, 256, result.Metadata.Width)
+		assert.Equal(t, 128, result.Metadata.Height)
+		assert.Nil(t, result.Metadata.Audio)
+	}
+
+	// Broken media is reported as an error rather than crashing the worker
+	go func() {
+		assert.NoError(t, sandbox.WriteJob(inW, sandbox.Job{Kind: sandbox.JobKindMetadata, ContentType: "image/png", Config: conf}, bytes.NewReader(pngBytes.Bytes()[:20])))
+	}()
+	result, _, err = sandbox.ReadResult(results)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, result.Error)
+	assert.Nil(t, result.Metadata)
+
+	// Closing the input stops the worker
+	assert.NoError(t, inW.Close())
+	assert.NoError(t, <-done)
+}
+
+func TestExtractMetadata(t *testing.T) {
+	ctx := rcontext.InitialNoConfig()
+	img := image.NewNRGBA(image.Rect(0, 0, 40, 30))
+	pngBytes := &bytes.Buffer{}
+	if err := png.Encode(pngBytes, img); err != nil {
+		t.Fatal(err)
+	}
+
+	metadata, err := thumbnailing.ExtractMetadata(bytes.NewReader(pngBytes.Bytes()), "image/png", ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 40, metadata.Width)
+	assert.Equal(t, 30, metadata.Height)
+
+	// Types we can't parse have empty metadata, but broken media of a type we can parse is an error
+	metadata, err = thumbnailing.ExtractMetadata(bytes.NewReader([]byte("hello")), "text/plain", ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, metadata.Width)
+	_, err = thumbnailing.ExtractMetadata(bytes.NewReader(pngBytes.Bytes()[:20]), "image/png", ctx)
+	assert.Error(t, err)
+}
@@ -0,0 +1,194 @@
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/gif"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/thumbnails"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/i"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/u"
+)
+
+// A 1x1 lossless WebP bitstream
+var webpPixel = []byte{0x2f, 0x00, 0x00, 0x00, 0x10, 0x07, 0x10, 0x11, 0x11, 0x88, 0x88, 0xfe, 0x07}
+
+// A lossless WebP bitstream header claiming to be 16384x16384
+var webpHuge = []byte{0x2f, 0xff, 0xff, 0xff, 0x0f}
+
+func webpChunk(fourCC string, payload []byte) []byte {
+	b := append([]byte(fourCC), binary.LittleEndian.AppendUint32(nil, uint32(len(payload)))...)
+	b = append(b, payload...)
+	if len(payload)%2 == 1 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func webpUint24(v int) []byte {
+	return []byte{byte(v), byte(v >> 8), byte(v >> 16)}
+}
+
+func webpFile(chunks ...[]byte) []byte {
+	body := []byte("WEBP")
+	for _, c := range chunks {
+		body = append(body, c...)
+	}
+	return append(append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...), body...)
+}
+
+func webpCanvas(width int, height int, animated bool) []byte {
+	flags := byte(0)
+	if animated {
+		flags = 0x02
+	}
+	payload := append([]byte{flags, 0, 0, 0}, webpUint24(width-1)...)
+	return webpChunk("VP8X", append(payload, webpUint24(height-1)...))
+}
+
+func webpFrame(width int, height int, delayMs int, image ...[]byte) []byte {
+	payload := append(webpUint24(0), webpUint24(0)...)
+	payload = append(payload, webpUint24(width-1)...)
+	payload = append(payload, webpUint24(height-1)...)
+	payload = append(payload, webpUint24(delayMs)...)
+	payload = append(payload, 0)
+	for _, c := range image {
+		payload = append(payload, c...)
+	}
+	return webpChunk("ANMF", payload)
+}
+
+func TestWebpAnimations(t *testing.T) {
+	ctx := rcontext.InitialNoConfig()
+	ctx.Config.Thumbnails = config.Get().Thumbnails.ThumbnailsConfig
+	ctx.Config.Thumbnails.MaxPixels = 1000 * 1000
+
+	anim := webpChunk("ANIM", []byte{0, 0, 0, 0, 0, 0})
+	pixel := webpChunk("VP8L", webpPixel)
+	tests := []struct {
+		name    string
+		file    []byte
+		tooBig  bool
+		success bool
+	}{
+		{name: "valid", file: webpFile(webpCanvas(1, 1, true), anim, webpFrame(1, 1, 100, pixel), webpFrame(1, 1, 100, pixel)), success: true},
+		{name: "truncated chunk header", file: webpFile(webpCanvas(1, 1, true), anim, webpFrame(1, 1, 100, pixel), []byte("ANMF\x01"))},
+		{name: "truncated chunk", file: webpFile(webpCanvas(1, 1, true), anim, webpFrame(1, 1, 100, pixel)[:20])},
+		{name: "truncated frame header", file: webpFile(webpCanvas(1, 1, true), anim, webpChunk("ANMF", make([]byte, 10)))},
+		{name: "truncated frame image", file: webpFile(webpCanvas(1, 1, true), anim, webpFrame(1, 1, 100, pixel[:12]))},
+		{name: "no frames", file: webpFile(webpCanvas(1, 1, true), anim)},
+		{name: "frame without image", file: webpFile(webpCanvas(1, 1, true), anim, webpFrame(1, 1, 100))},
+		{name: "oversized canvas", file: webpFile(webpCanvas(20000, 20000, true), anim, webpFrame(1, 1, 100, pixel)), tooBig: true},
+		{name: "oversized frame", file: webpFile(webpCanvas(1, 1, true), anim, webpFrame(2000, 2000, 100, pixel)), tooBig: true},
+		{name: "oversized frame bitstream", file: webpFile(webpCanvas(1, 1, true), anim, webpFrame(1, 1, 100, webpChunk("VP8L", webpHuge))), tooBig: true},
+		{name: "not a webp", file: []byte("RIFF\x04\x00\x00\x00WAVE")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			generator, _ := i.GetGenerator(bytes.NewReader(test.file), "image/webp", true)
+			if !assert.NotNil(t, generator) {
+				return
+			}
+			animated, ok := generator.(i.AnimatedGenerator)
+			if !assert.True(t, ok) {
+				return
+			}
+
+			thumb, err := animated.GenerateAnimatedThumbnail(bytes.NewReader(test.file), "image/webp", 32, 32, "scale", u.AnimatedFormatGif, ctx)
+			if test.success {
+				if assert.NoError(t, err) {
+					assert.Equal(t, "image/gif", thumb.ContentType)
+					_ = thumb.Reader.Close()
+				}
+				return
+			}
+			assert.Error(t, err)
+			if test.tooBig {
+				assert.ErrorIs(t, err, common.ErrMediaTooLarge)
+			} else {
+				assert.NotErrorIs(t, err, common.ErrMediaTooLarge)
+			}
+		})
+	}
+}
+
+func TestAnimationFramePicking(t *testing.T) {
+	ctx := rcontext.InitialNoConfig()
+	delays := make([]time.Duration, 10)
+	for idx := range delays {
+		delays[idx] = 10 * time.Millisecond
+	}
+	build := func(maxFps int, maxFrames int) (*u.AnimationBuilder, []int) {
+		ctx.Config.Thumbnails.MaxAnimatedFps = maxFps
+		ctx.Config.Thumbnails.MaxAnimatedFrames = maxFrames
+		builder := u.NewAnimationBuilder(ctx, 4, 4, "scale", delays, 0)
+		wanted := make([]int, 0)
+		for idx := range delays {
+			if builder.Wants(idx) {
+				wanted = append(wanted, idx)
+				assert.NoError(t, builder.AddFrame(idx, image.NewRGBA(image.Rect(0, 0, 8, 8)), nil))
+			}
+		}
+		return builder, wanted
+	}
+	gifDelays := func(builder *u.AnimationBuilder) []int {
+		thumb, err := builder.Encode(u.AnimatedFormatGif)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		defer thumb.Reader.Close()
+		b, err := io.ReadAll(thumb.Reader)
+		assert.NoError(t, err)
+		g, err := gif.DecodeAll(bytes.NewReader(b))
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		return g.Delay
+	}
+
+	// No limits keeps every frame
+	_, wanted := build(0, 0)
+	assert.Equal(t, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, wanted)
+
+	// Frames are merged to stay under the frame rate, keeping the overall timing
+	builder, wanted := build(50, 0)
+	assert.Equal(t, []int{0, 2, 4, 6, 8}, wanted)
+	assert.Equal(t, []int{2, 2, 2, 2, 2}, gifDelays(builder))
+
+	// Then evenly dropped to stay under the frame count
+	builder, wanted = build(50, 3)
+	assert.Equal(t, []int{0, 4, 8}, wanted)
+	assert.Equal(t, []int{4, 4, 2}, gifDelays(builder))
+}
+
+func TestPickAnimatedFormat(t *testing.T) {
+	ctx := rcontext.InitialNoConfig()
+	ctx.Config.Thumbnails.AnimatedFormats = []string{"webp", "apng", "gif"}
+
+	tests := []struct {
+		accept   string
+		expected string
+	}{
+		{accept: "", expected: "gif"},
+		{accept: "image/webp", expected: "webp"},
+		{accept: "image/avif,image/webp,*/*", expected: "webp"},
+		{accept: "image/apng, image/webp;q=0.9", expected: "webp"}, // configured order wins over q-values
+		{accept: "image/webp;q=0, image/apng", expected: "apng"},
+		{accept: "image/webp;q=0.0,image/apng;q=0.000", expected: "gif"},
+		{accept: "image/webp;q=invalid", expected: "webp"},
+		{accept: "IMAGE/WEBP", expected: "webp"},
+		{accept: "image/webp;;;", expected: "gif"}, // unparsable entries are ignored
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, thumbnails.PickAnimatedFormat(ctx, true, test.accept), test.accept)
+	}
+	assert.Equal(t, "", thumbnails.PickAnimatedFormat(ctx, false, "image/webp"))
+}
@@ -0,0 +1,77 @@
+package test
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/u"
+)
+
+// detailedImage makes a flat grey image with a busy pattern inside the detail rectangle.
+func detailedImage(width int, height int, detail image.Rectangle) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.NRGBA{R: 128, G: 128, B: 128, A: 255}
+			if (image.Point{X: x, Y: y}).In(detail) {
+				v := uint8((x*37 + y*91 + (x*y)%53) % 256)
+				c = color.NRGBA{R: v, G: 255 - v, B: v / 2, A: 255}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestNormalizeCropStrategy(t *testing.T) {
+	assert.Equal(t, u.CropEntropy, u.NormalizeCropStrategy(u.CropEntropy))
+	assert.Equal(t, u.CropEdges, u.NormalizeCropStrategy(u.CropEdges))
+	assert.Equal(t, u.CropCenter, u.NormalizeCropStrategy(u.CropCenter))
+	assert.Equal(t, u.CropCenter, u.NormalizeCropStrategy(""))
+	assert.Equal(t, u.CropCenter, u.NormalizeCropStrategy("faces"))
+}
+
+func TestPickCropRegion(t *testing.T) {
+	left := detailedImage(300, 100, image.Rect(0, 0, 100, 100))
+	bottom := detailedImage(100, 300, image.Rect(0, 200, 100, 300))
+	flat := detailedImage(300, 100, image.Rect(0, 0, 0, 0))
+
+	// Centre cropping (and unknown strategies) always use the middle of the image
+	assert.Equal(t, image.Rect(100, 0, 200, 100), u.PickCropRegion(left, 50, 50, u.CropCenter))
+	assert.Equal(t, image.Rect(100, 0, 200, 100), u.PickCropRegion(left, 50, 50, "faces"))
+
+	// Images which already have the right aspect ratio aren't cropped
+	assert.Equal(t, image.Rect(0, 0, 300, 100), u.PickCropRegion(left, 90, 30, u.CropEntropy))
+
+	// Without any detail, the centre wins the tie
+	assert.Equal(t, image.Rect(100, 0, 200, 100), u.PickCropRegion(flat, 50, 50, u.CropEntropy))
+	assert.Equal(t, image.Rect(100, 0, 200, 100), u.PickCropRegion(flat, 50, 50, u.CropEdges))
+
+	for _, strategy := range []string{u.CropEntropy, u.CropEdges} {
+		// The region moves towards the detail, along whichever axis is being cropped
+		region := u.PickCropRegion(left, 50, 50, strategy)
+		assert.Equal(t, 100, region.Dx(), strategy)
+		assert.Equal(t, 100, region.Dy(), strategy)
+		assert.LessOrEqual(t, region.Min.X, 10, strategy)
+
+		region = u.PickCropRegion(bottom, 50, 50, strategy)
+		assert.Equal(t, 100, region.Dx(), strategy)
+		assert.Equal(t, 100, region.Dy(), strategy)
+		assert.GreaterOrEqual(t, region.Min.Y, 190, strategy)
+
+		// Regions are relative to the image's bounds, which don't always start at zero
+		sub := left.SubImage(image.Rect(0, 10, 300, 60))
+		region = u.PickCropRegion(sub, 50, 50, strategy)
+		assert.Equal(t, 10, region.Min.Y, strategy)
+		assert.Equal(t, 50, region.Dx(), strategy)
+		assert.Equal(t, 50, region.Dy(), strategy)
+		assert.LessOrEqual(t, region.Min.X, 50, strategy)
+	}
+
+	// Extreme aspect ratios still produce a region at least a pixel wide
+	region := u.PickCropRegion(left, 1, 1000, u.CropEdges)
+	assert.Equal(t, 1, region.Dx())
+	assert.Equal(t, 100, region.Dy())
+}
@@ -0,0 +1,160 @@
+package test
+
+import (
+	"log"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"github.com/t2bot/matrix-media-repo/api/_apimeta"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/api/custom"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_preview"
+	"github.com/t2bot/matrix-media-repo/test/test_internals"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+type UrlPreviewAdminSuite struct {
+	suite.Suite
+	deps *test_internals.ContainerDeps
+}
+
+func (s *UrlPreviewAdminSuite) SetupSuite() {
+	deps, err := test_internals.MakeTestDeps()
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.deps = deps
+}
+
+func (s *UrlPreviewAdminSuite) TearDownSuite() {
+	if s.deps != nil {
+		if s.T().Failed() {
+			s.deps.Debug()
+		}
+		s.deps.Teardown()
+	}
+}
+
+func (s *UrlPreviewAdminSuite) makeContext() rcontext.RequestContext {
+	ctx := rcontext.Initial()
+	ctx.Config.UrlPreviews.Canonicalization.Enabled = true
+	ctx.Config.UrlPreviews.Canonicalization.StripParams = []string{"utm_*"}
+	return ctx
+}
+
+// insertPreview caches a preview for the URL in the current hour, with an image if imageMxc is set.
+func (s *UrlPreviewAdminSuite) insertPreview(ctx rcontext.RequestContext, previewUrl string, imageMxc string) {
+	assert.NoError(s.T(), database.GetInstance().UrlPreviews.Prepare(ctx).Insert(&database.DbUrlPreview{
+		Url:            previewUrl,
+		BucketTs:       util.GetHourBucket(util.NowMillis()),
+		Title:          "Cached preview",
+		ImageMxc:       imageMxc,
+		LanguageHeader: ctx.Config.UrlPreviews.DefaultLanguage,
+	}))
+}
+
+func (s *UrlPreviewAdminSuite) payload(res interface{}) interface{} {
+	dnc, ok := res.(*_responses.DoNotCacheResponse)
+	if !assert.True(s.T(), ok, "expected a successful response, got %#v", res) {
+		s.T().FailNow()
+	}
+	return dnc.Payload
+}
+
+func (s *UrlPreviewAdminSuite) TestBlockAndUnblock() {
+	t := s.T()
+	ctx := s.makeContext()
+	user := _apimeta.UserInfo{UserId: "@admin:example.org"}
+
+	domain, err := util.GenerateRandomString(16)
+	assert.NoError(t, err)
+	domain = strings.ToLower(domain) + ".example.org"
+	pageUrl := "https://" + domain + "/page"
+	s.insertPreview(ctx, pageUrl, "mxc://"+domain+"/image")
+
+	// Blocking a variant of the URL deletes the cached preview
+	res := custom.BlockUrlPreview(httptest.NewRequest("POST", "/", strings.NewReader(`{"url": "`+pageUrl+`?utm_source=x#top", "reason": "spam"}`)), ctx, user)
+	deleted := s.payload(res).(*custom.DeletedUrlPreviews)
+	assert.Equal(t, 1, deleted.Deleted)
+	assert.Equal(t, []string{"mxc://" + domain + "/image"}, deleted.ImageMxcs)
+
+	// ... and stops it from being previewed in any of its forms, before anything is fetched
+	for _, variant := range []string{pageUrl, pageUrl + "#other", strings.Replace(pageUrl, "https://", "HTTPS://", 1) + "?utm_medium=y"} {
+		_, err = pipeline_preview.Execute(ctx, s.deps.Homeservers[0].ServerName, variant, "", pipeline_preview.PreviewOpts{
+			Timestamp:      util.NowMillis(),
+			LanguageHeader: ctx.Config.UrlPreviews.DefaultLanguage,
+		})
+		assert.ErrorIs(t, err, common.ErrUrlNotAllowed, variant)
+	}
+
+	// Blocked URLs are reported
+	res = custom.GetUrlPreviews(httptest.NewRequest("GET", "/?url="+url.QueryEscape(pageUrl+"#frag"), nil), ctx, user)
+	info := s.payload(res).(*custom.UrlPreviewsInfo)
+	assert.True(t, info.Blocked)
+	assert.Empty(t, info.Previews)
+	if assert.NotNil(t, info.Block) {
+		assert.Equal(t, pageUrl, info.Block.Url)
+		assert.Equal(t, "spam", info.Block.Reason)
+	}
+	blocks := s.payload(custom.GetUrlPreviewBlocks(httptest.NewRequest("GET", "/", nil), ctx, user)).([]*custom.UrlPreviewBlockInfo)
+	found := false
+	for _, b := range blocks {
+		found = found || b.Url == pageUrl
+	}
+	assert.True(t, found)
+
+	// Unblocking lets the cache be used again
+	res = custom.UnblockUrlPreview(httptest.NewRequest("DELETE", "/?url="+url.QueryEscape(pageUrl), nil), ctx, user)
+	s.payload(res)
+	s.insertPreview(ctx, pageUrl, "")
+	preview, err := pipeline_preview.Execute(ctx, s.deps.Homeservers[0].ServerName, pageUrl, "", pipeline_preview.PreviewOpts{
+		Timestamp:      util.NowMillis(),
+		LanguageHeader: ctx.Config.UrlPreviews.DefaultLanguage,
+	})
+	assert.NoError(t, err)
+	if assert.NotNil(t, preview) {
+		assert.Equal(t, "Cached preview", preview.Title)
+	}
+}
+
+func (s *UrlPreviewAdminSuite) TestDeletePreviews() {
+	t := s.T()
+	ctx := s.makeContext()
+	user := _apimeta.UserInfo{UserId: "@admin:example.org"}
+
+	domain, err := util.GenerateRandomString(16)
+	assert.NoError(t, err)
+	domain = strings.ToLower(domain) + ".example.org"
+	s.insertPreview(ctx, "https://"+domain+"/a", "mxc://"+domain+"/a")
+	s.insertPreview(ctx, "https://"+domain+":8443/b", "")
+	s.insertPreview(ctx, "https://"+domain+"/100%_real", "")
+	s.insertPreview(ctx, "https://"+domain+"/100x_real", "")
+	s.insertPreview(ctx, "https://sub."+domain+"/c", "")
+
+	// Prefixes are matched literally, even with LIKE wildcards in them
+	res := custom.DeleteUrlPreviews(httptest.NewRequest("DELETE", "/?url_prefix="+url.QueryEscape("https://"+domain+"/100%_"), nil), ctx, user)
+	deleted := s.payload(res).(*custom.DeletedUrlPreviews)
+	assert.Equal(t, 1, deleted.Deleted)
+	assert.Empty(t, deleted.ImageMxcs)
+
+	// Domains match with any port, but not subdomains
+	res = custom.DeleteUrlPreviews(httptest.NewRequest("DELETE", "/?domain="+url.QueryEscape(domain), nil), ctx, user)
+	deleted = s.payload(res).(*custom.DeletedUrlPreviews)
+	assert.Equal(t, 3, deleted.Deleted)
+	assert.Equal(t, []string{"mxc://" + domain + "/a"}, deleted.ImageMxcs)
+
+	previews, err := database.GetInstance().UrlPreviews.Prepare(ctx).GetAllForUrl("https://sub." + domain + "/c")
+	assert.NoError(t, err)
+	assert.Len(t, previews, 1)
+}
+
+func TestUrlPreviewAdminSuite(t *testing.T) {
+	suite.Run(t, new(UrlPreviewAdminSuite))
+}
@@ -0,0 +1,83 @@
+package test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/api/_apimeta"
+	"github.com/t2bot/matrix-media-repo/api/_responses"
+	"github.com/t2bot/matrix-media-repo/api/custom"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_preview"
+)
+
+func TestUrlPreviewBlockKey(t *testing.T) {
+	blockKey := func(ctx rcontext.RequestContext, raw string) string {
+		parsed, err := pipeline_preview.ParseUrl(ctx, raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pipeline_preview.BlockKey(parsed)
+	}
+
+	ctx := rcontext.InitialNoConfig()
+	ctx.Config.UrlPreviews.Canonicalization = config.UrlCanonicalizationConfig{Enabled: false}
+
+	// Fragments never matter, but everything else does without canonicalization
+	assert.Equal(t, "https://example.org/page?a=1", blockKey(ctx, "https://example.org/page?a=1#section"))
+	assert.Equal(t, "https://example.org/page?a=1", blockKey(ctx, "https://example.org/page?a=1#"))
+	assert.Equal(t, "https://Example.org/page?utm_source=x", blockKey(ctx, "https://Example.org/page?utm_source=x"))
+
+	// With canonicalization, the forms of a URL which are previewed the same are blocked the same
+	ctx.Config.UrlPreviews.Canonicalization = config.UrlCanonicalizationConfig{Enabled: true, StripParams: []string{"utm_*"}}
+	blocked := blockKey(ctx, "https://example.org/page")
+	for _, variant := range []string{
+		"https://example.org/page#section",
+		"HTTPS://EXAMPLE.ORG:443/page",
+		"https://example.org/page?utm_source=x&utm_medium=y",
+	} {
+		assert.Equal(t, blocked, blockKey(ctx, variant), variant)
+	}
+	assert.NotEqual(t, blocked, blockKey(ctx, "https://example.org/page?id=1"))
+	assert.NotEqual(t, blocked, blockKey(ctx, "https://example.org/other"))
+
+	_, err := pipeline_preview.ParseUrl(ctx, "https://example.org/%zz")
+	assert.ErrorIs(t, err, common.ErrInvalidHost)
+}
+
+func TestUrlPreviewAdminValidation(t *testing.T) {
+	user := _apimeta.UserInfo{UserId: "@admin:example.org"}
+	tests := []struct {
+		name    string
+		handler func(r *http.Request, rctx rcontext.RequestContext, user _apimeta.UserInfo) interface{}
+		method  string
+		query   url.Values
+		body    string
+	}{
+		{name: "get without url", handler: custom.GetUrlPreviews, method: "GET", query: url.Values{}},
+		{name: "get non-http url", handler: custom.GetUrlPreviews, method: "GET", query: url.Values{"url": {"ftp://example.org/file"}}},
+		{name: "delete without filter", handler: custom.DeleteUrlPreviews, method: "DELETE", query: url.Values{}},
+		{name: "delete with both filters", handler: custom.DeleteUrlPreviews, method: "DELETE", query: url.Values{"url_prefix": {"https://example.org/"}, "domain": {"example.org"}}},
+		{name: "delete with path in domain", handler: custom.DeleteUrlPreviews, method: "DELETE", query: url.Values{"domain": {"example.org/page"}}},
+		{name: "refresh with invalid json", handler: custom.RefreshUrlPreview, method: "POST", body: "{"},
+		{name: "refresh non-http url", handler: custom.RefreshUrlPreview, method: "POST", body: `{"url": "mxc://example.org/abc"}`},
+		{name: "block with invalid json", handler: custom.BlockUrlPreview, method: "POST", body: "not json"},
+		{name: "block without url", handler: custom.BlockUrlPreview, method: "POST", body: `{"reason": "spam"}`},
+		{name: "unblock relative url", handler: custom.UnblockUrlPreview, method: "DELETE", query: url.Values{"url": {"/page"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(test.method, "/_matrix/media/unstable/admin/url_previews?"+test.query.Encode(), strings.NewReader(test.body))
+			res := test.handler(r, rcontext.InitialNoConfig(), user)
+			if errRes, ok := res.(*_responses.ErrorResponse); assert.True(t, ok, "expected an error response, got %#v", res) {
+				assert.Equal(t, common.ErrCodeBadRequest, errRes.InternalCode)
+			}
+		})
+	}
+}
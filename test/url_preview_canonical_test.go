@@ -0,0 +1,39 @@
+package test
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/url_previewing/u"
+)
+
+func TestCanonicalize(t *testing.T) {
+	ctx := rcontext.InitialNoConfig()
+	ctx.Config.UrlPreviews.Canonicalization = config.UrlCanonicalizationConfig{
+		Enabled:     true,
+		StripParams: []string{"utm_*", "fbclid"},
+		Rules: []config.UrlCanonicalizationRule{
+			{Domains: []string{"*.youtube.com"}, StripParams: []string{"si"}, KeepParams: []string{"utm_keep"}},
+		},
+	}
+	canonicalize := func(raw string) string {
+		parsed, err := url.Parse(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u.Canonicalize(parsed, ctx).String()
+	}
+
+	assert.Equal(t, "https://example.org/?b=2&a=1", canonicalize("HTTPS://Example.org:443?utm_source=x&b=2&fbclid=y&a=1#frag"))
+	assert.Equal(t, "https://example.org/", canonicalize("https://example.org/?utm_source=x"))
+
+	// Queries without stripped parameters are left exactly as they were sent
+	assert.Equal(t, "https://example.org/?z=1;y=2&q=a+b%20c", canonicalize("https://example.org/?z=1;y=2&q=a+b%20c"))
+	assert.Equal(t, "https://example.org/?z=1;y=2&q=%7E", canonicalize("https://example.org/?z=1;y=2&utm_medium=x&q=%7E"))
+
+	// Per-domain rules
+	assert.Equal(t, "https://www.youtube.com/watch?v=abc&utm_keep=1", canonicalize("https://www.youtube.com/watch?v=abc&si=x&utm_keep=1"))
+}
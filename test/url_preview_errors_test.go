@@ -0,0 +1,49 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/url_preview"
+	"github.com/t2bot/matrix-media-repo/url_previewing/m"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+func TestUrlPreviewCachedErrorCode(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected string
+	}{
+		{name: "unsupported", err: m.ErrPreviewUnsupported, expected: common.ErrCodeNotFound},
+		{name: "not found", err: common.ErrMediaNotFound, expected: common.ErrCodeNotFound},
+		{name: "host not allowed", err: common.ErrHostNotAllowed, expected: common.ErrCodeForbidden},
+		{name: "wrapped host not allowed", err: fmt.Errorf("dial: %w", common.ErrHostNotAllowed), expected: common.ErrCodeForbidden},
+		{name: "invalid host", err: common.ErrInvalidHost, expected: common.ErrCodeInvalidHost},
+
+		// These may work next time, so aren't cached
+		{name: "timeout", err: context.DeadlineExceeded, expected: ""},
+		{name: "transfer error", err: errors.New("error during transfer"), expected: ""},
+		{name: "too large", err: common.ErrMediaTooLarge, expected: ""},
+		{name: "rate limited", err: common.ErrRateLimitExceeded, expected: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, url_preview.CachedErrorCode(test.err))
+		})
+	}
+}
+
+func TestUrlPreviewHourBucket(t *testing.T) {
+	// Previews are cached per hour, so requests within the same hour share a bucket
+	hour := int64(1700000000000) / 3600000 * 3600000
+	assert.Equal(t, hour, util.GetHourBucket(hour))
+	assert.Equal(t, hour, util.GetHourBucket(hour+1))
+	assert.Equal(t, hour, util.GetHourBucket(hour+3599999))
+	assert.Equal(t, hour+3600000, util.GetHourBucket(hour+3600000))
+	assert.Equal(t, hour-3600000, util.GetHourBucket(hour-1))
+}
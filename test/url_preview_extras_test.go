@@ -0,0 +1,246 @@
+package test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/url_previewing/m"
+	"github.com/t2bot/matrix-media-repo/url_previewing/p"
+)
+
+type extrasTestPage struct {
+	html            string
+	contentLanguage string
+}
+
+// makeExtrasServer serves the pages under /page/, and a small PNG for any other path ending in .png. /huge.png is
+// larger than the favicon limit used by makeExtrasContext.
+func makeExtrasServer(pages map[string]extrasTestPage) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if page, ok := pages[strings.TrimPrefix(r.URL.Path, "/page/")]; ok {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			if page.contentLanguage != "" {
+				w.Header().Set("Content-Language", page.contentLanguage)
+			}
+			_, _ = w.Write([]byte(page.html))
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, ".png") {
+			w.Header().Set("Content-Type", "image/png")
+			if r.URL.Path == "/huge.png" {
+				_, _ = w.Write(make([]byte, 4096))
+			} else {
+				_, _ = w.Write([]byte("not really a png"))
+			}
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+}
+
+func makeExtrasContext() rcontext.RequestContext {
+	ctx := rcontext.InitialNoConfig()
+	ctx.Config.TimeoutSeconds.UrlPreviews = 5
+	ctx.Config.UrlPreviews.AllowedNetworks = []string{"127.0.0.1/32"}
+	ctx.Config.UrlPreviews.DisallowedNetworks = []string{}
+	ctx.Config.UrlPreviews.NumWords = 50
+	ctx.Config.UrlPreviews.NumTitleWords = 30
+	ctx.Config.UrlPreviews.MaxLength = 200
+	ctx.Config.UrlPreviews.MaxTitleLength = 150
+	ctx.Config.UrlPreviews.MaxPageSizeBytes = 10240
+	ctx.Config.UrlPreviews.Favicons.Enabled = true
+	ctx.Config.UrlPreviews.Favicons.MaxSizeBytes = 1024
+	return ctx
+}
+
+func generateExtrasPreview(t *testing.T, ctx rcontext.RequestContext, server *httptest.Server, page string, languageHeader string) m.PreviewResult {
+	parsed, err := url.Parse(server.URL + "/page/" + page)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	preview, err := p.GenerateOpenGraphPreview(&m.UrlPayload{UrlString: parsed.String(), ParsedUrl: parsed}, languageHeader, ctx)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	for _, img := range []*m.PreviewImage{preview.Image, preview.Favicon} {
+		if img != nil && img.Data != nil {
+			_, _ = io.Copy(io.Discard, img.Data)
+			_ = img.Data.Close()
+		}
+	}
+	return preview
+}
+
+func TestUrlPreviewTwitterCard(t *testing.T) {
+	server := makeExtrasServer(map[string]extrasTestPage{
+		"twitter": {html: `<html><head>
+			<meta name="twitter:card" content="summary_large_image">
+			<meta name="twitter:site" content="@example">
+			<meta name="twitter:creator" content=" @author ">
+			<meta name="twitter:title" content="Twitter title">
+			<meta name="twitter:description" content="Twitter description">
+			<meta name="twitter:image:src" content="/card.png">
+		</head><body></body></html>`},
+		"opengraph": {html: `<html><head>
+			<meta property="og:title" content="OpenGraph title">
+			<meta name="twitter:title" content="Twitter title">
+			<meta name="twitter:description" content="Twitter description">
+			<meta property="twitter:card" content="summary">
+		</head><body></body></html>`},
+	})
+	defer server.Close()
+	ctx := makeExtrasContext()
+
+	preview := generateExtrasPreview(t, ctx, server, "twitter", "")
+	assert.Equal(t, "summary_large_image", preview.TwitterCard)
+	assert.Equal(t, "@example", preview.TwitterSite)
+	assert.Equal(t, "@author", preview.TwitterCreator)
+	assert.Equal(t, "Twitter title", preview.Title)
+	assert.Equal(t, "Twitter description", preview.Description)
+	if assert.NotNil(t, preview.Image) {
+		assert.Equal(t, server.URL+"/card.png", preview.Image.Url)
+	}
+
+	// OpenGraph takes priority, and the card is still read from property attributes
+	preview = generateExtrasPreview(t, ctx, server, "opengraph", "")
+	assert.Equal(t, "OpenGraph title", preview.Title)
+	assert.Equal(t, "Twitter description", preview.Description)
+	assert.Equal(t, "summary", preview.TwitterCard)
+}
+
+func TestUrlPreviewJsonLd(t *testing.T) {
+	server := makeExtrasServer(map[string]extrasTestPage{
+		"article": {html: `<html><head>
+			<script type="application/ld+json">{not json</script>
+			<script type="application/ld+json">{
+				"@context": "https://schema.org",
+				"@graph": [
+					{"@type": "WebSite", "name": "Example site"},
+					{"@type": ["NewsArticle"], "headline": "Article headline", "name": "Article name",
+					 "description": "Article description", "datePublished": "2024-01-02T03:04:05Z",
+					 "author": [{"@type": "Person", "name": "Alice"}, "Bob"],
+					 "image": [{"@type": "ImageObject", "url": "/article.png"}]}
+				]
+			}</script>
+		</head><body></body></html>`},
+		"product": {html: `<html><head>
+			<script type="application/ld+json">[
+				{"@type": "Organization", "name": "Example org"},
+				{"@type": "Product", "name": "Product name", "thumbnailUrl": "/product.png", "author": {"name": "Carol"}}
+			]</script>
+		</head><body></body></html>`},
+		"ignored": {html: `<html><head><title>Page title</title>
+			<script type="application/ld+json">{"@type": "WebSite", "name": "Example site"}</script>
+		</head><body></body></html>`},
+	})
+	defer server.Close()
+	ctx := makeExtrasContext()
+
+	preview := generateExtrasPreview(t, ctx, server, "article", "")
+	assert.Equal(t, "Article headline", preview.Title)
+	assert.Equal(t, "Article description", preview.Description)
+	assert.Equal(t, "Alice, Bob", preview.Author)
+	assert.Equal(t, "2024-01-02T03:04:05Z", preview.PublishedTime)
+	if assert.NotNil(t, preview.Image) {
+		assert.Equal(t, server.URL+"/article.png", preview.Image.Url)
+	}
+
+	preview = generateExtrasPreview(t, ctx, server, "product", "")
+	assert.Equal(t, "Product name", preview.Title)
+	assert.Equal(t, "Carol", preview.Author)
+	if assert.NotNil(t, preview.Image) {
+		assert.Equal(t, server.URL+"/product.png", preview.Image.Url)
+	}
+
+	// Objects describing something other than the page aren't used
+	preview = generateExtrasPreview(t, ctx, server, "ignored", "")
+	assert.Equal(t, "Page title", preview.Title)
+	assert.Equal(t, "", preview.Author)
+}
+
+func TestUrlPreviewFavicon(t *testing.T) {
+	server := makeExtrasServer(map[string]extrasTestPage{
+		"touch": {html: `<html><head>
+			<link rel="icon" href="/favicon.png" sizes="16x16">
+			<link rel="apple-touch-icon" href="/touch.png">
+			<link rel="icon" type="image/svg+xml" href="/vector-icon">
+			<link rel="icon" href="/vector.svg" sizes="any">
+		</head><body></body></html>`},
+		"sized": {html: `<html><head>
+			<link rel="apple-touch-icon" href="/touch.png">
+			<link rel="shortcut icon" href="/large.png" sizes="32x32 512x512">
+			<link rel="stylesheet" href="/style.png">
+		</head><body></body></html>`},
+		"huge": {html: `<html><head><link rel="icon" href="/huge.png"></head><body></body></html>`},
+		"none": {html: `<html><head><link rel="stylesheet" href="/style.css"></head><body></body></html>`},
+	})
+	defer server.Close()
+	ctx := makeExtrasContext()
+
+	tests := []struct {
+		page     string
+		expected string
+	}{
+		{page: "touch", expected: "/touch.png"},
+		{page: "sized", expected: "/large.png"},
+		{page: "huge", expected: ""}, // over the size limit
+		{page: "none", expected: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.page, func(t *testing.T) {
+			preview := generateExtrasPreview(t, ctx, server, test.page, "")
+			if test.expected == "" {
+				assert.Nil(t, preview.Favicon)
+			} else if assert.NotNil(t, preview.Favicon) {
+				assert.Equal(t, server.URL+test.expected, preview.Favicon.Url)
+				assert.Equal(t, "image/png", preview.Favicon.ContentType)
+			}
+		})
+	}
+
+	ctx.Config.UrlPreviews.Favicons.Enabled = false
+	preview := generateExtrasPreview(t, ctx, server, "touch", "")
+	assert.Nil(t, preview.Favicon)
+}
+
+func TestUrlPreviewLocale(t *testing.T) {
+	head := `<meta property="og:locale" content="en_US">
+		<meta property="og:locale:alternate" content="fr_FR">
+		<meta property="og:locale:alternate" content="de_DE">`
+	server := makeExtrasServer(map[string]extrasTestPage{
+		"plain":    {html: `<html><head>` + head + `</head><body></body></html>`},
+		"served":   {html: `<html><head>` + head + `</head><body></body></html>`, contentLanguage: "fr"},
+		"lang":     {html: `<html lang="de"><head>` + head + `</head><body></body></html>`},
+		"single":   {html: `<html><head><meta property="og:locale" content=" en_GB "></head><body></body></html>`},
+		"nonsense": {html: `<html><head><meta property="og:locale" content="en_US"><meta property="og:locale:alternate" content="!!"></head><body></body></html>`},
+	})
+	defer server.Close()
+	ctx := makeExtrasContext()
+
+	tests := []struct {
+		name           string
+		page           string
+		languageHeader string
+		expected       string
+	}{
+		{name: "no preference", page: "plain", expected: "en_US"},
+		{name: "requested language", page: "plain", languageHeader: "de-DE,de;q=0.9", expected: "de_DE"},
+		{name: "unavailable language", page: "plain", languageHeader: "ja", expected: "en_US"},
+		{name: "served language", page: "served", languageHeader: "de", expected: "fr_FR"},
+		{name: "page language", page: "lang", languageHeader: "fr", expected: "de_DE"},
+		{name: "single locale", page: "single", languageHeader: "fr", expected: "en_GB"},
+		{name: "invalid alternate", page: "nonsense", languageHeader: "fr", expected: "en_US"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			preview := generateExtrasPreview(t, ctx, server, test.page, test.languageHeader)
+			assert.Equal(t, test.expected, preview.Locale)
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package test
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/database"
+	"github.com/t2bot/matrix-media-repo/pipelines/_steps/url_preview"
+	"github.com/t2bot/matrix-media-repo/test/test_internals"
+	"github.com/t2bot/matrix-media-repo/url_previewing/m"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+type UrlPreviewFaviconSuite struct {
+	suite.Suite
+	deps *test_internals.ContainerDeps
+}
+
+func (s *UrlPreviewFaviconSuite) SetupSuite() {
+	deps, err := test_internals.MakeTestDeps()
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.deps = deps
+}
+
+func (s *UrlPreviewFaviconSuite) TearDownSuite() {
+	if s.deps != nil {
+		if s.T().Failed() {
+			s.deps.Debug()
+		}
+		s.deps.Teardown()
+	}
+}
+
+func (s *UrlPreviewFaviconSuite) uploadFavicon(ctx rcontext.RequestContext, iconUrl string, userId string) *database.DbUrlPreview {
+	t := s.T()
+	_, img, err := test_internals.MakeTestImage(32, 32)
+	assert.NoError(t, err)
+	b, err := io.ReadAll(img)
+	assert.NoError(t, err)
+
+	record := &database.DbUrlPreview{}
+	url_preview.UploadFavicon(ctx, &m.PreviewImage{
+		ContentType: "image/png",
+		Data:        io.NopCloser(bytes.NewReader(b)),
+		Url:         iconUrl,
+	}, s.deps.Homeservers[0].ServerName, userId, record)
+	return record
+}
+
+func (s *UrlPreviewFaviconSuite) TestSharesFavicons() {
+	t := s.T()
+	ctx := rcontext.Initial()
+
+	suffix, err := util.GenerateRandomString(16)
+	assert.NoError(t, err)
+	first := "@first_" + suffix + ":" + s.deps.Homeservers[0].ServerName
+	second := "@second_" + suffix + ":" + s.deps.Homeservers[0].ServerName
+	iconUrl := "https://" + suffix + ".example.org/favicon.png"
+
+	record1 := s.uploadFavicon(ctx, iconUrl, first)
+	if !assert.NotNil(t, record1.Extra) || !assert.NotEmpty(t, record1.Extra.FaviconMxc) {
+		return
+	}
+	assert.Equal(t, "image/png", record1.Extra.FaviconType)
+
+	// Another preview using the same icon gets the same media, without storing it for the second user
+	record2 := s.uploadFavicon(ctx, iconUrl, second)
+	if assert.NotNil(t, record2.Extra) {
+		assert.Equal(t, record1.Extra.FaviconMxc, record2.Extra.FaviconMxc)
+		assert.Equal(t, record1.Extra.FaviconType, record2.Extra.FaviconType)
+	}
+	media, err := database.GetInstance().Media.Prepare(ctx).GetByUserId(second)
+	assert.NoError(t, err)
+	assert.Empty(t, media)
+
+	// Icons from elsewhere are stored separately
+	record3 := s.uploadFavicon(ctx, "https://other."+suffix+".example.org/favicon.png", second)
+	if assert.NotNil(t, record3.Extra) {
+		assert.NotEqual(t, record1.Extra.FaviconMxc, record3.Extra.FaviconMxc)
+	}
+	media, err = database.GetInstance().Media.Prepare(ctx).GetByUserId(second)
+	assert.NoError(t, err)
+	assert.Len(t, media, 1)
+}
+
+func TestUrlPreviewFaviconSuite(t *testing.T) {
+	suite.Run(t, new(UrlPreviewFaviconSuite))
+}
@@ -0,0 +1,105 @@
+package test
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/url_previewing/u"
+)
+
+// connectProxy is a minimal HTTP proxy which only supports CONNECT, recording where it was asked to connect to.
+type connectProxy struct {
+	lock    sync.Mutex
+	targets []string
+}
+
+func (p *connectProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	p.lock.Lock()
+	p.targets = append(p.targets, r.Host)
+	p.lock.Unlock()
+
+	upstream, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		_ = upstream.Close()
+		return
+	}
+	_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	go func() {
+		_, _ = io.Copy(upstream, conn)
+		_ = upstream.Close()
+	}()
+	go func() {
+		_, _ = io.Copy(conn, upstream)
+		_ = conn.Close()
+	}()
+}
+
+func (p *connectProxy) connectedTo() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]string(nil), p.targets...)
+}
+
+func TestUrlPreviewProxy(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hello world"))
+	}))
+	defer target.Close()
+
+	proxy := &connectProxy{}
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	ctx := rcontext.Initial()
+	ctx.Config.UrlPreviews.Proxy = proxyServer.URL
+	ctx.Config.UrlPreviews.AllowedNetworks = []string{"127.0.0.0/8"}
+	ctx.Config.UrlPreviews.DisallowedNetworks = []string{}
+	ctx.Config.TimeoutSeconds.UrlPreviews = 5
+
+	client, err := u.NewPreviewClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(target.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, "hello world", string(b))
+	assert.Equal(t, []string{target.Listener.Addr().String()}, proxy.connectedTo())
+
+	// The destination is still checked against the networks, without asking the proxy
+	ctx.Config.UrlPreviews.DisallowedNetworks = []string{"127.0.0.0/8"}
+	client, err = u.NewPreviewClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Get(target.URL)
+	assert.ErrorIs(t, err, common.ErrHostNotAllowed)
+	assert.Len(t, proxy.connectedTo(), 1)
+}
+
+func TestUrlPreviewProxyUnsupportedScheme(t *testing.T) {
+	ctx := rcontext.Initial()
+	ctx.Config.UrlPreviews.Proxy = "ftp://proxy.example.org"
+	_, err := u.NewPreviewClient(ctx)
+	assert.Error(t, err)
+}
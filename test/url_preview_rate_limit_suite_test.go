@@ -0,0 +1,115 @@
+package test
+
+import (
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/limits"
+	"github.com/t2bot/matrix-media-repo/pipelines/pipeline_preview"
+	"github.com/t2bot/matrix-media-repo/test/test_internals"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+type UrlPreviewRateLimitSuite struct {
+	suite.Suite
+	deps *test_internals.ContainerDeps
+}
+
+func (s *UrlPreviewRateLimitSuite) SetupSuite() {
+	deps, err := test_internals.MakeTestDeps()
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.deps = deps
+}
+
+func (s *UrlPreviewRateLimitSuite) TearDownSuite() {
+	if s.deps != nil {
+		if s.T().Failed() {
+			s.deps.Debug()
+		}
+		s.deps.Teardown()
+	}
+}
+
+func (s *UrlPreviewRateLimitSuite) TestJoinedPreviewsAreRefunded() {
+	t := s.T()
+	withPreviewRateLimits(t,
+		config.RateLimitCountBucketConfig{Capacity: 10, DrainPerMinute: 1},
+		config.RateLimitCountBucketConfig{Capacity: 10, DrainPerMinute: 1},
+	)
+
+	// The page is held until both users are waiting on it
+	requested := make(chan bool, 2)
+	release := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested <- true
+		<-release
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte(`<html><head><title>Shared page</title></head><body></body></html>`))
+	}))
+	defer server.Close()
+
+	ctx := rcontext.Initial()
+	ctx.Config.UrlPreviews.AllowedNetworks = []string{"127.0.0.1/32"}
+	ctx.Config.UrlPreviews.DisallowedNetworks = []string{}
+	ctx.Config.UrlPreviews.OEmbed = false
+
+	suffix, err := util.GenerateRandomString(16)
+	assert.NoError(t, err)
+	leader := "@leader_" + suffix + ":" + s.deps.Homeservers[0].ServerName
+	follower := "@follower_" + suffix + ":" + s.deps.Homeservers[0].ServerName
+	pageUrl := server.URL + "/" + suffix
+
+	wg := new(sync.WaitGroup)
+	preview := func(userId string) {
+		defer wg.Done()
+		record, err := pipeline_preview.Execute(ctx, s.deps.Homeservers[0].ServerName, pageUrl, userId, pipeline_preview.PreviewOpts{
+			Timestamp:      util.NowMillis(),
+			LanguageHeader: ctx.Config.UrlPreviews.DefaultLanguage,
+		})
+		assert.NoError(t, err)
+		if assert.NotNil(t, record) {
+			assert.Equal(t, "Shared page", record.Title)
+		}
+	}
+	wg.Add(2)
+	go preview(leader)
+	select {
+	case <-requested:
+	case <-time.After(30 * time.Second):
+		t.Fatal("page was not requested")
+	}
+	go preview(follower)
+	time.Sleep(250 * time.Millisecond) // let the follower join the leader's request
+	close(release)
+	wg.Wait()
+
+	// The page was only fetched once, so only the leader is charged for it
+	select {
+	case <-requested:
+		t.Fatal("page was requested twice")
+	default:
+	}
+	leaderBucket, err := limits.GetUrlPreviewUserBucket(ctx, leader)
+	assert.NoError(t, err)
+	followerBucket, err := limits.GetUrlPreviewUserBucket(ctx, follower)
+	assert.NoError(t, err)
+	domainBucket, err := limits.GetUrlPreviewDomainBucket(ctx, "127.0.0.1")
+	assert.NoError(t, err)
+	assert.InDelta(t, 1, leaderBucket.Value(), 0.1)
+	assert.InDelta(t, 0, followerBucket.Value(), 0.1)
+	assert.InDelta(t, 1, domainBucket.Value(), 0.1)
+}
+
+func TestUrlPreviewRateLimitSuite(t *testing.T) {
+	suite.Run(t, new(UrlPreviewRateLimitSuite))
+}
@@ -0,0 +1,123 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/go-leaky-bucket"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/limits"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+// withPreviewRateLimits sets the URL preview bucket config for the rest of the test.
+func withPreviewRateLimits(t *testing.T, users config.RateLimitCountBucketConfig, domains config.RateLimitCountBucketConfig) {
+	original := config.Get().RateLimit
+	t.Cleanup(func() {
+		config.Get().RateLimit = original
+		limits.ExpandBuckets()
+	})
+	config.Get().RateLimit.Enabled = true
+	config.Get().RateLimit.Buckets.UrlPreviewUsers = users
+	config.Get().RateLimit.Buckets.UrlPreviewDomains = domains
+}
+
+func TestUrlPreviewDomainKey(t *testing.T) {
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		{host: "example.org", expected: "example.org"},
+		{host: "www.example.org", expected: "example.org"},
+		{host: "a.b.c.Example.ORG.", expected: "example.org"},
+		{host: "news.example.co.uk", expected: "example.co.uk"},
+		{host: "user.github.io", expected: "user.github.io"}, // a private suffix, so each user is separate
+		{host: "co.uk", expected: "co.uk"},                   // a suffix on its own
+		{host: "localhost", expected: "localhost"},
+		{host: "127.0.0.1", expected: "127.0.0.1"},
+		{host: "10.0.0.1", expected: "10.0.0.1"},
+		{host: "::1", expected: "::1"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, limits.UrlPreviewDomainKey(test.host), test.host)
+	}
+}
+
+func TestUrlPreviewCountBuckets(t *testing.T) {
+	withPreviewRateLimits(t,
+		config.RateLimitCountBucketConfig{Capacity: 2, DrainPerMinute: 1},
+		config.RateLimitCountBucketConfig{Capacity: 3, DrainPerMinute: 1},
+	)
+	ctx := rcontext.InitialNoConfig()
+	suffix, err := util.GenerateRandomString(16)
+	assert.NoError(t, err)
+
+	// Each user has their own bucket
+	alice, err := limits.GetUrlPreviewUserBucket(ctx, "@alice_"+suffix+":example.org")
+	assert.NoError(t, err)
+	bob, err := limits.GetUrlPreviewUserBucket(ctx, "@bob_"+suffix+":example.org")
+	assert.NoError(t, err)
+	if !assert.NotNil(t, alice) || !assert.NotNil(t, bob) {
+		return
+	}
+	assert.NotSame(t, alice, bob)
+	again, err := limits.GetUrlPreviewUserBucket(ctx, "@alice_"+suffix+":example.org")
+	assert.NoError(t, err)
+	assert.Same(t, alice, again)
+
+	assert.NoError(t, alice.Add(1))
+	assert.NoError(t, alice.Add(1))
+	assert.ErrorIs(t, alice.Add(1), leaky.ErrBucketFull)
+	assert.NoError(t, bob.Add(1))
+
+	// Refunding a preview lets the user have another
+	assert.NoError(t, alice.Drain(1))
+	assert.NoError(t, alice.Add(1))
+	assert.ErrorIs(t, alice.Add(1), leaky.ErrBucketFull)
+
+	// Subdomains share their domain's bucket
+	domain := suffix + ".example.org"
+	first, err := limits.GetUrlPreviewDomainBucket(ctx, "a."+domain)
+	assert.NoError(t, err)
+	second, err := limits.GetUrlPreviewDomainBucket(ctx, "B."+domain)
+	assert.NoError(t, err)
+	other, err := limits.GetUrlPreviewDomainBucket(ctx, suffix+".example.net")
+	assert.NoError(t, err)
+	if assert.NotNil(t, first) {
+		assert.Same(t, first, second)
+		assert.NotSame(t, first, other)
+	}
+
+	// New limits apply to existing buckets
+	config.Get().RateLimit.Buckets.UrlPreviewUsers.Capacity = 5
+	limits.ExpandBuckets()
+	assert.Equal(t, int64(5), alice.Capacity)
+	assert.NoError(t, alice.Add(1))
+}
+
+func TestUrlPreviewCountBucketsDisabled(t *testing.T) {
+	withPreviewRateLimits(t,
+		config.RateLimitCountBucketConfig{Capacity: 0, DrainPerMinute: 1},
+		config.RateLimitCountBucketConfig{Capacity: 3, DrainPerMinute: 0},
+	)
+	ctx := rcontext.InitialNoConfig()
+
+	bucket, err := limits.GetUrlPreviewUserBucket(ctx, "@alice:example.org")
+	assert.NoError(t, err)
+	assert.Nil(t, bucket)
+	bucket, err = limits.GetUrlPreviewDomainBucket(ctx, "example.org")
+	assert.NoError(t, err)
+	assert.Nil(t, bucket)
+
+	// Turning off rate limiting disables both
+	config.Get().RateLimit.Buckets.UrlPreviewUsers.Capacity = 10
+	config.Get().RateLimit.Buckets.UrlPreviewDomains.DrainPerMinute = 10
+	config.Get().RateLimit.Enabled = false
+	bucket, err = limits.GetUrlPreviewUserBucket(ctx, "@alice:example.org")
+	assert.NoError(t, err)
+	assert.Nil(t, bucket)
+	bucket, err = limits.GetUrlPreviewDomainBucket(ctx, "example.org")
+	assert.NoError(t, err)
+	assert.Nil(t, bucket)
+}
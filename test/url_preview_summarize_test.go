@@ -0,0 +1,49 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/t2bot/matrix-media-repo/url_previewing/u"
+	"github.com/t2bot/matrix-media-repo/util"
+	"golang.org/x/text/encoding/japanese"
+)
+
+func TestSummarize(t *testing.T) {
+	assert.Equal(t, "one two three", u.Summarize("  one\ntwo   three ", 10, 100))
+	assert.Equal(t, "one two", u.Summarize("one two three", 2, 100))
+	assert.Equal(t, "one two", u.Summarize("one two three", 10, 10))
+	assert.Equal(t, "abcde...", u.Summarize("abcdefghij", 10, 5))
+
+	// Text without spaces is cut by character, not dropped for being one long word
+	assert.Equal(t, "東京都は日...", u.Summarize("東京都は日本の首都です。", 10, 5))
+	assert.Equal(t, "東京都は日本の首都です。", u.Summarize("東京都は日本の首都です。", 1, 100))
+
+	// Mixed text is still cut between words, unless the cut falls within unspaced text
+	assert.Equal(t, "The capital of Japan", u.Summarize("The capital of Japan is 東京", 10, 22))
+	assert.Equal(t, "Tokyo (東京都は日本...", u.Summarize("Tokyo (東京都は日本の首都です。)", 10, 13))
+	assert.Equal(t, "東京 is the capital", u.Summarize("東京 is the capital of Japan", 10, 18))
+
+	// Characters made of several code points are never split
+	assert.Equal(t, "éé...", u.Summarize("ééé", 10, 2))
+	assert.Equal(t, "👍🏽...", u.Summarize("👍🏽👍🏽", 10, 1))
+}
+
+func TestToUtf8(t *testing.T) {
+	sjis, err := japanese.ShiftJIS.NewEncoder().String("こんにちは")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// From the content type
+	assert.Equal(t, "こんにちは", util.ToUtf8(sjis, "text/html; charset=Shift_JIS"))
+
+	// From a <meta> tag after the first kilobyte
+	padding := "<!-- " + string(make([]byte, 2048)) + " -->"
+	page := "<html><head>" + padding + `<meta charset="shift_jis"></head><body>` + sjis + "</body></html>"
+	assert.Contains(t, util.ToUtf8(page, "text/html"), "<body>こんにちは</body>")
+
+	// UTF-8 which claims to be Latin-1 is left alone
+	assert.Equal(t, "café", util.ToUtf8("café", "text/html; charset=iso-8859-1"))
+	assert.Equal(t, "café", util.ToUtf8("caf\xe9", "text/html; charset=iso-8859-1"))
+}
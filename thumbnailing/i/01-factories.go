@@ -16,6 +16,13 @@ type Generator interface {
 	GetOriginDimensions(b io.Reader, contentType string, ctx rcontext.RequestContext) (bool, int, int, error)
 }
 
+// AnimatedGenerator is implemented by generators which can produce animated thumbnails in a choice of formats. The
+// format is one of the u.AnimatedFormat* constants.
+type AnimatedGenerator interface {
+	Generator
+	GenerateAnimatedThumbnail(img io.Reader, contentType string, width int, height int, method string, format string, ctx rcontext.RequestContext) (*m.Thumbnail, error)
+}
+
 type AudioGenerator interface {
 	Generator
 	GetAudioData(b io.Reader, nKeys int, ctx rcontext.RequestContext) (*m.AudioInfo, error)
@@ -5,6 +5,7 @@ import (
 	"image"
 	"image/draw"
 	"io"
+	"time"
 
 	"github.com/getsentry/sentry-go"
 	"github.com/kettek/apng"
@@ -40,71 +41,65 @@ func (d apngGenerator) GenerateThumbnail(b io.Reader, contentType string, width
 	if !animated {
 		return pngGenerator{}.GenerateThumbnail(b, "image/png", width, height, method, false, ctx)
 	}
+	return d.GenerateAnimatedThumbnail(b, contentType, width, height, method, u.AnimatedFormatApng, ctx)
+}
 
+func (d apngGenerator) GenerateAnimatedThumbnail(b io.Reader, contentType string, width int, height int, method string, format string, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
 	p, err := apng.DecodeAll(b)
 	if err != nil {
 		return nil, errors.New("apng: error decoding image: " + err.Error())
 	}
 
-	// prepare a blank frame to use as swap space
-	frameImg := image.NewRGBA(p.Frames[0].Image.Bounds())
+	// The default image isn't part of the animation
+	frames := make([]apng.Frame, 0, len(p.Frames))
+	for _, frame := range p.Frames {
+		if !frame.IsDefault {
+			frames = append(frames, frame)
+		}
+	}
+	if len(frames) == 0 {
+		return nil, errors.New("apng: no frames to thumbnail")
+	}
 
-	for i, frame := range p.Frames {
-		img := frame.Image
+	delays := make([]time.Duration, len(frames))
+	for i, frame := range frames {
+		delays[i] = u.NormalizeFrameDelay(time.Duration(frame.GetDelay() * float64(time.Second)))
+	}
 
-		// we must make sure that blend op, frame disposal etc. fit together correctly.
-		// as we re-render all frames at (0, 0) we need to keep a swap space of the preivous image
-		// For which blend op etc. is what, see https://wiki.mozilla.org/APNG_Specification#.60fcTL.60:_The_Frame_Control_Chunk
-		if p.Frames[i].DisposeOp == apng.DISPOSE_OP_BACKGROUND || p.Frames[i].BlendOp == apng.BLEND_OP_OVER {
-			// Clear the transparency of the previous frame
-			draw.Draw(frameImg, frameImg.Bounds(), image.Transparent, image.Point{X: 0, Y: 0}, draw.Src)
-		}
+	builder := u.NewAnimationBuilder(ctx, width, height, method, delays, int(p.LoopCount))
 
-		// preserve our frame, if the dispose method is previous
-		tmpImg := image.NewRGBA(frameImg.Bounds())
-		if p.Frames[i].DisposeOp == apng.DISPOSE_OP_PREVIOUS {
-			draw.Draw(tmpImg, frameImg.Bounds(), frameImg, image.Point{X: 0, Y: 0}, draw.Src)
+	// We re-render every frame at full size, so we need to follow the blend and dispose operations ourselves.
+	// See https://wiki.mozilla.org/APNG_Specification#.60fcTL.60:_The_Frame_Control_Chunk
+	canvas := image.NewRGBA(p.Frames[0].Image.Bounds())
+	var previous *image.RGBA
+	for i, frame := range frames {
+		if frame.DisposeOp == apng.DISPOSE_OP_PREVIOUS {
+			previous = image.NewRGBA(canvas.Bounds())
+			draw.Draw(previous, previous.Bounds(), canvas, image.Point{}, draw.Src)
 		}
 
-		// Copy the frame to a new image and use that
-		draw.Draw(frameImg, image.Rect(frame.XOffset, frame.YOffset, frameImg.Rect.Max.X, frameImg.Rect.Max.Y), img, image.Point{X: 0, Y: 0}, draw.Src)
-
-		// Do the thumbnailing on the copied frame
-		frameThumb, err := u.MakeThumbnail(frameImg, method, width, height)
-		if err != nil {
-			return nil, errors.New("apng: error generating thumbnail frame: " + err.Error())
+		op := draw.Over
+		if frame.BlendOp == apng.BLEND_OP_SOURCE {
+			op = draw.Src
 		}
-		if frameThumb == nil {
-			tmpImg := image.NewRGBA(frameImg.Bounds())
-			draw.Draw(tmpImg, tmpImg.Bounds(), frameImg, image.Point{X: 0, Y: 0}, draw.Src)
-			frameThumb = tmpImg
+		frameBounds := frame.Image.Bounds()
+		region := image.Rect(frame.XOffset, frame.YOffset, frame.XOffset+frameBounds.Dx(), frame.YOffset+frameBounds.Dy())
+		draw.Draw(canvas, region, frame.Image, frameBounds.Min, op)
+
+		if builder.Wants(i) {
+			if err = builder.AddFrame(i, canvas, nil); err != nil {
+				return nil, errors.New("apng: error generating thumbnail frame: " + err.Error())
+			}
 		}
 
-		p.Frames[i].Image = frameThumb
-		p.Frames[i].XOffset = 0
-		p.Frames[i].YOffset = 0
-
-		// restore the frame, if the dispose method is previous
-		if p.Frames[i].DisposeOp == apng.DISPOSE_OP_PREVIOUS {
-			draw.Draw(frameImg, frameImg.Bounds(), tmpImg, image.Point{X: 0, Y: 0}, draw.Src)
+		if frame.DisposeOp == apng.DISPOSE_OP_BACKGROUND {
+			draw.Draw(canvas, region, image.Transparent, image.Point{}, draw.Src)
+		} else if frame.DisposeOp == apng.DISPOSE_OP_PREVIOUS && previous != nil {
+			draw.Draw(canvas, canvas.Bounds(), previous, image.Point{}, draw.Src)
 		}
 	}
 
-	pr, pw := io.Pipe()
-	go func(pw *io.PipeWriter, p apng.APNG) {
-		err = apng.Encode(pw, p)
-		if err != nil {
-			_ = pw.CloseWithError(errors.New("apng: error encoding final thumbnail: " + err.Error()))
-		} else {
-			_ = pw.Close()
-		}
-	}(pw, p)
-
-	return &m.Thumbnail{
-		ContentType: "image/png",
-		Animated:    true,
-		Reader:      pr,
-	}, nil
+	return builder.Encode(format)
 }
 
 func init() {
@@ -7,6 +7,7 @@ import (
 	"image/gif"
 	"io"
 	"math"
+	"time"
 
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/thumbnailing/m"
@@ -33,98 +34,89 @@ func (d gifGenerator) GetOriginDimensions(b io.Reader, contentType string, ctx r
 }
 
 func (d gifGenerator) GenerateThumbnail(b io.Reader, contentType string, width int, height int, method string, animated bool, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
+	if animated {
+		return d.GenerateAnimatedThumbnail(b, contentType, width, height, method, u.AnimatedFormatGif, ctx)
+	}
+
 	g, err := gif.DecodeAll(b)
 	if err != nil {
 		return nil, errors.New("gif: error decoding image: " + err.Error())
 	}
 
-	// Prepare a blank frame to use as swap space
-	frameImg := image.NewRGBA(image.Rectangle{Min: image.Point{X: 0, Y: 0}, Max: image.Point{X: g.Config.Width, Y: g.Config.Height}})
-
 	targetStaticFrame := int(math.Floor(math.Min(1, math.Max(0, float64(ctx.Config.Thumbnails.StillFrame))) * float64(len(g.Image))))
+	targetStaticFrame = min(targetStaticFrame, len(g.Image)-1)
 
-	for i, img := range g.Image {
-		var disposal byte
-		// use disposal method 0 by default
-		if g.Disposal == nil {
-			disposal = 0
-		} else {
-			disposal = g.Disposal[i]
+	var still image.Image
+	renderGifFrames(g, func(i int, canvas *image.RGBA) bool {
+		if i == targetStaticFrame {
+			still = canvas
+			return false
 		}
+		return true
+	})
+	if still == nil {
+		return nil, errors.New("gif: no frames to thumbnail")
+	}
 
-		// Copy the frame to a new image and use that
-		draw.Draw(frameImg, frameImg.Bounds(), img, image.Point{X: 0, Y: 0}, draw.Over)
-
-		// Do the thumbnailing on the copied frame
-		frameThumb, err := u.MakeThumbnail(frameImg, method, width, height)
-		if err != nil {
-			return nil, errors.New("gif: error generating thumbnail frame: " + err.Error())
-		}
-		if frameThumb == nil {
-			tmpImg := image.NewRGBA(frameImg.Bounds())
-			draw.Draw(tmpImg, tmpImg.Bounds(), frameImg, image.Point{X: 0, Y: 0}, draw.Src)
-			frameThumb = tmpImg
-		}
+	return pngGenerator{}.GenerateThumbnailOf(still, width, height, method, ctx)
+}
 
-		targetImg := image.NewPaletted(frameThumb.Bounds(), img.Palette)
-		draw.FloydSteinberg.Draw(targetImg, frameThumb.Bounds(), frameThumb, image.Point{X: 0, Y: 0})
-
-		if !animated && i == targetStaticFrame {
-			t, err := pngGenerator{}.GenerateThumbnailOf(targetImg, width, height, method, ctx)
-			if err != nil || t != nil {
-				return t, err
-			}
-
-			// The thumbnailer decided that it shouldn't thumbnail, so encode it ourselves
-			pr, pw := io.Pipe()
-			go func(pw *io.PipeWriter, p *image.Paletted) {
-				err = u.Encode(ctx, pw, p)
-				if err != nil {
-					_ = pw.CloseWithError(errors.New("gif: error encoding still frame thumbnail: " + err.Error()))
-				} else {
-					_ = pw.Close()
-				}
-			}(pw, targetImg)
-			return &m.Thumbnail{
-				Animated:    false,
-				ContentType: "image/png",
-				Reader:      pr,
-			}, nil
-		}
+func (d gifGenerator) GenerateAnimatedThumbnail(b io.Reader, contentType string, width int, height int, method string, format string, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
+	g, err := gif.DecodeAll(b)
+	if err != nil {
+		return nil, errors.New("gif: error decoding image: " + err.Error())
+	}
 
-		// if disposal type is 0 or 1 (preserve previous frame) we can get artifacts from re-scaling.
-		// as such, we re-render those frames to disposal type 1 (do not dispose)
-		// Importantly, we do not clear the previous frame buffer canvas
-		// see https://www.w3.org/Graphics/GIF/spec-gif89a.txt
-		// This also applies to frame disposal type 0, https://legacy.imagemagick.org/Usage/anim_basics/#none
-		if disposal == 1 || disposal == 0 {
-			g.Disposal[i] = 1
+	delays := make([]time.Duration, len(g.Image))
+	for i := range g.Image {
+		if i < len(g.Delay) {
+			delays[i] = u.NormalizeFrameDelay(time.Duration(g.Delay[i]) * 10 * time.Millisecond)
 		} else {
-			draw.Draw(frameImg, frameImg.Bounds(), image.Transparent, image.Point{X: 0, Y: 0}, draw.Src)
+			delays[i] = u.NormalizeFrameDelay(0)
 		}
+	}
 
-		g.Image[i] = targetImg
+	builder := u.NewAnimationBuilder(ctx, width, height, method, delays, u.GifPlays(g.LoopCount))
+	renderGifFrames(g, func(i int, canvas *image.RGBA) bool {
+		if builder.Wants(i) {
+			err = builder.AddFrame(i, canvas, g.Image[i].Palette)
+		}
+		return err == nil
+	})
+	if err != nil {
+		return nil, errors.New("gif: error generating thumbnail frame: " + err.Error())
 	}
 
-	// Set the image size to the first frame's size
-	g.Config.Width = g.Image[0].Bounds().Max.X
-	g.Config.Height = g.Image[0].Bounds().Max.Y
+	return builder.Encode(format)
+}
 
-	pr, pw := io.Pipe()
-	go func(pw *io.PipeWriter, g *gif.GIF) {
-		err = gif.EncodeAll(pw, g)
-		if err != nil {
-			_ = pw.CloseWithError(errors.New("gif: error encoding final thumbnail: " + err.Error()))
-		} else {
-			_ = pw.Close()
+// renderGifFrames composites each frame of the GIF onto a full-size canvas, calling fn with the result. The canvas
+// is re-used between frames. Return false from fn to stop rendering.
+func renderGifFrames(g *gif.GIF, fn func(i int, canvas *image.RGBA) bool) {
+	canvas := image.NewRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	var previous *image.RGBA
+	for i, img := range g.Image {
+		disposal := byte(gif.DisposalNone)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewRGBA(canvas.Bounds())
+			draw.Draw(previous, previous.Bounds(), canvas, image.Point{}, draw.Src)
 		}
-	}(pw, g)
 
-	return &m.Thumbnail{
-		ContentType: "image/gif",
-		Animated:    true,
-		Reader:      pr,
-	}, nil
+		draw.Draw(canvas, img.Bounds(), img, img.Bounds().Min, draw.Over)
+		if !fn(i, canvas) {
+			return
+		}
+
+		// See https://www.w3.org/Graphics/GIF/spec-gif89a.txt for disposal methods
+		if disposal == gif.DisposalBackground {
+			draw.Draw(canvas, img.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		} else if disposal == gif.DisposalPrevious && previous != nil {
+			draw.Draw(canvas, canvas.Bounds(), previous, image.Point{}, draw.Src)
+		}
+	}
 }
 
 func init() {
@@ -43,7 +43,7 @@ func (d jpgGenerator) GenerateThumbnail(b io.Reader, contentType string, width i
 		return nil, errors.New("jpg: error decoding thumbnail: " + err.Error())
 	}
 
-	thumb, err := u.MakeThumbnail(src, method, width, height)
+	thumb, err := u.MakeThumbnail(src, method, width, height, ctx.Config.Thumbnails.CropStrategy)
 	if err != nil {
 		return nil, errors.New("jpg: error making thumbnail: " + err.Error())
 	}
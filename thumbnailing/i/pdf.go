@@ -0,0 +1,86 @@
+package i
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/m"
+	"github.com/t2bot/matrix-media-repo/util"
+)
+
+// How long pdftoppm may take to render a page before it is killed
+const pdfRenderTimeout = 30 * time.Second
+
+type pdfGenerator struct {
+}
+
+func (d pdfGenerator) supportedContentTypes() []string {
+	return []string{"application/pdf"}
+}
+
+func (d pdfGenerator) supportsAnimation() bool {
+	return false
+}
+
+func (d pdfGenerator) matches(img io.Reader, contentType string) bool {
+	return util.ArrayContains(d.supportedContentTypes(), contentType)
+}
+
+func (d pdfGenerator) GetOriginDimensions(b io.Reader, contentType string, ctx rcontext.RequestContext) (bool, int, int, error) {
+	return false, 0, 0, nil
+}
+
+func (d pdfGenerator) GenerateThumbnail(b io.Reader, contentType string, width int, height int, method string, animated bool, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
+	dir, err := os.MkdirTemp(os.TempDir(), "mmr-pdf")
+	if err != nil {
+		return nil, errors.New("pdf: error creating temporary directory: " + err.Error())
+	}
+
+	tempFile1 := path.Join(dir, "i.pdf")
+	tempFile2 := path.Join(dir, "o") // pdftoppm adds the extension
+
+	defer os.Remove(tempFile1)
+	defer os.Remove(tempFile2 + ".png")
+	defer os.Remove(dir)
+
+	f, err := os.OpenFile(tempFile1, os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, errors.New("pdf: error creating temp pdf file: " + err.Error())
+	}
+	if _, err = io.Copy(f, b); err != nil {
+		_ = f.Close()
+		return nil, errors.New("pdf: error writing temp pdf file: " + err.Error())
+	}
+	_ = f.Close()
+
+	// Render just the first page, at a resolution suitable for the requested size
+	scaleTo := width
+	if height > scaleTo {
+		scaleTo = height
+	}
+	renderCtx, cancel := context.WithTimeout(ctx.Context, pdfRenderTimeout)
+	defer cancel()
+	err = exec.CommandContext(renderCtx, "pdftoppm", "-png", "-f", "1", "-l", "1", "-singlefile", "-scale-to", strconv.Itoa(scaleTo), tempFile1, tempFile2).Run()
+	if err != nil {
+		return nil, errors.New("pdf: error rendering pdf file: " + err.Error())
+	}
+
+	f, err = os.OpenFile(tempFile2+".png", os.O_RDONLY, 0640)
+	if err != nil {
+		return nil, errors.New("pdf: error reading temp png file: " + err.Error())
+	}
+	defer f.Close()
+
+	return pngGenerator{}.GenerateThumbnail(f, "image/png", width, height, method, false, ctx)
+}
+
+func init() {
+	generators = append(generators, pdfGenerator{})
+}
@@ -1,11 +1,19 @@
 package i
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
+	"image"
+	"image/draw"
 	"io"
+	"math"
+	"time"
 
+	"github.com/t2bot/matrix-media-repo/common"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/thumbnailing/m"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/u"
 	"golang.org/x/image/webp"
 )
 
@@ -33,14 +41,293 @@ func (d webpGenerator) GetOriginDimensions(b io.Reader, contentType string, ctx
 }
 
 func (d webpGenerator) GenerateThumbnail(b io.Reader, contentType string, width int, height int, method string, animated bool, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
-	src, err := webp.Decode(b)
+	data, err := io.ReadAll(b)
 	if err != nil {
-		return nil, errors.New("webp: error decoding thumbnail: " + err.Error())
+		return nil, errors.New("webp: error reading image: " + err.Error())
 	}
 
-	return pngGenerator{}.GenerateThumbnailOf(src, width, height, method, ctx)
+	anim, err := parseAnimatedWebp(data, ctx.Config.Thumbnails.MaxPixels)
+	if errors.Is(err, common.ErrMediaTooLarge) {
+		return nil, err
+	} else if err != nil {
+		return nil, errors.New("webp: error parsing image: " + err.Error())
+	}
+	if anim == nil {
+		src, err := webp.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, errors.New("webp: error decoding thumbnail: " + err.Error())
+		}
+		return pngGenerator{}.GenerateThumbnailOf(src, width, height, method, ctx)
+	}
+
+	if animated {
+		return d.generateAnimated(anim, width, height, method, u.AnimatedFormatWebp, ctx)
+	}
+
+	targetStaticFrame := int(math.Floor(math.Min(1, math.Max(0, float64(ctx.Config.Thumbnails.StillFrame))) * float64(len(anim.frames))))
+	targetStaticFrame = min(targetStaticFrame, len(anim.frames)-1)
+
+	var still image.Image
+	err = renderWebpFrames(anim, func(i int, canvas *image.RGBA) bool {
+		if i == targetStaticFrame {
+			still = canvas
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.New("webp: error decoding frame: " + err.Error())
+	}
+	if still == nil {
+		return nil, errors.New("webp: no frames to thumbnail")
+	}
+	return pngGenerator{}.GenerateThumbnailOf(still, width, height, method, ctx)
+}
+
+func (d webpGenerator) GenerateAnimatedThumbnail(b io.Reader, contentType string, width int, height int, method string, format string, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
+	data, err := io.ReadAll(b)
+	if err != nil {
+		return nil, errors.New("webp: error reading image: " + err.Error())
+	}
+
+	anim, err := parseAnimatedWebp(data, ctx.Config.Thumbnails.MaxPixels)
+	if errors.Is(err, common.ErrMediaTooLarge) {
+		return nil, err
+	} else if err != nil {
+		return nil, errors.New("webp: error parsing image: " + err.Error())
+	}
+	if anim == nil {
+		// Not actually animated
+		return d.GenerateThumbnail(bytes.NewReader(data), contentType, width, height, method, false, ctx)
+	}
+	return d.generateAnimated(anim, width, height, method, format, ctx)
+}
+
+func (d webpGenerator) generateAnimated(anim *webpAnimation, width int, height int, method string, format string, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
+	delays := make([]time.Duration, len(anim.frames))
+	for i, frame := range anim.frames {
+		delays[i] = u.NormalizeFrameDelay(frame.delay)
+	}
+
+	builder := u.NewAnimationBuilder(ctx, width, height, method, delays, anim.loopCount)
+	var frameErr error
+	err := renderWebpFrames(anim, func(i int, canvas *image.RGBA) bool {
+		if builder.Wants(i) {
+			frameErr = builder.AddFrame(i, canvas, nil)
+		}
+		return frameErr == nil
+	})
+	if err != nil {
+		return nil, errors.New("webp: error decoding frame: " + err.Error())
+	}
+	if frameErr != nil {
+		return nil, errors.New("webp: error generating thumbnail frame: " + frameErr.Error())
+	}
+
+	return builder.Encode(format)
 }
 
 func init() {
 	generators = append(generators, webpGenerator{})
 }
+
+// The x/image/webp decoder doesn't support animation, so we split animated images into individual frames ourselves.
+// See https://developers.google.com/speed/webp/docs/riff_container for the container format.
+
+type webpAnimation struct {
+	width     int
+	height    int
+	loopCount int
+	frames    []*webpFrame
+}
+
+type webpFrame struct {
+	x                   int
+	y                   int
+	width               int
+	height              int
+	delay               time.Duration
+	disposeToBackground bool
+	blend               bool
+
+	// A standalone WebP image containing only this frame
+	image []byte
+}
+
+type webpChunk struct {
+	fourCC  string
+	payload []byte
+}
+
+func readWebpChunks(b []byte) ([]webpChunk, error) {
+	chunks := make([]webpChunk, 0)
+	for len(b) > 0 {
+		if len(b) < 8 {
+			return nil, errors.New("truncated chunk header")
+		}
+		size := binary.LittleEndian.Uint32(b[4:8])
+		if uint64(size) > uint64(len(b)-8) {
+			return nil, errors.New("truncated chunk")
+		}
+		chunks = append(chunks, webpChunk{fourCC: string(b[0:4]), payload: b[8 : 8+size]})
+		b = b[8+size:]
+		if size%2 == 1 && len(b) > 0 {
+			b = b[1:] // padding
+		}
+	}
+	return chunks, nil
+}
+
+func readUint24(b []byte) int {
+	return int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+}
+
+func writeWebpChunk(buf *bytes.Buffer, fourCC string, payload []byte) {
+	buf.WriteString(fourCC)
+	_ = binary.Write(buf, binary.LittleEndian, uint32(len(payload)))
+	buf.Write(payload)
+	if len(payload)%2 == 1 {
+		buf.WriteByte(0)
+	}
+}
+
+// parseAnimatedWebp returns the frames of an animated WebP image, or nil if the image is not animated. If the canvas or
+// any frame has maxPixels or more pixels, common.ErrMediaTooLarge is returned before anything is decoded.
+func parseAnimatedWebp(b []byte, maxPixels int) (*webpAnimation, error) {
+	if len(b) < 12 || string(b[0:4]) != "RIFF" || string(b[8:12]) != "WEBP" {
+		return nil, errors.New("not a webp image")
+	}
+	riffSize := binary.LittleEndian.Uint32(b[4:8])
+	body := b[12:]
+	if uint64(riffSize) >= 4 && uint64(riffSize)-4 < uint64(len(body)) {
+		body = body[:riffSize-4]
+	}
+	chunks, err := readWebpChunks(body)
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks) == 0 || chunks[0].fourCC != "VP8X" || len(chunks[0].payload) < 10 {
+		return nil, nil
+	}
+	const flagAnimation = 0x02
+	if chunks[0].payload[0]&flagAnimation == 0 {
+		return nil, nil
+	}
+
+	anim := &webpAnimation{
+		width:  readUint24(chunks[0].payload[4:7]) + 1,
+		height: readUint24(chunks[0].payload[7:10]) + 1,
+		frames: make([]*webpFrame, 0),
+	}
+	if tooManyPixels(anim.width, anim.height, maxPixels) {
+		return nil, common.ErrMediaTooLarge
+	}
+	for _, chunk := range chunks[1:] {
+		if chunk.fourCC == "ANIM" && len(chunk.payload) >= 6 {
+			anim.loopCount = int(binary.LittleEndian.Uint16(chunk.payload[4:6]))
+		} else if chunk.fourCC == "ANMF" {
+			frame, err := parseWebpFrame(chunk.payload, maxPixels)
+			if err != nil {
+				return nil, err
+			}
+			anim.frames = append(anim.frames, frame)
+		}
+	}
+	if len(anim.frames) == 0 {
+		return nil, errors.New("animation has no frames")
+	}
+	return anim, nil
+}
+
+func parseWebpFrame(b []byte, maxPixels int) (*webpFrame, error) {
+	if len(b) < 16 {
+		return nil, errors.New("truncated frame header")
+	}
+	frame := &webpFrame{
+		x:                   readUint24(b[0:3]) * 2,
+		y:                   readUint24(b[3:6]) * 2,
+		width:               readUint24(b[6:9]) + 1,
+		height:              readUint24(b[9:12]) + 1,
+		delay:               time.Duration(readUint24(b[12:15])) * time.Millisecond,
+		disposeToBackground: b[15]&0x01 != 0,
+		blend:               b[15]&0x02 == 0,
+	}
+	if tooManyPixels(frame.width, frame.height, maxPixels) {
+		return nil, common.ErrMediaTooLarge
+	}
+
+	chunks, err := readWebpChunks(b[16:])
+	if err != nil {
+		return nil, err
+	}
+	var alpha []byte
+	body := &bytes.Buffer{}
+	for _, chunk := range chunks {
+		if chunk.fourCC == "ALPH" {
+			alpha = chunk.payload
+		} else if chunk.fourCC == "VP8 " || chunk.fourCC == "VP8L" {
+			if chunk.fourCC == "VP8 " && alpha != nil {
+				// Lossy frames with transparency need an extended header for the decoder to pick up the alpha
+				header := make([]byte, 10)
+				header[0] = 0x10 // alpha
+				header[4], header[5], header[6] = byte(frame.width-1), byte((frame.width-1)>>8), byte((frame.width-1)>>16)
+				header[7], header[8], header[9] = byte(frame.height-1), byte((frame.height-1)>>8), byte((frame.height-1)>>16)
+				writeWebpChunk(body, "VP8X", header)
+				writeWebpChunk(body, "ALPH", alpha)
+			}
+			writeWebpChunk(body, chunk.fourCC, chunk.payload)
+			break
+		}
+	}
+	if body.Len() == 0 {
+		return nil, errors.New("frame has no image data")
+	}
+
+	img := &bytes.Buffer{}
+	img.WriteString("RIFF")
+	_ = binary.Write(img, binary.LittleEndian, uint32(4+body.Len()))
+	img.WriteString("WEBP")
+	img.Write(body.Bytes())
+	frame.image = img.Bytes()
+
+	// The bitstream has its own dimensions, which are what the decoder allocates for
+	cfg, err := webp.DecodeConfig(bytes.NewReader(frame.image))
+	if err != nil {
+		return nil, err
+	}
+	if tooManyPixels(cfg.Width, cfg.Height, maxPixels) {
+		return nil, common.ErrMediaTooLarge
+	}
+	return frame, nil
+}
+
+func tooManyPixels(width int, height int, maxPixels int) bool {
+	return width*height >= maxPixels
+}
+
+// renderWebpFrames composites each frame onto a full-size canvas, calling fn with the result. The canvas is re-used
+// between frames. Return false from fn to stop rendering.
+func renderWebpFrames(anim *webpAnimation, fn func(i int, canvas *image.RGBA) bool) error {
+	canvas := image.NewRGBA(image.Rect(0, 0, anim.width, anim.height))
+	for i, frame := range anim.frames {
+		img, err := webp.Decode(bytes.NewReader(frame.image))
+		if err != nil {
+			return err
+		}
+
+		op := draw.Src
+		if frame.blend {
+			op = draw.Over
+		}
+		region := image.Rect(frame.x, frame.y, frame.x+frame.width, frame.y+frame.height)
+		draw.Draw(canvas, region, img, img.Bounds().Min, op)
+		if !fn(i, canvas) {
+			return nil
+		}
+
+		if frame.disposeToBackground {
+			draw.Draw(canvas, region, image.Transparent, image.Point{}, draw.Src)
+		}
+	}
+	return nil
+}
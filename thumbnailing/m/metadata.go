@@ -0,0 +1,7 @@
+package m
+
+type MediaMetadata struct {
+	Width  int
+	Height int
+	Audio  *AudioInfo
+}
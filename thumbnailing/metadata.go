@@ -0,0 +1,53 @@
+package thumbnailing
+
+import (
+	"errors"
+	"io"
+
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/i"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/m"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/sandbox"
+	"github.com/t2bot/matrix-media-repo/util/readers"
+)
+
+// AudioKeySamples is the number of key samples extracted from audio media.
+const AudioKeySamples = 768
+
+// ExtractMetadata reads the dimensions and audio information (where applicable) of the media stream. Content types
+// without a generator return empty metadata rather than an error. When the sandbox is enabled, the media is parsed
+// by a worker process like thumbnails are.
+func ExtractMetadata(stream io.Reader, contentType string, ctx rcontext.RequestContext) (*m.MediaMetadata, error) {
+	if sandbox.IsEnabled() {
+		return extractSandboxed(stream, contentType, ctx)
+	}
+	return extractInProcess(stream, contentType, ctx)
+}
+
+func extractInProcess(stream io.Reader, contentType string, ctx rcontext.RequestContext) (*m.MediaMetadata, error) {
+	metadata := &m.MediaMetadata{}
+	generator, reconstructed := i.GetGenerator(stream, contentType, false)
+	if generator == nil {
+		return metadata, nil
+	}
+
+	buffered := readers.NewBufferReadsReader(reconstructed)
+	dimensional, w, h, err := generator.GetOriginDimensions(buffered, contentType, ctx)
+	if err != nil {
+		return nil, errors.New("error getting dimensions: " + err.Error())
+	}
+	if dimensional {
+		metadata.Width = w
+		metadata.Height = h
+	}
+
+	if audioGenerator, ok := generator.(i.AudioGenerator); ok {
+		audioInfo, err := audioGenerator.GetAudioData(buffered.GetRewoundReader(), AudioKeySamples, ctx)
+		if err != nil {
+			return nil, errors.New("error getting audio data: " + err.Error())
+		}
+		metadata.Audio = audioInfo
+	}
+
+	return metadata, nil
+}
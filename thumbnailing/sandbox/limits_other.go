@@ -0,0 +1,33 @@
+//go:build !unix
+
+package sandbox
+
+import (
+	"os/exec"
+	"runtime/debug"
+)
+
+// ApplyLimits restricts the current (worker) process. Only a soft memory limit is supported on this platform.
+func ApplyLimits(limits Limits) error {
+	if limits.MaxMemoryBytes > 0 {
+		debug.SetMemoryLimit(limits.MaxMemoryBytes)
+	}
+	return nil
+}
+
+// WatchCpu is not supported on this platform: the job timeout still applies.
+func WatchCpu(limits Limits) func() {
+	return func() {}
+}
+
+// setProcessGroup is not supported on this platform.
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+// killProcessGroup only kills the worker on this platform, as process groups aren't supported.
+func killProcessGroup(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	return cmd.Process.Kill()
+}
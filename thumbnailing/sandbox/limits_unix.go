@@ -0,0 +1,86 @@
+//go:build unix
+
+package sandbox
+
+import (
+	"os"
+	"os/exec"
+	"runtime/debug"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ApplyLimits restricts the current (worker) process. The memory limit is applied to the data segment rather than the
+// address space because the Go runtime reserves far more address space than it uses. Helper processes spawned by the
+// generators (ffmpeg, ImageMagick) inherit the same limit.
+func ApplyLimits(limits Limits) error {
+	if limits.MaxMemoryBytes > 0 {
+		// Have the garbage collector work harder before we hit the hard limit
+		debug.SetMemoryLimit(limits.MaxMemoryBytes * 3 / 4)
+		lim := &syscall.Rlimit{Cur: uint64(limits.MaxMemoryBytes), Max: uint64(limits.MaxMemoryBytes)}
+		if err := syscall.Setrlimit(syscall.RLIMIT_DATA, lim); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WatchCpu terminates the worker process if the current job uses more than the allowed CPU time, including the time
+// used by helper processes which have finished. Helpers which are still running are stopped by the job timeout, which
+// kills the worker's whole process group. Call the returned function once the job is complete.
+func WatchCpu(limits Limits) func() {
+	if limits.MaxCpuTime <= 0 {
+		return func() {}
+	}
+
+	start := cpuTime()
+	ticker := time.NewTicker(250 * time.Millisecond)
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if cpuTime()-start > limits.MaxCpuTime {
+					logrus.Errorf("Thumbnail job exceeded CPU limit of %s - exiting", limits.MaxCpuTime)
+					os.Exit(ExitCodeCpuLimit)
+				}
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+	}
+}
+
+func cpuTime() time.Duration {
+	total := time.Duration(0)
+	for _, who := range []int{syscall.RUSAGE_SELF, syscall.RUSAGE_CHILDREN} {
+		usage := &syscall.Rusage{}
+		if err := syscall.Getrusage(who, usage); err != nil {
+			continue
+		}
+		total += time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+	}
+	return total
+}
+
+// setProcessGroup starts the worker in its own process group, so helpers it spawns can be killed along with it.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killProcessGroup kills the worker and any helper processes it spawned.
+func killProcessGroup(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil {
+		return cmd.Process.Kill()
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+package sandbox
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+// ExitCodeCpuLimit is used by worker processes which exceed their per-job CPU time.
+const ExitCodeCpuLimit = 3
+
+var ErrTimeout = errors.New("thumbnail worker timed out")
+
+type Limits struct {
+	MaxMemoryBytes int64
+	MaxCpuTime     time.Duration
+}
+
+type worker struct {
+	id     uint64
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	log    *io.PipeWriter
+	jobs   int
+}
+
+type workerPool struct {
+	conf   config.ThumbnailSandboxConfig
+	slots  chan bool
+	lock   sync.Mutex
+	idle   []*worker
+	closed bool
+}
+
+var currentPool *workerPool
+var poolLock = new(sync.Mutex)
+var workerIds = new(atomic.Uint64)
+
+func IsEnabled() bool {
+	return config.Get().Thumbnails.Sandbox.Enabled
+}
+
+// Run runs the job in a worker process, returning the worker's result and thumbnail bytes (if any). The media is
+// streamed to the worker rather than being held in memory. Workers which crash, time out, or otherwise misbehave are
+// discarded and replaced on the next job.
+func Run(ctx rcontext.RequestContext, job Job, media io.Reader) (*Result, []byte, error) {
+	p := getPool()
+	w, err := p.acquire(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	healthy := false
+	defer func() {
+		p.release(w, healthy)
+	}()
+
+	var timer *time.Timer
+	if p.conf.TimeoutSeconds > 0 {
+		timer = time.AfterFunc(time.Duration(p.conf.TimeoutSeconds)*time.Second, func() {
+			_ = killProcessGroup(w.cmd)
+		})
+	}
+
+	ctx.Log.Debugf("Dispatching %s job to worker %d", job.Kind, w.id)
+	if err = WriteJob(w.stdin, job, media); err == nil {
+		var result *Result
+		var thumbnail []byte
+		result, thumbnail, err = ReadResult(w.stdout)
+		if err == nil {
+			if timer != nil {
+				timer.Stop()
+			}
+			healthy = true
+			return result, thumbnail, nil
+		}
+	}
+
+	if timer != nil && !timer.Stop() {
+		return nil, nil, ErrTimeout
+	}
+	return nil, nil, errors.Join(errors.New("thumbnail worker failed"), err)
+}
+
+// Reload stops all idle workers, causing new ones to be started with the current config.
+func Reload() {
+	poolLock.Lock()
+	old := currentPool
+	currentPool = nil
+	poolLock.Unlock()
+
+	if old != nil {
+		old.close()
+	}
+}
+
+func Stop() {
+	Reload()
+}
+
+func getPool() *workerPool {
+	poolLock.Lock()
+	defer poolLock.Unlock()
+	if currentPool == nil {
+		conf := config.Get().Thumbnails.Sandbox
+		currentPool = &workerPool{
+			conf:  conf,
+			slots: make(chan bool, max(1, conf.NumWorkers)),
+			idle:  make([]*worker, 0),
+		}
+	}
+	return currentPool
+}
+
+func (p *workerPool) acquire(ctx rcontext.RequestContext) (*worker, error) {
+	select {
+	case p.slots <- true:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	p.lock.Lock()
+	if len(p.idle) > 0 {
+		w := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.lock.Unlock()
+		return w, nil
+	}
+	p.lock.Unlock()
+
+	w, err := startWorker(p.conf)
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	return w, nil
+}
+
+func (p *workerPool) release(w *worker, healthy bool) {
+	defer func() {
+		<-p.slots
+	}()
+
+	w.jobs++
+	p.lock.Lock()
+	if healthy && !p.closed && (p.conf.MaxJobsPerWorker <= 0 || w.jobs < p.conf.MaxJobsPerWorker) {
+		p.idle = append(p.idle, w)
+		p.lock.Unlock()
+		return
+	}
+	p.lock.Unlock()
+
+	if !healthy {
+		logrus.Warnf("Thumbnail worker %d failed - it will be replaced", w.id)
+	}
+	w.stop()
+}
+
+func (p *workerPool) close() {
+	p.lock.Lock()
+	p.closed = true
+	idle := p.idle
+	p.idle = make([]*worker, 0)
+	p.lock.Unlock()
+
+	for _, w := range idle {
+		w.stop()
+	}
+}
+
+func startWorker(conf config.ThumbnailSandboxConfig) (*worker, error) {
+	executable, err := findExecutable(conf.Executable)
+	if err != nil {
+		return nil, err
+	}
+
+	id := workerIds.Add(1)
+	cmd := exec.Command(executable,
+		"-worker",
+		"-worker-memory-mb", strconv.FormatInt(conf.MaxMemoryMegabytes, 10),
+		"-worker-cpu-seconds", strconv.Itoa(conf.MaxCpuSeconds),
+		"-assets", config.Runtime.AssetsPath,
+		"-log-level", config.Get().General.LogLevel,
+	)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	logWriter := logrus.WithField("thumbnail_worker", id).Writer()
+	cmd.Stderr = logWriter
+	setProcessGroup(cmd)
+	if err = cmd.Start(); err != nil {
+		_ = logWriter.Close()
+		return nil, err
+	}
+	logrus.Debugf("Started thumbnail worker %d (pid %d)", id, cmd.Process.Pid)
+
+	return &worker{
+		id:     id,
+		cmd:    cmd,
+		stdin:  stdin,
+		stdout: bufio.NewReader(stdout),
+		log:    logWriter,
+	}, nil
+}
+
+func (w *worker) stop() {
+	// Closing stdin asks the worker to exit nicely, but we don't wait around for it to do so
+	_ = w.stdin.Close()
+	_ = killProcessGroup(w.cmd)
+	_ = w.cmd.Wait()
+	_ = w.log.Close()
+	logrus.Debugf("Stopped thumbnail worker %d", w.id)
+}
+
+func findExecutable(configured string) (string, error) {
+	if configured != "" {
+		return configured, nil
+	}
+
+	// Prefer the thumbnailer shipped alongside the media repo binary
+	if self, err := os.Executable(); err == nil {
+		candidate := filepath.Join(filepath.Dir(self), "thumbnailer")
+		if _, err = os.Stat(candidate); err == nil {
+			return candidate, nil
+		}
+	}
+	return exec.LookPath("thumbnailer")
+}
@@ -0,0 +1,189 @@
+package sandbox
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/m"
+)
+
+const (
+	// JobKindThumbnail generates a thumbnail of the media. This is the default.
+	JobKindThumbnail = "thumbnail"
+	// JobKindMetadata extracts the metadata of the media, returned in Result.Metadata.
+	JobKindMetadata = "metadata"
+)
+
+// The largest chunk of source media sent to a worker at once. Workers reject larger chunks so a corrupt length can't
+// make them allocate huge buffers.
+const maxChunkBytes = 64 * 1024
+
+// Job is sent by the media repo to a worker process, followed by the source media as a sequence of chunks. Each chunk
+// is a 4 byte big endian length and that many bytes. An empty chunk ends the media.
+type Job struct {
+	Kind           string                  `json:"kind,omitempty"`
+	ContentType    string                  `json:"content_type"`
+	Width          int                     `json:"width"`
+	Height         int                     `json:"height"`
+	Method         string                  `json:"method"`
+	Animated       bool                    `json:"animated"`
+	AnimatedFormat string                  `json:"animated_format"`
+	Config         config.ThumbnailsConfig `json:"config"`
+}
+
+// Result is sent by a worker process in response to a Job, followed by SizeBytes of thumbnail.
+type Result struct {
+	Animated    bool             `json:"animated"`
+	ContentType string           `json:"content_type"`
+	Metadata    *m.MediaMetadata `json:"metadata,omitempty"`
+	ErrorCode   string           `json:"error_code,omitempty"`
+	Error       string           `json:"error,omitempty"`
+	SizeBytes   int64            `json:"size_bytes"`
+}
+
+// WriteJob sends the job, streaming the media to the worker as it is read.
+func WriteJob(w io.Writer, job Job, media io.Reader) error {
+	b, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(append(b, '\n')); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 4+maxChunkBytes)
+	for {
+		n, readErr := media.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n))
+			if _, err = w.Write(buf[:4+n]); err != nil {
+				return err
+			}
+		}
+		if errors.Is(readErr, io.EOF) {
+			break
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+	binary.BigEndian.PutUint32(buf[:4], 0)
+	_, err = w.Write(buf[:4])
+	return err
+}
+
+// ReadJob reads the next job. The returned reader provides the job's media, and must be read to EOF (such as with
+// io.Copy to io.Discard) before reading the next job.
+func ReadJob(r *bufio.Reader) (*Job, io.Reader, error) {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		if errors.Is(err, io.EOF) && len(line) > 0 {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		return nil, nil, err
+	}
+	job := &Job{}
+	if err = json.Unmarshal(line, job); err != nil {
+		return nil, nil, err
+	}
+	return job, &chunkReader{r: r}, nil
+}
+
+// chunkReader reads the chunked media following a Job.
+type chunkReader struct {
+	r         *bufio.Reader
+	remaining int
+	done      bool
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(c.r, header); err != nil {
+			return 0, noEOF(err)
+		}
+		size := binary.BigEndian.Uint32(header)
+		if size > maxChunkBytes {
+			return 0, errors.New("media chunk too large")
+		}
+		c.remaining = int(size)
+		c.done = size == 0
+	}
+
+	if len(p) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.remaining -= n
+	if err != nil {
+		return n, noEOF(err)
+	}
+	return n, nil
+}
+
+// noEOF converts EOFs part way through a frame into io.ErrUnexpectedEOF, so they aren't mistaken for the end of media.
+func noEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func WriteResult(w io.Writer, result Result, thumbnail []byte) error {
+	result.SizeBytes = int64(len(thumbnail))
+	return writeFrame(w, result, thumbnail)
+}
+
+func ReadResult(r *bufio.Reader) (*Result, []byte, error) {
+	result := &Result{}
+	b, err := readFrame(r, result, func() int64 { return result.SizeBytes })
+	if err != nil {
+		return nil, nil, err
+	}
+	return result, b, nil
+}
+
+// writeFrame writes the header as a single line of JSON, followed by the raw payload.
+func writeFrame(w io.Writer, header interface{}, payload []byte) error {
+	b, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	if len(payload) == 0 {
+		return nil
+	}
+	_, err = w.Write(payload)
+	return err
+}
+
+func readFrame(r *bufio.Reader, header interface{}, sizeFn func() int64) ([]byte, error) {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		if errors.Is(err, io.EOF) && len(line) > 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if err = json.Unmarshal(line, header); err != nil {
+		return nil, err
+	}
+	size := sizeFn()
+	if size < 0 {
+		return nil, errors.New("negative payload size")
+	}
+	b := make([]byte, size)
+	if _, err = io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,139 @@
+package thumbnailing
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/m"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/sandbox"
+)
+
+// Errors which callers check for, and therefore need to survive the trip back from a worker process
+var sandboxErrorCodes = map[string]error{
+	"unsupported":     ErrUnsupported,
+	"too_large":       common.ErrMediaTooLarge,
+	"too_small":       common.ErrMediaDimensionsTooSmall,
+	"not_thumbnailed": common.ErrMediaNotFound,
+}
+
+func generateSandboxed(imgStream io.Reader, contentType string, width int, height int, method string, animated bool, animatedFormat string, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
+	result, thumbnail, err := sandbox.Run(ctx, sandbox.Job{
+		Kind:           sandbox.JobKindThumbnail,
+		ContentType:    contentType,
+		Width:          width,
+		Height:         height,
+		Method:         method,
+		Animated:       animated,
+		AnimatedFormat: animatedFormat,
+		Config:         ctx.Config.Thumbnails,
+	}, imgStream)
+	if err != nil {
+		return nil, err
+	}
+	if result.ErrorCode != "" {
+		if knownErr, ok := sandboxErrorCodes[result.ErrorCode]; ok {
+			return nil, knownErr
+		}
+	}
+	if result.Error != "" {
+		return nil, errors.New(result.Error)
+	}
+
+	return &m.Thumbnail{
+		Animated:    result.Animated,
+		ContentType: result.ContentType,
+		Reader:      io.NopCloser(bytes.NewReader(thumbnail)),
+	}, nil
+}
+
+func extractSandboxed(stream io.Reader, contentType string, ctx rcontext.RequestContext) (*m.MediaMetadata, error) {
+	result, _, err := sandbox.Run(ctx, sandbox.Job{
+		Kind:        sandbox.JobKindMetadata,
+		ContentType: contentType,
+		Config:      ctx.Config.Thumbnails,
+	}, stream)
+	if err != nil {
+		return nil, err
+	}
+	if result.Error != "" {
+		return nil, errors.New(result.Error)
+	}
+	if result.Metadata == nil {
+		return nil, errors.New("worker did not return metadata")
+	}
+	return result.Metadata, nil
+}
+
+// ServeSandboxWorker runs the worker side of the thumbnail sandbox, generating thumbnails and extracting metadata for
+// jobs read from `in` until it is closed. Panics are deliberately not recovered: the media repo will replace the worker process.
+func ServeSandboxWorker(in io.Reader, out io.Writer, limits sandbox.Limits) error {
+	if err := sandbox.ApplyLimits(limits); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(in)
+	for {
+		job, media, err := sandbox.ReadJob(r)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+
+		stopWatch := sandbox.WatchCpu(limits)
+		result, thumbnail := runSandboxJob(job, media)
+		stopWatch()
+
+		// The generator might not need all of the media, but it has to be read before the next job
+		if _, err = io.Copy(io.Discard, media); err != nil {
+			return err
+		}
+
+		if err = sandbox.WriteResult(out, result, thumbnail); err != nil {
+			return err
+		}
+	}
+}
+
+func runSandboxJob(job *sandbox.Job, media io.Reader) (sandbox.Result, []byte) {
+	ctx := rcontext.InitialNoConfig().WithConfig(config.DomainRepoConfig{Thumbnails: job.Config})
+
+	if job.Kind == sandbox.JobKindMetadata {
+		metadata, err := extractInProcess(media, job.ContentType, ctx)
+		if err != nil {
+			return sandbox.Result{Error: err.Error()}, nil
+		}
+		return sandbox.Result{Metadata: metadata}, nil
+	}
+
+	thumb, err := generateInProcess(media, job.ContentType, job.Width, job.Height, job.Method, job.Animated, job.AnimatedFormat, ctx)
+	if err == nil && thumb == nil {
+		err = common.ErrMediaNotFound
+	}
+	if err != nil {
+		if thumb != nil && thumb.Reader != nil {
+			_ = thumb.Reader.Close()
+		}
+		result := sandbox.Result{Error: err.Error()}
+		for code, knownErr := range sandboxErrorCodes {
+			if errors.Is(err, knownErr) {
+				result.ErrorCode = code
+				break
+			}
+		}
+		return result, nil
+	}
+	defer thumb.Reader.Close()
+
+	b, err := io.ReadAll(thumb.Reader)
+	if err != nil {
+		return sandbox.Result{Error: err.Error()}, nil
+	}
+	return sandbox.Result{Animated: thumb.Animated, ContentType: thumb.ContentType}, b
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 	"github.com/t2bot/matrix-media-repo/thumbnailing/i"
 	"github.com/t2bot/matrix-media-repo/thumbnailing/m"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/sandbox"
 	"github.com/t2bot/matrix-media-repo/thumbnailing/u"
 	"github.com/t2bot/matrix-media-repo/util"
 	"github.com/t2bot/matrix-media-repo/util/readers"
@@ -20,17 +21,21 @@ func IsSupported(contentType string) bool {
 	return util.ArrayContains(i.GetSupportedContentTypes(), contentType)
 }
 
-func GenerateThumbnail(imgStream io.ReadCloser, contentType string, width int, height int, method string, animated bool, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
+// GenerateThumbnail creates a thumbnail of the media. When animated, the animatedFormat (one of the u.AnimatedFormat*
+// constants) is used for the thumbnail if the source is animated.
+func GenerateThumbnail(imgStream io.ReadCloser, contentType string, width int, height int, method string, animated bool, animatedFormat string, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
 	defer imgStream.Close()
-	if !IsSupported(contentType) {
-		ctx.Log.Debugf("Unsupported content type '%s'", contentType)
-		return nil, ErrUnsupported
+	if err := checkContentType(contentType, ctx); err != nil {
+		return nil, err
 	}
-	if !util.ArrayContains(ctx.Config.Thumbnails.Types, contentType) {
-		ctx.Log.Debugf("Disabled content type '%s'", contentType)
-		return nil, ErrUnsupported
+
+	if sandbox.IsEnabled() {
+		return generateSandboxed(imgStream, contentType, width, height, method, animated, animatedFormat, ctx)
 	}
+	return generateInProcess(imgStream, contentType, width, height, method, animated, animatedFormat, ctx)
+}
 
+func generateInProcess(imgStream io.Reader, contentType string, width int, height int, method string, animated bool, animatedFormat string, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
 	generator, reconstructed := i.GetGenerator(imgStream, contentType, animated)
 	if generator == nil {
 		ctx.Log.Debugf("Unsupported thumbnail type at generator for '%s'", contentType)
@@ -46,22 +51,54 @@ func GenerateThumbnail(imgStream io.ReadCloser, contentType string, width int, h
 		return nil, errors.New("error getting dimensions: " + err.Error())
 	}
 	if dimensional {
-		if (w * h) >= ctx.Config.Thumbnails.MaxPixels {
-			ctx.Log.Debug("Image too large: too many pixels")
-			return nil, common.ErrMediaTooLarge
-		}
-
-		// While we're here, check to ensure we're not about to produce a thumbnail which is larger than the source material
-		shouldThumbnail := true
-		shouldThumbnail, width, height, method = u.AdjustProperties(w, h, width, height, animated, method)
-		if !shouldThumbnail {
-			return nil, common.ErrMediaDimensionsTooSmall
+		width, height, method, err = checkDimensions(w, h, width, height, method, animated, ctx)
+		if err != nil {
+			return nil, err
 		}
 	}
 
+	if animatedGenerator, ok := generator.(i.AnimatedGenerator); ok && animated && u.IsAnimatedFormat(animatedFormat) {
+		return animatedGenerator.GenerateAnimatedThumbnail(buffered.GetRewoundReader(), contentType, width, height, method, animatedFormat, ctx)
+	}
 	return generator.GenerateThumbnail(buffered.GetRewoundReader(), contentType, width, height, method, animated, ctx)
 }
 
+// CanThumbnail determines whether media with the given content type and known source dimensions can be thumbnailed
+// at the requested size, without needing to read the media itself.
+func CanThumbnail(contentType string, srcWidth int, srcHeight int, width int, height int, method string, animated bool, ctx rcontext.RequestContext) error {
+	if err := checkContentType(contentType, ctx); err != nil {
+		return err
+	}
+	_, _, _, err := checkDimensions(srcWidth, srcHeight, width, height, method, animated, ctx)
+	return err
+}
+
+func checkContentType(contentType string, ctx rcontext.RequestContext) error {
+	if !IsSupported(contentType) {
+		ctx.Log.Debugf("Unsupported content type '%s'", contentType)
+		return ErrUnsupported
+	}
+	if !util.ArrayContains(ctx.Config.Thumbnails.Types, contentType) {
+		ctx.Log.Debugf("Disabled content type '%s'", contentType)
+		return ErrUnsupported
+	}
+	return nil
+}
+
+func checkDimensions(srcWidth int, srcHeight int, width int, height int, method string, animated bool, ctx rcontext.RequestContext) (int, int, string, error) {
+	if (srcWidth * srcHeight) >= ctx.Config.Thumbnails.MaxPixels {
+		ctx.Log.Debug("Image too large: too many pixels")
+		return 0, 0, "", common.ErrMediaTooLarge
+	}
+
+	// While we're here, check to ensure we're not about to produce a thumbnail which is larger than the source material
+	shouldThumbnail, width, height, method := u.AdjustProperties(srcWidth, srcHeight, width, height, animated, method)
+	if !shouldThumbnail {
+		return 0, 0, "", common.ErrMediaDimensionsTooSmall
+	}
+	return width, height, method, nil
+}
+
 func GetGenerator(imgStream io.Reader, contentType string, animated bool) (i.Generator, io.Reader, error) {
 	generator, reconstructed := i.GetGenerator(imgStream, contentType, animated)
 	if generator == nil {
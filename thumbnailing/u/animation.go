@@ -0,0 +1,252 @@
+package u
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"io"
+	"math"
+	"time"
+
+	"github.com/HugoSmits86/nativewebp"
+	"github.com/kettek/apng"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+	"github.com/t2bot/matrix-media-repo/thumbnailing/m"
+)
+
+const (
+	AnimatedFormatWebp = "webp"
+	AnimatedFormatApng = "apng"
+	AnimatedFormatGif  = "gif"
+)
+
+// Browsers treat very short frame delays as 100ms, so we do the same to avoid runaway frame rates.
+const minFrameDelay = 20 * time.Millisecond
+const defaultFrameDelay = 100 * time.Millisecond
+
+func IsAnimatedFormat(format string) bool {
+	return format == AnimatedFormatWebp || format == AnimatedFormatApng || format == AnimatedFormatGif
+}
+
+// AnimatedContentType returns the content type used for animated thumbnails of the given format.
+func AnimatedContentType(format string) string {
+	switch format {
+	case AnimatedFormatWebp:
+		return "image/webp"
+	case AnimatedFormatApng:
+		return "image/png" // served as a regular PNG so clients without APNG support can show the first frame
+	default:
+		return "image/gif"
+	}
+}
+
+// NormalizeFrameDelay applies the same minimum frame delay as browsers to a source frame delay.
+func NormalizeFrameDelay(delay time.Duration) time.Duration {
+	if delay < minFrameDelay {
+		return defaultFrameDelay
+	}
+	return delay
+}
+
+// GifLoopCount converts a number of times to play an animation (zero being forever) to a GIF loop count, which
+// counts repeats instead of plays.
+func GifLoopCount(plays int) int {
+	if plays <= 0 {
+		return 0
+	} else if plays == 1 {
+		return -1
+	}
+	return plays - 1
+}
+
+// GifPlays is the reverse of GifLoopCount.
+func GifPlays(loopCount int) int {
+	if loopCount < 0 {
+		return 1
+	} else if loopCount == 0 {
+		return 0
+	}
+	return loopCount + 1
+}
+
+// AnimationBuilder thumbnails the frames of an animation, dropping frames to stay within the configured frame
+// rate and frame count. Callers composite each source frame onto a full-size canvas and pass it to AddFrame.
+type AnimationBuilder struct {
+	framer    *Framer
+	keep      map[int]time.Duration
+	frames    []image.Image
+	delays    []time.Duration
+	palettes  []color.Palette
+	loopCount int
+}
+
+// NewAnimationBuilder creates a builder for an animation with the given source frame delays. The number of plays is
+// zero to loop forever.
+func NewAnimationBuilder(ctx rcontext.RequestContext, width int, height int, method string, delays []time.Duration, plays int) *AnimationBuilder {
+	return &AnimationBuilder{
+		framer:    &Framer{Method: method, Width: width, Height: height, CropStrategy: ctx.Config.Thumbnails.CropStrategy},
+		keep:      pickFrames(delays, ctx.Config.Thumbnails.MaxAnimatedFps, ctx.Config.Thumbnails.MaxAnimatedFrames),
+		frames:    make([]image.Image, 0),
+		delays:    make([]time.Duration, 0),
+		palettes:  make([]color.Palette, 0),
+		loopCount: plays,
+	}
+}
+
+// Wants returns true if the frame at the given index will be part of the thumbnail.
+func (b *AnimationBuilder) Wants(frameIndex int) bool {
+	_, ok := b.keep[frameIndex]
+	return ok
+}
+
+// AddFrame thumbnails the canvas if the frame at the given index is wanted. The palette is optional, and only used
+// when encoding GIFs. The canvas is not retained.
+func (b *AnimationBuilder) AddFrame(frameIndex int, canvas image.Image, framePalette color.Palette) error {
+	delay, ok := b.keep[frameIndex]
+	if !ok {
+		return nil
+	}
+	frame, err := b.framer.MakeThumbnail(canvas)
+	if err != nil {
+		return err
+	}
+	b.frames = append(b.frames, frame)
+	b.delays = append(b.delays, delay)
+	b.palettes = append(b.palettes, framePalette)
+	return nil
+}
+
+// Encode returns the animated thumbnail in the requested format.
+func (b *AnimationBuilder) Encode(format string) (*m.Thumbnail, error) {
+	if len(b.frames) == 0 {
+		return nil, errors.New("animation has no frames")
+	}
+	if !IsAnimatedFormat(format) {
+		format = AnimatedFormatGif
+	}
+
+	pr, pw := io.Pipe()
+	go func(pw *io.PipeWriter) {
+		var err error
+		switch format {
+		case AnimatedFormatWebp:
+			err = b.encodeWebp(pw)
+		case AnimatedFormatApng:
+			err = b.encodeApng(pw)
+		default:
+			err = b.encodeGif(pw)
+		}
+		if err != nil {
+			_ = pw.CloseWithError(errors.New(format + ": error encoding animated thumbnail: " + err.Error()))
+		} else {
+			_ = pw.Close()
+		}
+	}(pw)
+
+	return &m.Thumbnail{
+		Animated:    true,
+		ContentType: AnimatedContentType(format),
+		Reader:      pr,
+	}, nil
+}
+
+func (b *AnimationBuilder) encodeWebp(w io.Writer) error {
+	anim := &nativewebp.Animation{
+		Images:    b.frames,
+		Durations: make([]uint, len(b.frames)),
+		Disposals: make([]uint, len(b.frames)),
+		LoopCount: uint16(b.loopCount),
+	}
+	for i, d := range b.delays {
+		anim.Durations[i] = uint(d.Milliseconds())
+		anim.Disposals[i] = 1 // frames are complete, so clear the canvas between them
+	}
+	return nativewebp.EncodeAll(w, anim, nil)
+}
+
+func (b *AnimationBuilder) encodeApng(w io.Writer) error {
+	a := apng.APNG{
+		Frames:    make([]apng.Frame, len(b.frames)),
+		LoopCount: uint(b.loopCount),
+	}
+	for i, img := range b.frames {
+		a.Frames[i] = apng.Frame{
+			Image:            img,
+			DelayNumerator:   uint16(min(b.delays[i].Milliseconds(), math.MaxUint16)),
+			DelayDenominator: 1000,
+			DisposeOp:        apng.DISPOSE_OP_NONE,
+			BlendOp:          apng.BLEND_OP_SOURCE,
+		}
+	}
+	return apng.Encode(w, a)
+}
+
+func (b *AnimationBuilder) encodeGif(w io.Writer) error {
+	// Sources without a palette of their own get web-safe colours, plus transparency
+	fallbackPalette := append(color.Palette{color.Transparent}, palette.WebSafe...)
+
+	g := &gif.GIF{
+		Image:     make([]*image.Paletted, len(b.frames)),
+		Delay:     make([]int, len(b.frames)),
+		Disposal:  make([]byte, len(b.frames)),
+		LoopCount: GifLoopCount(b.loopCount),
+	}
+	for i, img := range b.frames {
+		p := b.palettes[i]
+		if len(p) == 0 {
+			p = fallbackPalette
+		}
+		target := image.NewPaletted(img.Bounds(), p)
+		draw.FloydSteinberg.Draw(target, img.Bounds(), img, img.Bounds().Min)
+		g.Image[i] = target
+		g.Delay[i] = int(b.delays[i].Milliseconds() / 10)
+		g.Disposal[i] = gif.DisposalBackground
+	}
+	return gif.EncodeAll(w, g)
+}
+
+// pickFrames decides which frames to keep to stay under the given frame rate and frame count, returning the kept frame
+// indices mapped to their new delays. Dropped frames have their delay added to the previously kept frame so the
+// overall timing of the animation is preserved. Limits of zero or less are not applied.
+func pickFrames(delays []time.Duration, maxFps int, maxFrames int) map[int]time.Duration {
+	indices := make([]int, 0, len(delays))
+	newDelays := make([]time.Duration, 0, len(delays))
+
+	minDelay := time.Duration(0)
+	if maxFps > 0 {
+		minDelay = time.Second / time.Duration(maxFps)
+	}
+	for i, d := range delays {
+		if len(indices) > 0 && newDelays[len(newDelays)-1] < minDelay {
+			newDelays[len(newDelays)-1] += d
+			continue
+		}
+		indices = append(indices, i)
+		newDelays = append(newDelays, d)
+	}
+
+	if maxFrames > 0 && len(indices) > maxFrames {
+		step := int(math.Ceil(float64(len(indices)) / float64(maxFrames)))
+		reducedIndices := make([]int, 0, maxFrames)
+		reducedDelays := make([]time.Duration, 0, maxFrames)
+		for i, idx := range indices {
+			if i%step == 0 {
+				reducedIndices = append(reducedIndices, idx)
+				reducedDelays = append(reducedDelays, newDelays[i])
+			} else {
+				reducedDelays[len(reducedDelays)-1] += newDelays[i]
+			}
+		}
+		indices = reducedIndices
+		newDelays = reducedDelays
+	}
+
+	keep := make(map[int]time.Duration, len(indices))
+	for i, idx := range indices {
+		keep[idx] = newDelays[i]
+	}
+	return keep
+}
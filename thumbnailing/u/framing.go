@@ -10,18 +10,44 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-func MakeThumbnail(src image.Image, method string, width int, height int) (image.Image, error) {
+func MakeThumbnail(src image.Image, method string, width int, height int, cropStrategy string) (image.Image, error) {
 	var result image.Image
 	if method == "scale" {
 		result = imaging.Fit(src, width, height, imaging.Linear)
 	} else if method == "crop" {
-		result = imaging.Fill(src, width, height, imaging.Center, imaging.Linear)
+		if NormalizeCropStrategy(cropStrategy) == CropCenter {
+			result = imaging.Fill(src, width, height, imaging.Center, imaging.Linear)
+		} else {
+			result = CropToRegion(src, PickCropRegion(src, width, height, cropStrategy), width, height)
+		}
 	} else {
 		return nil, errors.New("unrecognized method: " + method)
 	}
 	return result, nil
 }
 
+// Framer makes thumbnails of a sequence of same-sized frames, such as those of an animation. Content-aware
+// crop regions are picked from the first frame and re-used for the remaining frames to avoid jitter.
+type Framer struct {
+	Method       string
+	Width        int
+	Height       int
+	CropStrategy string
+
+	region *image.Rectangle
+}
+
+func (f *Framer) MakeThumbnail(src image.Image) (image.Image, error) {
+	if f.Method != "crop" || NormalizeCropStrategy(f.CropStrategy) == CropCenter {
+		return MakeThumbnail(src, f.Method, f.Width, f.Height, f.CropStrategy)
+	}
+	if f.region == nil {
+		region := PickCropRegion(src, f.Width, f.Height, f.CropStrategy)
+		f.region = &region
+	}
+	return CropToRegion(src, *f.region, f.Width, f.Height), nil
+}
+
 func ExtractExifOrientation(r io.Reader) *ExifOrientation {
 	orientation, err := GetExifOrientation(r)
 	if err != nil {
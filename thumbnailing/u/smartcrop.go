@@ -0,0 +1,208 @@
+package u
+
+import (
+	"image"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	CropCenter  = "center"
+	CropEntropy = "entropy"
+	CropEdges   = "edges"
+)
+
+// The longest edge, in pixels, of the downscaled copy used to score crop regions
+const cropAnalysisSize = 256
+
+// The number of luminance buckets used when calculating entropy
+const cropEntropyBuckets = 32
+
+// NormalizeCropStrategy returns the crop strategy which will actually be used for the given input. Unknown
+// strategies fall back to centre cropping.
+func NormalizeCropStrategy(strategy string) string {
+	switch strategy {
+	case CropEntropy, CropEdges:
+		return strategy
+	default:
+		return CropCenter
+	}
+}
+
+// PickCropRegion determines the largest region of the source image matching the aspect ratio of the target
+// dimensions, positioned according to the crop strategy.
+func PickCropRegion(src image.Image, width int, height int, strategy string) image.Rectangle {
+	bounds := src.Bounds()
+	srcWidth := bounds.Dx()
+	srcHeight := bounds.Dy()
+
+	cropWidth := srcWidth
+	cropHeight := int(math.Round(float64(srcWidth) * float64(height) / float64(width)))
+	if cropHeight > srcHeight {
+		cropHeight = srcHeight
+		cropWidth = int(math.Round(float64(srcHeight) * float64(width) / float64(height)))
+	}
+	cropWidth = max(1, min(cropWidth, srcWidth))
+	cropHeight = max(1, min(cropHeight, srcHeight))
+
+	// Start with a centred region, and only move it if we can (and have been asked to)
+	x := (srcWidth - cropWidth) / 2
+	y := (srcHeight - cropHeight) / 2
+	strategy = NormalizeCropStrategy(strategy)
+	if strategy != CropCenter && (cropWidth < srcWidth || cropHeight < srcHeight) {
+		vertical := cropHeight < srcHeight
+		if vertical {
+			y = pickCropOffset(src, srcHeight, cropHeight, vertical, strategy)
+		} else {
+			x = pickCropOffset(src, srcWidth, cropWidth, vertical, strategy)
+		}
+	}
+
+	return image.Rect(bounds.Min.X+x, bounds.Min.Y+y, bounds.Min.X+x+cropWidth, bounds.Min.Y+y+cropHeight)
+}
+
+// CropToRegion crops the source image to the given region, then resizes the result to the target dimensions.
+func CropToRegion(src image.Image, region image.Rectangle, width int, height int) image.Image {
+	return imaging.Resize(imaging.Crop(src, region), width, height, imaging.Linear)
+}
+
+// pickCropOffset returns the offset along the free axis (in source pixels) for the crop window which scores the
+// highest under the given strategy. Ties are resolved in favour of the window closest to the centre.
+func pickCropOffset(src image.Image, srcLength int, cropLength int, vertical bool, strategy string) int {
+	analysis := imaging.Clone(src)
+	if analysis.Bounds().Dx() > cropAnalysisSize || analysis.Bounds().Dy() > cropAnalysisSize {
+		analysis = imaging.Fit(analysis, cropAnalysisSize, cropAnalysisSize, imaging.Box)
+	}
+	lum := luminance(analysis)
+	w := analysis.Bounds().Dx()
+	h := analysis.Bounds().Dy()
+
+	lines := w
+	if vertical {
+		lines = h
+	}
+	scale := float64(lines) / float64(srcLength)
+	window := max(1, min(lines, int(math.Round(float64(cropLength)*scale))))
+	if window >= lines {
+		return (srcLength - cropLength) / 2
+	}
+
+	var scores []float64
+	if strategy == CropEdges {
+		scores = edgeWindowScores(lum, w, h, vertical, window)
+	} else {
+		scores = entropyWindowScores(lum, w, h, vertical, window)
+	}
+
+	centre := float64(lines-window) / 2
+	best := 0
+	for i, s := range scores {
+		if s > scores[best] || (s == scores[best] && math.Abs(float64(i)-centre) < math.Abs(float64(best)-centre)) {
+			best = i
+		}
+	}
+
+	offset := int(math.Round(float64(best) / scale))
+	return max(0, min(offset, srcLength-cropLength))
+}
+
+// luminance converts the image to a flat slice of alpha-weighted luminance values.
+func luminance(img *image.NRGBA) []uint8 {
+	w := img.Bounds().Dx()
+	h := img.Bounds().Dy()
+	lum := make([]uint8, w*h)
+	for y := 0; y < h; y++ {
+		row := img.Pix[y*img.Stride : y*img.Stride+w*4]
+		for x := 0; x < w; x++ {
+			p := row[x*4 : x*4+4]
+			l := (299*uint32(p[0]) + 587*uint32(p[1]) + 114*uint32(p[2])) / 1000
+			lum[y*w+x] = uint8(l * uint32(p[3]) / 255)
+		}
+	}
+	return lum
+}
+
+// lineOf returns the index of the line along the free axis which the given pixel belongs to.
+func lineOf(x int, y int, vertical bool) int {
+	if vertical {
+		return y
+	}
+	return x
+}
+
+func entropyWindowScores(lum []uint8, w int, h int, vertical bool, window int) []float64 {
+	lines := w
+	if vertical {
+		lines = h
+	}
+
+	histograms := make([][cropEntropyBuckets]int, lines)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			histograms[lineOf(x, y, vertical)][int(lum[y*w+x])*cropEntropyBuckets/256]++
+		}
+	}
+
+	scores := make([]float64, lines-window+1)
+	var sum [cropEntropyBuckets]int
+	for i := 0; i < lines; i++ {
+		for b := range sum {
+			sum[b] += histograms[i][b]
+		}
+		if i >= window {
+			for b := range sum {
+				sum[b] -= histograms[i-window][b]
+			}
+		}
+		if i >= window-1 {
+			scores[i-window+1] = entropy(sum[:])
+		}
+	}
+	return scores
+}
+
+func entropy(histogram []int) float64 {
+	total := 0
+	for _, c := range histogram {
+		total += c
+	}
+	if total == 0 {
+		return 0
+	}
+	e := 0.0
+	for _, c := range histogram {
+		if c == 0 {
+			continue
+		}
+		p := float64(c) / float64(total)
+		e -= p * math.Log2(p)
+	}
+	return e
+}
+
+func edgeWindowScores(lum []uint8, w int, h int, vertical bool, window int) []float64 {
+	lines := w
+	if vertical {
+		lines = h
+	}
+
+	// Sum a cheap gradient magnitude for each line, then slide the window over the prefix sums
+	prefix := make([]float64, lines+1)
+	for y := 1; y < h-1; y++ {
+		for x := 1; x < w-1; x++ {
+			dx := int(lum[y*w+x+1]) - int(lum[y*w+x-1])
+			dy := int(lum[(y+1)*w+x]) - int(lum[(y-1)*w+x])
+			prefix[lineOf(x, y, vertical)+1] += math.Abs(float64(dx)) + math.Abs(float64(dy))
+		}
+	}
+	for i := 1; i <= lines; i++ {
+		prefix[i] += prefix[i-1]
+	}
+
+	scores := make([]float64, lines-window+1)
+	for i := range scores {
+		scores[i] = prefix[i+window] - prefix[i]
+	}
+	return scores
+}
@@ -9,10 +9,37 @@ type PreviewResult struct {
 	Description string
 	Title       string
 	Image       *PreviewImage
+
+	Favicon        *PreviewImage
+	Video          *PreviewMedia
+	Audio          *PreviewMedia
+	TwitterCard    string
+	TwitterSite    string
+	TwitterCreator string
+	Author         string
+	PublishedTime  string
+	DurationMs     int64
+	Locale         string
 }
 
 type PreviewImage struct {
 	ContentType string
 	Data        io.ReadCloser
 	Filename    string
+
+	// Where the image was downloaded from, if known.
+	Url string
+
+	// The dimensions reported by the page, if known. These are only used if the image's own dimensions can't be read.
+	Width  int
+	Height int
+}
+
+// PreviewMedia is a video or audio file referenced by the page. Unlike images, these are linked to rather than
+// downloaded.
+type PreviewMedia struct {
+	Url         string
+	ContentType string
+	Width       int
+	Height      int
 }
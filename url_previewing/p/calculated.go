@@ -1,8 +1,15 @@
 package p
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
 
+	"github.com/dhowden/tag"
+	"github.com/getsentry/sentry-go"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/t2bot/matrix-media-repo/common"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
@@ -25,6 +32,9 @@ func GenerateCalculatedPreview(urlPayload *m.UrlPayload, languageHeader string,
 		// We'll consider it not found for the sake of processing
 		return m.PreviewResult{}, common.ErrMediaNotFound
 	}
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		contentType = mediaType
+	}
 
 	img := &m.PreviewImage{
 		Data:        r,
@@ -48,17 +58,84 @@ func GenerateCalculatedPreview(urlPayload *m.UrlPayload, languageHeader string,
 	result := &m.PreviewResult{
 		Type:        "", // intentionally empty
 		Url:         urlPayload.ParsedUrl.String(),
-		Title:       u.Summarize(filename, ctx.Config.UrlPreviews.NumTitleWords, ctx.Config.UrlPreviews.MaxTitleLength),
-		Description: u.Summarize(description, ctx.Config.UrlPreviews.NumWords, ctx.Config.UrlPreviews.MaxLength),
+		Title:       filename,
+		Description: description,
 		SiteName:    "", // intentionally empty
 	}
 
-	if thumbnailing.IsSupported(img.ContentType) {
+	if strings.HasPrefix(img.ContentType, "image/") && thumbnailing.IsSupported(img.ContentType) {
 		result.Image = img
+	} else if thumbnailing.IsSupported(img.ContentType) {
+		// Files like PDFs, audio, and video get a thumbnail as the preview image instead
+		defer img.Data.Close()
+		previewFile(img, result, ctx)
 	} else {
 		defer img.Data.Close()
 	}
 
+	result.Title = u.Summarize(result.Title, ctx.Config.UrlPreviews.NumTitleWords, ctx.Config.UrlPreviews.MaxTitleLength)
+	result.Description = u.Summarize(result.Description, ctx.Config.UrlPreviews.NumWords, ctx.Config.UrlPreviews.MaxLength)
+
 	metrics.UrlPreviewsGenerated.With(prometheus.Labels{"type": "calculated"}).Inc()
 	return *result, nil
 }
+
+// previewFile fills in the preview for a file which isn't an image, using the thumbnailer to create the preview image.
+// The title and duration are filled in where the file has them. Errors are non-fatal: the file just gets a plainer
+// preview.
+func previewFile(file *m.PreviewImage, result *m.PreviewResult, ctx rcontext.RequestContext) {
+	// The download is already limited to maxPageSizeBytes
+	b, err := io.ReadAll(file.Data)
+	if err != nil {
+		ctx.Log.Warn("Non-fatal error reading file for preview: ", err)
+		return
+	}
+
+	if strings.HasPrefix(file.ContentType, "video/") {
+		result.Video = &m.PreviewMedia{Url: result.Url, ContentType: file.ContentType}
+	} else if strings.HasPrefix(file.ContentType, "audio/") {
+		result.Audio = &m.PreviewMedia{Url: result.Url, ContentType: file.ContentType}
+
+		if tags, err := tag.ReadFrom(bytes.NewReader(b)); err == nil && tags.Title() != "" {
+			result.Title = tags.Title()
+			if tags.Artist() != "" {
+				result.Description = fmt.Sprintf("%s - %s", tags.Artist(), tags.Album())
+				result.Description = strings.TrimSuffix(result.Description, " - ")
+			}
+		}
+	}
+
+	metadata, err := thumbnailing.ExtractMetadata(bytes.NewReader(b), file.ContentType, ctx)
+	if err != nil {
+		ctx.Log.Warn("Non-fatal error getting file metadata for preview: ", err)
+	} else if metadata.Audio != nil {
+		result.DurationMs = metadata.Audio.Duration.Milliseconds()
+	}
+
+	width, height := previewImageSize(ctx)
+	thumb, err := thumbnailing.GenerateThumbnail(io.NopCloser(bytes.NewReader(b)), file.ContentType, width, height, "scale", false, "", ctx)
+	if err != nil {
+		ctx.Log.Warn("Non-fatal error generating preview image for file: ", err)
+		if !errors.Is(err, thumbnailing.ErrUnsupported) && !errors.Is(err, common.ErrMediaTooLarge) && !errors.Is(err, common.ErrMediaDimensionsTooSmall) {
+			sentry.CaptureException(err)
+		}
+		return
+	}
+	result.Image = &m.PreviewImage{
+		ContentType: thumb.ContentType,
+		Data:        thumb.Reader,
+	}
+}
+
+// previewImageSize picks the largest configured thumbnail size for preview images of files.
+func previewImageSize(ctx rcontext.RequestContext) (int, int) {
+	width := 640
+	height := 480
+	for _, size := range ctx.Config.Thumbnails.Sizes {
+		if size.Width*size.Height > width*height {
+			width = size.Width
+			height = size.Height
+		}
+	}
+	return width, height
+}
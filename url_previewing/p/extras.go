@@ -0,0 +1,240 @@
+package p
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"golang.org/x/text/language"
+)
+
+type twitterCard struct {
+	Card        string
+	Site        string
+	Creator     string
+	Title       string
+	Description string
+	Image       string
+}
+
+type jsonLdInfo struct {
+	Title         string
+	Description   string
+	Image         string
+	Author        string
+	PublishedTime string
+}
+
+// JSON-LD types which describe something other than the page itself, and so shouldn't be used for the preview.
+var jsonLdIgnoredTypes = []string{"WebSite", "Organization", "Person", "BreadcrumbList", "ImageObject", "SiteNavigationElement", "SearchAction"}
+
+func metaContent(doc *goquery.Document, name string) string {
+	content, _ := doc.Find(fmt.Sprintf("meta[name='%s'], meta[property='%s']", name, name)).First().Attr("content")
+	return strings.TrimSpace(content)
+}
+
+func calcTwitterCard(doc *goquery.Document) twitterCard {
+	card := twitterCard{
+		Card:        metaContent(doc, "twitter:card"),
+		Site:        metaContent(doc, "twitter:site"),
+		Creator:     metaContent(doc, "twitter:creator"),
+		Title:       metaContent(doc, "twitter:title"),
+		Description: metaContent(doc, "twitter:description"),
+		Image:       metaContent(doc, "twitter:image"),
+	}
+	if card.Image == "" {
+		card.Image = metaContent(doc, "twitter:image:src")
+	}
+	return card
+}
+
+// calcJsonLd finds the first schema.org JSON-LD object describing the page, such as an article or product.
+func calcJsonLd(doc *goquery.Document) jsonLdInfo {
+	info := jsonLdInfo{}
+	doc.Find("script[type='application/ld+json']").EachWithBreak(func(i int, s *goquery.Selection) bool {
+		var val interface{}
+		if err := json.Unmarshal([]byte(s.Text()), &val); err != nil {
+			return true // try the next one
+		}
+		for _, obj := range jsonLdObjects(val) {
+			if slices.ContainsFunc(jsonLdStrings(obj["@type"]), func(t string) bool {
+				return slices.Contains(jsonLdIgnoredTypes, t)
+			}) {
+				continue
+			}
+			title := jsonLdString(obj["headline"])
+			if title == "" {
+				title = jsonLdString(obj["name"])
+			}
+			if title == "" {
+				continue
+			}
+			info = jsonLdInfo{
+				Title:         title,
+				Description:   jsonLdString(obj["description"]),
+				Image:         jsonLdUrl(obj["image"]),
+				Author:        strings.Join(jsonLdNames(obj["author"]), ", "),
+				PublishedTime: jsonLdString(obj["datePublished"]),
+			}
+			if info.Image == "" {
+				info.Image = jsonLdUrl(obj["thumbnailUrl"])
+			}
+			return false
+		}
+		return true
+	})
+	return info
+}
+
+// jsonLdObjects flattens arrays and graphs of JSON-LD objects.
+func jsonLdObjects(val interface{}) []map[string]interface{} {
+	objs := make([]map[string]interface{}, 0)
+	switch v := val.(type) {
+	case map[string]interface{}:
+		if graph, ok := v["@graph"]; ok {
+			objs = append(objs, jsonLdObjects(graph)...)
+		} else {
+			objs = append(objs, v)
+		}
+	case []interface{}:
+		for _, item := range v {
+			objs = append(objs, jsonLdObjects(item)...)
+		}
+	}
+	return objs
+}
+
+func jsonLdStrings(val interface{}) []string {
+	switch v := val.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		vals := make([]string, 0)
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				vals = append(vals, s)
+			}
+		}
+		return vals
+	}
+	return []string{}
+}
+
+func jsonLdString(val interface{}) string {
+	vals := jsonLdStrings(val)
+	if len(vals) == 0 {
+		return ""
+	}
+	return strings.TrimSpace(vals[0])
+}
+
+// jsonLdUrl gets a URL from a value which may be the URL itself, an object (such as an ImageObject), or a list of either.
+func jsonLdUrl(val interface{}) string {
+	switch v := val.(type) {
+	case string:
+		return v
+	case map[string]interface{}:
+		if u := jsonLdString(v["url"]); u != "" {
+			return u
+		}
+		return jsonLdString(v["contentUrl"])
+	case []interface{}:
+		for _, item := range v {
+			if u := jsonLdUrl(item); u != "" {
+				return u
+			}
+		}
+	}
+	return ""
+}
+
+func jsonLdNames(val interface{}) []string {
+	switch v := val.(type) {
+	case string:
+		return []string{v}
+	case map[string]interface{}:
+		if name := jsonLdString(v["name"]); name != "" {
+			return []string{name}
+		}
+	case []interface{}:
+		names := make([]string, 0)
+		for _, item := range v {
+			names = append(names, jsonLdNames(item)...)
+		}
+		return names
+	}
+	return []string{}
+}
+
+// calcFavicon finds the largest icon for the page, preferring larger touch icons over the typically tiny favicon.
+// SVG icons are skipped because they can't be thumbnailed.
+func calcFavicon(doc *goquery.Document) string {
+	best := ""
+	bestSize := -1
+	doc.Find("link[rel][href]").Each(func(i int, s *goquery.Selection) {
+		rels := strings.Fields(strings.ToLower(s.AttrOr("rel", "")))
+		href := strings.TrimSpace(s.AttrOr("href", ""))
+		if href == "" || s.AttrOr("type", "") == "image/svg+xml" || strings.HasSuffix(strings.ToLower(href), ".svg") {
+			return
+		}
+
+		size := 0
+		if slices.Contains(rels, "apple-touch-icon") || slices.Contains(rels, "apple-touch-icon-precomposed") {
+			size = 180 // the usual size, if not specified
+		} else if !slices.Contains(rels, "icon") {
+			return
+		}
+		for _, dims := range strings.Fields(s.AttrOr("sizes", "")) {
+			if w, _, ok := strings.Cut(strings.ToLower(dims), "x"); ok {
+				if n, err := strconv.Atoi(w); err == nil && n > size {
+					size = n
+				}
+			}
+		}
+
+		if size > bestSize {
+			best = href
+			bestSize = size
+		}
+	})
+	return best
+}
+
+// calcLocale picks the page's locale from og:locale and og:locale:alternate. The language the page says it was served
+// in is preferred, then the language which was asked for. If neither matches, og:locale is used.
+func calcLocale(locale string, alternates []string, doc *goquery.Document, contentLanguage string, languageHeader string) string {
+	candidates := make([]string, 0)
+	tags := make([]language.Tag, 0)
+	for _, l := range append([]string{locale}, alternates...) {
+		l = strings.TrimSpace(l)
+		if l == "" || slices.Contains(candidates, l) {
+			continue
+		}
+		// OpenGraph locales use underscores, like en_US
+		tag, err := language.Parse(strings.ReplaceAll(l, "_", "-"))
+		if err != nil {
+			continue
+		}
+		candidates = append(candidates, l)
+		tags = append(tags, tag)
+	}
+	if len(candidates) <= 1 {
+		return strings.TrimSpace(locale)
+	}
+
+	matcher := language.NewMatcher(tags)
+	for _, preferred := range []string{contentLanguage, doc.Find("html").AttrOr("lang", ""), languageHeader} {
+		prefs, _, err := language.ParseAcceptLanguage(preferred)
+		if err != nil || len(prefs) == 0 {
+			continue
+		}
+		_, i, confidence := matcher.Match(prefs...)
+		if confidence >= language.High {
+			return candidates[i]
+		}
+	}
+	return strings.TrimSpace(locale)
+}
@@ -2,12 +2,18 @@ package p
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"net/url"
 	"os"
 	"path"
+	"slices"
+	"strings"
 	"sync"
 
+	"github.com/PuerkitoBio/goquery"
 	"github.com/getsentry/sentry-go"
+	"github.com/ryanuber/go-glob"
 	"github.com/t2bot/matrix-media-repo/url_previewing/m"
 	"github.com/t2bot/matrix-media-repo/url_previewing/u"
 
@@ -20,31 +26,150 @@ import (
 	"github.com/t2bot/matrix-media-repo/metrics"
 )
 
+// oembedDiscoveryEndpoint stands in for the endpoint URL of configured providers which find their endpoint on the page
+// being previewed instead.
+const oembedDiscoveryEndpoint = "mmr-oembed-discovery:"
+
 var oembedInstance *oembed.Oembed
-var oembedLock = new(sync.Once)
+var oembedLock = new(sync.RWMutex)
 
 func getOembed() *oembed.Oembed {
-	if oembedInstance != nil {
-		return oembedInstance
+	oembedLock.RLock()
+	instance := oembedInstance
+	oembedLock.RUnlock()
+	if instance != nil {
+		return instance
 	}
 
-	oembedLock.Do(func() {
-		oembedInstance = oembed.NewOembed()
-
-		data, err := os.ReadFile(path.Join(config.Runtime.AssetsPath, "providers.json"))
+	oembedLock.Lock()
+	defer oembedLock.Unlock()
+	if oembedInstance == nil {
+		var err error
+		oembedInstance, err = loadOembedProviders()
 		if err != nil {
+			// Previews still work without oEmbed, so carry on without any providers until they're fixed and reloaded
+			logrus.Error("Error loading oEmbed providers - previews will not use oEmbed: ", err)
 			sentry.CaptureException(err)
-			logrus.Fatal(err)
+			oembedInstance = oembed.NewOembed()
+		}
+	}
+	return oembedInstance
+}
+
+// ReloadOEmbedProviders reloads the built-in and configured oEmbed providers. If the providers can't be loaded, the
+// previous providers are kept and the error is returned.
+func ReloadOEmbedProviders() error {
+	instance, err := loadOembedProviders()
+	if err != nil {
+		logrus.Error("Error reloading oEmbed providers - keeping previous providers: ", err)
+		sentry.CaptureException(err)
+		return err
+	}
+
+	oembedLock.Lock()
+	defer oembedLock.Unlock()
+	oembedInstance = instance
+	return nil
+}
+
+func loadOembedProviders() (instance *oembed.Oembed, err error) {
+	conf := config.Get().UrlPreviews.OEmbedProviders
+	if err = conf.Validate(); err != nil {
+		return nil, err
+	}
+
+	// Configured providers go first so they take precedence over the built-in ones
+	providers := make([]oembed.Provider, 0)
+	for _, provider := range conf.Providers {
+		endpoints := make([]oembed.Endpoint, 0, len(provider.Endpoints))
+		for _, endpoint := range provider.Endpoints {
+			endpointUrl := endpoint.Url
+			if endpointUrl == "" {
+				if !endpoint.Discovery {
+					logrus.Warnf("oEmbed provider %s has an endpoint without a url or discovery - skipping endpoint", provider.Name)
+					continue
+				}
+				endpointUrl = oembedDiscoveryEndpoint
+			}
+			endpoints = append(endpoints, oembed.Endpoint{
+				URL:       endpointUrl,
+				Discovery: endpoint.Discovery,
+				Schemes:   endpoint.Schemes,
+			})
 		}
+		providers = append(providers, oembed.Provider{
+			Name:      provider.Name,
+			URL:       provider.Url,
+			Endpoints: endpoints,
+		})
+	}
 
-		err = oembedInstance.ParseProviders(bytes.NewReader(data))
+	if conf.UseBuiltin {
+		data, err := os.ReadFile(path.Join(config.Runtime.AssetsPath, "providers.json"))
 		if err != nil {
-			sentry.CaptureException(err)
-			logrus.Fatal(err)
+			return nil, err
+		}
+		builtin := make([]oembed.Provider, 0)
+		if err = json.Unmarshal(data, &builtin); err != nil {
+			return nil, err
+		}
+		providers = append(providers, builtin...)
+	}
+
+	providers = slices.DeleteFunc(providers, func(provider oembed.Provider) bool {
+		for _, pattern := range conf.Disabled {
+			if glob.Glob(strings.ToLower(pattern), strings.ToLower(provider.Name)) {
+				return true
+			}
 		}
+		return false
 	})
 
-	return oembedInstance
+	// The library only parses providers from JSON, and panics on schemes it can't convert to a regular expression
+	b, err := json.Marshal(providers)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			instance = nil
+			err = fmt.Errorf("invalid oEmbed provider scheme: %v", r)
+		}
+	}()
+	instance = oembed.NewOembed()
+	if err = instance.ParseProviders(bytes.NewReader(b)); err != nil {
+		return nil, err
+	}
+	logrus.Debugf("Loaded %d oEmbed providers", len(providers))
+	return instance, nil
+}
+
+// discoverOembedEndpoint finds the oEmbed endpoint for the page from its <link rel="alternate"> tags.
+func discoverOembedEndpoint(urlPayload *m.UrlPayload, languageHeader string, ctx rcontext.RequestContext) (string, error) {
+	html, _, err := u.DownloadHtmlContent(urlPayload, ogSupportedTypes, languageHeader, ctx)
+	if err != nil {
+		return "", err
+	}
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(html))
+	if err != nil {
+		return "", err
+	}
+
+	href := ""
+	doc.Find("link[type='application/json+oembed'][href]").EachWithBreak(func(i int, s *goquery.Selection) bool {
+		if slices.Contains(strings.Fields(strings.ToLower(s.AttrOr("rel", ""))), "alternate") {
+			href = strings.TrimSpace(s.AttrOr("href", ""))
+		}
+		return href == ""
+	})
+	if href == "" {
+		return "", m.ErrPreviewUnsupported
+	}
+	endpointUrl, err := url.Parse(href)
+	if err != nil {
+		return "", err
+	}
+	return urlPayload.ParsedUrl.ResolveReference(endpointUrl).String(), nil
 }
 
 func GenerateOEmbedPreview(urlPayload *m.UrlPayload, languageHeader string, ctx rcontext.RequestContext) (m.PreviewResult, error) {
@@ -52,8 +177,28 @@ func GenerateOEmbedPreview(urlPayload *m.UrlPayload, languageHeader string, ctx
 	if item == nil {
 		return m.PreviewResult{}, m.ErrPreviewUnsupported
 	}
+	if strings.HasPrefix(item.EndpointURL, oembedDiscoveryEndpoint) {
+		endpointUrl, err := discoverOembedEndpoint(urlPayload, languageHeader, ctx)
+		if err != nil {
+			ctx.Log.Debug("Error discovering oEmbed endpoint: ", err)
+			return m.PreviewResult{}, m.ErrPreviewUnsupported
+		}
+		item = &oembed.Item{
+			IsEndpointURLComplete: true,
+			EndpointURL:           endpointUrl,
+			ProviderName:          item.ProviderName,
+			ProviderURL:           item.ProviderURL,
+		}
+	}
+
+	client, err := u.NewPreviewClient(ctx)
+	if err != nil {
+		ctx.Log.Error("Error preparing oEmbed client: ", err)
+		return m.PreviewResult{}, err
+	}
 
 	info, err := item.FetchOembed(oembed.Options{
+		Client:         client,
 		URL:            urlPayload.ParsedUrl.String(),
 		AcceptLanguage: languageHeader,
 	})
@@ -62,44 +207,84 @@ func GenerateOEmbedPreview(urlPayload *m.UrlPayload, languageHeader string, ctx
 		return m.PreviewResult{}, err
 	}
 
-	if info.Type == "rich" {
-		info.Description = html2text.HTML2Text(info.HTML)
-	} else if info.Type == "photo" {
-		info.ThumbnailURL = info.URL
-	}
-
 	graph := &m.PreviewResult{
-		Type:        info.Type,
+		Type:        oembedOgType(info.Type),
 		Url:         info.URL,
 		Title:       info.Title,
 		Description: info.Description,
 		SiteName:    info.ProviderName,
+		Author:      info.AuthorName,
 	}
 
-	if info.ThumbnailURL != "" {
-		imgUrl, err := url.Parse(info.ThumbnailURL)
-		if err != nil {
-			ctx.Log.Error("Non-fatal error getting thumbnail (parsing image url): ", err)
-			sentry.CaptureException(err)
-			return *graph, nil
-		}
+	imgUrl := info.ThumbnailURL
+	imgWidth := int(info.ThumbnailWidth)
+	imgHeight := int(info.ThumbnailHeight)
+	if info.Type == "photo" {
+		// The photo itself is the best preview image, and the url is the photo rather than the page
+		imgUrl = info.URL
+		imgWidth = int(info.Width)
+		imgHeight = int(info.Height)
+		graph.Url = urlPayload.ParsedUrl.String()
+	}
 
-		imgAbsUrl := urlPayload.ParsedUrl.ResolveReference(imgUrl)
-		imgUrlPayload := &m.UrlPayload{
-			UrlString: imgAbsUrl.String(),
-			ParsedUrl: imgAbsUrl,
+	if info.HTML != "" {
+		embed, err := goquery.NewDocumentFromReader(strings.NewReader(info.HTML))
+		if err != nil {
+			ctx.Log.Warn("Non-fatal error parsing oEmbed html: ", err)
+		} else {
+			if info.Type == "video" {
+				// Videos are normally embedded as an iframe player, which is what og:video:type=text/html describes
+				// Only http(s) players are linked, so javascript: and data: sources are dropped
+				src := strings.TrimSpace(embed.Find("iframe[src]").First().AttrOr("src", ""))
+				if playerUrl := resolveUrl(urlPayload, src); playerUrl != "" {
+					graph.Video = &m.PreviewMedia{
+						Url:         playerUrl,
+						ContentType: "text/html",
+						Width:       int(info.Width),
+						Height:      int(info.Height),
+					}
+				}
+			}
+			if imgUrl == "" {
+				imgUrl = strings.TrimSpace(embed.Find("img[src]").First().AttrOr("src", ""))
+				imgWidth = 0
+				imgHeight = 0
+			}
+			if info.Type == "rich" && graph.Description == "" {
+				graph.Description = html2text.HTML2Text(info.HTML)
+			}
 		}
+	}
 
-		img, err := u.DownloadImage(imgUrlPayload, languageHeader, ctx)
+	if imgUrl != "" {
+		img, err := downloadPreviewImage(urlPayload, imgUrl, languageHeader, ctx)
 		if err != nil {
-			ctx.Log.Error("Non-fatal error getting thumbnail (downloading image): ", err)
-			sentry.CaptureException(err)
-			return *graph, nil
+			ctx.Log.Warn("Non-fatal error getting thumbnail: ", err)
+		} else if !strings.HasPrefix(img.ContentType, "image/") {
+			ctx.Log.Warn("Non-fatal error getting thumbnail: not an image: ", img.ContentType)
+			_ = img.Data.Close()
+		} else {
+			img.Width = imgWidth
+			img.Height = imgHeight
+			graph.Image = img
 		}
-
-		graph.Image = img
 	}
 
+	graph.Title = u.Summarize(graph.Title, ctx.Config.UrlPreviews.NumTitleWords, ctx.Config.UrlPreviews.MaxTitleLength)
+	graph.Description = u.Summarize(graph.Description, ctx.Config.UrlPreviews.NumWords, ctx.Config.UrlPreviews.MaxLength)
+
 	metrics.UrlPreviewsGenerated.With(prometheus.Labels{"type": "oembed"}).Inc()
 	return *graph, nil
 }
+
+// oembedOgType maps the oEmbed type to the closest OpenGraph type.
+func oembedOgType(oembedType string) string {
+	switch oembedType {
+	case "photo":
+		return "image"
+	case "video":
+		return "video.other"
+	default: // link and rich
+		return "website"
+	}
+}
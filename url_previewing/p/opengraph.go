@@ -1,10 +1,13 @@
 package p
 
 import (
+	"bytes"
 	"errors"
+	"io"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/getsentry/sentry-go"
 	"github.com/t2bot/matrix-media-repo/url_previewing/m"
@@ -22,7 +25,7 @@ import (
 var ogSupportedTypes = []string{"text/*"}
 
 func GenerateOpenGraphPreview(urlPayload *m.UrlPayload, languageHeader string, ctx rcontext.RequestContext) (m.PreviewResult, error) {
-	html, err := u.DownloadHtmlContent(urlPayload, ogSupportedTypes, languageHeader, ctx)
+	html, contentLanguage, err := u.DownloadHtmlContent(urlPayload, ogSupportedTypes, languageHeader, ctx)
 	if err != nil {
 		ctx.Log.Error("Error downloading content: ", err)
 
@@ -42,12 +45,32 @@ func GenerateOpenGraphPreview(urlPayload *m.UrlPayload, languageHeader string, c
 		return m.PreviewResult{}, err
 	}
 
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(html))
+	if err != nil {
+		ctx.Log.Error("Error parsing HTML: ", err)
+		return m.PreviewResult{}, err
+	}
+	twitter := calcTwitterCard(doc)
+	jsonLd := calcJsonLd(doc)
+
+	// OpenGraph takes priority, then Twitter Cards, then JSON-LD, then whatever we can find on the page
+	if og.Title == "" {
+		og.Title = firstNonEmpty(twitter.Title, jsonLd.Title)
+	}
 	if og.Title == "" {
 		og.Title = calcTitle(html)
 	}
+	if og.Description == "" {
+		og.Description = firstNonEmpty(twitter.Description, jsonLd.Description)
+	}
 	if og.Description == "" {
 		og.Description = calcDescription(html)
 	}
+	if len(og.Images) == 0 {
+		if imgUrl := firstNonEmpty(twitter.Image, jsonLd.Image); imgUrl != "" {
+			og.Images = []*ogimage.Image{{URL: imgUrl}}
+		}
+	}
 	if len(og.Images) == 0 {
 		og.Images = calcImages(html)
 	}
@@ -57,41 +80,138 @@ func GenerateOpenGraphPreview(urlPayload *m.UrlPayload, languageHeader string, c
 	og.Description = u.Summarize(og.Description, ctx.Config.UrlPreviews.NumWords, ctx.Config.UrlPreviews.MaxLength)
 
 	graph := &m.PreviewResult{
-		Type:        og.Type,
-		Url:         og.URL,
-		Title:       og.Title,
-		Description: og.Description,
-		SiteName:    og.SiteName,
+		Type:           og.Type,
+		Url:            og.URL,
+		Title:          og.Title,
+		Description:    og.Description,
+		SiteName:       og.SiteName,
+		TwitterCard:    twitter.Card,
+		TwitterSite:    twitter.Site,
+		TwitterCreator: twitter.Creator,
+		Author:         jsonLd.Author,
+		PublishedTime:  jsonLd.PublishedTime,
+		Locale:         calcLocale(og.Locale, og.LocalesAlternate, doc, contentLanguage, languageHeader),
+	}
+	if og.Article != nil && og.Article.PublishedTime != nil {
+		graph.PublishedTime = og.Article.PublishedTime.Format(time.RFC3339)
 	}
 
-	if og.Images != nil && len(og.Images) > 0 {
-		imgUrl, err := url.Parse(og.Images[0].URL)
-		if err != nil {
-			ctx.Log.Error("Non-fatal error getting thumbnail (parsing image url): ", err)
-			sentry.CaptureException(err)
-			return *graph, nil
+	if len(og.Videos) > 0 {
+		v := og.Videos[0]
+		graph.Video = &m.PreviewMedia{
+			Url:         resolveUrl(urlPayload, firstNonEmpty(v.SecureURL, v.URL)),
+			ContentType: v.Type,
+			Width:       int(v.Width),
+			Height:      int(v.Height),
+		}
+	}
+	if len(og.Audios) > 0 {
+		a := og.Audios[0]
+		graph.Audio = &m.PreviewMedia{
+			Url:         resolveUrl(urlPayload, firstNonEmpty(a.SecureURL, a.URL)),
+			ContentType: a.Type,
 		}
+	}
+	if graph.Video != nil && graph.Video.Url == "" {
+		graph.Video = nil
+	}
+	if graph.Audio != nil && graph.Audio.Url == "" {
+		graph.Audio = nil
+	}
 
-		imgAbsUrl := urlPayload.ParsedUrl.ResolveReference(imgUrl)
-		imgUrlPayload := &m.UrlPayload{
-			UrlString: imgAbsUrl.String(),
-			ParsedUrl: imgAbsUrl,
+	if favicon := calcFavicon(doc); favicon != "" && ctx.Config.UrlPreviews.Favicons.Enabled {
+		img, err := downloadFavicon(urlPayload, favicon, languageHeader, ctx)
+		if err != nil {
+			ctx.Log.Warn("Non-fatal error getting favicon: ", err)
+		} else {
+			graph.Favicon = img
 		}
+	}
 
-		img, err := u.DownloadImage(imgUrlPayload, languageHeader, ctx)
+	if og.Images != nil && len(og.Images) > 0 {
+		img, err := downloadPreviewImage(urlPayload, og.Images[0].URL, languageHeader, ctx)
 		if err != nil {
-			ctx.Log.Error("Non-fatal error getting thumbnail (downloading image): ", err)
+			ctx.Log.Error("Non-fatal error getting thumbnail: ", err)
 			sentry.CaptureException(err)
-			return *graph, nil
+		} else {
+			graph.Image = img
 		}
-
-		graph.Image = img
 	}
 
 	metrics.UrlPreviewsGenerated.With(prometheus.Labels{"type": "opengraph"}).Inc()
 	return *graph, nil
 }
 
+// downloadPreviewImage downloads an image referenced by the page, resolving it relative to the page.
+func downloadPreviewImage(urlPayload *m.UrlPayload, imgUrlStr string, languageHeader string, ctx rcontext.RequestContext) (*m.PreviewImage, error) {
+	imgUrl, err := url.Parse(imgUrlStr)
+	if err != nil {
+		return nil, errors.New("error parsing image url: " + err.Error())
+	}
+
+	imgAbsUrl := urlPayload.ParsedUrl.ResolveReference(imgUrl)
+	imgUrlPayload := &m.UrlPayload{
+		UrlString: imgAbsUrl.String(),
+		ParsedUrl: imgAbsUrl,
+	}
+
+	img, err := u.DownloadImage(imgUrlPayload, languageHeader, ctx)
+	if err != nil {
+		return nil, errors.New("error downloading image: " + err.Error())
+	}
+	img.Url = imgUrlPayload.UrlString
+	return img, nil
+}
+
+// downloadFavicon downloads the page's icon, buffering it to make sure it isn't larger than allowed.
+func downloadFavicon(urlPayload *m.UrlPayload, iconUrlStr string, languageHeader string, ctx rcontext.RequestContext) (*m.PreviewImage, error) {
+	img, err := downloadPreviewImage(urlPayload, iconUrlStr, languageHeader, ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Data.Close()
+
+	if !strings.HasPrefix(img.ContentType, "image/") {
+		return nil, errors.New("not an image: " + img.ContentType)
+	}
+	maxSize := ctx.Config.UrlPreviews.Favicons.MaxSizeBytes
+	b, err := io.ReadAll(io.LimitReader(img.Data, maxSize+1))
+	if err != nil {
+		return nil, errors.New("error reading favicon: " + err.Error())
+	}
+	if int64(len(b)) > maxSize {
+		return nil, errors.New("favicon is too large")
+	}
+	img.Data = io.NopCloser(bytes.NewReader(b))
+	return img, nil
+}
+
+// resolveUrl resolves a URL referenced by the page, returning an empty string if it can't be parsed or isn't an
+// http(s) URL.
+func resolveUrl(urlPayload *m.UrlPayload, ref string) string {
+	if ref == "" {
+		return ""
+	}
+	refUrl, err := url.Parse(ref)
+	if err != nil {
+		return ""
+	}
+	resolved := urlPayload.ParsedUrl.ResolveReference(refUrl)
+	if resolved.Scheme != "http" && resolved.Scheme != "https" {
+		return ""
+	}
+	return resolved.String()
+}
+
+func firstNonEmpty(vals ...string) string {
+	for _, val := range vals {
+		if val != "" {
+			return val
+		}
+	}
+	return ""
+}
+
 func calcTitle(html string) string {
 	doc, err := goquery.NewDocumentFromReader(strings.NewReader(html))
 	if err != nil {
@@ -2,14 +2,20 @@ package u
 
 import (
 	"net"
+	"strings"
 
 	"github.com/getsentry/sentry-go"
+	"github.com/ryanuber/go-glob"
 
 	"github.com/t2bot/matrix-media-repo/common"
+	"github.com/t2bot/matrix-media-repo/common/config"
 	"github.com/t2bot/matrix-media-repo/common/rcontext"
 )
 
-func getSafeAddress(addr string, ctx rcontext.RequestContext) (net.IP, string, error) {
+// getSafeAddress resolves the address, returning an error if it isn't permitted by the URL preview rules. Hosts on the
+// allowedDomains list skip the network checks only if useAllowedDomains is set: that list is for previews, and must
+// not let other requests (like redirects from remote servers) reach internal networks.
+func getSafeAddress(addr string, useAllowedDomains bool, ctx rcontext.RequestContext) (net.IP, string, error) {
 	ctx.Log.Debug("Checking address: " + addr)
 	realHost, p, err := net.SplitHostPort(addr)
 	if err != nil {
@@ -18,6 +24,12 @@ func getSafeAddress(addr string, ctx rcontext.RequestContext) (net.IP, string, e
 		realHost = addr
 	}
 
+	alwaysAllowed, err := checkDomain(realHost, ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	alwaysAllowed = alwaysAllowed && useAllowedDomains
+
 	ipAddr := net.IPv4(127, 0, 0, 1)
 	if realHost != "localhost" {
 		addrs, err := net.LookupIP(realHost)
@@ -40,9 +52,16 @@ func getSafeAddress(addr string, ctx rcontext.RequestContext) (net.IP, string, e
 		deniedCidrs = []string{}
 	}
 
-	// Forcefully append 0.0.0.0 and :: because they are unroutable and resolve to localhost
-	deniedCidrs = append(deniedCidrs, "0.0.0.0/32")
-	deniedCidrs = append(deniedCidrs, "::/128")
+	// Forcefully deny 0.0.0.0 and :: because they are unroutable and resolve to localhost
+	unroutableCidrs := []string{"0.0.0.0/32", "::/128"}
+	deniedCidrs = append(deniedCidrs, unroutableCidrs...)
+
+	if alwaysAllowed {
+		if inRange(ipAddr, unroutableCidrs, ctx) {
+			return nil, "", common.ErrHostNotAllowed
+		}
+		return ipAddr, p, nil
+	}
 
 	if !isAllowed(ipAddr, allowedCidrs, deniedCidrs, ctx) {
 		return nil, "", common.ErrHostNotAllowed
@@ -50,6 +69,45 @@ func getSafeAddress(addr string, ctx rcontext.RequestContext) (net.IP, string, e
 	return ipAddr, p, nil
 }
 
+// CheckDomainAllowed returns an error if the host is denied by the URL preview domain rules. This doesn't resolve the
+// host, so can be done before anything else.
+func CheckDomainAllowed(host string, ctx rcontext.RequestContext) error {
+	_, err := checkDomain(host, ctx)
+	return err
+}
+
+// checkDomain evaluates the URL preview domain rules for the host. Denied hosts result in an error, while hosts on the
+// allowed list return true to skip the network checks. Other hosts are left to the network checks.
+func checkDomain(host string, ctx rcontext.RequestContext) (bool, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range ctx.Config.UrlPreviews.DisallowedDomains {
+		if glob.Glob(strings.ToLower(pattern), host) {
+			ctx.Log.Debugf("Host %s denied by domain rule %s", host, pattern)
+			return false, common.ErrHostNotAllowed
+		}
+	}
+	for _, pattern := range ctx.Config.UrlPreviews.AllowedDomains {
+		if glob.Glob(strings.ToLower(pattern), host) {
+			ctx.Log.Debugf("Host %s allowed by domain rule %s", host, pattern)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// GetDomainOverride returns the first URL preview domain override matching the host, or nil if none match.
+func GetDomainOverride(host string, ctx rcontext.RequestContext) *config.UrlPreviewDomainOverride {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for i, override := range ctx.Config.UrlPreviews.DomainOverrides {
+		for _, pattern := range override.Domains {
+			if glob.Glob(strings.ToLower(pattern), host) {
+				return &ctx.Config.UrlPreviews.DomainOverrides[i]
+			}
+		}
+	}
+	return nil
+}
+
 func isAllowed(ip net.IP, allowed []string, disallowed []string, ctx rcontext.RequestContext) bool {
 	ctx.Log.Debug("Validating host")
 
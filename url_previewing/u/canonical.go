@@ -0,0 +1,88 @@
+package u
+
+import (
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/ryanuber/go-glob"
+	"github.com/t2bot/matrix-media-repo/common/rcontext"
+)
+
+// Canonicalize strips tracking parameters and normalises the URL according to the configured rules, so the same page
+// is fetched (and cached) once no matter how it was shared. If canonicalization is disabled, the URL is returned as-is.
+func Canonicalize(parsedUrl *url.URL, ctx rcontext.RequestContext) *url.URL {
+	conf := ctx.Config.UrlPreviews.Canonicalization
+	if !conf.Enabled {
+		return parsedUrl
+	}
+
+	canonical := *parsedUrl
+	canonical.Scheme = strings.ToLower(canonical.Scheme)
+	host := strings.ToLower(strings.TrimSuffix(canonical.Hostname(), "."))
+	port := canonical.Port()
+	if (canonical.Scheme == "http" && port == "80") || (canonical.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	if port != "" {
+		canonical.Host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		canonical.Host = "[" + host + "]" // IPv6
+	} else {
+		canonical.Host = host
+	}
+	if canonical.Path == "" {
+		canonical.Path = "/"
+	}
+	canonical.Fragment = ""
+	canonical.RawFragment = ""
+
+	stripAll := conf.StripAllParams
+	strip := append([]string{}, conf.StripParams...)
+	keep := make([]string, 0)
+	for _, rule := range conf.Rules {
+		for _, pattern := range rule.Domains {
+			if glob.Glob(strings.ToLower(pattern), host) {
+				strip = append(strip, rule.StripParams...)
+				keep = append(keep, rule.KeepParams...)
+				break
+			}
+		}
+	}
+
+	// The query is filtered as raw pairs rather than through Query() so the parameters we keep are left exactly as
+	// they were sent (including their order, encoding, and any which Query() can't parse).
+	if canonical.RawQuery != "" {
+		pairs := strings.Split(canonical.RawQuery, "&")
+		kept := make([]string, 0, len(pairs))
+		for _, pair := range pairs {
+			name, _, _ := strings.Cut(pair, "=")
+			if unescaped, err := url.QueryUnescape(name); err == nil {
+				name = unescaped
+			}
+			if pair != "" && !matchesParam(keep, name) && (stripAll || matchesParam(strip, name)) {
+				continue
+			}
+			kept = append(kept, pair)
+		}
+		if len(kept) != len(pairs) {
+			canonical.RawQuery = strings.Join(kept, "&")
+			canonical.ForceQuery = false
+		}
+	}
+
+	if canonical.String() != parsedUrl.String() {
+		ctx.Log.Debugf("Canonicalized %s to %s", parsedUrl.String(), canonical.String())
+	}
+	return &canonical
+}
+
+func matchesParam(patterns []string, name string) bool {
+	name = strings.ToLower(name)
+	for _, pattern := range patterns {
+		if glob.Glob(strings.ToLower(pattern), name) {
+			return true
+		}
+	}
+	return false
+}
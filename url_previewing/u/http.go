@@ -8,6 +8,7 @@ import (
 	"mime"
 	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"time"
 
@@ -19,62 +20,88 @@ import (
 	"github.com/t2bot/matrix-media-repo/util/readers"
 )
 
-func doHttpGet(urlPayload *m.UrlPayload, languageHeader string, ctx rcontext.RequestContext) (*http.Response, error) {
-	var client *http.Client
+// NewSafeTransport creates an HTTP transport which only connects to addresses permitted by the configured URL preview
+// networks. Unlike the preview client, hosts on the URL preview allowedDomains list don't get to skip the network
+// checks. The timeout applies to connecting and to waiting for response headers, but not to reading the body.
+func NewSafeTransport(ctx rcontext.RequestContext, timeout time.Duration) *http.Transport {
+	return &http.Transport{
+		DisableKeepAlives:     true,
+		DialContext:           safeDialContext(ctx, timeout, nil, false),
+		ResponseHeaderTimeout: timeout,
+	}
+}
+
+// NewPreviewClient creates an HTTP client for generating URL previews. Like NewSafeTransport, it only connects to
+// addresses permitted by the configured URL preview networks (or hosts on the allowedDomains list), and connects through
+// the configured proxy (if any).
+func NewPreviewClient(ctx rcontext.RequestContext) (*http.Client, error) {
+	timeout := time.Duration(ctx.Config.TimeoutSeconds.UrlPreviews) * time.Second
+	proxyUrl, err := parseProxyUrl(ctx.Config.UrlPreviews.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	dialContext := safeDialContext(ctx, timeout, proxyUrl, true)
+
+	tr := &http.Transport{
+		DisableKeepAlives:     true,
+		DialContext:           dialContext,
+		ResponseHeaderTimeout: timeout,
+	}
+	if ctx.Config.UrlPreviews.UnsafeCertificates {
+		ctx.Log.Warn("Ignoring any certificate errors while making request")
+		tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		// Based on https://github.com/matrix-org/gomatrixserverlib/blob/51152a681e69a832efcd934b60080b92bc98b286/client.go#L74-L90
+		tr.DialTLSContext = func(ctx2 context.Context, network, addr string) (net.Conn, error) {
+			rawconn, err := dialContext(ctx2, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			// Wrap a raw connection ourselves since tls.Dial defaults the SNI
+			conn := tls.Client(rawconn, &tls.Config{
+				ServerName:         "",
+				InsecureSkipVerify: true,
+			})
+			if err := conn.Handshake(); err != nil {
+				return nil, err
+			}
+			return conn, nil
+		}
+	}
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: tr,
+	}, nil
+}
 
+func safeDialContext(ctx rcontext.RequestContext, timeout time.Duration, proxyUrl *url.URL, useAllowedDomains bool) func(ctx2 context.Context, network, addr string) (net.Conn, error) {
 	dialer := &net.Dialer{
-		Timeout:   time.Duration(ctx.Config.TimeoutSeconds.UrlPreviews) * time.Second,
-		KeepAlive: time.Duration(ctx.Config.TimeoutSeconds.UrlPreviews) * time.Second,
+		Timeout:   timeout,
+		KeepAlive: timeout,
 	}
 
-	dialContext := func(ctx2 context.Context, network, addr string) (conn net.Conn, e error) {
+	return func(ctx2 context.Context, network, addr string) (conn net.Conn, e error) {
 		if network != "tcp" {
 			return nil, errors.New("invalid network: expected tcp")
 		}
 
-		safeIp, safePort, err := getSafeAddress(addr, ctx)
+		safeIp, safePort, err := getSafeAddress(addr, useAllowedDomains, ctx)
 		if err != nil {
 			return nil, err
 		}
 
-		return dialer.DialContext(ctx2, network, net.JoinHostPort(safeIp.String(), safePort))
+		target := net.JoinHostPort(safeIp.String(), safePort)
+		if proxyUrl != nil {
+			return dialProxy(ctx2, dialer, proxyUrl, target)
+		}
+		return dialer.DialContext(ctx2, network, target)
 	}
+}
 
-	if ctx.Config.UrlPreviews.UnsafeCertificates {
-		ctx.Log.Warn("Ignoring any certificate errors while making request")
-		tr := &http.Transport{
-			DisableKeepAlives: true,
-			DialContext:       dialContext,
-			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
-			// Based on https://github.com/matrix-org/gomatrixserverlib/blob/51152a681e69a832efcd934b60080b92bc98b286/client.go#L74-L90
-			DialTLSContext: func(ctx2 context.Context, network, addr string) (net.Conn, error) {
-				rawconn, err := net.Dial(network, addr)
-				if err != nil {
-					return nil, err
-				}
-				// Wrap a raw connection ourselves since tls.Dial defaults the SNI
-				conn := tls.Client(rawconn, &tls.Config{
-					ServerName:         "",
-					InsecureSkipVerify: true,
-				})
-				if err := conn.Handshake(); err != nil {
-					return nil, err
-				}
-				return conn, nil
-			},
-		}
-		client = &http.Client{
-			Timeout:   time.Duration(ctx.Config.TimeoutSeconds.UrlPreviews) * time.Second,
-			Transport: tr,
-		}
-	} else {
-		client = &http.Client{
-			Timeout: time.Duration(ctx.Config.TimeoutSeconds.UrlPreviews) * time.Second,
-			Transport: &http.Transport{
-				DisableKeepAlives: true,
-				DialContext:       dialContext,
-			},
-		}
+func doHttpGet(urlPayload *m.UrlPayload, languageHeader string, ctx rcontext.RequestContext) (*http.Response, error) {
+	client, err := NewPreviewClient(ctx)
+	if err != nil {
+		return nil, err
 	}
 
 	req, err := http.NewRequest("GET", urlPayload.ParsedUrl.String(), nil)
@@ -87,21 +114,53 @@ func doHttpGet(urlPayload *m.UrlPayload, languageHeader string, ctx rcontext.Req
 }
 
 func DownloadRawContent(urlPayload *m.UrlPayload, supportedTypes []string, languageHeader string, ctx rcontext.RequestContext) (io.ReadCloser, string, string, error) {
+	reader, headers, err := downloadContent(urlPayload, supportedTypes, languageHeader, ctx)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	disposition := headers.Get("Content-Disposition")
+	_, params, _ := mime.ParseMediaType(disposition)
+	filename := ""
+	if params != nil {
+		filename = params["filename"]
+	}
+
+	return reader, filename, headers.Get("Content-Type"), nil
+}
+
+// DownloadHtmlContent downloads the page, converting it to UTF-8. The language of the page is also returned from the
+// Content-Language header, if the server supplied one.
+func DownloadHtmlContent(urlPayload *m.UrlPayload, supportedTypes []string, languageHeader string, ctx rcontext.RequestContext) (string, string, error) {
+	r, headers, err := downloadContent(urlPayload, supportedTypes, languageHeader, ctx)
+	if err != nil {
+		return "", "", err
+	}
+	html := ""
+	defer r.Close()
+	raw, _ := io.ReadAll(r)
+	if raw != nil {
+		html = util.ToUtf8(string(raw), headers.Get("Content-Type"))
+	}
+	return html, headers.Get("Content-Language"), nil
+}
+
+func downloadContent(urlPayload *m.UrlPayload, supportedTypes []string, languageHeader string, ctx rcontext.RequestContext) (io.ReadCloser, http.Header, error) {
 	ctx.Log.Info("Fetching remote content...")
 	resp, err := doHttpGet(urlPayload, languageHeader, ctx)
 	if err != nil {
-		return nil, "", "", err
+		return nil, nil, err
 	}
 	if resp.StatusCode != http.StatusOK {
 		ctx.Log.Warn("Received status code " + strconv.Itoa(resp.StatusCode))
-		return nil, "", "", errors.New("error during transfer")
+		return nil, nil, errors.New("error during transfer")
 	}
 
 	if ctx.Config.UrlPreviews.MaxPageSizeBytes > 0 && resp.ContentLength >= 0 && resp.ContentLength > ctx.Config.UrlPreviews.MaxPageSizeBytes {
-		return nil, "", "", common.ErrMediaTooLarge
+		return nil, nil, common.ErrMediaTooLarge
 	}
 
-	var reader io.ReadCloser
+	var reader io.ReadCloser = resp.Body
 	if ctx.Config.UrlPreviews.MaxPageSizeBytes > 0 {
 		lr := io.LimitReader(resp.Body, ctx.Config.UrlPreviews.MaxPageSizeBytes)
 		reader = readers.NewCancelCloser(io.NopCloser(lr), func() {
@@ -110,34 +169,19 @@ func DownloadRawContent(urlPayload *m.UrlPayload, supportedTypes []string, langu
 	}
 
 	contentType := resp.Header.Get("Content-Type")
+	supported := false
 	for _, supportedType := range supportedTypes {
-		if !glob.Glob(supportedType, contentType) {
-			return nil, "", "", m.ErrPreviewUnsupported
+		if glob.Glob(supportedType, contentType) {
+			supported = true
+			break
 		}
 	}
-
-	disposition := resp.Header.Get("Content-Disposition")
-	_, params, _ := mime.ParseMediaType(disposition)
-	filename := ""
-	if params != nil {
-		filename = params["filename"]
+	if !supported {
+		_ = reader.Close()
+		return nil, nil, m.ErrPreviewUnsupported
 	}
 
-	return reader, filename, contentType, nil
-}
-
-func DownloadHtmlContent(urlPayload *m.UrlPayload, supportedTypes []string, languageHeader string, ctx rcontext.RequestContext) (string, error) {
-	r, _, contentType, err := DownloadRawContent(urlPayload, supportedTypes, languageHeader, ctx)
-	if err != nil {
-		return "", err
-	}
-	html := ""
-	defer r.Close()
-	raw, _ := io.ReadAll(r)
-	if raw != nil {
-		html = util.ToUtf8(string(raw), contentType)
-	}
-	return html, nil
+	return reader, resp.Header, nil
 }
 
 func DownloadImage(urlPayload *m.UrlPayload, languageHeader string, ctx rcontext.RequestContext) (*m.PreviewImage, error) {
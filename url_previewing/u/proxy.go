@@ -0,0 +1,112 @@
+package u
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+func parseProxyUrl(proxyUrl string) (*url.URL, error) {
+	if proxyUrl == "" {
+		return nil, nil
+	}
+	parsed, err := url.Parse(proxyUrl)
+	if err != nil {
+		return nil, err
+	}
+	switch parsed.Scheme {
+	case "http", "https", "socks5", "socks5h":
+		return parsed, nil
+	default:
+		return nil, fmt.Errorf("unsupported URL preview proxy scheme: %s", parsed.Scheme)
+	}
+}
+
+// dialProxy connects to the target through the proxy. The target should be an IP address which has already been
+// checked against the allowed networks, so the proxy doesn't get a chance to resolve the hostname differently.
+func dialProxy(ctx context.Context, dialer *net.Dialer, proxyUrl *url.URL, target string) (net.Conn, error) {
+	if proxyUrl.Scheme == "socks5" || proxyUrl.Scheme == "socks5h" {
+		d, err := proxy.FromURL(proxyUrl, dialer)
+		if err != nil {
+			return nil, err
+		}
+		if cd, ok := d.(proxy.ContextDialer); ok {
+			return cd.DialContext(ctx, "tcp", target)
+		}
+		return d.Dial("tcp", target)
+	}
+	return dialHttpProxy(ctx, dialer, proxyUrl, target)
+}
+
+// dialHttpProxy opens a CONNECT tunnel to the target through an HTTP or HTTPS proxy.
+func dialHttpProxy(ctx context.Context, dialer *net.Dialer, proxyUrl *url.URL, target string) (net.Conn, error) {
+	proxyAddr := proxyUrl.Host
+	if proxyUrl.Port() == "" {
+		if proxyUrl.Scheme == "https" {
+			proxyAddr = net.JoinHostPort(proxyUrl.Hostname(), "443")
+		} else {
+			proxyAddr = net.JoinHostPort(proxyUrl.Hostname(), "80")
+		}
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if proxyUrl.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyUrl.Hostname()})
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+	if proxyUrl.User != nil {
+		password, _ := proxyUrl.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxyUrl.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err = req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("proxy refused to connect: %s", resp.Status)
+	}
+	if br.Buffered() > 0 {
+		// The target can't have said anything yet, so the proxy is misbehaving
+		_ = conn.Close()
+		return nil, errors.New("unexpected data from proxy after connecting")
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
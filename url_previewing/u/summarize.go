@@ -3,12 +3,32 @@ package u
 import (
 	"regexp"
 	"strings"
+	"unicode"
+
+	"github.com/rivo/uniseg"
 )
 
 var surroundingWhitespace = regexp.MustCompile(`^[\s\p{Zs}]+|[\s\p{Zs}]+$`)
 var interiorWhitespace = regexp.MustCompile(`[\s\p{Zs}]{2,}`)
 var newlines = regexp.MustCompile(`[\r\n]`)
 
+// Scripts which are normally written without spaces between words, so splitting on spaces doesn't find words.
+var unspacedScripts = []*unicode.RangeTable{
+	unicode.Han,
+	unicode.Hiragana,
+	unicode.Katakana,
+	unicode.Thai,
+	unicode.Lao,
+	unicode.Khmer,
+	unicode.Myanmar,
+	unicode.Tibetan,
+}
+
+// Summarize limits the text to maxWords words, then maxLength characters. Characters are counted as user-perceived
+// characters (grapheme clusters), so accents and emoji are never split. Text in scripts written without spaces, like
+// Chinese, Japanese, and Thai, only counts towards the length because its words can't be found by splitting on spaces.
+// When the text is too long, it is cut at the last space that fits unless it is mostly in such scripts or the cut
+// would fall within a run of them, in which case it is cut at the last character that fits.
 func Summarize(text string, maxWords int, maxLength int) string {
 	// Normalize the whitespace to be something useful (crush it to one giant line)
 	text = surroundingWhitespace.ReplaceAllString(text, "")
@@ -17,27 +37,77 @@ func Summarize(text string, maxWords int, maxLength int) string {
 
 	words := strings.Split(text, " ")
 	result := text
-	if len(words) >= maxWords {
-		result = strings.Join(words[:maxWords], " ")
+	numWords := 0
+	for i, word := range words {
+		if !isUnspaced(word) {
+			numWords++
+		}
+		if numWords > maxWords {
+			result = strings.Join(words[:i], " ")
+			break
+		}
 	}
 
-	if len(result) > maxLength {
+	if uniseg.GraphemeClusterCount(result) > maxLength && !isMostlyUnspaced(result) {
 		// First try trimming off the last word
-		words = strings.Split(result, " ")
 		newResult := ""
-		for _, word := range words {
-			if len(newResult+" "+word) > maxLength {
+		for _, word := range strings.Split(result, " ") {
+			candidate := word
+			if newResult != "" {
+				candidate = newResult + " " + word
+			}
+			if uniseg.GraphemeClusterCount(candidate) > maxLength {
+				if isUnspaced(word) {
+					newResult = "" // cut within the word instead of dropping all of it
+				}
 				break
 			}
-			newResult = newResult + " " + word
+			newResult = candidate
+		}
+		if newResult != "" {
+			result = newResult
 		}
-		result = newResult
 	}
 
-	if len(result) > maxLength {
+	if uniseg.GraphemeClusterCount(result) > maxLength {
 		// It's still too long, just trim the thing and add an ellipsis
-		result = result[:maxLength] + "..."
+		result = truncateGraphemes(result, maxLength) + "..."
 	}
 
 	return result
 }
+
+func isUnspaced(text string) bool {
+	return strings.IndexFunc(text, func(r rune) bool {
+		return unicode.IsOneOf(unspacedScripts, r)
+	}) >= 0
+}
+
+// isMostlyUnspaced returns whether most of the letters in the text are from scripts written without spaces.
+func isMostlyUnspaced(text string) bool {
+	letters := 0
+	unspaced := 0
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		if unicode.IsOneOf(unspacedScripts, r) {
+			unspaced++
+		}
+	}
+	return unspaced*2 > letters
+}
+
+// truncateGraphemes returns the first maxLength grapheme clusters of the text.
+func truncateGraphemes(text string, maxLength int) string {
+	state := -1
+	end := 0
+	remaining := text
+	for count := 0; count < maxLength && remaining != ""; count++ {
+		var cluster string
+		cluster, remaining, _, state = uniseg.FirstGraphemeClusterInString(remaining, state)
+		end += len(cluster)
+	}
+	return text[:end]
+}
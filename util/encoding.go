@@ -1,7 +1,7 @@
 package util
 
 import (
-	"io"
+	"regexp"
 	"strings"
 	"unicode/utf8"
 
@@ -9,38 +9,70 @@ import (
 	"golang.org/x/net/html/charset"
 )
 
-func ToUtf8(text string, possibleContentType string) string {
-	if utf8.ValidString(text) {
-		return text
-	}
+var metaCharset = regexp.MustCompile(`(?i)<meta[^>]+charset\s*=\s*["']?\s*([a-z0-9_.:-]+)`)
+var xmlEncoding = regexp.MustCompile(`(?i)^\s*<\?xml[^>]+encoding\s*=\s*["']([a-z0-9_.:-]+)["']`)
 
-	textCharset := ""
+// How much of the text to search for a <meta> tag declaring the charset. Browsers only look at the first 1kb, but
+// plenty of pages put the tag after large scripts or styles.
+const metaCharsetSearchBytes = 65536
 
-	if possibleContentType != "" {
-		_, name, ok := charset.DetermineEncoding([]byte(text), possibleContentType)
-		if ok {
-			textCharset = name
+// ToUtf8 converts the text to UTF-8. The charset is taken from a byte order mark, the content type, or a <meta> tag or
+// XML declaration in the text, in that order. If none of those say, the charset is detected from the text itself.
+func ToUtf8(text string, possibleContentType string) string {
+	name := declaredCharset(text, possibleContentType)
+	if name == "" {
+		if utf8.ValidString(text) {
+			return text
 		}
-	}
-
-	if textCharset == "" {
 		detector := chardet.NewTextDetector()
 		cs, err := detector.DetectBest([]byte(text))
 		if err != nil {
 			return text // best we can do
 		}
-		textCharset = cs.Charset
+		name = cs.Charset
 	}
 
-	r, err := charset.NewReader(strings.NewReader(text), textCharset)
-	if err != nil {
+	enc, canonicalName := charset.Lookup(name)
+	if enc == nil {
+		// Detected names are sometimes spelled differently, like "GB-18030"
+		enc, canonicalName = charset.Lookup(strings.ReplaceAll(name, "-", ""))
+	}
+	if enc == nil {
 		return text // best we can do
 	}
 
-	converted, err := io.ReadAll(r)
+	if canonicalName == "utf-8" {
+		return strings.ToValidUTF8(text, "�")
+	}
+	if canonicalName == "windows-1252" && utf8.ValidString(text) {
+		// Servers commonly claim Latin-1 (which is treated as windows-1252) while actually serving UTF-8. Valid UTF-8
+		// is very unlikely to be intended as windows-1252, so believe the text instead.
+		return text
+	}
+
+	converted, err := enc.NewDecoder().String(text)
 	if err != nil {
 		return text // best we can do
 	}
+	return converted
+}
+
+func declaredCharset(text string, possibleContentType string) string {
+	head := text
+	if len(head) > metaCharsetSearchBytes {
+		head = head[:metaCharsetSearchBytes]
+	}
 
-	return string(converted)
+	// A byte order mark or charset in the content type is authoritative
+	if _, name, certain := charset.DetermineEncoding([]byte(head), possibleContentType); certain {
+		return name
+	}
+
+	if match := metaCharset.FindStringSubmatch(head); match != nil {
+		return match[1]
+	}
+	if match := xmlEncoding.FindStringSubmatch(head); match != nil {
+		return match[1]
+	}
+	return ""
 }
@@ -0,0 +1,34 @@
+package readers
+
+import (
+	"io"
+	"sync"
+)
+
+// CountingCloser counts the bytes read from the underlying reader, reporting the total when closed.
+type CountingCloser struct {
+	io.ReadCloser
+	read    int64
+	onClose func(read int64)
+	once    sync.Once
+}
+
+func NewCountingCloser(r io.ReadCloser, onClose func(read int64)) *CountingCloser {
+	return &CountingCloser{
+		ReadCloser: r,
+		onClose:    onClose,
+	}
+}
+
+func (c *CountingCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.read += int64(n)
+	return n, err
+}
+
+func (c *CountingCloser) Close() error {
+	c.once.Do(func() {
+		c.onClose(c.read)
+	})
+	return c.ReadCloser.Close()
+}
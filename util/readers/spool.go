@@ -0,0 +1,115 @@
+package readers
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// Spool is written to by one writer while being read by one reader, buffering to a temporary file so neither has to
+// wait for the other. The reader only sees EOF (or an error) once the writer calls Finish.
+type Spool struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	file    *os.File
+	written int64
+	read    int64
+	done    bool
+	err     error
+
+	writerClosed bool
+	readerClosed bool
+}
+
+func NewSpool(dir string) (*Spool, error) {
+	f, err := os.CreateTemp(dir, "mmr-spool")
+	if err != nil {
+		return nil, err
+	}
+	s := &Spool{file: f}
+	s.cond = sync.NewCond(&s.mu)
+	return s, nil
+}
+
+// Write appends to the spool. Writes after the reader is closed are discarded.
+func (s *Spool) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.readerClosed || s.done {
+		return len(p), nil
+	}
+	n, err := s.file.WriteAt(p, s.written)
+	s.written += int64(n)
+	s.cond.Broadcast()
+	if err != nil {
+		// Don't fail the writer because of the reader: the reader will see the error instead
+		s.done = true
+		s.err = err
+	}
+	return len(p), nil
+}
+
+// Finish marks the end of the spool. A nil error gives the reader an EOF once it has read everything, otherwise the
+// reader receives the error as soon as it next reads.
+func (s *Spool) Finish(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.done {
+		s.done = true
+		s.err = err
+	}
+	s.writerClosed = true
+	s.cond.Broadcast()
+	s.cleanupLocked()
+}
+
+func (s *Spool) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		if s.readerClosed {
+			return 0, os.ErrClosed
+		}
+		if s.done && s.err != nil {
+			return 0, s.err
+		}
+		if s.read < s.written {
+			break
+		}
+		if s.done {
+			return 0, io.EOF
+		}
+		s.cond.Wait()
+	}
+
+	if int64(len(p)) > s.written-s.read {
+		p = p[:s.written-s.read]
+	}
+	n, err := s.file.ReadAt(p, s.read)
+	s.read += int64(n)
+	if err == io.EOF {
+		err = nil // more may be written later
+	}
+	return n, err
+}
+
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readerClosed = true
+	s.cond.Broadcast()
+	return s.cleanupLocked()
+}
+
+func (s *Spool) cleanupLocked() error {
+	if !s.readerClosed || !s.writerClosed || s.file == nil {
+		return nil
+	}
+	_ = s.file.Close()
+	err := os.Remove(s.file.Name())
+	s.file = nil
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package readers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+
+	"github.com/t2bot/matrix-media-repo/common"
+)
+
+// NewVerifyingReader returns a reader which fails with common.ErrMediaMismatch instead of io.EOF if the stream does
+// not have the expected size or sha256 hash. An expected size less than zero or an empty hash is not checked.
+func NewVerifyingReader(r io.ReadCloser, expectedSize int64, expectedSha256 string) io.ReadCloser {
+	return &verifyingReader{
+		r:              r,
+		expectedSize:   expectedSize,
+		expectedSha256: expectedSha256,
+		hasher:         sha256.New(),
+	}
+}
+
+type verifyingReader struct {
+	r              io.ReadCloser
+	expectedSize   int64
+	expectedSha256 string
+	hasher         hash.Hash
+	read           int64
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.read += int64(n)
+	r.hasher.Write(p[:n])
+	if r.expectedSize >= 0 && r.read > r.expectedSize {
+		return n, common.ErrMediaMismatch
+	}
+	if err == io.EOF {
+		if r.expectedSize >= 0 && r.read != r.expectedSize {
+			return n, common.ErrMediaMismatch
+		}
+		if r.expectedSha256 != "" && hex.EncodeToString(r.hasher.Sum(nil)) != r.expectedSha256 {
+			return n, common.ErrMediaMismatch
+		}
+	}
+	return n, err
+}
+
+func (r *verifyingReader) Close() error {
+	return r.r.Close()
+}